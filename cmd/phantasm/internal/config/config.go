@@ -0,0 +1,213 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dormoron/phantasm/config/encrypt"
+)
+
+// CmdConfig 是配置工具
+var CmdConfig = &cobra.Command{
+	Use:   "config",
+	Short: "配置工具",
+	Long:  `配置相关的工具，例如生成和解密 ENC(...) 形式的加密配置值，以及使用JSON Schema验证配置文件`,
+}
+
+// cmdEncrypt 加密配置值
+var cmdEncrypt = &cobra.Command{
+	Use:   "encrypt [value]",
+	Short: "加密配置值",
+	Long: `加密配置值并输出 ENC(...) 形式的结果，没有参数时从标准输入读取。
+使用 --file 时重新加密文件中所有已有的加密值，用于密钥轮换。例如：
+  phantasm config encrypt --key k1:<base64密钥> 'secret'
+  phantasm config encrypt --key k1:<旧密钥> --key k2:<新密钥> --primary k2 --file config.yaml -w
+  phantasm config encrypt --kms .keystore.json --algorithm chacha20-poly1305 'secret'`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runEncrypt,
+}
+
+// cmdDecrypt 解密配置值
+var cmdDecrypt = &cobra.Command{
+	Use:   "decrypt [value]",
+	Short: "解密配置值",
+	Long: `解密字符串或文件中所有 ENC(...) 形式的加密值，没有参数时从标准输入读取。例如：
+  phantasm config decrypt --key k1:<base64密钥> 'ENC(...)'
+  phantasm config decrypt --key k1:<base64密钥> --file config.yaml`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runDecrypt,
+}
+
+var (
+	keys      []string
+	primary   string
+	keyFile   string
+	kms       string
+	algorithm string
+	file      string
+	write     bool
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{cmdEncrypt, cmdDecrypt} {
+		cmd.Flags().StringArrayVarP(&keys, "key", "k", nil, "base64编码的AES密钥，格式为 [id:]key，可以重复指定；未指定时读取PHANTASM_CONFIG_KEY环境变量")
+		cmd.Flags().StringVar(&primary, "primary", "", "加密使用的密钥ID，默认为第一个密钥")
+		cmd.Flags().StringVar(&keyFile, "key-file", "", "主密钥文件，每行一个 [id:]key，使用信封加密")
+		cmd.Flags().StringVar(&kms, "kms", "", "本地KMS密钥库文件，不存在时自动创建，使用信封加密")
+		cmd.Flags().StringVarP(&algorithm, "algorithm", "a", "aes-gcm", "加密算法: aes-gcm 或 chacha20-poly1305")
+		cmd.Flags().StringVarP(&file, "file", "f", "", "处理文件中所有的加密值")
+		cmd.Flags().BoolVarP(&write, "write", "w", false, "将结果写回文件而不是输出到标准输出")
+	}
+	CmdConfig.AddCommand(cmdEncrypt)
+	CmdConfig.AddCommand(cmdDecrypt)
+}
+
+func runEncrypt(_ *cobra.Command, args []string) error {
+	e, err := newEncrypter()
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		return processFile(file, func(s string) (string, error) { return encrypt.ReencryptValue(e, s) })
+	}
+	value, err := readValue(args)
+	if err != nil {
+		return err
+	}
+	result, err := encrypt.EncryptValue(e, value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func runDecrypt(_ *cobra.Command, args []string) error {
+	e, err := newEncrypter()
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		return processFile(file, func(s string) (string, error) { return encrypt.DecryptValue(e, s) })
+	}
+	value, err := readValue(args)
+	if err != nil {
+		return err
+	}
+	result, err := encrypt.DecryptValue(e, value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+// readValue 读取参数中的值，没有参数时读取标准输入
+func readValue(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// processFile 转换文件内容，输出到标准输出或写回文件
+func processFile(path string, convert func(string) (string, error)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	result, err := convert(string(data))
+	if err != nil {
+		return err
+	}
+	if !write {
+		fmt.Print(result)
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(result), info.Mode().Perm())
+}
+
+// newEncrypter 根据密钥参数创建加密器
+// 指定主密钥文件或KMS密钥库时使用信封加密；只有一个不带ID的密钥时直接使用该密钥，否则创建密钥环，加密值中带有密钥ID
+func newEncrypter() (encrypt.Encrypter, error) {
+	var alg encrypt.Algorithm
+	switch algorithm {
+	case "aes-gcm":
+		alg = encrypt.AlgorithmAESGCM
+	case "chacha20-poly1305":
+		alg = encrypt.AlgorithmChaCha20Poly1305
+	default:
+		return nil, fmt.Errorf("不支持的加密算法: %s", algorithm)
+	}
+
+	if kms != "" {
+		provider, err := encrypt.NewLocalKMS(kms)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewEnvelopeEncrypter(provider, encrypt.WithAlgorithm(alg))
+	}
+	if keyFile != "" {
+		return encrypt.NewEnvelopeEncrypter(encrypt.NewFileKeyProvider(keyFile), encrypt.WithAlgorithm(alg))
+	}
+
+	specs := keys
+	if len(specs) == 0 {
+		if env := os.Getenv("PHANTASM_CONFIG_KEY"); env != "" {
+			specs = strings.Split(env, ",")
+		}
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("未指定密钥，请使用 --key、--key-file、--kms 或 PHANTASM_CONFIG_KEY 环境变量")
+	}
+
+	encrypters := make(map[string]encrypt.Encrypter, len(specs))
+	var first string
+	for i, spec := range specs {
+		id, value, ok := strings.Cut(spec, ":")
+		if !ok {
+			if len(specs) > 1 {
+				return nil, fmt.Errorf("指定多个密钥时需要使用 id:key 格式: 第%d个密钥", i+1)
+			}
+			id, value = "", spec
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("密钥 %q 不是有效的base64: %w", id, err)
+		}
+		newKey := encrypt.NewAESEncrypter
+		if alg == encrypt.AlgorithmChaCha20Poly1305 {
+			newKey = encrypt.NewChaCha20Encrypter
+		}
+		e, err := newKey(encrypt.WithKey(key))
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			first = id
+		}
+		encrypters[id] = e
+	}
+
+	if first == "" {
+		return encrypters[""], nil
+	}
+	if primary == "" {
+		primary = first
+	}
+	return encrypt.NewKeyring(primary, encrypters)
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	phconfig "github.com/dormoron/phantasm/config"
+	filesource "github.com/dormoron/phantasm/config/file"
+)
+
+// cmdValidate 使用JSON Schema验证配置文件
+var cmdValidate = &cobra.Command{
+	Use:   "validate file...",
+	Short: "使用JSON Schema验证配置文件",
+	Long: `使用JSON Schema验证配置文件，输出每个不满足Schema的值的键路径，验证失败时以非零状态退出，可用于CI。
+默认分别验证每个文件，使用 --merge 时按顺序合并所有文件后验证，与运行时多个配置源的合并方式一致。例如：
+  phantasm config validate --schema server.schema.json --schema log.schema.json configs/*.yaml
+  phantasm config validate --schema app.schema.json --merge config.yaml config.prod.yaml`,
+	Args:         cobra.MinimumNArgs(1),
+	RunE:         runValidate,
+	SilenceUsage: true,
+}
+
+var (
+	schemas []string
+	merge   bool
+)
+
+func init() {
+	cmdValidate.Flags().StringArrayVarP(&schemas, "schema", "s", nil, "JSON Schema文件，可以重复指定，配置需要满足所有的Schema")
+	cmdValidate.Flags().BoolVar(&merge, "merge", false, "合并所有文件后验证")
+	_ = cmdValidate.MarkFlagRequired("schema")
+	CmdConfig.AddCommand(cmdValidate)
+}
+
+func runValidate(_ *cobra.Command, args []string) error {
+	validators := make([]phconfig.Validator, 0, len(schemas))
+	for _, path := range schemas {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		v, err := phconfig.NewSchemaValidator(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		validators = append(validators, v)
+	}
+
+	groups := make([][]string, 0, len(args))
+	if merge {
+		groups = append(groups, args)
+	} else {
+		for _, path := range args {
+			groups = append(groups, []string{path})
+		}
+	}
+
+	failed := 0
+	for _, paths := range groups {
+		name := paths[0]
+		if len(paths) > 1 {
+			name = fmt.Sprint(paths)
+		}
+		errs, err := validateFiles(paths, validators)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(errs) == 0 {
+			fmt.Printf("%s: ok\n", name)
+			continue
+		}
+		failed++
+		for _, e := range errs {
+			fmt.Printf("%s: %s\n", name, e)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d个配置验证失败", failed)
+	}
+	return nil
+}
+
+// validateFiles 合并配置文件并使用所有的Schema验证，返回所有不满足Schema的值，加载失败时返回错误
+func validateFiles(paths []string, validators []phconfig.Validator) (phconfig.SchemaErrors, error) {
+	sources := make([]phconfig.Source, len(paths))
+	for i, path := range paths {
+		sources[i] = filesource.NewSource(path)
+	}
+
+	var errs phconfig.SchemaErrors
+	c := phconfig.New(phconfig.WithSource(sources...), phconfig.WithValidator(func(values map[string]interface{}) error {
+		for _, v := range validators {
+			err := v(values)
+			var schemaErrs phconfig.SchemaErrors
+			if errors.As(err, &schemaErrs) {
+				errs = append(errs, schemaErrs...)
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if err := c.Load(); err != nil {
+		return nil, err
+	}
+	_ = c.Close()
+	return errs, nil
+}
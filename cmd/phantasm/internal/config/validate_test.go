@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	phconfig "github.com/dormoron/phantasm/config"
+)
+
+func TestValidateFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	validator, err := phconfig.NewSchemaValidator([]byte(`{
+		"type": "object",
+		"properties": {"port": {"type": "integer"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	validators := []phconfig.Validator{validator}
+
+	if errs, err := validateFiles([]string{write("good.yaml", "port: 8000\n")}, validators); err != nil || len(errs) != 0 {
+		t.Errorf("good.yaml = %v, %v", errs, err)
+	}
+	if errs, err := validateFiles([]string{write("wrong.yaml", "port: abc\n")}, validators); err != nil || len(errs) != 1 {
+		t.Errorf("wrong.yaml = %v, %v", errs, err)
+	}
+	// 无法解析的文件不能被当作验证通过
+	if _, err := validateFiles([]string{write("bad.yaml", "port: [unclosed\n")}, validators); err == nil {
+		t.Error("expected error for a file that fails to parse")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/dormoron/phantasm"
 	"github.com/dormoron/phantasm/cmd/phantasm/internal/change"
 	"github.com/dormoron/phantasm/cmd/phantasm/internal/completion"
+	"github.com/dormoron/phantasm/cmd/phantasm/internal/config"
 	"github.com/dormoron/phantasm/cmd/phantasm/internal/project"
 	"github.com/dormoron/phantasm/cmd/phantasm/internal/proto"
 	"github.com/dormoron/phantasm/cmd/phantasm/internal/run"
@@ -39,6 +40,7 @@ func init() {
 	rootCmd.AddCommand(run.CmdRun)
 	rootCmd.AddCommand(upgrade.CmdUpgrade)
 	rootCmd.AddCommand(change.CmdChange)
+	rootCmd.AddCommand(config.CmdConfig)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(completion.CmdCompletion)
 
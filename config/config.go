@@ -2,8 +2,11 @@ package config
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"errors"
-	"os"
+	"fmt"
+	"path"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,6 +15,8 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/magiconair/properties"
 	"gopkg.in/yaml.v3"
+
+	"github.com/dormoron/phantasm/log"
 )
 
 var (
@@ -56,6 +61,28 @@ type KeyValue struct {
 	Value string
 	// Format 是配置内容的格式，例如 "json", "yaml", "toml", "properties"
 	Format string
+	// Literals 是值中的占位符不被展开的键路径，相对于配置的根，切片元素以下标作为路径的一部分，
+	// 例如加密配置源解密得到的值
+	Literals []string
+}
+
+// FormatOf 根据文件名或键的扩展名推断配置格式，无法识别时返回空字符串
+func FormatOf(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	switch strings.TrimPrefix(ext, ".") {
+	case "json":
+		return "json"
+	case "yaml", "yml":
+		return "yaml"
+	case "toml":
+		return "toml"
+	case "xml":
+		return "xml"
+	case "properties", "prop", "props":
+		return "properties"
+	default:
+		return ""
+	}
 }
 
 // Config 是配置接口
@@ -72,50 +99,116 @@ type ValueCallback func(string, Value)
 
 // config 是配置实现
 type config struct {
-	opts      options
-	reader    Reader
-	cached    sync.Map
-	observers sync.Map
+	opts   options
+	lock   sync.RWMutex
+	reader Reader
+	kvs    [][]*KeyValue // 每个配置源最近一次的键值
+	cached sync.Map
+
+	observerLock sync.Mutex
+	observers    map[string][]Observer
+	dispatchLock sync.Mutex // 串行化观察者通知，保证观察者按变更顺序收到通知
+
+	watchLock sync.Mutex
 	watchers  []Watcher
+	closed    bool
+	wg        sync.WaitGroup
 }
 
 // New 创建一个配置
 func New(opts ...Option) Config {
 	o := options{
-		sources:  nil,
-		decoder:  defaultDecoder,
-		resolver: defaultResolver,
+		sources: nil,
+		decoder: DefaultDecoder,
+		logger:  log.DefaultLogger,
 	}
 	for _, opt := range opts {
 		opt(&o)
 	}
 	return &config{
-		opts:   o,
-		reader: newReader(o),
+		opts:      o,
+		reader:    newReader(o),
+		kvs:       make([][]*KeyValue, len(o.sources)),
+		observers: make(map[string][]Observer),
 	}
 }
 
-// Load 加载配置源
+// Load 加载配置源，首次加载成功后开始监视所有配置源
+// 重复调用会重新加载所有配置源，并通知发生变化的键的观察者
 func (c *config) Load() error {
-	for _, src := range c.opts.sources {
-		kvs, err := src.Load()
+	kvs := make([][]*KeyValue, len(c.opts.sources))
+	for i, src := range c.opts.sources {
+		kv, err := src.Load()
 		if err != nil {
 			return err
 		}
-		for _, v := range kvs {
-			c.reader.Merge(v)
+		kvs[i] = kv
+	}
+
+	c.lock.Lock()
+	changed, err := c.merge(kvs)
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	c.dispatch(changed)
+
+	return c.watch()
+}
+
+// merge 将所有配置源的键值合并为新的快照，返回变化的键路径，调用方需持有锁
+// 键值无法解码或新的快照验证失败时保留之前的快照和键值
+func (c *config) merge(sources [][]*KeyValue) ([]string, error) {
+	r := newReader(c.opts)
+	for _, kvs := range sources {
+		for _, kv := range kvs {
+			if err := r.Merge(kv); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return nil
+	old, _ := c.reader.Values("")
+	values, _ := r.Values("")
+	if c.opts.resolver != nil {
+		resolveWith(values, r.literals, c.opts.resolver)
+	} else {
+		resolve(values, r.literals)
+	}
+	for _, schema := range c.opts.schemas {
+		if err := schema(values); err != nil {
+			return nil, err
+		}
+	}
+	if c.opts.validator != nil {
+		if err := c.opts.validator(values); err != nil {
+			return nil, err
+		}
+	}
+	c.reader = r
+	copy(c.kvs, sources)
+
+	changed := diff(old, values)
+	if len(changed) > 0 {
+		c.invalidate(changed)
+	}
+	return changed, nil
 }
 
 // Scan 扫描配置到结构体
 func (c *config) Scan(v interface{}) error {
+	c.lock.RLock()
 	data, err := c.reader.Values("")
+	c.lock.RUnlock()
 	if err != nil {
 		return err
 	}
-	return c.opts.decoder(data, v)
+	if err := c.opts.decoder(data, v); err != nil {
+		return err
+	}
+	if c.opts.scanValidator != nil {
+		return c.opts.scanValidator(v)
+	}
+	return nil
 }
 
 // Value 获取配置值
@@ -123,6 +216,9 @@ func (c *config) Value(key string) Value {
 	if v, ok := c.cached.Load(key); ok {
 		return v.(Value)
 	}
+	// 持有读锁写入缓存，重新加载在写锁下替换读取器并清除缓存，不会缓存到旧快照的值
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	v, err := c.reader.Value(key)
 	if err != nil {
 		return defaultValue{}
@@ -131,26 +227,30 @@ func (c *config) Value(key string) Value {
 	return v
 }
 
-// Watch 观察配置更改
+// Watch 观察配置更改，键或其下任一子键变化时调用观察者
 func (c *config) Watch(key string, o Observer) error {
-	if v, ok := c.observers.Load(key); ok {
-		callbacks := v.([]Observer)
-		callbacks = append(callbacks, o)
-		c.observers.Store(key, callbacks)
-	} else {
-		c.observers.Store(key, []Observer{o})
-	}
+	c.observerLock.Lock()
+	defer c.observerLock.Unlock()
+	c.observers[key] = append(c.observers[key], o)
 	return nil
 }
 
-// Close 关闭配置
+// Close 停止监视所有配置源
 func (c *config) Close() error {
-	for _, w := range c.watchers {
+	c.watchLock.Lock()
+	c.closed = true
+	watchers := c.watchers
+	c.watchers = nil
+	c.watchLock.Unlock()
+
+	var errs []error
+	for _, w := range watchers {
 		if err := w.Stop(); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	c.wg.Wait()
+	return errors.Join(errs...)
 }
 
 // defaultValue 是默认值
@@ -198,54 +298,94 @@ func (v defaultValue) Scan(interface{}) error {
 
 // Reader 是配置读取器
 type Reader interface {
-	Merge(*KeyValue)
+	Merge(*KeyValue) error
 	Value(string) (Value, error)
 	Values(string) (map[string]interface{}, error)
 }
 
 // newReader 创建一个新读取器
-func newReader(o options) Reader {
+func newReader(o options) *reader {
 	return &reader{
-		opts:   o,
-		values: make(map[string]interface{}),
+		opts:     o,
+		values:   make(map[string]interface{}),
+		literals: make(map[string]bool),
 	}
 }
 
 // reader 是读取器实现
 type reader struct {
-	opts   options
-	values map[string]interface{}
-	lock   sync.Mutex
+	opts     options
+	values   map[string]interface{}
+	literals map[string]bool // 不展开占位符的键路径
+	lock     sync.Mutex
 }
 
-// Merge 合并键值
-func (r *reader) Merge(kv *KeyValue) {
+// Merge 合并键值，键值无法解码时返回错误
+func (r *reader) Merge(kv *KeyValue) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	var values map[string]interface{}
-	var err error
+	values, err := Decode(kv)
+	if err != nil {
+		return fmt.Errorf("config: decode %s: %w", kv.Key, err)
+	}
+
+	// 被覆盖的值不再保留之前的标记
+	for path := range r.literals {
+		if covers(values, path) {
+			delete(r.literals, path)
+		}
+	}
+	for _, path := range kv.Literals {
+		r.literals[path] = true
+	}
+	r.mergeValues(r.values, values)
+	return nil
+}
 
+// covers 判断合并values后path处的值是否会被替换
+func covers(values map[string]interface{}, path string) bool {
+	current := values
+	for _, part := range strings.Split(path, ".") {
+		v, ok := current[part]
+		if !ok {
+			return false
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return true
+		}
+		current = m
+	}
+	return true
+}
+
+// Decode 按格式将键值解码为映射
+// 没有格式的值以键为路径保存，键中的"."表示嵌套
+func Decode(kv *KeyValue) (map[string]interface{}, error) {
 	switch kv.Format {
 	case "json":
-		values, err = r.decodeJSON(kv.Value)
+		return decodeJSON(kv.Value)
 	case "yaml":
-		values, err = r.decodeYAML(kv.Value)
+		return decodeYAML(kv.Value)
 	case "toml":
-		values, err = r.decodeTOML(kv.Value)
+		return decodeTOML(kv.Value)
 	case "properties":
-		values, err = r.decodeProperties(kv.Value)
-	default:
-		values = map[string]interface{}{
-			kv.Key: kv.Value,
-		}
+		return decodeProperties(kv.Value)
+	case "xml":
+		return decodeXML(kv.Value)
 	}
 
-	if err != nil {
-		return
+	values := make(map[string]interface{})
+	parts := strings.Split(kv.Key, ".")
+	current := values
+	for _, part := range parts[:len(parts)-1] {
+		next := make(map[string]interface{})
+		current[part] = next
+		current = next
 	}
-
-	r.mergeValues(r.values, values)
+	current[parts[len(parts)-1]] = kv.Value
+	return values, nil
 }
 
 // Value 获取值
@@ -282,50 +422,31 @@ func (r *reader) Values(path string) (map[string]interface{}, error) {
 	return nil, ErrTypeMismatch
 }
 
-// defaultDecoder 是默认解码器
-func defaultDecoder(src map[string]interface{}, dst interface{}) error {
-	data, err := json.Marshal(src)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, dst)
-}
-
-// defaultResolver 是默认解析器
-func defaultResolver(str string) string {
-	// 支持环境变量解析
-	if strings.HasPrefix(str, "${") && strings.HasSuffix(str, "}") {
-		env := strings.TrimSuffix(strings.TrimPrefix(str, "${"), "}")
-		return os.Getenv(env)
-	}
-	return str
-}
-
 // 新增的辅助方法
 
 // decodeJSON 解码JSON
-func (r *reader) decodeJSON(data string) (map[string]interface{}, error) {
+func decodeJSON(data string) (map[string]interface{}, error) {
 	var result map[string]interface{}
 	err := json.Unmarshal([]byte(data), &result)
 	return result, err
 }
 
 // decodeYAML 解码YAML
-func (r *reader) decodeYAML(data string) (map[string]interface{}, error) {
+func decodeYAML(data string) (map[string]interface{}, error) {
 	var result map[string]interface{}
 	err := yaml.Unmarshal([]byte(data), &result)
 	return result, err
 }
 
 // decodeTOML 解码TOML
-func (r *reader) decodeTOML(data string) (map[string]interface{}, error) {
+func decodeTOML(data string) (map[string]interface{}, error) {
 	var result map[string]interface{}
 	err := toml.Unmarshal([]byte(data), &result)
 	return result, err
 }
 
 // decodeProperties 解码Properties
-func (r *reader) decodeProperties(data string) (map[string]interface{}, error) {
+func decodeProperties(data string) (map[string]interface{}, error) {
 	props := properties.NewProperties()
 	err := props.Load([]byte(data), properties.UTF8)
 	if err != nil {
@@ -340,6 +461,66 @@ func (r *reader) decodeProperties(data string) (map[string]interface{}, error) {
 	return result, nil
 }
 
+// decodeXML 解码XML，根元素下的子元素作为顶级键
+// 只有文本的元素解码为字符串，属性与子元素同样作为键，同名的子元素解码为切片
+func decodeXML(data string) (map[string]interface{}, error) {
+	dec := xml.NewDecoder(strings.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			v, err := decodeXMLElement(dec, start)
+			if err != nil {
+				return nil, err
+			}
+			if m, ok := v.(map[string]interface{}); ok {
+				return m, nil
+			}
+			return map[string]interface{}{}, nil
+		}
+	}
+}
+
+// decodeXMLElement 解码一个元素，返回字符串或映射
+func decodeXMLElement(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	values := make(map[string]interface{})
+	for _, attr := range start.Attr {
+		values[attr.Name.Local] = attr.Value
+	}
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(dec, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := values[name].(type) {
+			case nil:
+				values[name] = child
+			case []interface{}:
+				values[name] = append(existing, child)
+			default:
+				values[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(values) == 0 {
+				return strings.TrimSpace(text.String()), nil
+			}
+			return values, nil
+		}
+	}
+}
+
 // mergeValues 合并值
 func (r *reader) mergeValues(dst, src map[string]interface{}) {
 	for k, v := range src {
@@ -472,7 +653,13 @@ func (v sliceValue) Slice() ([]Value, error) {
 	return values, nil
 }
 func (v sliceValue) Map() (map[string]Value, error) { return nil, ErrTypeMismatch }
-func (v sliceValue) Scan(interface{}) error         { return ErrTypeMismatch }
+func (v sliceValue) Scan(dst interface{}) error {
+	data, err := json.Marshal(weaken([]interface{}(v), reflect.TypeOf(dst)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
 
 func (v mapValue) Bool() (bool, error)              { return false, ErrTypeMismatch }
 func (v mapValue) Int() (int64, error)              { return 0, ErrTypeMismatch }
@@ -504,4 +691,4 @@ func (v mapValue) Map() (map[string]Value, error) {
 	}
 	return values, nil
 }
-func (v mapValue) Scan(interface{}) error { return ErrTypeMismatch }
+func (v mapValue) Scan(dst interface{}) error { return DefaultDecoder(v, dst) }
@@ -0,0 +1,469 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSource 是测试用的配置源，通过update推送新的配置
+type memSource struct {
+	kvs []*KeyValue
+	ch  chan []*KeyValue
+}
+
+func newMemSource(format, value string) *memSource {
+	return &memSource{
+		kvs: []*KeyValue{{Key: "app", Value: value, Format: format}},
+		ch:  make(chan []*KeyValue, 1),
+	}
+}
+
+func (s *memSource) Load() ([]*KeyValue, error) { return s.kvs, nil }
+
+func (s *memSource) Watch() (Watcher, error) {
+	return &memWatcher{ch: s.ch, done: make(chan struct{})}, nil
+}
+
+func (s *memSource) update(format, value string) {
+	s.ch <- []*KeyValue{{Key: "app", Value: value, Format: format}}
+}
+
+type memWatcher struct {
+	ch   chan []*KeyValue
+	done chan struct{}
+	once sync.Once
+}
+
+func (w *memWatcher) Next() ([]*KeyValue, error) {
+	select {
+	case <-w.done:
+		return nil, ErrWatcherClosed
+	case kvs := <-w.ch:
+		return kvs, nil
+	}
+}
+
+func (w *memWatcher) Stop() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	base := newMemSource("json", `{"server":{"port":8000,"host":"a"},"log":{"level":"info"}}`)
+	override := newMemSource("yaml", "server:\n  host: b\n")
+	c := New(WithSource(base, override))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	if host, _ := c.Value("server.host").String(); host != "b" {
+		t.Fatalf("server.host = %q", host)
+	}
+
+	events := make(chan string, 10)
+	for _, key := range []string{"server", "server.port", "server.host", "log"} {
+		_ = c.Watch(key, func(key string, v Value) { events <- key })
+	}
+
+	base.update("json", `{"server":{"port":9000,"host":"a"},"log":{"level":"info"}}`)
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-events:
+			got[key] = true
+		case <-time.After(time.Second):
+			t.Fatalf("missing notification, got %v", got)
+		}
+	}
+	if !got["server"] || !got["server.port"] {
+		t.Errorf("notified = %v", got)
+	}
+	select {
+	case key := <-events:
+		t.Errorf("unexpected notification for %q", key)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if port, _ := c.Value("server.port").Int(); port != 9000 {
+		t.Errorf("server.port = %d, expected cached value to be invalidated", port)
+	}
+	// 覆盖配置源中的值保持不变
+	if host, _ := c.Value("server.host").String(); host != "b" {
+		t.Errorf("server.host = %q", host)
+	}
+
+	// 删除的键同样通知观察者
+	override.update("yaml", "other: 1\n")
+	select {
+	case key := <-events:
+		if key != "server" && key != "server.host" {
+			t.Errorf("unexpected notification for %q", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("missing notification for removed key")
+	}
+}
+
+func TestClose(t *testing.T) {
+	c := New(WithSource(newMemSource("json", `{"a":1}`)))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close did not stop watchers")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := map[string]interface{}{"a": map[string]interface{}{"b": 1, "c": "x"}, "d": true}
+	new := map[string]interface{}{"a": map[string]interface{}{"b": 2, "c": "x"}, "e": "y"}
+	got := diff(old, new)
+	want := []string{"a.b", "d", "e"}
+	if len(got) != len(want) {
+		t.Fatalf("diff = %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("diff = %v", got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv("PHANTASM_TEST_HOST", "example.com")
+	base := newMemSource("yaml", `
+server:
+  port: 8000
+  host: ${PHANTASM_TEST_HOST}
+  addr: ${server.host}:${server.port}
+  public: ${server.port}
+  timeout: ${PHANTASM_TEST_MISSING:5s}
+  loop: ${server.loop}
+  missing: ${PHANTASM_TEST_MISSING}
+  partial: ${server.host}/${PHANTASM_TEST_MISSING}
+`)
+	override := newMemSource("json", `{"server":{"port":9000}}`)
+	c := New(WithSource(base, override))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	var cfg struct {
+		Server struct {
+			Addr    string `json:"addr"`
+			Public  int    `json:"public"`
+			Timeout string `json:"timeout"`
+			Loop    string `json:"loop"`
+			Missing string `json:"missing"`
+			Partial string `json:"partial"`
+		} `json:"server"`
+	}
+	if err := c.Scan(&cfg); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if cfg.Server.Addr != "example.com:9000" || cfg.Server.Public != 9000 || cfg.Server.Timeout != "5s" {
+		t.Errorf("resolved = %+v", cfg.Server)
+	}
+	// 无法解析的占位符保持原样
+	if cfg.Server.Loop != "${server.loop}" || cfg.Server.Missing != "${PHANTASM_TEST_MISSING}" ||
+		cfg.Server.Partial != "example.com/${PHANTASM_TEST_MISSING}" {
+		t.Errorf("unresolved = %+v", cfg.Server)
+	}
+
+	c = New(WithSource(base), WithResolver(strings.ToUpper))
+	_ = c.Load()
+	defer c.Close()
+	if host, _ := c.Value("server.host").String(); host != "${PHANTASM_TEST_HOST}" {
+		t.Errorf("custom resolver result = %q", host)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	source := newMemSource("json", `{"server":{"port":8000}}`)
+	validator := func(values map[string]interface{}) error {
+		server, _ := values["server"].(map[string]interface{})
+		if port, _ := server["port"].(float64); port <= 0 {
+			return errors.New("server.port must be positive")
+		}
+		return nil
+	}
+	var scanned interface{}
+	c := New(WithSource(source), WithValidator(validator), WithScanValidator(func(v interface{}) error {
+		scanned = v
+		return nil
+	}))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	var cfg struct{}
+	if err := c.Scan(&cfg); err != nil || scanned != &cfg {
+		t.Errorf("scan validator not called: %v", err)
+	}
+
+	changed := make(chan int64, 2)
+	_ = c.Watch("server.port", func(_ string, v Value) {
+		port, _ := v.Int()
+		changed <- port
+	})
+
+	// 验证失败的更新被拒绝，之后合法的更新仍然生效
+	source.update("json", `{"server":{"port":0}}`)
+	source.update("json", `{"server":{"port":9000}}`)
+	select {
+	case port := <-changed:
+		if port != 9000 {
+			t.Errorf("notified port %d", port)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called")
+	}
+
+	source.update("json", `{"server":{"port":-1}}`)
+	time.Sleep(time.Millisecond * 50)
+	if port, _ := c.Value("server.port").Int(); port != 9000 {
+		t.Errorf("server.port = %d after rejected reload", port)
+	}
+
+	invalid := New(WithSource(newMemSource("json", `{"server":{"port":0}}`)), WithValidator(validator))
+	if err := invalid.Load(); err == nil {
+		t.Error("expected Load to fail validation")
+	}
+}
+
+func TestLoadDecodeError(t *testing.T) {
+	c := New(WithSource(newMemSource("json", `{"server":{"port":8000}}`), newMemSource("yaml", "port: [unclosed\n")))
+	err := c.Load()
+	if err == nil || !strings.Contains(err.Error(), "decode app") {
+		t.Errorf("expected decode error, got %v", err)
+	}
+}
+
+func TestReloadDecodeError(t *testing.T) {
+	source := newMemSource("yaml", "server:\n  port: 8000\n")
+	c := New(WithSource(source))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	changed := make(chan int64, 2)
+	_ = c.Watch("server.port", func(_ string, v Value) {
+		port, _ := v.Int()
+		changed <- port
+	})
+
+	// 无法解析的更新被拒绝，之前的配置保持不变，之后合法的更新仍然生效
+	source.update("yaml", "server:\n  port: [unclosed\n")
+	source.update("yaml", "server:\n  port: 9000\n")
+	select {
+	case port := <-changed:
+		if port != 9000 {
+			t.Errorf("notified port %d", port)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called")
+	}
+
+	source.update("yaml", "server: [unclosed\n")
+	time.Sleep(time.Millisecond * 50)
+	if port, _ := c.Value("server.port").Int(); port != 9000 {
+		t.Errorf("server.port = %d after rejected reload", port)
+	}
+	select {
+	case port := <-changed:
+		t.Errorf("unexpected notification %d", port)
+	default:
+	}
+}
+
+const testSchema = `{
+	"type": "object",
+	"required": ["server"],
+	"properties": {
+		"server": {
+			"type": "object",
+			"required": ["addr"],
+			"properties": {
+				"addr": {"type": "string", "pattern": "^[^:]*:[0-9]+$"},
+				"port": {"type": "integer", "minimum": 1, "maximum": 65535}
+			}
+		},
+		"backends": {"type": "array", "items": {"type": "object", "properties": {"weight": {"type": "number", "minimum": 0}}}},
+		"log": {"type": "object", "properties": {"level": {"enum": ["debug", "info", "warn", "error"]}}}
+	}
+}`
+
+func TestSchema(t *testing.T) {
+	source := newMemSource("yaml", "server:\n  addr: 0.0.0.0:8000\n  port: 8000\nlog:\n  level: info\n")
+	c := New(WithSource(source), WithSchema([]byte(testSchema)))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	changed := make(chan string, 2)
+	_ = c.Watch("log.level", func(_ string, v Value) {
+		level, _ := v.String()
+		changed <- level
+	})
+
+	// 不满足Schema的热更新被拒绝
+	source.update("yaml", "server:\n  addr: 0.0.0.0:8000\nlog:\n  level: trace\n")
+	source.update("yaml", "server:\n  addr: 0.0.0.0:8000\nlog:\n  level: debug\n")
+	select {
+	case level := <-changed:
+		if level != "debug" {
+			t.Errorf("notified level %q", level)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called")
+	}
+
+	invalid := New(WithSource(newMemSource("json",
+		`{"server":{"addr":"bad","port":0},"backends":[{"weight":1},{"weight":-1}],"log":{"level":"trace"}}`)),
+		WithSchema([]byte(testSchema)))
+	err := invalid.Load()
+	var errs SchemaErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected SchemaErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	if got := strings.Join(paths, ","); got != "backends[1].weight,log.level,server.addr,server.port" {
+		t.Errorf("error paths = %s (%v)", got, err)
+	}
+
+	missing := New(WithSource(newMemSource("json", `{}`)), WithSchema([]byte(testSchema)))
+	if err := missing.Load(); !errors.As(err, &errs) || len(errs) != 1 || errs[0].Path != "" {
+		t.Errorf("expected root error, got %v", err)
+	}
+
+	broken := New(WithSource(newMemSource("json", `{}`)), WithSchema([]byte(`{"type": 1}`)))
+	if err := broken.Load(); err == nil || !strings.Contains(err.Error(), "invalid schema") {
+		t.Errorf("expected schema error, got %v", err)
+	}
+}
+
+func TestValueScan(t *testing.T) {
+	c := New(WithSource(newMemSource("yaml", `
+server:
+  host: a
+  port: 8000
+  tags: [x, y]
+  backends:
+    - {name: b1, weight: 1}
+    - {name: b2, weight: 2}
+`)))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	var server struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	if err := c.Value("server").Scan(&server); err != nil || server.Host != "a" || server.Port != 8000 {
+		t.Errorf("map scan = %+v, err = %v", server, err)
+	}
+
+	var tags []string
+	if err := c.Value("server.tags").Scan(&tags); err != nil || strings.Join(tags, ",") != "x,y" {
+		t.Errorf("slice scan = %v, err = %v", tags, err)
+	}
+
+	var backends []struct {
+		Name   string `json:"name"`
+		Weight int    `json:"weight"`
+	}
+	if err := c.Value("server.backends").Scan(&backends); err != nil || len(backends) != 2 || backends[1].Weight != 2 {
+		t.Errorf("slice of maps scan = %+v, err = %v", backends, err)
+	}
+
+	// 类型不匹配时返回解码错误
+	if err := c.Value("server.tags").Scan(&server); err == nil {
+		t.Error("expected error scanning a slice into a struct")
+	}
+	if err := c.Value("server.host").Scan(&server); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("scalar scan err = %v", err)
+	}
+	if err := c.Value("server.missing").Scan(&server); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing scan err = %v", err)
+	}
+}
+
+// seqSource 是每次加载返回当前端口的配置源
+type seqSource struct {
+	lock sync.Mutex
+	port int
+	memSource
+}
+
+func (s *seqSource) set(port int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.port = port
+}
+
+func (s *seqSource) Load() ([]*KeyValue, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return []*KeyValue{{Key: "app", Value: fmt.Sprintf(`{"server":{"port":%d}}`, s.port), Format: "json"}}, nil
+}
+
+func TestValueConcurrentReload(t *testing.T) {
+	src := &seqSource{memSource: memSource{ch: make(chan []*KeyValue)}}
+	c := New(WithSource(src))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	const reloads = 500
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					_, _ = c.Value("server.port").Int()
+				}
+			}
+		}()
+	}
+	for i := 1; i <= reloads; i++ {
+		src.set(i)
+		if err := c.Load(); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// 并发读取不会把旧快照的值留在缓存中
+	if port, err := c.Value("server.port").Int(); err != nil || port != reloads {
+		t.Errorf("port = %d, %v, want %d", port, err, reloads)
+	}
+}
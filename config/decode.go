@@ -0,0 +1,144 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
+// DefaultDecoder 是默认解码器，按JSON规则将配置解码到dst
+// 解码前按dst的类型转换字符串值，环境变量、命令行参数等只能提供字符串的配置源也可以解码到数值和布尔字段，
+// time.Duration 字段可以使用 "1s"、"500ms" 形式的时长
+func DefaultDecoder(src map[string]interface{}, dst interface{}) error {
+	data, err := json.Marshal(weaken(src, reflect.TypeOf(dst)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// weaken 按目标类型转换值中的字符串，返回转换后的副本，无法转换的值保持不变，由JSON解码报告错误
+func weaken(v interface{}, t reflect.Type) interface{} {
+	if t == nil {
+		return v
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// 自定义解码的类型按原样交给它处理
+	if reflect.PointerTo(t).Implements(jsonUnmarshalerType) || reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return v
+	}
+
+	switch val := v.(type) {
+	case string:
+		return weakenString(val, t)
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(t)
+			out := make(map[string]interface{}, len(val))
+			for k, item := range val {
+				if ft, ok := fields[strings.ToLower(k)]; ok {
+					item = weaken(item, ft)
+				}
+				out[k] = item
+			}
+			return out
+		case reflect.Map:
+			out := make(map[string]interface{}, len(val))
+			for k, item := range val {
+				out[k] = weaken(item, t.Elem())
+			}
+			return out
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			out := make([]interface{}, len(val))
+			for i, item := range val {
+				out[i] = weaken(item, t.Elem())
+			}
+			return out
+		}
+	}
+	return v
+}
+
+// weakenString 将字符串转换为目标类型的数值、布尔值或时长的纳秒数
+func weakenString(s string, t reflect.Type) interface{} {
+	if t == durationType {
+		if d, err := time.ParseDuration(s); err == nil {
+			return int64(d)
+		}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	}
+	return s
+}
+
+// jsonFields 返回结构体字段的JSON名称（小写，与JSON解码一样不区分大小写）到字段类型的映射
+// 没有JSON名称的嵌入结构体展开到外层，带有string选项的字段按JSON的规则需要字符串，不做转换
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+		if !f.IsExported() || strings.Contains(","+opts+",", ",string,") {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	// 外层的字段优先于嵌入结构体的字段
+	for _, et := range embedded {
+		for name, ft := range jsonFields(et) {
+			if _, ok := fields[name]; !ok {
+				fields[name] = ft
+			}
+		}
+	}
+	return fields
+}
@@ -3,10 +3,9 @@ package encrypt
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
 	"errors"
-	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Encrypter 是配置加密器接口
@@ -22,7 +21,9 @@ type Option func(*options)
 
 // options 是加密器选项
 type options struct {
-	key []byte
+	key       []byte
+	keyID     string
+	algorithm Algorithm
 }
 
 // WithKey 设置加密密钥
@@ -32,6 +33,30 @@ func WithKey(key []byte) Option {
 	}
 }
 
+// WithKeyID 设置写入密文头的密钥ID，解密时密文头中的ID必须与之一致（密文头中没有ID时不检查）
+// 加入密钥环时没有设置ID的加密器使用密钥环中的ID
+func WithKeyID(id string) Option {
+	return func(o *options) {
+		o.keyID = id
+	}
+}
+
+// WithAlgorithm 设置信封加密中加密数据使用的算法，默认为AES-GCM
+func WithAlgorithm(algorithm Algorithm) Option {
+	return func(o *options) {
+		o.algorithm = algorithm
+	}
+}
+
+// keyedEncrypter 是把密钥ID写入密文头的加密器，密钥环按密文头中的ID选择解密的密钥
+type keyedEncrypter interface {
+	Encrypter
+	// keyID 返回写入密文头的密钥ID
+	keyID() string
+	// withKeyID 返回使用同一密钥、以id作为密钥ID的加密器
+	withKeyID(id string) Encrypter
+}
+
 // aesEncrypter 是基于AES的加密器实现
 type aesEncrypter struct {
 	opts options
@@ -52,76 +77,134 @@ func NewAESEncrypter(opts ...Option) (Encrypter, error) {
 	if len(o.key) != 16 && len(o.key) != 24 && len(o.key) != 32 {
 		return nil, errors.New("invalid key size: must be 16, 24, or 32 bytes")
 	}
+	if len(o.keyID) > 255 {
+		return nil, errors.New("key id too long")
+	}
 
 	return &aesEncrypter{opts: o}, nil
 }
 
-// Encrypt 使用AES-GCM加密数据
-func (e *aesEncrypter) Encrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(e.opts.key)
-	if err != nil {
-		return nil, err
+// newAEAD 按算法创建AEAD
+func newAEAD(algorithm Algorithm, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case AlgorithmAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgorithmChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, errors.New("encrypt: unsupported algorithm")
 	}
+}
 
-	gcm, err := cipher.NewGCM(block)
+// Encrypt 使用AES-GCM加密数据，密文带有记录算法和密钥ID的密文头
+func (e *aesEncrypter) Encrypt(data []byte) ([]byte, error) {
+	gcm, err := newAEAD(AlgorithmAESGCM, e.opts.key)
 	if err != nil {
 		return nil, err
 	}
+	return seal(gcm, &header{Algorithm: AlgorithmAESGCM, KeyID: e.opts.keyID}, data)
+}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
+// Decrypt 使用AES-GCM解密数据，同时支持没有密文头的旧版本密文
+func (e *aesEncrypter) Decrypt(data []byte) ([]byte, error) {
+	return decryptWith(AlgorithmAESGCM, e.opts, data, true)
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return []byte(base64.StdEncoding.EncodeToString(ciphertext)), nil
+// keyID 返回写入密文头的密钥ID
+func (e *aesEncrypter) keyID() string {
+	return e.opts.keyID
 }
 
-// Decrypt 使用AES-GCM解密数据
-func (e *aesEncrypter) Decrypt(data []byte) ([]byte, error) {
-	ciphertext, err := base64.StdEncoding.DecodeString(string(data))
-	if err != nil {
-		return nil, err
+// withKeyID 返回以id作为密钥ID的加密器
+func (e *aesEncrypter) withKeyID(id string) Encrypter {
+	o := e.opts
+	o.keyID = id
+	return &aesEncrypter{opts: o}
+}
+
+// chachaEncrypter 是基于ChaCha20-Poly1305的加密器实现
+type chachaEncrypter struct {
+	opts options
+}
+
+// NewChaCha20Encrypter 创建一个基于ChaCha20-Poly1305的加密器，密钥为32字节
+// 在没有AES硬件加速的平台上比AES-GCM更快
+func NewChaCha20Encrypter(opts ...Option) (Encrypter, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	block, err := aes.NewCipher(e.opts.key)
-	if err != nil {
-		return nil, err
+	if len(o.key) != chacha20poly1305.KeySize {
+		return nil, errors.New("invalid key size: must be 32 bytes")
+	}
+	if len(o.keyID) > 255 {
+		return nil, errors.New("key id too long")
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return &chachaEncrypter{opts: o}, nil
+}
+
+// Encrypt 使用ChaCha20-Poly1305加密数据，密文带有记录算法和密钥ID的密文头
+func (e *chachaEncrypter) Encrypt(data []byte) ([]byte, error) {
+	aead, err := newAEAD(AlgorithmChaCha20Poly1305, e.opts.key)
 	if err != nil {
 		return nil, err
 	}
+	return seal(aead, &header{Algorithm: AlgorithmChaCha20Poly1305, KeyID: e.opts.keyID}, data)
+}
 
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, errors.New("ciphertext too short")
-	}
+// Decrypt 使用ChaCha20-Poly1305解密数据
+func (e *chachaEncrypter) Decrypt(data []byte) ([]byte, error) {
+	return decryptWith(AlgorithmChaCha20Poly1305, e.opts, data, false)
+}
 
-	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+// keyID 返回写入密文头的密钥ID
+func (e *chachaEncrypter) keyID() string {
+	return e.opts.keyID
 }
 
-// Source 是加密配置源包装器
-type Source struct {
-	source    interface{} // 原始配置源
-	encrypter Encrypter   // 加密器
+// withKeyID 返回以id作为密钥ID的加密器
+func (e *chachaEncrypter) withKeyID(id string) Encrypter {
+	o := e.opts
+	o.keyID = id
+	return &chachaEncrypter{opts: o}
 }
 
-// NewSource 创建一个加密配置源
-func NewSource(source interface{}, encrypter Encrypter) *Source {
-	return &Source{
-		source:    source,
-		encrypter: encrypter,
+// decryptWith 校验密文头中的算法和密钥ID后解密，legacy为true时没有密文头的数据按 nonce+密文 解密
+func decryptWith(algorithm Algorithm, o options, data []byte, legacy bool) ([]byte, error) {
+	h, raw, rest, decoded, err := decodeCiphertext(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(algorithm, o.key)
+	if err != nil {
+		return nil, err
 	}
-}
 
-// GetSource 获取原始配置源
-func (s *Source) GetSource() interface{} {
-	return s.source
-}
+	if h != nil {
+		err = errors.New("encrypt: ciphertext was produced by another algorithm or key")
+		if h.Algorithm == algorithm && (h.KeyID == o.keyID || h.KeyID == "") && len(h.WrappedKey) == 0 {
+			var plaintext []byte
+			if plaintext, err = open(aead, raw, rest); err == nil {
+				return plaintext, nil
+			}
+		}
+		// 旧版本密文的nonce恰好以密文头开始的概率极低，仍然按旧版本尝试一次
+		if !legacy {
+			return nil, err
+		}
+	} else if !legacy {
+		return nil, ErrMalformedCiphertext
+	}
 
-// GetEncrypter 获取加密器
-func (s *Source) GetEncrypter() Encrypter {
-	return s.encrypter
+	if len(decoded) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := decoded[:aead.NonceSize()], decoded[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
 }
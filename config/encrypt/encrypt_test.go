@@ -0,0 +1,360 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+// staticSource 是测试用的静态配置源
+type staticSource []*config.KeyValue
+
+func (s staticSource) Load() ([]*config.KeyValue, error) { return s, nil }
+func (s staticSource) Watch() (config.Watcher, error) {
+	return &staticWatcher{done: make(chan struct{})}, nil
+}
+
+// staticWatcher 阻塞直到停止
+type staticWatcher struct {
+	done chan struct{}
+}
+
+func (w *staticWatcher) Next() ([]*config.KeyValue, error) {
+	<-w.done
+	return nil, config.ErrWatcherClosed
+}
+
+func (w *staticWatcher) Stop() error {
+	close(w.done)
+	return nil
+}
+
+func newTestEncrypter(t *testing.T, key string) Encrypter {
+	t.Helper()
+	e, err := NewAESEncrypter(WithKey([]byte(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestDecryptValue(t *testing.T) {
+	e := newTestEncrypter(t, "0123456789abcdef")
+	password, err := EncryptValue(e, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(password, "ENC(") || !strings.HasSuffix(password, ")") {
+		t.Fatalf("encrypted value = %q", password)
+	}
+
+	got, err := DecryptValue(e, "postgres://app:"+password+"@db/app")
+	if err != nil || got != "postgres://app:s3cret@db/app" {
+		t.Errorf("DecryptValue = %q, %v", got, err)
+	}
+	if got, _ := DecryptValue(e, "plain"); got != "plain" {
+		t.Errorf("plain value changed to %q", got)
+	}
+	if _, err := DecryptValue(e, "ENC(abc"); err != ErrMalformedValue {
+		t.Errorf("expected ErrMalformedValue, got %v", err)
+	}
+	if _, err := DecryptValue(newTestEncrypter(t, "fedcba9876543210"), password); err == nil {
+		t.Error("expected error with wrong key")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey := newTestEncrypter(t, "0123456789abcdef")
+	newKey := newTestEncrypter(t, "fedcba9876543210")
+
+	legacy, _ := EncryptValue(oldKey, "legacy")
+	before, _ := NewKeyring("k1", map[string]Encrypter{"k1": oldKey})
+	v1, _ := EncryptValue(before, "v1")
+	if id := headerKeyID(t, v1); id != "k1" {
+		t.Fatalf("key id of %q = %q", v1, id)
+	}
+
+	after, err := NewKeyring("k2", map[string]Encrypter{"k1": oldKey, "k2": newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := "a: " + legacy + "\nb: " + v1 + "\n"
+	if got, err := DecryptValue(after, doc); err != nil || got != "a: legacy\nb: v1\n" {
+		t.Errorf("DecryptValue = %q, %v", got, err)
+	}
+
+	rotated, err := ReencryptValue(after, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range encrypted.FindAllString(rotated, -1) {
+		if id := headerKeyID(t, match); id != "k2" {
+			t.Errorf("key id of rotated %q = %q", match, id)
+		}
+	}
+	onlyNew, _ := NewKeyring("k2", map[string]Encrypter{"k2": newKey})
+	if got, err := DecryptValue(onlyNew, rotated); err != nil || got != "a: legacy\nb: v1\n" {
+		t.Errorf("DecryptValue after rotation = %q, %v", got, err)
+	}
+	if _, err := DecryptValue(onlyNew, v1); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+// headerKeyID 返回加密值的密文头中记录的密钥ID
+func headerKeyID(t *testing.T, value string) string {
+	t.Helper()
+	h, _, _, _, err := decodeCiphertext([]byte(strings.TrimSuffix(strings.TrimPrefix(value, "ENC("), ")")))
+	if err != nil || h == nil {
+		t.Fatalf("decode %q: %v", value, err)
+	}
+	return h.KeyID
+}
+
+func TestKeyringKeyID(t *testing.T) {
+	key := make([]byte, 32)
+	named, _ := NewAESEncrypter(WithKey(key), WithKeyID("a1"))
+	if _, err := NewKeyring("b1", map[string]Encrypter{"b1": named}); err == nil {
+		t.Error("expected error for mismatched key id")
+	}
+	kms, _ := NewLocalKMS(filepath.Join(t.TempDir(), "keystore.json"))
+	envelope, _ := NewEnvelopeEncrypter(kms)
+	if _, err := NewKeyring("e1", map[string]Encrypter{"e1": envelope}); err == nil {
+		t.Error("expected error for envelope encrypter in a keyring")
+	}
+
+	// 加入密钥环不改变原加密器写入的密钥ID
+	unnamed, _ := NewAESEncrypter(WithKey(key))
+	keyring, err := NewKeyring("a2", map[string]Encrypter{"a1": named, "a2": unnamed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := EncryptValue(unnamed, "plain")
+	if id := headerKeyID(t, plain); id != "" {
+		t.Errorf("unnamed key id = %q", id)
+	}
+	if got, err := DecryptValue(keyring, plain); err != nil || got != "plain" {
+		t.Errorf("DecryptValue = %q, %v", got, err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	e := newTestEncrypter(t, "0123456789abcdef")
+	password, _ := EncryptValue(e, "s3cret")
+	token, _ := EncryptValue(e, "t0ken")
+
+	source := NewSource(staticSource{
+		{Key: "app", Format: "yaml", Value: "db:\n  user: app\n  password: " + password + "\n  hosts:\n    - " + token + "\n"},
+		{Key: "api.token", Value: token},
+		{Key: "plain", Format: "json", Value: `{"plain":true}`},
+	}, e)
+	c := config.New(config.WithSource(source))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	for key, want := range map[string]string{"db.user": "app", "db.password": "s3cret", "api.token": "t0ken"} {
+		if got, _ := c.Value(key).String(); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	hosts, _ := c.Value("db.hosts").Slice()
+	if len(hosts) != 1 {
+		t.Fatalf("db.hosts = %v", hosts)
+	}
+	if host, _ := hosts[0].String(); host != "t0ken" {
+		t.Errorf("db.hosts[0] = %q", host)
+	}
+	if plain, _ := c.Value("plain").Bool(); !plain {
+		t.Error("plain value lost")
+	}
+
+	bad := NewSource(staticSource{{Key: "app", Format: "json", Value: `{"password":"ENC(bm9wZQ==)"}`}}, e)
+	if _, err := bad.Load(); err == nil {
+		t.Error("expected error for undecryptable value")
+	}
+}
+
+func TestSourceLiterals(t *testing.T) {
+	t.Setenv("PHANTASM_TEST_HOST", "example.com")
+	e := newTestEncrypter(t, "0123456789abcdef")
+	password, _ := EncryptValue(e, "p${PHANTASM_TEST_HOST}")
+	token, _ := EncryptValue(e, "${db.user}")
+
+	source := NewSource(staticSource{
+		{Key: "app", Format: "yaml", Value: "db:\n  user: app\n  password: " + password + "\n  host: ${PHANTASM_TEST_HOST}\n  secret: ${db.password}\n"},
+		{Key: "api.token", Value: token},
+	}, e)
+	c := config.New(config.WithSource(source))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	// 解密得到的值不展开占位符，被引用时按原样替换，其余值照常展开
+	for key, want := range map[string]string{
+		"db.password": "p${PHANTASM_TEST_HOST}",
+		"db.secret":   "p${PHANTASM_TEST_HOST}",
+		"db.host":     "example.com",
+		"api.token":   "${db.user}",
+	} {
+		if got, _ := c.Value(key).String(); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLegacyCiphertext(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("old"), nil))
+
+	e := newTestEncrypter(t, string(key))
+	if got, err := e.Decrypt([]byte(legacy)); err != nil || string(got) != "old" {
+		t.Errorf("Decrypt legacy = %q, %v", got, err)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	key := make([]byte, 32)
+	aesKey, _ := NewAESEncrypter(WithKey(key), WithKeyID("a1"))
+	chacha, err := NewChaCha20Encrypter(WithKey(key), WithKeyID("c1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		e         Encrypter
+		algorithm Algorithm
+		keyID     string
+	}{{aesKey, AlgorithmAESGCM, "a1"}, {chacha, AlgorithmChaCha20Poly1305, "c1"}} {
+		ciphertext, err := tc.e.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _, _, _, err := decodeCiphertext(ciphertext)
+		if err != nil || h == nil || h.Algorithm != tc.algorithm || h.KeyID != tc.keyID {
+			t.Fatalf("%s header = %+v, %v", tc.algorithm, h, err)
+		}
+		if got, err := tc.e.Decrypt(ciphertext); err != nil || string(got) != "hello" {
+			t.Errorf("%s Decrypt = %q, %v", tc.algorithm, got, err)
+		}
+	}
+
+	// 同一个密钥不能解密另一个算法的密文
+	ciphertext, _ := chacha.Encrypt([]byte("hello"))
+	if _, err := aesKey.Decrypt(ciphertext); err == nil {
+		t.Error("expected error for ciphertext of another algorithm")
+	}
+	// 篡改密文头会导致认证失败
+	raw, _ := base64.StdEncoding.DecodeString(string(ciphertext))
+	raw[5] = 'x'
+	if _, err := chacha.Decrypt([]byte(base64.StdEncoding.EncodeToString(raw))); err == nil {
+		t.Error("expected error for tampered header")
+	}
+
+	// 密钥环按密文头中的密钥ID选择加密器
+	keyring, _ := NewKeyring("a1", map[string]Encrypter{"a1": aesKey, "c1": chacha})
+	if got, err := keyring.Decrypt(ciphertext); err != nil || string(got) != "hello" {
+		t.Errorf("keyring Decrypt = %q, %v", got, err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	kms, err := NewLocalKMS(filepath.Join(t.TempDir(), "keystore.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEnvelopeEncrypter(kms, WithAlgorithm(AlgorithmChaCha20Poly1305))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := EncryptValue(e, "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kms.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := EncryptValue(e, "after")
+	if ids := kms.KeyIDs(); len(ids) != 2 || ids[0] != "k2" {
+		t.Fatalf("key ids = %v", ids)
+	}
+
+	// 重新打开密钥库后，轮换前后的值都可以解密
+	reopened, err := NewLocalKMS(kms.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := NewEnvelopeEncrypter(reopened)
+	if got, err := DecryptValue(d, before+","+after); err != nil || got != "before,after" {
+		t.Errorf("DecryptValue = %q, %v", got, err)
+	}
+	ciphertext, _ := e.Encrypt([]byte("x"))
+	h, _, _, _, _ := decodeCiphertext(ciphertext)
+	if h.KeyID != "k2" || h.Algorithm != AlgorithmChaCha20Poly1305 || len(h.WrappedKey) == 0 {
+		t.Errorf("header = %+v", h)
+	}
+}
+
+func TestLocalKMSRotate(t *testing.T) {
+	// 手工编辑过的密钥库中缺少k2，新密钥的ID不能与k3冲突
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	store := `{"current":"k3","keys":{"k1":"` + key + `","k3":"` + key + `","manual":"` + key + `"}}`
+	if err := os.WriteFile(path, []byte(store), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := NewLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := kms.Rotate()
+	if err != nil || id != "k4" {
+		t.Fatalf("Rotate = %q, %v", id, err)
+	}
+	if ids := kms.KeyIDs(); len(ids) != 4 || ids[0] != "k4" {
+		t.Errorf("key ids = %v", ids)
+	}
+}
+
+func TestKeyProviders(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	k2 := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+
+	t.Setenv("TEST_CONFIG_KEYS", "k1:"+k1)
+	env, _ := NewEnvelopeEncrypter(NewEnvKeyProvider("TEST_CONFIG_KEYS"))
+	old, err := env.Encrypt([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# 当前密钥\nk2:"+k2+"\nk1:"+k1+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := NewEnvelopeEncrypter(NewFileKeyProvider(path))
+	if got, err := file.Decrypt(old); err != nil || string(got) != "old" {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+	ciphertext, _ := file.Encrypt([]byte("new"))
+	if _, err := env.Decrypt(ciphertext); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+
+	t.Setenv("TEST_CONFIG_KEYS", "k1:bad")
+	if _, err := env.Encrypt([]byte("x")); err == nil {
+		t.Error("expected error for invalid key")
+	}
+}
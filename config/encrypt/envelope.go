@@ -0,0 +1,69 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// envelopeEncrypter 是信封加密器
+type envelopeEncrypter struct {
+	provider  KeyProvider
+	algorithm Algorithm
+}
+
+// NewEnvelopeEncrypter 创建信封加密器
+// 每次加密生成一个随机的数据密钥加密数据，数据密钥由KeyProvider的主密钥加密后与主密钥ID一起保存在密文头中，
+// 轮换主密钥后旧的密文仍然按密文头中的主密钥ID解密；加密数据的算法通过WithAlgorithm设置，默认为AES-GCM
+func NewEnvelopeEncrypter(provider KeyProvider, opts ...Option) (Encrypter, error) {
+	o := options{algorithm: AlgorithmAESGCM}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if provider == nil {
+		return nil, errors.New("key provider is required")
+	}
+	if o.algorithm != AlgorithmAESGCM && o.algorithm != AlgorithmChaCha20Poly1305 {
+		return nil, errors.New("encrypt: unsupported algorithm")
+	}
+
+	return &envelopeEncrypter{provider: provider, algorithm: o.algorithm}, nil
+}
+
+// Encrypt 生成数据密钥并加密数据
+func (e *envelopeEncrypter) Encrypt(data []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := e.provider.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(e.algorithm, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, &header{Algorithm: e.algorithm, KeyID: keyID, WrappedKey: wrapped}, data)
+}
+
+// Decrypt 用密文头中的主密钥ID解密数据密钥，再按密文头中的算法解密数据
+func (e *envelopeEncrypter) Decrypt(data []byte) ([]byte, error) {
+	h, raw, rest, _, err := decodeCiphertext(data)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil || len(h.WrappedKey) == 0 {
+		return nil, ErrMalformedCiphertext
+	}
+	dataKey, err := e.provider.UnwrapKey(h.KeyID, h.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(h.Algorithm, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, raw, rest)
+}
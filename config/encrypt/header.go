@@ -0,0 +1,120 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Algorithm 是加密数据使用的算法
+type Algorithm byte
+
+const (
+	// AlgorithmAESGCM 是AES-GCM
+	AlgorithmAESGCM Algorithm = 1
+	// AlgorithmChaCha20Poly1305 是ChaCha20-Poly1305
+	AlgorithmChaCha20Poly1305 Algorithm = 2
+)
+
+// String 返回算法名称
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmAESGCM:
+		return "aes-gcm"
+	case AlgorithmChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return "unknown"
+	}
+}
+
+// headerVersion 是当前的密文头版本
+const headerVersion = 1
+
+// headerMagic 标识带有密文头的密文，没有密文头的是旧版本输出的 nonce+密文
+var headerMagic = []byte("PH")
+
+// ErrMalformedCiphertext 是密文格式错误时返回的错误
+var ErrMalformedCiphertext = errors.New("encrypt: malformed ciphertext")
+
+// header 是密文头，记录解密需要的算法和密钥ID，作为附加数据参与认证
+// 格式为 magic(2) version(1) algorithm(1) len(keyID)(1) keyID len(wrappedKey)(2) wrappedKey
+type header struct {
+	Algorithm  Algorithm
+	KeyID      string
+	WrappedKey []byte // 信封加密时用主密钥加密的数据密钥
+}
+
+// marshal 编码密文头
+func (h *header) marshal() []byte {
+	buf := make([]byte, 0, 7+len(h.KeyID)+len(h.WrappedKey))
+	buf = append(buf, headerMagic...)
+	buf = append(buf, headerVersion, byte(h.Algorithm), byte(len(h.KeyID)))
+	buf = append(buf, h.KeyID...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.WrappedKey)))
+	return append(buf, h.WrappedKey...)
+}
+
+// parseHeader 解析密文头，返回密文头的原始字节和剩余的数据
+func parseHeader(data []byte) (*header, []byte, []byte, error) {
+	if len(data) < 5 || !bytes.HasPrefix(data, headerMagic) {
+		return nil, nil, nil, ErrMalformedCiphertext
+	}
+	if data[2] != headerVersion {
+		return nil, nil, nil, ErrMalformedCiphertext
+	}
+	h := &header{Algorithm: Algorithm(data[3])}
+	n := 5 + int(data[4])
+	if len(data) < n+2 {
+		return nil, nil, nil, ErrMalformedCiphertext
+	}
+	h.KeyID = string(data[5:n])
+	m := n + 2 + int(binary.BigEndian.Uint16(data[n:]))
+	if len(data) < m {
+		return nil, nil, nil, ErrMalformedCiphertext
+	}
+	if m > n+2 {
+		h.WrappedKey = data[n+2 : m]
+	}
+	return h, data[:m], data[m:], nil
+}
+
+// seal 加密数据，输出base64编码的 密文头+nonce+密文
+func seal(aead cipher.AEAD, h *header, plaintext []byte) ([]byte, error) {
+	if len(h.KeyID) > 255 || len(h.WrappedKey) > 65535 {
+		return nil, errors.New("encrypt: key id or wrapped key too long")
+	}
+	raw := h.marshal()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := aead.Seal(append(raw, nonce...), nonce, plaintext, raw)
+	return []byte(base64.StdEncoding.EncodeToString(out)), nil
+}
+
+// open 解密带有密文头的数据，raw是密文头的原始字节，data是 nonce+密文
+func open(aead cipher.AEAD, raw, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, raw)
+}
+
+// decodeCiphertext 解码base64密文并解析密文头，没有密文头时h为nil
+func decodeCiphertext(data []byte) (h *header, raw, rest, decoded []byte, err error) {
+	decoded, err = base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	h, raw, rest, err = parseHeader(decoded)
+	if err != nil {
+		return nil, nil, nil, decoded, nil
+	}
+	return h, raw, rest, decoded, nil
+}
@@ -0,0 +1,76 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrUnknownKey 是密文使用的密钥ID不在密钥环中时返回的错误
+var ErrUnknownKey = errors.New("encrypt: unknown key id")
+
+// keyring 是按密钥ID区分的多个加密器
+type keyring struct {
+	primary string
+	keys    map[string]Encrypter
+	ids     []string // 排序后的密钥ID，用于解密没有记录密钥ID的密文
+}
+
+// NewKeyring 创建支持密钥轮换的加密器
+// 加密时使用primary对应的加密器，密钥ID记录在密文头中；没有通过WithKeyID设置ID的加密器使用keys中的ID，
+// 设置了不同ID的加密器会返回错误。解密时按密文头中的密钥ID选择加密器，
+// 没有记录密钥ID的密文（没有密文头的旧版本密文或者未设置ID的加密器的输出）依次尝试所有密钥
+// 信封加密器的密文头记录的是主密钥ID，轮换主密钥由KeyProvider负责，不能加入密钥环
+func NewKeyring(primary string, keys map[string]Encrypter) (Encrypter, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("encrypt: primary key %q not found", primary)
+	}
+	k := &keyring{primary: primary, keys: make(map[string]Encrypter, len(keys)), ids: make([]string, 0, len(keys))}
+	for id, e := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("encrypt: invalid key id %q", id)
+		}
+		switch e := e.(type) {
+		case *envelopeEncrypter:
+			return nil, fmt.Errorf("encrypt: envelope encrypter %q cannot be used in a keyring", id)
+		case keyedEncrypter:
+			if e.keyID() != "" && e.keyID() != id {
+				return nil, fmt.Errorf("encrypt: key %q writes key id %q to the header", id, e.keyID())
+			}
+			k.keys[id] = e.withKeyID(id)
+		default:
+			k.keys[id] = e
+		}
+		k.ids = append(k.ids, id)
+	}
+	sort.Strings(k.ids)
+	return k, nil
+}
+
+// Encrypt 使用主密钥加密数据
+func (k *keyring) Encrypt(data []byte) ([]byte, error) {
+	return k.keys[k.primary].Encrypt(data)
+}
+
+// Decrypt 使用密文头中的密钥ID对应的加密器解密数据
+func (k *keyring) Decrypt(data []byte) ([]byte, error) {
+	h, _, _, _, err := decodeCiphertext(data)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil && h.KeyID != "" {
+		e, ok := k.keys[h.KeyID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, h.KeyID)
+		}
+		return e.Decrypt(data)
+	}
+
+	for _, id := range k.ids {
+		var plaintext []byte
+		if plaintext, err = k.keys[id].Decrypt(data); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
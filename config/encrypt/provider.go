@@ -0,0 +1,338 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyProvider 是主密钥的提供者，用于信封加密
+// 主密钥只用来加密和解密数据密钥，对接云厂商KMS时主密钥不离开KMS
+type KeyProvider interface {
+	// WrapKey 用当前的主密钥加密数据密钥，返回主密钥ID和加密后的数据密钥
+	WrapKey(dataKey []byte) (string, []byte, error)
+	// UnwrapKey 用指定ID的主密钥解密数据密钥
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// DefaultKeyID 是没有指定ID的密钥使用的ID
+const DefaultKeyID = "default"
+
+// keySet 是一组按ID区分的主密钥，第一个密钥用于加密
+type keySet struct {
+	current string
+	keys    map[string][]byte
+}
+
+// parseKeys 解析以逗号或换行分隔的 [id:]base64密钥 列表，忽略空行和#开头的注释
+func parseKeys(text string) (*keySet, error) {
+	set := &keySet{keys: make(map[string][]byte)}
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		id, value, ok := strings.Cut(field, ":")
+		if !ok {
+			id, value = DefaultKeyID, field
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: key %q is not valid base64: %w", id, err)
+		}
+		if err := set.add(strings.TrimSpace(id), key); err != nil {
+			return nil, err
+		}
+	}
+	if set.current == "" {
+		return nil, errors.New("encrypt: no key found")
+	}
+	return set, nil
+}
+
+// add 添加主密钥，第一个添加的密钥作为当前密钥
+func (s *keySet) add(id string, key []byte) error {
+	if id == "" || len(id) > 255 || strings.Contains(id, ":") {
+		return fmt.Errorf("encrypt: invalid key id %q", id)
+	}
+	if _, ok := s.keys[id]; ok {
+		return fmt.Errorf("encrypt: duplicate key id %q", id)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return fmt.Errorf("encrypt: invalid size of key %q: must be 16, 24, or 32 bytes", id)
+	}
+	s.keys[id] = key
+	if s.current == "" {
+		s.current = id
+	}
+	return nil
+}
+
+// WrapKey 用当前的主密钥以AES-GCM加密数据密钥，主密钥ID作为附加数据参与认证
+func (s *keySet) WrapKey(dataKey []byte) (string, []byte, error) {
+	aead, err := newAEAD(AlgorithmAESGCM, s.keys[s.current])
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return s.current, aead.Seal(nonce, nonce, dataKey, []byte(s.current)), nil
+}
+
+// UnwrapKey 用指定ID的主密钥解密数据密钥
+func (s *keySet) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	aead, err := newAEAD(AlgorithmAESGCM, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+// NewStaticKeyProvider 创建使用固定主密钥的提供者，current是用于加密的主密钥ID
+func NewStaticKeyProvider(current string, keys map[string][]byte) (KeyProvider, error) {
+	return newKeySet(current, keys)
+}
+
+// newKeySet 创建以current作为当前密钥的主密钥集合
+func newKeySet(current string, keys map[string][]byte) (*keySet, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("encrypt: current key %q not found", current)
+	}
+	set := &keySet{keys: make(map[string][]byte, len(keys))}
+	if err := set.add(current, keys[current]); err != nil {
+		return nil, err
+	}
+	for id, key := range keys {
+		if id == current {
+			continue
+		}
+		if err := set.add(id, key); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// envKeyProvider 从环境变量读取主密钥
+type envKeyProvider struct {
+	name string
+}
+
+// NewEnvKeyProvider 创建从环境变量读取主密钥的提供者
+// 环境变量的值是以逗号分隔的 [id:]base64密钥 列表，第一个密钥用于加密，例如 "k2:...,k1:..."
+// 每次使用时重新读取环境变量
+func NewEnvKeyProvider(name string) KeyProvider {
+	return &envKeyProvider{name: name}
+}
+
+// keys 读取并解析环境变量
+func (p *envKeyProvider) keys() (*keySet, error) {
+	value, ok := os.LookupEnv(p.name)
+	if !ok {
+		return nil, fmt.Errorf("encrypt: environment variable %s is not set", p.name)
+	}
+	return parseKeys(value)
+}
+
+// WrapKey 用当前的主密钥加密数据密钥
+func (p *envKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	set, err := p.keys()
+	if err != nil {
+		return "", nil, err
+	}
+	return set.WrapKey(dataKey)
+}
+
+// UnwrapKey 用指定ID的主密钥解密数据密钥
+func (p *envKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	set, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return set.UnwrapKey(keyID, wrapped)
+}
+
+// fileKeyProvider 从文件读取主密钥
+type fileKeyProvider struct {
+	path string
+}
+
+// NewFileKeyProvider 创建从文件读取主密钥的提供者
+// 文件每行是一个 [id:]base64密钥，第一个密钥用于加密，#开头的行是注释；
+// 每次使用时重新读取文件，适合挂载的Kubernetes Secret在轮换后自动生效
+func NewFileKeyProvider(path string) KeyProvider {
+	return &fileKeyProvider{path: path}
+}
+
+// keys 读取并解析密钥文件
+func (p *fileKeyProvider) keys() (*keySet, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(string(data))
+}
+
+// WrapKey 用当前的主密钥加密数据密钥
+func (p *fileKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	set, err := p.keys()
+	if err != nil {
+		return "", nil, err
+	}
+	return set.WrapKey(dataKey)
+}
+
+// UnwrapKey 用指定ID的主密钥解密数据密钥
+func (p *fileKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	set, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return set.UnwrapKey(keyID, wrapped)
+}
+
+// LocalKMS 是本地的KMS替身，在开发和测试环境代替云厂商的KMS
+// 主密钥保存在本地的JSON密钥库文件中，支持轮换，轮换后旧的主密钥仍然保留用于解密
+type LocalKMS struct {
+	lock sync.Mutex
+	path string
+	set  *keySet
+}
+
+// localKeystore 是密钥库文件的内容
+type localKeystore struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"` // 主密钥ID到base64编码的主密钥
+}
+
+// NewLocalKMS 打开本地密钥库，文件不存在时生成一个主密钥并创建密钥库
+func NewLocalKMS(path string) (*LocalKMS, error) {
+	kms := &LocalKMS{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := kms.Rotate(); err != nil {
+			return nil, err
+		}
+		return kms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store := &localKeystore{}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("encrypt: invalid keystore %s: %w", path, err)
+	}
+	keys := make(map[string][]byte, len(store.Keys))
+	for id, value := range store.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("encrypt: invalid key %q in keystore: %w", id, err)
+		}
+	}
+	if kms.set, err = newKeySet(store.Current, keys); err != nil {
+		return nil, err
+	}
+	return kms, nil
+}
+
+// Rotate 生成新的主密钥并作为当前密钥，返回新密钥的ID
+func (k *LocalKMS) Rotate() (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	// 新密钥的序号比已有的最大序号大1，密钥库中的密钥被手工删除或添加后也不会与已有的ID冲突
+	n := 0
+	keys := map[string][]byte{}
+	if k.set != nil {
+		for old, key := range k.set.keys {
+			keys[old] = key
+			if num, ok := strings.CutPrefix(old, "k"); ok {
+				if i, err := strconv.Atoi(num); err == nil && i > n {
+					n = i
+				}
+			}
+		}
+	}
+	id := "k" + strconv.Itoa(n+1)
+	if _, ok := keys[id]; ok {
+		return "", fmt.Errorf("encrypt: key id %q already exists in keystore", id)
+	}
+	keys[id] = key
+	set, err := newKeySet(id, keys)
+	if err != nil {
+		return "", err
+	}
+
+	store := &localKeystore{Current: id, Keys: make(map[string]string, len(set.keys))}
+	for id, key := range set.keys {
+		store.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return "", err
+	}
+	// 先写临时文件再重命名，避免写入中断损坏密钥库
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		return "", err
+	}
+	k.set = set
+	return id, nil
+}
+
+// KeyIDs 返回所有主密钥的ID，第一个是当前密钥
+func (k *LocalKMS) KeyIDs() []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	ids := make([]string, 0, len(k.set.keys))
+	for id := range k.set.keys {
+		if id != k.set.current {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return append([]string{k.set.current}, ids...)
+}
+
+// WrapKey 用当前的主密钥加密数据密钥
+func (k *LocalKMS) WrapKey(dataKey []byte) (string, []byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.set.WrapKey(dataKey)
+}
+
+// UnwrapKey 用指定ID的主密钥解密数据密钥
+func (k *LocalKMS) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.set.UnwrapKey(keyID, wrapped)
+}
@@ -0,0 +1,111 @@
+package encrypt
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+var (
+	_ config.Source = (*Source)(nil)
+)
+
+// Source 是加密配置源包装器，透明地解密原始配置源中 ENC(...) 形式的值
+// 包含加密值的结构化文档解码后逐个解密字符串值，再以JSON格式交给配置读取器，没有加密值的键值原样返回；
+// 解密得到的值记录在 config.KeyValue 的 Literals 中，其中的 ${...} 不会被当作占位符展开
+type Source struct {
+	source    config.Source // 原始配置源
+	encrypter Encrypter     // 加密器
+}
+
+// NewSource 创建一个加密配置源
+func NewSource(source config.Source, encrypter Encrypter) *Source {
+	return &Source{
+		source:    source,
+		encrypter: encrypter,
+	}
+}
+
+// GetSource 获取原始配置源
+func (s *Source) GetSource() config.Source {
+	return s.source
+}
+
+// GetEncrypter 获取加密器
+func (s *Source) GetEncrypter() Encrypter {
+	return s.encrypter
+}
+
+// Load 加载并解密配置
+func (s *Source) Load() ([]*config.KeyValue, error) {
+	kvs, err := s.source.Load()
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(kvs)
+}
+
+// decrypt 解密键值中的加密值，任一值解密失败时返回错误
+func (s *Source) decrypt(kvs []*config.KeyValue) ([]*config.KeyValue, error) {
+	result := make([]*config.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		if !IsEncrypted(kv.Value) {
+			result = append(result, kv)
+			continue
+		}
+
+		if kv.Format == "" {
+			value, err := DecryptValue(s.encrypter, kv.Value)
+			if err != nil {
+				return nil, fmt.Errorf("encrypt: decrypt %s: %w", kv.Key, err)
+			}
+			result = append(result, &config.KeyValue{Key: kv.Key, Value: value, Literals: []string{kv.Key}})
+			continue
+		}
+
+		values, err := config.Decode(kv)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: decode %s: %w", kv.Key, err)
+		}
+		var literals []string
+		if _, err := decryptValues(s.encrypter, values, "", &literals); err != nil {
+			return nil, fmt.Errorf("encrypt: decrypt %s: %w", kv.Key, err)
+		}
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &config.KeyValue{Key: kv.Key, Value: string(data), Format: "json", Literals: literals})
+	}
+	return result, nil
+}
+
+// Watch 监视原始配置源，返回解密后的配置
+func (s *Source) Watch() (config.Watcher, error) {
+	w, err := s.source.Watch()
+	if err != nil {
+		return nil, err
+	}
+	return &watcher{source: s, watcher: w}, nil
+}
+
+// watcher 是加密配置源的观察者
+type watcher struct {
+	source  *Source
+	watcher config.Watcher
+}
+
+// Next 返回解密后的配置，解密失败时返回错误，配置保留之前的值
+func (w *watcher) Next() ([]*config.KeyValue, error) {
+	kvs, err := w.watcher.Next()
+	if err != nil {
+		return nil, err
+	}
+	return w.source.decrypt(kvs)
+}
+
+// Stop 停止观察
+func (w *watcher) Stop() error {
+	return w.watcher.Stop()
+}
@@ -0,0 +1,118 @@
+package encrypt
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrMalformedValue 是加密值不符合 ENC(...) 格式时返回的错误
+var ErrMalformedValue = errors.New("encrypt: malformed encrypted value")
+
+// encrypted 匹配字符串中的加密值，括号中是加密器输出的密文
+var encrypted = regexp.MustCompile(`ENC\(([^()]*)\)`)
+
+// IsEncrypted 返回字符串中是否包含加密值
+func IsEncrypted(s string) bool {
+	return strings.Contains(s, "ENC(")
+}
+
+// EncryptValue 加密明文，返回 ENC(...) 形式的加密值
+func EncryptValue(e Encrypter, plaintext string) (string, error) {
+	ciphertext, err := e.Encrypt([]byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return "ENC(" + string(ciphertext) + ")", nil
+}
+
+// DecryptValue 解密字符串中所有的加密值，例如 "postgres://app:ENC(...)@db" 只替换括号部分
+func DecryptValue(e Encrypter, s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	var firstErr error
+	result := encrypted.ReplaceAllStringFunc(s, func(match string) string {
+		plaintext, err := e.Decrypt([]byte(match[len("ENC(") : len(match)-1]))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return match
+		}
+		return string(plaintext)
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	// 剩余的 ENC( 说明括号不完整
+	if strings.Contains(encrypted.ReplaceAllString(s, ""), "ENC(") {
+		return "", ErrMalformedValue
+	}
+	return result, nil
+}
+
+// ReencryptValue 解密字符串中所有的加密值并重新加密，用于轮换密钥后更新已有的配置
+// 使用 Keyring 时以旧密钥解密，以主密钥加密
+func ReencryptValue(e Encrypter, s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	var firstErr error
+	result := encrypted.ReplaceAllStringFunc(s, func(match string) string {
+		if firstErr != nil {
+			return match
+		}
+		plaintext, err := e.Decrypt([]byte(match[len("ENC(") : len(match)-1]))
+		if err == nil {
+			match, err = EncryptValue(e, string(plaintext))
+		}
+		if err != nil {
+			firstErr = err
+		}
+		return match
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return result, nil
+}
+
+// decryptValues 递归解密映射和切片中所有的字符串值，并将解密过的值的键路径追加到paths
+// 切片元素以下标作为路径的一部分，与 config.KeyValue 的 Literals 一致
+func decryptValues(e Encrypter, v interface{}, path string, paths *[]string) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		if !IsEncrypted(t) {
+			return t, nil
+		}
+		*paths = append(*paths, path)
+		return DecryptValue(e, t)
+	case map[string]interface{}:
+		for k, child := range t {
+			decrypted, err := decryptValues(e, child, join(path, k), paths)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = decrypted
+		}
+	case []interface{}:
+		for i, child := range t {
+			decrypted, err := decryptValues(e, child, join(path, strconv.Itoa(i)), paths)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = decrypted
+		}
+	}
+	return v, nil
+}
+
+// join 拼接键路径
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
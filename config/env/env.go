@@ -0,0 +1,112 @@
+package env
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+// Source 是基于环境变量的配置源
+// 变量名去掉前缀后转为小写，下划线作为键路径的分隔符，例如前缀为APP时 APP_SERVER_HTTP_ADDR 对应 server.http.addr
+// 变量的值加载为字符串，扫描时由 config.DefaultDecoder 按字段类型转换为数值或布尔值
+type Source struct {
+	prefix string
+}
+
+// NewSource 创建一个基于环境变量的配置源，只加载以prefix开头的变量，prefix为空时加载所有变量
+func NewSource(prefix string) config.Source {
+	return &Source{prefix: strings.TrimSuffix(prefix, "_")}
+}
+
+// Load 加载环境变量
+func (s *Source) Load() ([]*config.KeyValue, error) {
+	return load(s.prefix, os.Environ())
+}
+
+// load 将环境变量转换为嵌套的配置
+func load(prefix string, environ []string) ([]*config.KeyValue, error) {
+	keys := make(map[string]string)
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if prefix != "" {
+			if !strings.HasPrefix(name, prefix+"_") {
+				continue
+			}
+			name = name[len(prefix)+1:]
+		}
+		key := strings.Trim(strings.ToLower(name), "_")
+		if key == "" {
+			continue
+		}
+		keys[strings.ReplaceAll(key, "_", ".")] = value
+	}
+
+	// 按键排序后逐个设置，同时存在 APP_SERVER 和 APP_SERVER_PORT 时保留更深的键
+	paths := make([]string, 0, len(keys))
+	for path := range keys {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	values := make(map[string]interface{})
+	for _, path := range paths {
+		set(values, strings.Split(path, "."), keys[path])
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return []*config.KeyValue{
+		{
+			Key:    "env",
+			Value:  string(data),
+			Format: "json",
+		},
+	}, nil
+}
+
+// set 在嵌套映射中设置键路径的值
+func set(values map[string]interface{}, parts []string, value string) {
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := values[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			values[part] = next
+		}
+		values = next
+	}
+	last := parts[len(parts)-1]
+	if _, ok := values[last].(map[string]interface{}); !ok {
+		values[last] = value
+	}
+}
+
+// Watch 监视环境变量，进程的环境变量不会从外部改变，观察者只在停止时返回
+func (s *Source) Watch() (config.Watcher, error) {
+	return &watcher{done: make(chan struct{})}, nil
+}
+
+// watcher 是环境变量配置源的观察者
+type watcher struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// Next 阻塞直到观察者停止
+func (w *watcher) Next() ([]*config.KeyValue, error) {
+	<-w.done
+	return nil, config.ErrWatcherClosed
+}
+
+// Stop 停止观察
+func (w *watcher) Stop() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
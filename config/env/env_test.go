@@ -0,0 +1,65 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/config/validate"
+)
+
+func TestLoad(t *testing.T) {
+	t.Setenv("APP_SERVER_HTTP_ADDR", ":8000")
+	t.Setenv("APP_SERVER", "ignored")
+	t.Setenv("APP_LOG_LEVEL", "debug")
+	t.Setenv("OTHER_KEY", "x")
+
+	c := config.New(config.WithSource(NewSource("APP_")))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	if addr, _ := c.Value("server.http.addr").String(); addr != ":8000" {
+		t.Errorf("server.http.addr = %q", addr)
+	}
+	if level, _ := c.Value("log.level").String(); level != "debug" {
+		t.Errorf("log.level = %q", level)
+	}
+	if _, err := c.Value("other.key").String(); err == nil {
+		t.Error("expected variables without prefix to be skipped")
+	}
+}
+
+func TestScanTyped(t *testing.T) {
+	t.Setenv("APP_SERVER_PORT", "8080")
+	t.Setenv("APP_SERVER_DEBUG", "true")
+	t.Setenv("APP_SERVER_RATIO", "0.5")
+	t.Setenv("APP_SERVER_NAME", "123")
+
+	type server struct {
+		Port  int     `json:"port" validate:"min=1,max=65535"`
+		Debug bool    `json:"debug"`
+		Ratio float64 `json:"ratio"`
+		Name  string  `json:"name"`
+	}
+	type app struct {
+		Server server `json:"server"`
+	}
+	c := config.New(config.WithSource(NewSource("APP")), config.WithValidator(validate.For(app{})))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	var v app
+	if err := c.Scan(&v); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if want := (server{Port: 8080, Debug: true, Ratio: 0.5, Name: "123"}); v.Server != want {
+		t.Errorf("server = %+v, want %+v", v.Server, want)
+	}
+	// 字符串字段保留原值，按键读取仍可以转换类型
+	if name, _ := c.Value("server.name").String(); name != "123" {
+		t.Errorf("server.name = %q", name)
+	}
+}
@@ -3,101 +3,264 @@ package file
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
 
 	"github.com/dormoron/phantasm/config"
 )
 
 // Source 是基于文件的配置源
+// path可以是文件或目录，目录中每个支持格式的文件都作为一个独立的键值加载（不包括子目录和隐藏文件）
 type Source struct {
-	path   string
-	format string
+	path    string
+	format  string
+	options *Options
+}
+
+// Options 是文件配置源的选项
+type Options struct {
+	Debounce time.Duration // 合并连续文件事件的等待时间
+}
+
+// Option 是文件配置源的选项函数
+type Option func(*Options)
+
+// WithDebounce 设置合并连续文件事件的等待时间，默认100毫秒
+// 编辑器保存和ConfigMap更新通常会在短时间内产生多个事件，等待期间的事件只触发一次重新加载
+func WithDebounce(d time.Duration) Option {
+	return func(o *Options) {
+		o.Debounce = d
+	}
 }
 
 // NewSource 创建一个基于文件的配置源
-func NewSource(path string) config.Source {
+func NewSource(path string, opts ...Option) config.Source {
+	options := &Options{
+		Debounce: time.Millisecond * 100,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
 	return &Source{
-		path:   path,
-		format: detectFormat(path),
+		path:    path,
+		format:  detectFormat(path),
+		options: options,
 	}
 }
 
 // detectFormat 根据文件扩展名检测配置格式
 func detectFormat(path string) string {
-	ext := strings.ToLower(filepath.Ext(path))
-	if len(ext) > 0 {
-		// 移除前导点
-		ext = ext[1:]
-	}
-	switch ext {
-	case "json":
-		return "json"
-	case "yaml", "yml":
-		return "yaml"
-	case "toml":
-		return "toml"
-	case "xml":
-		return "xml"
-	case "properties", "prop", "props":
-		return "properties"
-	default:
-		return ""
-	}
+	return config.FormatOf(path)
 }
 
 // Load 加载文件配置
 func (s *Source) Load() ([]*config.KeyValue, error) {
-	// 判断文件是否存在
-	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return s.loadDir()
+	}
+
+	kv, err := loadFile(s.path, s.format)
+	if err != nil {
+		return nil, err
+	}
+	return []*config.KeyValue{kv}, nil
+}
+
+// loadDir 按文件名顺序加载目录中所有支持格式的文件
+func (s *Source) loadDir() ([]*config.KeyValue, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
 		return nil, err
 	}
 
-	data, err := os.ReadFile(s.path)
+	kvs := make([]*config.KeyValue, 0, len(entries))
+	for _, entry := range entries {
+		// Kubernetes ConfigMap挂载目录中的..data等隐藏条目不是配置文件
+		name := entry.Name()
+		format := detectFormat(name)
+		if strings.HasPrefix(name, ".") || format == "" {
+			continue
+		}
+		path := filepath.Join(s.path, name)
+		// ConfigMap中的文件是指向..data的符号链接，需要按目标判断是否为目录
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		kv, err := loadFile(path, format)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, nil
+}
+
+// loadFile 读取一个文件，文件名（不含扩展名）作为键
+func loadFile(path, format string) (*config.KeyValue, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
 	// 提取文件名作为顶级键
-	fileName := filepath.Base(s.path)
+	fileName := filepath.Base(path)
 	if ext := filepath.Ext(fileName); len(ext) > 0 {
 		fileName = fileName[:len(fileName)-len(ext)]
 	}
 
-	return []*config.KeyValue{
-		{
-			Key:    fileName,
-			Value:  string(data),
-			Format: s.format,
-		},
+	return &config.KeyValue{
+		Key:    fileName,
+		Value:  string(data),
+		Format: format,
 	}, nil
 }
 
 // Watch 监视配置文件变化
 func (s *Source) Watch() (config.Watcher, error) {
-	return newWatcher(s.path)
+	return newWatcher(s)
 }
 
 // Watcher 是文件配置监视器
+// 监视文件所在目录而不是文件本身，这样编辑器先写临时文件再重命名的保存方式，
+// 以及Kubernetes ConfigMap通过切换..data符号链接的更新方式都能被感知
 type Watcher struct {
-	path     string
-	format   string
+	source   *Source
+	fsw      *fsnotify.Watcher
+	files    map[string]struct{} // 监视单个文件时关心的文件路径，为空表示目录中的所有文件
+	last     []*config.KeyValue
 	closeCh  chan struct{}
 	changeCh chan []*config.KeyValue
+	once     sync.Once
 }
 
 // newWatcher 创建一个新的文件监视器
-func newWatcher(path string) (*Watcher, error) {
+func newWatcher(s *Source) (*Watcher, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	last, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
 	w := &Watcher{
-		path:     path,
-		format:   detectFormat(path),
+		source:   s,
+		fsw:      fsw,
+		last:     last,
 		closeCh:  make(chan struct{}),
 		changeCh: make(chan []*config.KeyValue, 1),
 	}
 
+	dirs := []string{s.path}
+	if !info.IsDir() {
+		path, _ := filepath.Abs(s.path)
+		dirs = []string{filepath.Dir(path)}
+		w.files = map[string]struct{}{path: {}}
+		// 文件是指向其他目录的符号链接时，同时监视目标所在的目录
+		if real, err := filepath.EvalSymlinks(path); err == nil && filepath.Dir(real) != dirs[0] {
+			dirs = append(dirs, filepath.Dir(real))
+			w.files[real] = struct{}{}
+		}
+	}
+	for _, dir := range dirs {
+		if err := fsw.Add(dir); err != nil {
+			fsw.Close()
+			return nil, err
+		}
+	}
+
+	go w.run()
 	return w, nil
 }
 
-// Next 阻塞直到接收到文件变化或上下文被取消
+// relevant 返回文件事件是否可能改变配置
+func (w *Watcher) relevant(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Base(ev.Name)
+	// ConfigMap更新时..data符号链接被原子地替换
+	if strings.HasPrefix(name, "..") {
+		return true
+	}
+	if w.files == nil {
+		return !strings.HasPrefix(name, ".") && detectFormat(name) != ""
+	}
+	path, _ := filepath.Abs(ev.Name)
+	_, ok := w.files[path]
+	return ok
+}
+
+// run 接收文件事件，在事件平息后重新加载并发布变化的配置
+func (w *Watcher) run() {
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-w.closeCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case _, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if !w.relevant(ev) {
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(w.source.options.Debounce)
+			} else {
+				timer.Reset(w.source.options.Debounce)
+			}
+			fire = timer.C
+		case <-fire:
+			fire = nil
+			w.reload()
+		}
+	}
+}
+
+// reload 重新加载配置，内容变化时发布
+// 文件可能正在被替换而暂时不存在，加载失败时等待下一个事件
+func (w *Watcher) reload() {
+	kvs, err := w.source.Load()
+	if err != nil || reflect.DeepEqual(kvs, w.last) {
+		return
+	}
+	w.last = kvs
+
+	// 只保留最新的配置，消费慢的一方不会读到过期内容
+	select {
+	case <-w.changeCh:
+	default:
+	}
+	w.changeCh <- kvs
+}
+
+// Next 阻塞直到接收到文件变化或监视器停止
 func (w *Watcher) Next() ([]*config.KeyValue, error) {
 	select {
 	case <-w.closeCh:
@@ -109,6 +272,10 @@ func (w *Watcher) Next() ([]*config.KeyValue, error) {
 
 // Stop 停止监视
 func (w *Watcher) Stop() error {
-	close(w.closeCh)
-	return nil
+	var err error
+	w.once.Do(func() {
+		close(w.closeCh)
+		err = w.fsw.Close()
+	})
+	return err
 }
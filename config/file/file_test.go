@@ -0,0 +1,169 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+func next(t *testing.T, w config.Watcher) []*config.KeyValue {
+	t.Helper()
+	ch := make(chan []*config.KeyValue, 1)
+	go func() {
+		kvs, _ := w.Next()
+		ch <- kvs
+	}()
+	select {
+	case kvs := <-ch:
+		return kvs
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for change")
+		return nil
+	}
+}
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "b.yaml"), "b: 1\n")
+	write(t, filepath.Join(dir, "a.json"), `{"a":1}`)
+	write(t, filepath.Join(dir, "README"), "ignored")
+	write(t, filepath.Join(dir, ".hidden.json"), "{}")
+
+	kvs, err := NewSource(dir).Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "a" || kvs[0].Format != "json" || kvs[1].Key != "b" {
+		t.Fatalf("kvs = %+v", kvs)
+	}
+}
+
+func TestWatchRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.yaml")
+	write(t, path, "port: 1\n")
+
+	w, err := NewSource(path, WithDebounce(time.Millisecond*20)).Watch()
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+
+	// 编辑器保存：写临时文件后重命名
+	tmp := filepath.Join(dir, ".app.yaml.swp")
+	write(t, tmp, "port: 2\n")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	if kvs := next(t, w); len(kvs) != 1 || kvs[0].Value != "port: 2\n" {
+		t.Fatalf("kvs = %+v", kvs)
+	}
+
+	// 连续写入只触发一次重新加载
+	for i := 3; i <= 5; i++ {
+		write(t, path, fmt.Sprintf("port: %d\n", i))
+	}
+	if kvs := next(t, w); kvs[0].Value != "port: 5\n" {
+		t.Fatalf("kvs = %+v", kvs)
+	}
+
+	// 其他文件的变化不触发重新加载
+	write(t, filepath.Join(dir, "other.yaml"), "x: 1\n")
+	ch := make(chan struct{})
+	go func() {
+		_, _ = w.Next()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		t.Fatal("unexpected change for unrelated file")
+	case <-time.After(time.Millisecond * 200):
+	}
+	_ = w.Stop()
+	<-ch
+}
+
+// TestWatchConfigMap 模拟Kubernetes ConfigMap挂载目录的符号链接切换
+func TestWatchConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	v1 := filepath.Join(dir, "..v1")
+	if err := os.Mkdir(v1, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(v1, "app.yaml"), "port: 1\n")
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "app.yaml"), filepath.Join(dir, "app.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "app.yaml"), dir} {
+		src := NewSource(path, WithDebounce(time.Millisecond*20))
+		kvs, err := src.Load()
+		if err != nil || len(kvs) != 1 || kvs[0].Value != "port: 1\n" {
+			t.Fatalf("load %s = %+v, %v", path, kvs, err)
+		}
+		w, err := src.Watch()
+		if err != nil {
+			t.Fatalf("watch: %v", err)
+		}
+
+		// 写入新版本目录，再原子地替换..data
+		version := "..v" + filepath.Base(path)
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		write(t, filepath.Join(dir, version, "app.yaml"), "port: 2\n")
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+		if kvs := next(t, w); len(kvs) != 1 || kvs[0].Value != "port: 2\n" {
+			t.Fatalf("kvs = %+v", kvs)
+		}
+		_ = w.Stop()
+
+		// 恢复到第一个版本
+		if err := os.Symlink("..v1", filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestXML(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.xml")
+	write(t, path, `<config><server port="8000"><host>localhost</host></server><peer>a</peer><peer>b</peer></config>`)
+
+	c := config.New(config.WithSource(NewSource(path)))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+	if port, err := c.Value("server.port").Int(); err != nil || port != 8000 {
+		t.Errorf("server.port = %d, %v", port, err)
+	}
+	if host, _ := c.Value("server.host").String(); host != "localhost" {
+		t.Errorf("server.host = %q", host)
+	}
+	if peers, err := c.Value("peer").Slice(); err != nil || len(peers) != 2 {
+		t.Errorf("peer = %v, %v", peers, err)
+	}
+}
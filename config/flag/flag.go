@@ -0,0 +1,126 @@
+package flag
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+// Source 是基于命令行参数的配置源
+// 默认只加载命令行中显式设置的参数，避免参数的默认值覆盖优先级更低的配置源
+type Source struct {
+	flags   *pflag.FlagSet
+	options *Options
+}
+
+// Options 是命令行参数配置源的选项
+type Options struct {
+	Keys     map[string]string // 参数名称到键路径的映射
+	Defaults bool              // 是否加载未设置的参数的默认值
+}
+
+// Option 是命令行参数配置源的选项函数
+type Option func(*Options)
+
+// WithKey 将参数映射到键路径，未映射的参数以参数名称作为键路径，名称中的"-"不做转换
+func WithKey(flag, key string) Option {
+	return func(o *Options) {
+		o.Keys[flag] = key
+	}
+}
+
+// WithDefaults 设置是否加载命令行中未设置的参数的默认值
+func WithDefaults(enable bool) Option {
+	return func(o *Options) {
+		o.Defaults = enable
+	}
+}
+
+// NewSource 创建一个基于命令行参数的配置源，flags需要在Load之前完成解析
+func NewSource(flags *pflag.FlagSet, opts ...Option) config.Source {
+	options := &Options{
+		Keys: make(map[string]string),
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Source{
+		flags:   flags,
+		options: options,
+	}
+}
+
+// Load 加载命令行参数，切片类型的参数加载为列表
+// 参数的值加载为字符串，扫描时由 config.DefaultDecoder 按字段类型转换为数值或布尔值
+func (s *Source) Load() ([]*config.KeyValue, error) {
+	values := make(map[string]interface{})
+	s.flags.VisitAll(func(f *pflag.Flag) {
+		if !f.Changed && !s.options.Defaults {
+			return
+		}
+		key, ok := s.options.Keys[f.Name]
+		if !ok {
+			key = f.Name
+		}
+
+		var value interface{} = f.Value.String()
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			value = sv.GetSlice()
+		}
+		set(values, strings.Split(key, "."), value)
+	})
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return []*config.KeyValue{
+		{
+			Key:    "flag",
+			Value:  string(data),
+			Format: "json",
+		},
+	}, nil
+}
+
+// set 在嵌套映射中设置键路径的值
+func set(values map[string]interface{}, parts []string, value interface{}) {
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := values[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			values[part] = next
+		}
+		values = next
+	}
+	values[parts[len(parts)-1]] = value
+}
+
+// Watch 监视命令行参数，参数在解析后不会改变，观察者只在停止时返回
+func (s *Source) Watch() (config.Watcher, error) {
+	return &watcher{done: make(chan struct{})}, nil
+}
+
+// watcher 是命令行参数配置源的观察者
+type watcher struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// Next 阻塞直到观察者停止
+func (w *watcher) Next() ([]*config.KeyValue, error) {
+	<-w.done
+	return nil, config.ErrWatcherClosed
+}
+
+// Stop 停止观察
+func (w *watcher) Stop() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
@@ -0,0 +1,79 @@
+package flag
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/config/validate"
+)
+
+func TestLoad(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.String("addr", ":8000", "")
+	fs.Int("server.port", 80, "")
+	fs.StringSlice("peers", nil, "")
+	fs.String("level", "info", "")
+	if err := fs.Parse([]string{"--addr=:9000", "--server.port=9090", "--peers=a,b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.New(config.WithSource(NewSource(fs, WithKey("addr", "server.http.addr"))))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	if addr, _ := c.Value("server.http.addr").String(); addr != ":9000" {
+		t.Errorf("server.http.addr = %q", addr)
+	}
+	if port, _ := c.Value("server.port").Int(); port != 9090 {
+		t.Errorf("server.port = %d", port)
+	}
+	if peers, _ := c.Value("peers").Slice(); len(peers) != 2 {
+		t.Errorf("peers = %v", peers)
+	}
+	if _, err := c.Value("level").String(); err == nil {
+		t.Error("expected unset flag to be skipped")
+	}
+
+	c = config.New(config.WithSource(NewSource(fs, WithDefaults(true))))
+	_ = c.Load()
+	defer c.Close()
+	if level, _ := c.Value("level").String(); level != "info" {
+		t.Errorf("level = %q", level)
+	}
+}
+
+func TestScanTyped(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Int("server.port", 80, "")
+	fs.Bool("server.debug", false, "")
+	fs.IntSlice("server.ports", nil, "")
+	if err := fs.Parse([]string{"--server.port=9090", "--server.debug", "--server.ports=1,2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	type server struct {
+		Port  int   `json:"port" validate:"min=1,max=65535"`
+		Debug bool  `json:"debug"`
+		Ports []int `json:"ports"`
+	}
+	type app struct {
+		Server server `json:"server"`
+	}
+	c := config.New(config.WithSource(NewSource(fs)), config.WithValidator(validate.For(app{})))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	var v app
+	if err := c.Scan(&v); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if v.Server.Port != 9090 || !v.Server.Debug || len(v.Server.Ports) != 2 || v.Server.Ports[1] != 2 {
+		t.Errorf("server = %+v", v.Server)
+	}
+}
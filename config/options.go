@@ -1,13 +1,19 @@
 package config
 
+import "github.com/dormoron/phantasm/log"
+
 // Option 是配置选项函数
 type Option func(*options)
 
 // options 是配置选项
 type options struct {
-	sources  []Source
-	decoder  Decoder
-	resolver Resolver
+	sources       []Source
+	decoder       Decoder
+	resolver      Resolver
+	schemas       []Validator
+	validator     Validator
+	scanValidator func(v interface{}) error
+	logger        log.Logger
 }
 
 // Decoder 是配置解码器函数类型
@@ -16,7 +22,10 @@ type Decoder func(src map[string]interface{}, dst interface{}) error
 // Resolver 是配置解析器函数类型
 type Resolver func(string) string
 
-// WithSource 添加配置源
+// Validator 是合并后配置的验证函数类型，values是解析占位符之后的完整配置
+type Validator func(values map[string]interface{}) error
+
+// WithSource 添加配置源，后添加的配置源优先级更高，相同的键会覆盖之前配置源中的值
 func WithSource(s ...Source) Option {
 	return func(o *options) {
 		o.sources = append(o.sources, s...)
@@ -30,9 +39,32 @@ func WithDecoder(d Decoder) Option {
 	}
 }
 
-// WithResolver 设置解析器
+// WithResolver 设置解析器，合并所有配置源后对每个字符串值调用，KeyValue.Literals 中的值除外
+// 默认解析器支持 ${VAR}、${VAR:default} 形式的占位符，VAR可以是其他配置的键路径或环境变量
 func WithResolver(r Resolver) Option {
 	return func(o *options) {
 		o.resolver = r
 	}
 }
+
+// WithValidator 设置合并后配置的验证函数，Load和热更新时调用
+// 验证失败时Load返回错误，热更新则被拒绝并保留之前的配置
+func WithValidator(v Validator) Option {
+	return func(o *options) {
+		o.validator = v
+	}
+}
+
+// WithScanValidator 设置Scan解码后对目标调用的验证函数，例如 validate.Struct
+func WithScanValidator(v func(v interface{}) error) Option {
+	return func(o *options) {
+		o.scanValidator = v
+	}
+}
+
+// WithLogger 设置日志记录器，用于记录被拒绝的热更新
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// resolveWith 对除literals外的所有字符串值调用自定义解析器
+func resolveWith(values map[string]interface{}, literals map[string]bool, resolver Resolver) {
+	walk(values, "", func(path, s string) interface{} {
+		if literals[path] {
+			return s
+		}
+		return resolver(s)
+	})
+}
+
+// resolve 展开除literals外所有字符串值中的 ${NAME} 和 ${NAME:default} 占位符
+// NAME先作为配置的键路径查找，不存在时查找环境变量，都不存在时使用默认值；没有默认值或循环引用的占位符保持原样。
+// 整个值就是一个引用其他键的占位符时保留被引用值的类型，例如 port: ${server.port} 仍然是数字；
+// literals中的值（例如解密得到的值）不展开，被引用时也按原样替换
+func resolve(values map[string]interface{}, literals map[string]bool) {
+	r := &interpolator{values: values, literals: literals, resolving: make(map[string]bool)}
+	walk(values, "", func(path, s string) interface{} {
+		if literals[path] {
+			return s
+		}
+		return r.expand(s)
+	})
+}
+
+// walk 用fn的结果替换嵌套映射和切片中的每个字符串值，fn的参数是值的键路径和值
+func walk(v interface{}, path string, fn func(string, string) interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			p := joinPath(path, k)
+			if s, ok := item.(string); ok {
+				val[k] = fn(p, s)
+			} else {
+				walk(item, p, fn)
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			p := joinPath(path, strconv.Itoa(i))
+			if s, ok := item.(string); ok {
+				val[i] = fn(p, s)
+			} else {
+				walk(item, p, fn)
+			}
+		}
+	}
+}
+
+// joinPath 拼接键路径
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// interpolator 展开占位符，记录正在展开的键以避免循环引用
+type interpolator struct {
+	values    map[string]interface{}
+	literals  map[string]bool
+	resolving map[string]bool
+}
+
+// expand 展开字符串中的所有占位符
+func (r *interpolator) expand(s string) interface{} {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	// 整个字符串是单个占位符时保留引用值的类型
+	if strings.HasPrefix(s, "${") && strings.Index(s, "}") == len(s)-1 {
+		if v, ok := r.lookup(s[2 : len(s)-1]); ok {
+			return v
+		}
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			break
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			b.WriteString(s)
+			break
+		}
+		end += start
+		b.WriteString(s[:start])
+		if v, ok := r.lookup(s[start+2 : end]); ok {
+			b.WriteString(fmt.Sprint(v))
+		} else {
+			// 无法解析的占位符保持原样
+			b.WriteString(s[start : end+1])
+		}
+		s = s[end+1:]
+	}
+	return b.String()
+}
+
+// lookup 查找占位符的值，依次尝试配置键、环境变量和默认值，都不存在时返回false
+func (r *interpolator) lookup(expr string) (interface{}, bool) {
+	name, def, hasDef := strings.Cut(expr, ":")
+	name = strings.TrimSpace(name)
+
+	if v, ok := r.key(name); ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	if hasDef {
+		return def, true
+	}
+	return nil, false
+}
+
+// key 查找配置键的标量值，被引用的值中的占位符会先被展开
+func (r *interpolator) key(path string) (interface{}, bool) {
+	if path == "" || r.resolving[path] {
+		return nil, false
+	}
+	parts := strings.Split(path, ".")
+	current := r.values
+	for i, part := range parts {
+		v, ok := current[part]
+		if !ok {
+			return nil, false
+		}
+		if i < len(parts)-1 {
+			if current, ok = v.(map[string]interface{}); !ok {
+				return nil, false
+			}
+			continue
+		}
+		switch val := v.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			return nil, false
+		case string:
+			if r.literals[path] {
+				return val, true
+			}
+			r.resolving[path] = true
+			expanded := r.expand(val)
+			delete(r.resolving, path)
+			current[part] = expanded
+			return expanded, true
+		default:
+			return val, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// SchemaError 是JSON Schema验证失败的一个值
+type SchemaError struct {
+	Path    string // 值的键路径，例如 server.http.addr 或 servers[0].addr，整个配置为空
+	Message string
+}
+
+// Error 返回错误信息
+func (e *SchemaError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// SchemaErrors 是按键路径排序的JSON Schema验证错误
+type SchemaErrors []*SchemaError
+
+// Error 返回所有值的错误信息
+func (e SchemaErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// NewSchemaValidator 编译JSON Schema并返回验证合并后配置的 Validator
+// 未声明$schema的文档按draft 2020-12处理，验证失败时返回 SchemaErrors
+func NewSchemaValidator(schema []byte) (Validator, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, fmt.Errorf("config: invalid schema: %w", err)
+	}
+	s, err := compiler.Compile("schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("config: invalid schema: %w", err)
+	}
+
+	return func(values map[string]interface{}) error {
+		// 按JSON重新解码，统一不同格式解码出的数值和映射类型
+		data, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+
+		err = s.Validate(doc)
+		var ve *jsonschema.ValidationError
+		if !errors.As(err, &ve) {
+			return err
+		}
+		var errs SchemaErrors
+		collectSchemaErrors(ve, doc, &errs)
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+		return errs
+	}, nil
+}
+
+// WithSchema 设置验证合并后配置的JSON Schema，Load和热更新时在 WithValidator 之前调用
+// 可以多次调用，配置需要满足所有的Schema；Schema无效时Load返回错误
+func WithSchema(schema []byte) Option {
+	v, err := NewSchemaValidator(schema)
+	if err != nil {
+		v = func(map[string]interface{}) error { return err }
+	}
+	return func(o *options) {
+		o.schemas = append(o.schemas, v)
+	}
+}
+
+// collectSchemaErrors 收集验证错误中最底层的原因
+func collectSchemaErrors(ve *jsonschema.ValidationError, doc interface{}, errs *SchemaErrors) {
+	if len(ve.Causes) == 0 {
+		*errs = append(*errs, &SchemaError{Path: schemaPath(ve.InstanceLocation, doc), Message: ve.Message})
+		return
+	}
+	for _, cause := range ve.Causes {
+		collectSchemaErrors(cause, doc, errs)
+	}
+}
+
+// schemaPath 将JSON Pointer转换为配置的键路径，数组下标按实际的值区分
+func schemaPath(pointer string, doc interface{}) string {
+	var b strings.Builder
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch v := doc.(type) {
+		case []interface{}:
+			i, _ := strconv.Atoi(token)
+			b.WriteString("[" + token + "]")
+			if i >= 0 && i < len(v) {
+				doc = v[i]
+			}
+			continue
+		case map[string]interface{}:
+			doc = v[token]
+		default:
+			doc = nil
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(token)
+	}
+	return b.String()
+}
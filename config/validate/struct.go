@@ -0,0 +1,318 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Struct 按 validate 结构体标签验证v的所有字段，包括嵌套的结构体、切片和映射中的元素
+// 返回所有失败字段的 Errors，字段路径使用json标签中的名称，与配置的键路径一致
+//
+// 支持的标签（以逗号分隔）：
+//   - required: 值不能为零值，切片和映射不能为空
+//   - omitempty: 值为零值时跳过其他规则
+//   - min=N, max=N: 数值的范围，字符串、切片和映射的长度；time.Duration 字段使用时长，例如 min=1s
+//   - oneof=a b c: 值必须是以空格分隔的值之一
+//   - url: 值必须是带有scheme和host的URL
+//   - duration: 字符串值必须是合法的时长
+//   - regex=EXPR: 值必须匹配正则表达式，表达式可以包含逗号，因此必须放在最后
+func Struct(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return errors.New("validate: nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("validate: expected struct, got %s", rv.Kind())
+	}
+
+	var errs Errors
+	if err := walkStruct(rv, "", &errs); err != nil {
+		return err
+	}
+	return errs.err()
+}
+
+// For 返回验证合并后配置的 config.Validator
+// 配置使用 config.DefaultDecoder 解码为v的类型的新值后按结构体标签验证，解码失败同样视为验证失败
+func For(v interface{}) config.Validator {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return func(values map[string]interface{}) error {
+		dst := reflect.New(t).Interface()
+		if err := config.DefaultDecoder(values, dst); err != nil {
+			return fmt.Errorf("validate: decode config: %w", err)
+		}
+		return Struct(dst)
+	}
+}
+
+// walkStruct 验证结构体的每个导出字段
+func walkStruct(v reflect.Value, prefix string, errs *Errors) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		fv := v.Field(i)
+
+		// 没有json名称的嵌入结构体与JSON一样展开到外层
+		if f.Anonymous && name == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := walkStruct(fv, prefix, errs); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if err := checkField(fv, f.Tag.Get("validate"), path, errs); err != nil {
+			return fmt.Errorf("validate: field %s.%s: %w", t.Name(), f.Name, err)
+		}
+		if err := walkValue(fv, path, errs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkValue 递归验证值中嵌套的结构体
+func walkValue(v reflect.Value, path string, errs *Errors) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return walkValue(v.Elem(), path, errs)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return nil
+		}
+		return walkStruct(v, path, errs)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkValue(v.Index(i), path+"["+strconv.Itoa(i)+"]", errs); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			if err := walkValue(v.MapIndex(k), path+"."+fmt.Sprint(k), errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName 返回字段json标签中的名称，标签为"-"时返回false
+func fieldName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	return name, true
+}
+
+// checkField 按标签验证一个字段，标签本身无效时返回错误
+func checkField(v reflect.Value, tag, path string, errs *Errors) error {
+	if tag == "" {
+		return nil
+	}
+	rules, required, omitempty, err := parseTag(tag, v.Type())
+	if err != nil {
+		return err
+	}
+
+	zero := v.IsZero()
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		zero = v.Len() == 0
+	}
+	if zero {
+		if required {
+			*errs = append(*errs, &FieldError{Path: path, Err: errors.New("value is required")})
+			return nil
+		}
+		if omitempty || v.Kind() == reflect.Ptr {
+			return nil
+		}
+	}
+
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	value := v.Interface()
+	if v.Kind() == reflect.String {
+		// 以字符串为底层类型的自定义类型按字符串验证
+		value = v.String()
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(value); err != nil {
+			*errs = append(*errs, &FieldError{Path: path, Err: err})
+		}
+	}
+	return nil
+}
+
+// parseTag 解析validate标签，t是字段的类型
+func parseTag(tag string, t reflect.Type) (rules []Rule, required, omitempty bool, err error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var min, max *string
+	parts := strings.Split(tag, ",")
+	for i := 0; i < len(parts); i++ {
+		name, arg, _ := strings.Cut(strings.TrimSpace(parts[i]), "=")
+		switch name {
+		case "":
+		case "required":
+			required = true
+		case "omitempty":
+			omitempty = true
+		case "min":
+			min = &arg
+		case "max":
+			max = &arg
+		case "oneof":
+			rules = append(rules, OneOf{Values: strings.Fields(arg)})
+		case "url":
+			rules = append(rules, URL{})
+		case "duration":
+			rules = append(rules, Duration{})
+		case "regex":
+			// 正则表达式可以包含逗号，标签剩余的部分都属于表达式
+			expr := strings.Join(append([]string{arg}, parts[i+1:]...), ",")
+			rule := Pattern{Regex: expr}
+			if rule.re, err = rule.compile(); err != nil {
+				return nil, false, false, err
+			}
+			rules = append(rules, rule)
+			i = len(parts)
+		default:
+			return nil, false, false, fmt.Errorf("unknown rule %q", name)
+		}
+	}
+
+	if min != nil || max != nil {
+		rule, err := boundRule(t, min, max)
+		if err != nil {
+			return nil, false, false, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, required, omitempty, nil
+}
+
+// boundRule 按字段类型将min和max转换为Range或Length规则
+func boundRule(t reflect.Type, min, max *string) (Rule, error) {
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		rule := Length{Min: 0, Max: math.MaxInt}
+		for _, b := range []struct {
+			arg *string
+			dst *int
+		}{{min, &rule.Min}, {max, &rule.Max}} {
+			if b.arg == nil {
+				continue
+			}
+			n, err := strconv.Atoi(*b.arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid length %q", *b.arg)
+			}
+			*b.dst = n
+		}
+		return rule, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		rule := bound()
+		for _, b := range []struct {
+			arg *string
+			dst *float64
+		}{{min, &rule.Min}, {max, &rule.Max}} {
+			if b.arg == nil {
+				continue
+			}
+			if t == durationType {
+				d, err := time.ParseDuration(*b.arg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid duration %q", *b.arg)
+				}
+				*b.dst = float64(d)
+				continue
+			}
+			n, err := strconv.ParseFloat(*b.arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", *b.arg)
+			}
+			*b.dst = n
+		}
+		if t == durationType {
+			return durationRange{rule}, nil
+		}
+		return rule, nil
+	default:
+		return nil, fmt.Errorf("min and max are not supported for %s", t.Kind())
+	}
+}
+
+// bound 返回没有边界的Range
+func bound() Range {
+	return Range{Min: math.Inf(-1), Max: math.Inf(1)}
+}
+
+// durationRange 是以时长显示边界的Range
+type durationRange struct {
+	Range
+}
+
+// Validate 验证时长是否在范围内
+func (r durationRange) Validate(value interface{}) error {
+	d, ok := value.(time.Duration)
+	if !ok {
+		return r.Range.Validate(value)
+	}
+	if float64(d) < r.Min {
+		return fmt.Errorf("duration %s is less than %s", d, time.Duration(r.Min))
+	}
+	if float64(d) > r.Max {
+		return fmt.Errorf("duration %s is greater than %s", d, time.Duration(r.Max))
+	}
+	return nil
+}
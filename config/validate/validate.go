@@ -2,8 +2,14 @@ package validate
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dormoron/phantasm/config"
 )
@@ -20,6 +26,42 @@ type Rule interface {
 	Validate(value interface{}) error
 }
 
+// FieldError 是一个字段的验证错误
+type FieldError struct {
+	Path string // 字段的键路径，例如 server.http.addr 或 servers[0].addr
+	Err  error
+}
+
+// Error 返回错误信息
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap 返回字段的原始错误
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Errors 是按字段路径聚合的验证错误
+type Errors []*FieldError
+
+// Error 返回所有字段的错误信息
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// err 没有错误时返回nil，避免返回包含nil切片的非空接口
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
 // Option 是验证器选项函数
 type Option func(*options)
 
@@ -54,7 +96,7 @@ func New(opts ...Option) Validator {
 	return &validator{opts: o}
 }
 
-// Validate 验证配置值
+// Validate 验证配置值，返回所有失败字段的 Errors
 func (v *validator) Validate(value config.Value) error {
 	if value == nil {
 		return errors.New("value is nil")
@@ -65,21 +107,29 @@ func (v *validator) Validate(value config.Value) error {
 		return err
 	}
 
-	for key, rules := range v.opts.rules {
+	keys := make([]string, 0, len(v.opts.rules))
+	for key := range v.opts.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs Errors
+	for _, key := range keys {
 		parts := strings.Split(key, ".")
 		val, ok := getNestedValue(m, parts)
 		if !ok {
-			return errors.New("key not found: " + key)
+			errs = append(errs, &FieldError{Path: key, Err: errors.New("key not found")})
+			continue
 		}
 
-		for _, rule := range rules {
-			if err := rule.Validate(val); err != nil {
-				return errors.New(key + ": " + err.Error())
+		for _, rule := range v.opts.rules[key] {
+			if err := rule.Validate(unwrap(val)); err != nil {
+				errs = append(errs, &FieldError{Path: key, Err: err})
 			}
 		}
 	}
 
-	return nil
+	return errs.err()
 }
 
 // getNestedValue 获取嵌套值
@@ -109,6 +159,31 @@ func getNestedValue(m map[string]config.Value, parts []string) (interface{}, boo
 	return getNestedValue(nextMap, parts[1:])
 }
 
+// unwrap 将config.Value转换为它包装的Go值，规则按实际值的类型验证
+func unwrap(value interface{}) interface{} {
+	if _, ok := value.(config.Value); !ok {
+		return value
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int64:
+		return v.Int()
+	case reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Slice:
+		return v.Convert(reflect.TypeOf([]interface{}{})).Interface()
+	case reflect.Map:
+		return v.Convert(reflect.TypeOf(map[string]interface{}{})).Interface()
+	default:
+		// 不存在的值
+		return nil
+	}
+}
+
 // 内置验证规则
 
 // Required 必填规则
@@ -130,6 +205,10 @@ func (r Required) Validate(value interface{}) error {
 		if v.Len() == 0 {
 			return errors.New("value is required")
 		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("value is required")
+		}
 	}
 
 	return nil
@@ -142,27 +221,25 @@ type Range struct {
 
 // Validate 验证值是否在范围内
 func (r Range) Validate(value interface{}) error {
+	var val float64
 	v := reflect.ValueOf(value)
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		val := float64(v.Int())
-		if val < r.Min || val > r.Max {
-			return errors.New("value out of range")
-		}
+		val = float64(v.Int())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		val := float64(v.Uint())
-		if val < r.Min || val > r.Max {
-			return errors.New("value out of range")
-		}
+		val = float64(v.Uint())
 	case reflect.Float32, reflect.Float64:
-		val := v.Float()
-		if val < r.Min || val > r.Max {
-			return errors.New("value out of range")
-		}
+		val = v.Float()
 	default:
 		return errors.New("value type not supported")
 	}
 
+	if val < r.Min {
+		return fmt.Errorf("value %v is less than %v", val, r.Min)
+	}
+	if val > r.Max {
+		return fmt.Errorf("value %v is greater than %v", val, r.Max)
+	}
 	return nil
 }
 
@@ -173,32 +250,114 @@ type Length struct {
 
 // Validate 验证值的长度是否在范围内
 func (l Length) Validate(value interface{}) error {
+	var n int
 	v := reflect.ValueOf(value)
 	switch v.Kind() {
 	case reflect.String:
-		len := len(v.String())
-		if len < l.Min || len > l.Max {
-			return errors.New("length out of range")
-		}
+		n = len(v.String())
 	case reflect.Slice, reflect.Map, reflect.Array:
-		len := v.Len()
-		if len < l.Min || len > l.Max {
-			return errors.New("length out of range")
-		}
+		n = v.Len()
 	default:
 		return errors.New("value type not supported")
 	}
 
+	if n < l.Min {
+		return fmt.Errorf("length %d is less than %d", n, l.Min)
+	}
+	if n > l.Max {
+		return fmt.Errorf("length %d is greater than %d", n, l.Max)
+	}
 	return nil
 }
 
 // Pattern 模式规则
 type Pattern struct {
 	Regex string
+
+	re *regexp.Regexp // 解析结构体标签时编译的表达式
 }
 
+// patterns 缓存编译后的正则表达式，直接构造的 Pattern 不会在每次验证时重新编译
+var patterns sync.Map
+
 // Validate 验证值是否匹配正则表达式
 func (p Pattern) Validate(value interface{}) error {
-	// 简化实现，实际应该使用正则表达式库
-	return errors.New("not implemented")
+	re := p.re
+	if re == nil {
+		var err error
+		if re, err = p.compile(); err != nil {
+			return err
+		}
+	}
+	s, ok := value.(string)
+	if !ok {
+		return errors.New("value type not supported")
+	}
+	if !re.MatchString(s) {
+		return fmt.Errorf("value %q does not match %q", s, p.Regex)
+	}
+	return nil
+}
+
+// compile 编译正则表达式，结果按表达式缓存
+func (p Pattern) compile() (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(p.Regex); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(p.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", p.Regex, err)
+	}
+	patterns.Store(p.Regex, re)
+	return re, nil
+}
+
+// OneOf 枚举规则，按值的字符串形式比较
+type OneOf struct {
+	Values []string
+}
+
+// Validate 验证值是否为允许的值之一
+func (o OneOf) Validate(value interface{}) error {
+	s := fmt.Sprint(value)
+	for _, allowed := range o.Values {
+		if s == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("value %q is not one of [%s]", s, strings.Join(o.Values, " "))
+}
+
+// URL 规则，值必须是带有scheme和host的URL
+type URL struct{}
+
+// Validate 验证值是否为URL
+func (URL) Validate(value interface{}) error {
+	s, ok := value.(string)
+	if !ok {
+		return errors.New("value type not supported")
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("value %q is not a valid url", s)
+	}
+	return nil
+}
+
+// Duration 规则，字符串值必须能被 time.ParseDuration 解析
+type Duration struct{}
+
+// Validate 验证值是否为时长
+func (Duration) Validate(value interface{}) error {
+	switch v := value.(type) {
+	case time.Duration:
+		return nil
+	case string:
+		if _, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("value %q is not a valid duration", v)
+		}
+		return nil
+	default:
+		return errors.New("value type not supported")
+	}
 }
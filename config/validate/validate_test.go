@@ -0,0 +1,201 @@
+package validate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+type serverConfig struct {
+	Addr    string        `json:"addr" validate:"required,regex=^[a-z0-9.]*:[0-9]{2,5}$"`
+	Port    int           `json:"port" validate:"min=1,max=65535"`
+	Network string        `json:"network" validate:"omitempty,oneof=tcp udp"`
+	Timeout time.Duration `json:"timeout" validate:"min=100ms,max=1m"`
+}
+
+type bootstrap struct {
+	Server   serverConfig               `json:"server"`
+	Backends []serverConfig             `json:"backends" validate:"max=2"`
+	Registry *struct{ Endpoint string } `json:"registry" validate:"required"`
+	Log      struct {
+		Level string `json:"level" validate:"oneof=debug info warn error"`
+		Sink  string `json:"sink" validate:"omitempty,url"`
+		Flush string `json:"flush" validate:"duration"`
+	} `json:"log"`
+	Tags map[string]string `json:"tags" validate:"required"`
+}
+
+func TestStruct(t *testing.T) {
+	valid := &bootstrap{
+		Server:   serverConfig{Addr: "0.0.0.0:8000", Port: 8000, Network: "tcp", Timeout: time.Second},
+		Registry: &struct{ Endpoint string }{Endpoint: "x"},
+		Tags:     map[string]string{"env": "prod"},
+	}
+	valid.Log.Level = "info"
+	valid.Log.Flush = "5s"
+	if err := Struct(valid); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	invalid := &bootstrap{
+		Server:   serverConfig{Addr: "bad addr", Port: 70000, Network: "unix", Timeout: time.Millisecond},
+		Backends: []serverConfig{{Addr: "a:80", Port: 80, Timeout: time.Second}, {Port: 0, Timeout: time.Second}},
+	}
+	invalid.Log.Level = "trace"
+	invalid.Log.Sink = "not a url"
+	invalid.Log.Flush = "soon"
+	err := Struct(invalid)
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+
+	got := map[string]bool{}
+	for _, e := range errs {
+		got[e.Path] = true
+	}
+	for _, path := range []string{
+		"server.addr", "server.port", "server.network", "server.timeout",
+		"backends[1].addr", "backends[1].port", "registry", "log.level", "log.sink", "log.flush", "tags",
+	} {
+		if !got[path] {
+			t.Errorf("missing error for %s in %v", path, err)
+		}
+	}
+	if len(errs) != 11 {
+		t.Errorf("got %d errors: %v", len(errs), err)
+	}
+	if !strings.Contains(err.Error(), "server.timeout: duration 1ms is less than 100ms") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestStructInvalidTag(t *testing.T) {
+	var v struct {
+		Name string `validate:"unknown"`
+	}
+	if err := Struct(&v); err == nil || errors.As(err, new(Errors)) {
+		t.Errorf("expected tag error, got %v", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rule  Rule
+		value interface{}
+		ok    bool
+	}{
+		{Pattern{Regex: `^v\d+$`}, "v1", true},
+		{Pattern{Regex: `^v\d+$`}, "x", false},
+		{OneOf{Values: []string{"1", "2"}}, 2, true},
+		{OneOf{Values: []string{"a"}}, "b", false},
+		{URL{}, "https://example.com/x", true},
+		{URL{}, "/relative", false},
+		{Duration{}, "1h30m", true},
+		{Duration{}, "1 hour", false},
+		{Range{Min: 1, Max: 10}, 10, true},
+		{Range{Min: 1, Max: 10}, 11.5, false},
+		{Length{Min: 1, Max: 2}, "abc", false},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(tt.value); (err == nil) != tt.ok {
+			t.Errorf("%T.Validate(%v) = %v", tt.rule, tt.value, err)
+		}
+	}
+}
+
+// TestValidatorValues 确认规则收到的是配置值包装的Go值而不是config.Value
+func TestValidatorValues(t *testing.T) {
+	c := config.New(config.WithSource(staticSource{{Key: "app", Format: "json",
+		Value: `{"server":{"port":8000,"name":"api","mode":"grpc"}}`}}))
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	root := c.Value("server")
+
+	v := New(
+		WithRule("port", Range{Min: 1, Max: 65535}),
+		WithRule("name", Length{Min: 1, Max: 10}),
+		WithRule("mode", OneOf{Values: []string{"http", "grpc"}}),
+	)
+	if err := v.Validate(root); err != nil {
+		t.Errorf("Validate = %v", err)
+	}
+
+	v = New(
+		WithRule("port", Range{Min: 1, Max: 100}),
+		WithRule("name", Pattern{Regex: `^\d+$`}),
+		WithRule("missing", Required{}),
+	)
+	err := v.Validate(root)
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Errorf("Validate = %v", err)
+	}
+}
+
+func TestFor(t *testing.T) {
+	validator := For(&serverConfig{})
+	if err := validator(map[string]interface{}{"addr": "a:80", "port": 80, "timeout": int64(time.Second)}); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+	if err := validator(map[string]interface{}{"addr": "a:80", "port": 0, "timeout": int64(time.Second)}); err == nil {
+		t.Error("expected validation error")
+	}
+	if err := validator(map[string]interface{}{"port": "eighty"}); err == nil {
+		t.Error("expected decode error")
+	}
+
+	// 时长字段可以使用字符串形式的时长，min和max按时长比较
+	c := config.New(config.WithSource(staticSource{{Key: "app", Format: "yaml",
+		Value: "addr: a:80\nport: 80\ntimeout: 1s\n"}}), config.WithValidator(validator))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+	var cfg serverConfig
+	if err := c.Scan(&cfg); err != nil || cfg.Timeout != time.Second {
+		t.Errorf("scan = %+v, %v", cfg, err)
+	}
+	err := validator(map[string]interface{}{"addr": "a:80", "port": 80, "timeout": "5m"})
+	if err == nil || !strings.Contains(err.Error(), "timeout: duration 5m0s is greater than 1m0s") {
+		t.Errorf("expected timeout range error, got %v", err)
+	}
+}
+
+func TestStructInvalidPattern(t *testing.T) {
+	var v struct {
+		Name string `validate:"regex=^[a-z"`
+	}
+	err := Struct(&v)
+	if err == nil || errors.As(err, new(Errors)) || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("expected tag error, got %v", err)
+	}
+}
+
+// staticSource 是测试用的静态配置源
+type staticSource []*config.KeyValue
+
+func (s staticSource) Load() ([]*config.KeyValue, error) { return s, nil }
+func (s staticSource) Watch() (config.Watcher, error) {
+	return &staticWatcher{done: make(chan struct{})}, nil
+}
+
+// staticWatcher 阻塞直到停止
+type staticWatcher struct {
+	done chan struct{}
+}
+
+func (w *staticWatcher) Next() ([]*config.KeyValue, error) {
+	<-w.done
+	return nil, config.ErrWatcherClosed
+}
+
+func (w *staticWatcher) Stop() error {
+	close(w.done)
+	return nil
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dormoron/phantasm/log"
+)
+
+// watchRetryInterval 是配置源观察者出错后重试的间隔
+const watchRetryInterval = time.Second
+
+// watch 为每个配置源启动监视，只在第一次调用时启动
+func (c *config) watch() error {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	if c.closed || c.watchers != nil {
+		return nil
+	}
+
+	watchers := make([]Watcher, 0, len(c.opts.sources))
+	for _, src := range c.opts.sources {
+		w, err := src.Watch()
+		if err != nil {
+			for _, started := range watchers {
+				_ = started.Stop()
+			}
+			return err
+		}
+		watchers = append(watchers, w)
+	}
+	c.watchers = watchers
+
+	for i, w := range watchers {
+		c.wg.Add(1)
+		go c.watchSource(i, w)
+	}
+	return nil
+}
+
+// watchSource 读取一个配置源的更新，用新的键值替换该配置源之前的键值后重新合并
+func (c *config) watchSource(i int, w Watcher) {
+	defer c.wg.Done()
+	for {
+		kvs, err := w.Next()
+		if err != nil {
+			if c.isClosed() || errors.Is(err, ErrWatcherClosed) {
+				return
+			}
+			time.Sleep(watchRetryInterval)
+			continue
+		}
+
+		c.lock.Lock()
+		sources := make([][]*KeyValue, len(c.kvs))
+		copy(sources, c.kvs)
+		sources[i] = kvs
+		changed, err := c.merge(sources)
+		c.lock.Unlock()
+		if err != nil {
+			c.opts.logger.Warn("配置更新无效，保留之前的配置", log.Err(err))
+			continue
+		}
+		c.dispatch(changed)
+	}
+}
+
+// isClosed 返回配置是否已关闭
+func (c *config) isClosed() bool {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	return c.closed
+}
+
+// invalidate 移除与变化的键路径相关的缓存值，包括它们的祖先和子键
+func (c *config) invalidate(changed []string) {
+	c.cached.Range(func(k, _ interface{}) bool {
+		key := k.(string)
+		for _, path := range changed {
+			if related(key, path) || related(path, key) {
+				c.cached.Delete(key)
+				break
+			}
+		}
+		return true
+	})
+}
+
+// dispatch 调用注册在变化的键或其祖先上的观察者
+func (c *config) dispatch(changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+
+	c.observerLock.Lock()
+	var keys []string
+	observers := make(map[string][]Observer)
+	for key, obs := range c.observers {
+		for _, path := range changed {
+			if related(key, path) {
+				keys = append(keys, key)
+				observers[key] = append([]Observer(nil), obs...)
+				break
+			}
+		}
+	}
+	c.observerLock.Unlock()
+
+	c.dispatchLock.Lock()
+	defer c.dispatchLock.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := c.Value(key)
+		for _, o := range observers[key] {
+			o(key, value)
+		}
+	}
+}
+
+// related 返回prefix是否等于path或是path的祖先
+func related(prefix, path string) bool {
+	return prefix == path || strings.HasPrefix(path, prefix+".")
+}
+
+// diff 比较两个配置快照，返回新增、删除或修改的叶子键路径
+func diff(old, new map[string]interface{}) []string {
+	oldLeaves := make(map[string]interface{})
+	newLeaves := make(map[string]interface{})
+	flatten("", old, oldLeaves)
+	flatten("", new, newLeaves)
+
+	var changed []string
+	for path, v := range newLeaves {
+		if ov, ok := oldLeaves[path]; !ok || !reflect.DeepEqual(ov, v) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range oldLeaves {
+		if _, ok := newLeaves[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// flatten 将嵌套的配置展开为叶子键路径到值的映射，空映射也作为叶子
+func flatten(prefix string, values map[string]interface{}, leaves map[string]interface{}) {
+	for k, v := range values {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			flatten(path, m, leaves)
+			continue
+		}
+		leaves[path] = v
+	}
+}
@@ -0,0 +1,222 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/log"
+)
+
+var (
+	_ config.Source = (*Source)(nil)
+)
+
+// ErrNotFound 是加载的单个键不存在时返回的错误
+var ErrNotFound = errors.New("consul: config key not found")
+
+// Source 是基于Consul KV的配置源
+// path以"/"结尾时加载该前缀下的所有键，否则只加载这一个键；
+// 键的格式由扩展名推断，例如 app/config.yaml 按YAML解码，没有扩展名的键以相对路径（"/"替换为"."）作为配置的键
+type Source struct {
+	client  *api.Client
+	path    string
+	options *Options
+	logger  log.Logger
+}
+
+// Options 是Consul配置源的选项
+type Options struct {
+	WaitTime   time.Duration // 阻塞查询的最长等待时间
+	RetryDelay time.Duration // 查询失败后重试的间隔
+	Logger     log.Logger
+}
+
+// Option 是Consul配置源的选项函数
+type Option func(*Options)
+
+// WithWaitTime 设置阻塞查询的最长等待时间
+func WithWaitTime(wait time.Duration) Option {
+	return func(o *Options) {
+		o.WaitTime = wait
+	}
+}
+
+// WithRetryDelay 设置查询失败后重试的间隔
+func WithRetryDelay(delay time.Duration) Option {
+	return func(o *Options) {
+		o.RetryDelay = delay
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewSource 创建基于Consul KV的配置源
+func NewSource(client *api.Client, path string, opts ...Option) config.Source {
+	options := &Options{
+		WaitTime:   time.Minute * 5,
+		RetryDelay: time.Second,
+		Logger:     log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Source{
+		client:  client,
+		path:    strings.TrimPrefix(path, "/"),
+		options: options,
+		logger:  options.Logger,
+	}
+}
+
+// isPrefix 返回是否加载前缀下的所有键
+func (s *Source) isPrefix() bool {
+	return s.path == "" || strings.HasSuffix(s.path, "/")
+}
+
+// Load 加载配置
+func (s *Source) Load() ([]*config.KeyValue, error) {
+	kvs, _, err := s.query(context.Background(), 0)
+	if err == nil && len(kvs) == 0 && !s.isPrefix() {
+		return nil, ErrNotFound
+	}
+	return kvs, err
+}
+
+// query 查询配置，index大于0时为阻塞查询，返回新的索引
+func (s *Source) query(ctx context.Context, index uint64) ([]*config.KeyValue, uint64, error) {
+	opts := (&api.QueryOptions{WaitIndex: index, WaitTime: s.options.WaitTime}).WithContext(ctx)
+
+	var pairs api.KVPairs
+	var meta *api.QueryMeta
+	var err error
+	if s.isPrefix() {
+		pairs, meta, err = s.client.KV().List(s.path, opts)
+	} else {
+		var pair *api.KVPair
+		pair, meta, err = s.client.KV().Get(s.path, opts)
+		if pair != nil {
+			pairs = api.KVPairs{pair}
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.convert(pairs), meta.LastIndex, nil
+}
+
+// convert 将KV对转换为配置键值，跳过目录占位键
+func (s *Source) convert(pairs api.KVPairs) []*config.KeyValue {
+	kvs := make([]*config.KeyValue, 0, len(pairs))
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") {
+			continue
+		}
+		key := pair.Key
+		if s.isPrefix() {
+			key = strings.TrimPrefix(key, s.path)
+		}
+		format := config.FormatOf(key)
+		if format == "" {
+			key = strings.ReplaceAll(strings.Trim(key, "/"), "/", ".")
+		}
+		kvs = append(kvs, &config.KeyValue{
+			Key:    key,
+			Value:  string(pair.Value),
+			Format: format,
+		})
+	}
+	return kvs
+}
+
+// Watch 通过阻塞查询监视配置变化
+func (s *Source) Watch() (config.Watcher, error) {
+	_, index, err := s.query(context.Background(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{
+		ctx:    ctx,
+		cancel: cancel,
+		ch:     make(chan []*config.KeyValue, 1),
+	}
+	go w.run(s, index)
+	return w, nil
+}
+
+// watcher 是Consul配置源的观察者
+type watcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     chan []*config.KeyValue
+	once   sync.Once
+}
+
+// run 循环执行阻塞查询，索引变化时发布新的配置
+func (w *watcher) run(s *Source, index uint64) {
+	for {
+		kvs, next, err := s.query(w.ctx, index)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("查询Consul配置失败", log.String("path", s.path), log.Err(err))
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(s.options.RetryDelay):
+			}
+			continue
+		}
+		// 索引回退（例如Consul重建了数据）时从头开始
+		if next < index {
+			index = 0
+			continue
+		}
+		if next == index {
+			continue
+		}
+		index = next
+
+		// 只保留最新的配置
+		select {
+		case <-w.ch:
+		default:
+		}
+		select {
+		case w.ch <- kvs:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// Next 阻塞直到配置变化或观察者停止
+func (w *watcher) Next() ([]*config.KeyValue, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, config.ErrWatcherClosed
+	case kvs := <-w.ch:
+		return kvs, nil
+	}
+}
+
+// Stop 停止观察
+func (w *watcher) Stop() error {
+	w.once.Do(w.cancel)
+	return nil
+}
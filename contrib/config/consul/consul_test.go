@@ -0,0 +1,135 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/dormoron/phantasm/config"
+)
+
+// fakeKV 是一个最小化的Consul KV HTTP API替身，支持前缀查询和阻塞查询
+type fakeKV struct {
+	lock    sync.Mutex
+	index   uint64
+	changed chan struct{}
+	data    map[string]string
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{index: 1, changed: make(chan struct{}), data: make(map[string]string)}
+}
+
+func (f *fakeKV) put(key, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.data[key] = value
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeKV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, "/v1/kv/") {
+		http.NotFound(w, req)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+	query := req.URL.Query()
+	wait, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+
+	f.lock.Lock()
+	if wait > 0 && wait >= f.index {
+		changed := f.changed
+		f.lock.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+			return
+		}
+		f.lock.Lock()
+	}
+	var pairs api.KVPairs
+	for k, v := range f.data {
+		if k == key || (query.Has("recurse") && strings.HasPrefix(k, key)) {
+			pairs = append(pairs, &api.KVPair{Key: k, Value: []byte(v)})
+		}
+	}
+	index := f.index
+	f.lock.Unlock()
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(pairs)
+}
+
+func newTestClient(t *testing.T, kv *fakeKV) *api.Client {
+	t.Helper()
+	srv := httptest.NewServer(kv)
+	t.Cleanup(srv.Close)
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestLoad(t *testing.T) {
+	kv := newFakeKV()
+	kv.put("app/config.yaml", "server:\n  port: 8000\n")
+	kv.put("app/log/level", "debug")
+	kv.put("other/key", "x")
+	client := newTestClient(t, kv)
+
+	kvs, err := NewSource(client, "app/").Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "config.yaml" || kvs[0].Format != "yaml" || kvs[1].Key != "log.level" {
+		t.Fatalf("kvs = %+v", kvs)
+	}
+
+	if _, err := NewSource(client, "app/missing.json").Load(); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	kv := newFakeKV()
+	kv.put("app/config.json", `{"server":{"port":8000}}`)
+	client := newTestClient(t, kv)
+
+	c := config.New(config.WithSource(NewSource(client, "app/config.json")))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	changed := make(chan int64, 1)
+	_ = c.Watch("server.port", func(_ string, v config.Value) {
+		port, _ := v.Int()
+		changed <- port
+	})
+	kv.put("app/config.json", `{"server":{"port":9000}}`)
+	select {
+	case port := <-changed:
+		if port != 9000 {
+			t.Errorf("server.port = %d", port)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called")
+	}
+}
@@ -0,0 +1,236 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/log"
+)
+
+var (
+	_ config.Source = (*Source)(nil)
+)
+
+// ErrNotFound 是加载的单个键不存在时返回的错误
+var ErrNotFound = errors.New("etcd: config key not found")
+
+// Source 是基于etcd的配置源
+// path以"/"结尾时加载该前缀下的所有键，否则只加载这一个键；
+// 键的格式由扩展名推断，例如 /app/config.yaml 按YAML解码，没有扩展名的键以相对路径（"/"替换为"."）作为配置的键
+type Source struct {
+	client  *clientv3.Client
+	path    string
+	options *Options
+	logger  log.Logger
+}
+
+// Options 是etcd配置源的选项
+type Options struct {
+	Timeout    time.Duration // 加载配置的超时时间
+	RetryDelay time.Duration // 监视中断后重试的间隔
+	Logger     log.Logger
+}
+
+// Option 是etcd配置源的选项函数
+type Option func(*Options)
+
+// WithTimeout 设置加载配置的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = timeout
+	}
+}
+
+// WithRetryDelay 设置监视中断后重试的间隔
+func WithRetryDelay(delay time.Duration) Option {
+	return func(o *Options) {
+		o.RetryDelay = delay
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewSource 创建基于etcd的配置源
+func NewSource(client *clientv3.Client, path string, opts ...Option) config.Source {
+	options := &Options{
+		Timeout:    time.Second * 5,
+		RetryDelay: time.Second,
+		Logger:     log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Source{
+		client:  client,
+		path:    path,
+		options: options,
+		logger:  options.Logger,
+	}
+}
+
+// isPrefix 返回是否加载前缀下的所有键
+func (s *Source) isPrefix() bool {
+	return strings.HasSuffix(s.path, "/")
+}
+
+// Load 加载配置
+func (s *Source) Load() ([]*config.KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.Timeout)
+	defer cancel()
+	kvs, _, err := s.get(ctx)
+	if err == nil && len(kvs) == 0 && !s.isPrefix() {
+		return nil, ErrNotFound
+	}
+	return kvs, err
+}
+
+// get 读取配置，返回读取时的revision
+func (s *Source) get(ctx context.Context) ([]*config.KeyValue, int64, error) {
+	var opts []clientv3.OpOption
+	if s.isPrefix() {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	resp, err := s.client.Get(ctx, s.path, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make([]*config.KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if s.isPrefix() {
+			key = strings.TrimPrefix(key, s.path)
+		}
+		format := config.FormatOf(key)
+		if format == "" {
+			key = strings.ReplaceAll(strings.Trim(key, "/"), "/", ".")
+		}
+		kvs = append(kvs, &config.KeyValue{
+			Key:    key,
+			Value:  string(kv.Value),
+			Format: format,
+		})
+	}
+	return kvs, resp.Header.Revision, nil
+}
+
+// Watch 通过etcd watch监视配置变化，任一键变化时重新读取所有键
+func (s *Source) Watch() (config.Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	getCtx, getCancel := context.WithTimeout(ctx, s.options.Timeout)
+	_, rev, err := s.get(getCtx)
+	getCancel()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	w := &watcher{
+		ctx:    ctx,
+		cancel: cancel,
+		ch:     make(chan []*config.KeyValue, 1),
+	}
+	go w.run(s, rev)
+	return w, nil
+}
+
+// watcher 是etcd配置源的观察者
+type watcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     chan []*config.KeyValue
+	once   sync.Once
+}
+
+// run 从rev之后开始监视，监视中断（例如revision已被压缩）后重新读取并继续监视
+func (w *watcher) run(s *Source, rev int64) {
+	opts := []clientv3.OpOption{clientv3.WithRev(rev + 1)}
+	if s.isPrefix() {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	wch := s.client.Watch(clientv3.WithRequireLeader(w.ctx), s.path, opts...)
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case resp, ok := <-wch:
+			if ok && resp.Err() == nil && !resp.Canceled {
+				if len(resp.Events) > 0 {
+					w.reload(s)
+				}
+				continue
+			}
+			if w.ctx.Err() != nil {
+				return
+			}
+			if ok {
+				s.logger.Warn("监视etcd配置失败", log.String("path", s.path), log.Err(resp.Err()))
+			}
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(s.options.RetryDelay):
+			}
+			// 重新读取以补上中断期间的变化，再从读取时的revision继续监视
+			rev, ok := w.reload(s)
+			if !ok {
+				continue
+			}
+			opts[0] = clientv3.WithRev(rev + 1)
+			wch = s.client.Watch(clientv3.WithRequireLeader(w.ctx), s.path, opts...)
+		}
+	}
+}
+
+// reload 重新读取并发布配置，返回读取时的revision
+func (w *watcher) reload(s *Source) (int64, bool) {
+	ctx, cancel := context.WithTimeout(w.ctx, s.options.Timeout)
+	defer cancel()
+	kvs, rev, err := s.get(ctx)
+	if err != nil {
+		if w.ctx.Err() == nil {
+			s.logger.Warn("读取etcd配置失败", log.String("path", s.path), log.Err(err))
+		}
+		return 0, false
+	}
+
+	// 只保留最新的配置
+	select {
+	case <-w.ch:
+	default:
+	}
+	select {
+	case w.ch <- kvs:
+	case <-w.ctx.Done():
+	}
+	return rev, true
+}
+
+// Next 阻塞直到配置变化或观察者停止
+func (w *watcher) Next() ([]*config.KeyValue, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, config.ErrWatcherClosed
+	case kvs := <-w.ch:
+		return kvs, nil
+	}
+}
+
+// Stop 停止观察
+func (w *watcher) Stop() error {
+	w.once.Do(w.cancel)
+	return nil
+}
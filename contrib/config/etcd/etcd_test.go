@@ -0,0 +1,115 @@
+package etcd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/internal/etcdtest"
+)
+
+// newTestClient 启动嵌入式etcd并返回连接它的客户端
+func newTestClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+	return etcdtest.NewServer(t).Client()
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	_, _ = client.Put(ctx, "/app/config.yaml", "server:\n  port: 8000\n")
+	_, _ = client.Put(ctx, "/app/log/level", "debug")
+	_, _ = client.Put(ctx, "/other/key", "x")
+
+	kvs, err := NewSource(client, "/app/").Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "config.yaml" || kvs[0].Format != "yaml" || kvs[1].Key != "log.level" {
+		t.Fatalf("kvs = %+v", kvs)
+	}
+
+	if _, err := NewSource(client, "/app/missing.json").Load(); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	_, _ = client.Put(ctx, "/app/config.json", `{"server":{"port":8000}}`)
+	_, _ = client.Put(ctx, "/app/log/level", "info")
+
+	c := config.New(config.WithSource(NewSource(client, "/app/")))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	changed := make(chan string, 4)
+	_ = c.Watch("server.port", func(key string, _ config.Value) { changed <- key })
+	_ = c.Watch("log", func(key string, _ config.Value) { changed <- key })
+
+	_, _ = client.Put(ctx, "/app/config.json", `{"server":{"port":9000}}`)
+	select {
+	case key := <-changed:
+		if key != "server.port" {
+			t.Errorf("notified %q", key)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called")
+	}
+	if port, _ := c.Value("server.port").Int(); port != 9000 {
+		t.Errorf("server.port = %d", port)
+	}
+
+	_, _ = client.Delete(ctx, "/app/log/level")
+	select {
+	case key := <-changed:
+		if key != "log" {
+			t.Errorf("notified %q", key)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called for deleted key")
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	_, _ = client.Put(ctx, "/app/config.yaml", "server:\n  port: 8000\n")
+
+	w, err := NewSource(client, "/app/config.yaml").Watch()
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+
+	// 只监视这一个键，相同前缀的其他键不触发更新
+	_, _ = client.Put(ctx, "/app/config.yaml.bak", "server:\n  port: 1\n")
+	_, _ = client.Put(ctx, "/app/config.yaml", "server:\n  port: 9000\n")
+
+	kvs := make(chan []*config.KeyValue, 1)
+	go func() {
+		items, _ := w.Next()
+		kvs <- items
+	}()
+	select {
+	case items := <-kvs:
+		if len(items) != 1 || items[0].Key != "/app/config.yaml" || items[0].Value != "server:\n  port: 9000\n" {
+			t.Fatalf("kvs = %+v", items)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("watcher not notified")
+	}
+
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Next(); err != config.ErrWatcherClosed {
+		t.Errorf("err after stop = %v", err)
+	}
+}
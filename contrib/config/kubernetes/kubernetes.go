@@ -0,0 +1,311 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/config/encrypt"
+	"github.com/dormoron/phantasm/internal/kubeapi"
+	"github.com/dormoron/phantasm/log"
+)
+
+var (
+	_ config.Source = (*Source)(nil)
+)
+
+// ErrNotFound 是ConfigMap或Secret不存在时返回的错误
+var ErrNotFound = errors.New("kubernetes: config object not found")
+
+// Kind 是配置对象的资源类型
+type Kind string
+
+const (
+	// KindConfigMap 从ConfigMap读取配置
+	KindConfigMap Kind = "configmaps"
+	// KindSecret 从Secret读取配置
+	KindSecret Kind = "secrets"
+)
+
+// Source 是通过API Server读取ConfigMap或Secret的配置源
+// 对象中的每个数据键作为一个键值，格式由扩展名推断，例如 app.yaml 按YAML解码，没有扩展名的键直接作为配置的键
+type Source struct {
+	client  *kubeapi.Client
+	name    string
+	options *Options
+	logger  log.Logger
+}
+
+// Options 是Kubernetes配置源的选项
+type Options struct {
+	Namespace  string            // 命名空间，为空时使用Pod所在的命名空间
+	Kind       Kind              // 配置对象的资源类型，默认为ConfigMap
+	Host       string            // API Server地址，为空时使用集群内的服务账号配置
+	Token      string            // 访问API Server的令牌
+	HTTPClient *http.Client      // 访问API Server的HTTP客户端
+	Encrypter  encrypt.Encrypter // 解密Secret数据的加密器，为空时不解密
+	Timeout    time.Duration     // 加载配置的超时时间
+	Logger     log.Logger
+}
+
+// Option 是Kubernetes配置源的选项函数
+type Option func(*Options)
+
+// WithNamespace 设置命名空间
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithSecret 从Secret而不是ConfigMap读取配置
+func WithSecret() Option {
+	return func(o *Options) {
+		o.Kind = KindSecret
+	}
+}
+
+// WithAPIServer 设置API Server地址和令牌，用于集群外访问
+func WithAPIServer(host, token string) Option {
+	return func(o *Options) {
+		o.Host = host
+		o.Token = token
+	}
+}
+
+// WithHTTPClient 设置访问API Server的HTTP客户端
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *Options) {
+		o.HTTPClient = client
+	}
+}
+
+// WithEncrypter 设置解密Secret数据的加密器，只对Secret生效
+// Secret中保存的是加密器输出的密文，读取后先解密再按格式解码
+func WithEncrypter(encrypter encrypt.Encrypter) Option {
+	return func(o *Options) {
+		o.Encrypter = encrypter
+	}
+}
+
+// WithTimeout 设置加载配置的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = timeout
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewSource 创建读取指定名称的ConfigMap或Secret的配置源
+func NewSource(name string, opts ...Option) (config.Source, error) {
+	options := &Options{
+		Kind:    KindConfigMap,
+		Timeout: time.Second * 5,
+		Logger:  log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	if name == "" {
+		return nil, errors.New("kubernetes: config object name is required")
+	}
+	if options.Namespace == "" {
+		options.Namespace = "default"
+		if data, err := os.ReadFile(kubeapi.ServiceAccountPath + "/namespace"); err == nil {
+			options.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+
+	var client *kubeapi.Client
+	if options.Host == "" {
+		c, err := kubeapi.InClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	} else {
+		client = &kubeapi.Client{Host: strings.TrimRight(options.Host, "/"), HTTPClient: http.DefaultClient, Token: options.Token}
+	}
+	if options.HTTPClient != nil {
+		client.HTTPClient = options.HTTPClient
+	}
+
+	return &Source{
+		client:  client,
+		name:    name,
+		options: options,
+		logger:  options.Logger,
+	}, nil
+}
+
+// object 是ConfigMap或Secret中配置源用到的字段
+// ConfigMap的data是原文，binaryData是base64编码；Secret的data是base64编码
+type object struct {
+	Data       map[string]string `json:"data"`
+	BinaryData map[string]string `json:"binaryData"`
+}
+
+// path 返回资源集合的路径
+func (s *Source) path() string {
+	return "/api/v1/namespaces/" + url.PathEscape(s.options.Namespace) + "/" + string(s.options.Kind)
+}
+
+// Load 加载配置
+func (s *Source) Load() ([]*config.KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.Timeout)
+	defer cancel()
+
+	obj := &object{}
+	if err := s.client.Get(ctx, s.path()+"/"+url.PathEscape(s.name), nil, obj); err != nil {
+		if kubeapi.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return s.convert(obj)
+}
+
+// convert 将对象的数据键转换为配置键值，按键名排序
+func (s *Source) convert(obj *object) ([]*config.KeyValue, error) {
+	data := make(map[string][]byte, len(obj.Data)+len(obj.BinaryData))
+	for key, value := range obj.BinaryData {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: decode %s: %w", key, err)
+		}
+		data[key] = decoded
+	}
+	for key, value := range obj.Data {
+		if s.options.Kind != KindSecret {
+			data[key] = []byte(value)
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: decode %s: %w", key, err)
+		}
+		if s.options.Encrypter != nil {
+			if decoded, err = s.options.Encrypter.Decrypt(decoded); err != nil {
+				return nil, fmt.Errorf("kubernetes: decrypt %s: %w", key, err)
+			}
+		}
+		data[key] = decoded
+	}
+
+	kvs := make([]*config.KeyValue, 0, len(data))
+	for key, value := range data {
+		kvs = append(kvs, &config.KeyValue{
+			Key:    key,
+			Value:  string(value),
+			Format: config.FormatOf(key),
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, nil
+}
+
+// Watch 通过informer监视对象变化，对象被删除时发布空配置
+func (s *Source) Watch() (config.Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{
+		source: s,
+		ctx:    ctx,
+		cancel: cancel,
+		ch:     make(chan []*config.KeyValue, 1),
+	}
+	w.informer = &kubeapi.Informer[object]{
+		Client:   s.client,
+		Path:     s.path(),
+		Fields:   "metadata.name=" + s.name,
+		Logger:   s.logger,
+		OnChange: w.onChange,
+	}
+
+	listCtx, listCancel := context.WithTimeout(ctx, s.options.Timeout)
+	err := w.informer.List(listCtx)
+	listCancel()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go w.informer.Run(ctx)
+	return w, nil
+}
+
+// watcher 是Kubernetes配置源的观察者
+type watcher struct {
+	source   *Source
+	informer *kubeapi.Informer[object]
+	ctx      context.Context
+	cancel   context.CancelFunc
+	ch       chan []*config.KeyValue
+	last     []*config.KeyValue
+	once     sync.Once
+}
+
+// onChange 在informer缓存变化时转换并发布配置，内容未变化时（例如重新列出对象）不发布
+func (w *watcher) onChange(items map[string]object) {
+	var kvs []*config.KeyValue
+	if obj, ok := items[w.source.name]; ok {
+		var err error
+		if kvs, err = w.source.convert(&obj); err != nil {
+			w.source.logger.Warn("解析Kubernetes配置失败", log.String("name", w.source.name), log.Err(err))
+			return
+		}
+	} else {
+		kvs = []*config.KeyValue{}
+	}
+	// 首次列出时只记录当前配置
+	if w.last == nil {
+		w.last = kvs
+		return
+	}
+	if reflect.DeepEqual(kvs, w.last) {
+		return
+	}
+	w.last = kvs
+
+	// 只保留最新的配置
+	select {
+	case <-w.ch:
+	default:
+	}
+	select {
+	case w.ch <- kvs:
+	case <-w.ctx.Done():
+	}
+}
+
+// Next 阻塞直到配置变化或观察者停止
+func (w *watcher) Next() ([]*config.KeyValue, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, config.ErrWatcherClosed
+	case kvs := <-w.ch:
+		return kvs, nil
+	}
+}
+
+// Stop 停止观察
+func (w *watcher) Stop() error {
+	w.once.Do(w.cancel)
+	return nil
+}
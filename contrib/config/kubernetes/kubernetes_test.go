@@ -0,0 +1,200 @@
+package kubernetes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/config/encrypt"
+	"github.com/dormoron/phantasm/internal/kubeapi"
+)
+
+// fakeAPIServer 是一个最小化的Kubernetes API Server替身，支持读取、按名称list和watch
+type fakeAPIServer struct {
+	lock    sync.Mutex
+	rv      int
+	objects map[string]map[string]json.RawMessage // 资源类型到对象的映射
+	history map[string][]kubeapi.WatchEvent       // 按resourceVersion递增的事件
+	streams map[string][]chan kubeapi.WatchEvent
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, string) {
+	f := &fakeAPIServer{
+		objects: map[string]map[string]json.RawMessage{"configmaps": {}, "secrets": {}},
+		history: make(map[string][]kubeapi.WatchEvent),
+		streams: make(map[string][]chan kubeapi.WatchEvent),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+// put 保存对象并通知监视流
+func (f *fakeAPIServer) put(kind, name string, data map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rv++
+	raw, _ := json.Marshal(map[string]interface{}{
+		"metadata": kubeapi.ObjectMeta{Name: name, ResourceVersion: strconv.Itoa(f.rv)},
+		"data":     data,
+	})
+
+	typ := "ADDED"
+	if _, ok := f.objects[kind][name]; ok {
+		typ = "MODIFIED"
+	}
+	f.objects[kind][name] = raw
+	ev := kubeapi.WatchEvent{Type: typ, Object: raw}
+	f.history[kind] = append(f.history[kind], ev)
+	for _, ch := range f.streams[kind] {
+		ch <- ev
+	}
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(req.URL.Path, "/namespaces/default/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	resource := strings.Split(parts[1], "/")
+	kind := resource[0]
+	query := req.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+
+	f.lock.Lock()
+	switch {
+	case f.objects[kind] == nil:
+		f.lock.Unlock()
+		http.NotFound(w, req)
+	case len(resource) == 2:
+		defer f.lock.Unlock()
+		obj, ok := f.objects[kind][resource[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(kubeapi.Status{Code: http.StatusNotFound, Reason: "NotFound"})
+			return
+		}
+		_, _ = w.Write(obj)
+	case query.Get("watch") == "":
+		defer f.lock.Unlock()
+		list := kubeapi.ObjectList[json.RawMessage]{Metadata: kubeapi.ListMeta{ResourceVersion: strconv.Itoa(f.rv)}}
+		name := strings.TrimPrefix(query.Get("fieldSelector"), "metadata.name=")
+		if obj, ok := f.objects[kind][name]; ok {
+			list.Items = append(list.Items, obj)
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	default:
+		// 先补发请求的resourceVersion之后的事件
+		from, _ := strconv.Atoi(query.Get("resourceVersion"))
+		ch := make(chan kubeapi.WatchEvent, 16+len(f.history[kind]))
+		for _, ev := range f.history[kind] {
+			_, rv, _, _ := kubeapi.DecodeObject[object](ev.Object)
+			if n, _ := strconv.Atoi(rv); n > from {
+				ch <- ev
+			}
+		}
+		f.streams[kind] = append(f.streams[kind], ch)
+		f.lock.Unlock()
+
+		name := strings.TrimPrefix(query.Get("fieldSelector"), "metadata.name=")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case ev := <-ch:
+				if n, _, _, _ := kubeapi.DecodeObject[object](ev.Object); n != name {
+					continue
+				}
+				_ = json.NewEncoder(w).Encode(ev)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	f, host := newFakeAPIServer(t)
+	f.put("configmaps", "app", map[string]string{
+		"config.yaml": "server:\n  port: 8000\n",
+		"log.level":   "debug",
+	})
+
+	source, err := NewSource("app", WithNamespace("default"), WithAPIServer(host, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := source.Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "config.yaml" || kvs[0].Format != "yaml" || kvs[1].Key != "log.level" || kvs[1].Value != "debug" {
+		t.Fatalf("kvs = %+v", kvs)
+	}
+
+	missing, _ := NewSource("missing", WithNamespace("default"), WithAPIServer(host, ""))
+	if _, err := missing.Load(); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSecretDecrypt(t *testing.T) {
+	f, host := newFakeAPIServer(t)
+	enc, err := encrypt.NewAESEncrypter(encrypt.WithKey([]byte("0123456789abcdef")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := enc.Encrypt([]byte(`{"db":{"password":"secret"}}`))
+	f.put("secrets", "app", map[string]string{
+		"db.json": base64.StdEncoding.EncodeToString(ciphertext),
+	})
+
+	source, _ := NewSource("app", WithNamespace("default"), WithAPIServer(host, ""), WithSecret(), WithEncrypter(enc))
+	c := config.New(config.WithSource(source))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+	if password, _ := c.Value("db.password").String(); password != "secret" {
+		t.Errorf("db.password = %q", password)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f, host := newFakeAPIServer(t)
+	f.put("configmaps", "app", map[string]string{"config.json": `{"server":{"port":8000}}`})
+	f.put("configmaps", "other", map[string]string{"config.json": `{"server":{"port":1}}`})
+
+	source, _ := NewSource("app", WithNamespace("default"), WithAPIServer(host, ""))
+	c := config.New(config.WithSource(source))
+	if err := c.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer c.Close()
+
+	changed := make(chan int64, 4)
+	_ = c.Watch("server.port", func(_ string, v config.Value) {
+		port, _ := v.Int()
+		changed <- port
+	})
+
+	// 其他对象的变化不影响配置
+	f.put("configmaps", "other", map[string]string{"config.json": `{"server":{"port":2}}`})
+	f.put("configmaps", "app", map[string]string{"config.json": `{"server":{"port":9000}}`})
+	select {
+	case port := <-changed:
+		if port != 9000 {
+			t.Errorf("server.port = %d", port)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("observer not called")
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/dormoron/phantasm/internal/fanout"
 	"github.com/dormoron/phantasm/log"
 	"github.com/dormoron/phantasm/registry"
 
@@ -19,14 +21,39 @@ var (
 	_ registry.ServiceRegistrar = (*Registry)(nil)
 )
 
+const (
+	// metaEndpoints 是Meta中保存全部端点的键，多个端点以逗号分隔
+	metaEndpoints = "phantasm-endpoints"
+	// metaVersion 是Meta中保存服务版本的键
+	metaVersion = "phantasm-version"
+	// metaValueMaxLength 是Consul对单个Meta值的长度限制
+	metaValueMaxLength = 512
+)
+
+// CheckType 是Consul健康检查类型
+type CheckType string
+
+const (
+	// CheckAuto 根据端点协议自动选择检查类型：http(s)使用HTTP检查，grpc(s)使用gRPC检查，其余使用TTL检查
+	CheckAuto CheckType = ""
+	// CheckTTL 使用TTL检查，由注册中心定期上报健康状态
+	CheckTTL CheckType = "ttl"
+	// CheckHTTP 使用HTTP检查
+	CheckHTTP CheckType = "http"
+	// CheckGRPC 使用gRPC健康检查
+	CheckGRPC CheckType = "grpc"
+	// CheckTCP 使用TCP连接检查
+	CheckTCP CheckType = "tcp"
+)
+
 // Registry 是基于Consul的服务注册发现中心
 type Registry struct {
 	client     *api.Client
 	ctx        context.Context
 	cancel     context.CancelFunc
 	lock       sync.RWMutex
-	watchChs   map[string]chan []*registry.ServiceInstance // 服务名称到观察通道的映射
-	registered map[string]struct{}                         // 已注册的服务实例ID集合
+	watchers   map[string]*serviceWatch      // 服务名称到共享监视循环的映射
+	registered map[string]context.CancelFunc // 已注册的服务实例ID到TTL上报循环的映射
 	logger     log.Logger
 	options    *Options
 }
@@ -34,9 +61,15 @@ type Registry struct {
 // Options 是Consul注册中心的选项
 type Options struct {
 	HealthCheck                    bool          // 是否启用健康检查
+	CheckType                      CheckType     // 健康检查类型
+	HTTPCheckPath                  string        // HTTP健康检查路径
 	TTL                            time.Duration // 健康检查TTL
 	Interval                       time.Duration // 健康检查间隔
+	Timeout                        time.Duration // 健康检查超时时间
 	DeregisterCriticalServiceAfter time.Duration // 服务不健康多久后注销
+	Datacenter                     string        // 服务发现使用的数据中心，为空时使用本地数据中心
+	Namespace                      string        // 命名空间（Consul企业版）
+	WaitTime                       time.Duration // 阻塞查询的最长等待时间
 	Logger                         log.Logger
 }
 
@@ -50,6 +83,20 @@ func WithHealthCheck(enable bool) Option {
 	}
 }
 
+// WithCheckType 设置健康检查类型
+func WithCheckType(t CheckType) Option {
+	return func(o *Options) {
+		o.CheckType = t
+	}
+}
+
+// WithHTTPCheckPath 设置HTTP健康检查路径
+func WithHTTPCheckPath(path string) Option {
+	return func(o *Options) {
+		o.HTTPCheckPath = path
+	}
+}
+
 // WithTTL 设置健康检查TTL
 func WithTTL(ttl time.Duration) Option {
 	return func(o *Options) {
@@ -64,6 +111,13 @@ func WithInterval(interval time.Duration) Option {
 	}
 }
 
+// WithCheckTimeout 设置健康检查超时时间
+func WithCheckTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = timeout
+	}
+}
+
 // WithDeregisterCriticalServiceAfter 设置服务不健康后自动注销时间
 func WithDeregisterCriticalServiceAfter(timeout time.Duration) Option {
 	return func(o *Options) {
@@ -71,6 +125,27 @@ func WithDeregisterCriticalServiceAfter(timeout time.Duration) Option {
 	}
 }
 
+// WithDatacenter 设置服务发现使用的数据中心
+func WithDatacenter(dc string) Option {
+	return func(o *Options) {
+		o.Datacenter = dc
+	}
+}
+
+// WithNamespace 设置命名空间（Consul企业版）
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithWaitTime 设置阻塞查询的最长等待时间
+func WithWaitTime(wait time.Duration) Option {
+	return func(o *Options) {
+		o.WaitTime = wait
+	}
+}
+
 // WithLogger 设置日志记录器
 func WithLogger(logger log.Logger) Option {
 	return func(o *Options) {
@@ -82,9 +157,12 @@ func WithLogger(logger log.Logger) Option {
 func NewRegistry(client *api.Client, opts ...Option) *Registry {
 	options := &Options{
 		HealthCheck:                    true,
+		HTTPCheckPath:                  "/health",
 		TTL:                            time.Second * 15,
 		Interval:                       time.Second * 10,
+		Timeout:                        time.Second * 5,
 		DeregisterCriticalServiceAfter: time.Minute * 1,
+		WaitTime:                       time.Minute,
 		Logger:                         log.DefaultLogger,
 	}
 
@@ -98,14 +176,15 @@ func NewRegistry(client *api.Client, opts ...Option) *Registry {
 		ctx:        ctx,
 		cancel:     cancel,
 		lock:       sync.RWMutex{},
-		watchChs:   make(map[string]chan []*registry.ServiceInstance),
-		registered: make(map[string]struct{}),
+		watchers:   make(map[string]*serviceWatch),
+		registered: make(map[string]context.CancelFunc),
 		logger:     options.Logger,
 		options:    options,
 	}
 }
 
 // Register 注册服务实例
+// Consul的服务地址使用第一个端点，全部端点和版本保存在Meta中，以便发现时完整还原
 func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
 	if service.Status == "" {
 		service.Status = registry.StatusUp
@@ -118,18 +197,24 @@ func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstan
 	}
 	service.UpdatedAt = now
 
-	var endpoint string
-	if len(service.Endpoints) > 0 {
-		endpoint = service.Endpoints[0]
-	} else {
+	if len(service.Endpoints) == 0 {
 		return fmt.Errorf("没有可用的服务端点")
 	}
 
 	// 解析端点地址
+	endpoint := service.Endpoints[0]
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return err
 	}
+	for _, e := range service.Endpoints {
+		if _, err := url.Parse(e); err != nil {
+			return err
+		}
+		if strings.Contains(e, ",") {
+			return fmt.Errorf("端点不能包含逗号: %s", e)
+		}
+	}
 
 	// 解析端口
 	host, portStr, err := net.SplitHostPort(u.Host)
@@ -141,302 +226,354 @@ func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstan
 		return err
 	}
 
+	meta := make(map[string]string, len(service.Metadata)+2)
+	for k, v := range service.Metadata {
+		meta[k] = v
+	}
+	meta[metaEndpoints] = strings.Join(service.Endpoints, ",")
+	if service.Version != "" {
+		meta[metaVersion] = service.Version
+	}
+	for k, v := range meta {
+		if len(v) > metaValueMaxLength {
+			return fmt.Errorf("元数据 %s 的长度 %d 超过Consul的%d字符限制", k, len(v), metaValueMaxLength)
+		}
+	}
+
 	// 构建Consul服务定义
 	serviceID := service.ID
 	reg := &api.AgentServiceRegistration{
-		ID:      serviceID,
-		Name:    service.Name,
-		Address: host,
-		Port:    port,
-		Tags:    []string{u.Scheme, service.Version},
-		Meta:    service.Metadata,
+		ID:        serviceID,
+		Name:      service.Name,
+		Address:   host,
+		Port:      port,
+		Tags:      schemeTags(service.Endpoints),
+		Meta:      meta,
+		Namespace: r.options.Namespace,
 	}
-
-	// 添加健康检查
-	check := &api.AgentServiceCheck{
-		DeregisterCriticalServiceAfter: "1m",
-	}
-
-	switch u.Scheme {
-	case "http":
-		check.HTTP = endpoint + "/health"
-		check.Interval = "10s"
-		check.Timeout = "5s"
-	case "grpc":
-		check.GRPC = fmt.Sprintf("%s/%s", u.Host, service.Name)
-		check.Interval = "10s"
-		check.Timeout = "5s"
-	default:
-		// 默认使用TTL检查
-		check.TTL = fmt.Sprintf("%ds", int(r.options.TTL.Seconds()))
+	if r.options.HealthCheck {
+		reg.Check = r.buildCheck(service.Name, u)
 	}
 
-	reg.Check = check
-
 	// 注册服务
 	if err := r.client.Agent().ServiceRegister(reg); err != nil {
 		return err
 	}
 
-	// 记录已注册服务
+	// 记录已注册服务，重复注册时停止旧的TTL上报循环
+	ttlCtx, ttlCancel := context.WithCancel(r.ctx)
 	r.lock.Lock()
-	r.registered[serviceID] = struct{}{}
+	if cancel, ok := r.registered[serviceID]; ok {
+		cancel()
+	}
+	r.registered[serviceID] = ttlCancel
 	r.lock.Unlock()
 
 	// 如果是TTL检查，需要启动定期更新健康状态
-	if check.TTL != "" {
-		go func() {
-			ticker := time.NewTicker(r.options.Interval)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-r.ctx.Done():
-					return
-				case <-ticker.C:
-					err := r.client.Agent().UpdateTTL("service:"+serviceID, "健康", api.HealthPassing)
-					if err != nil {
-						r.logger.Error("更新服务TTL失败",
-							log.String("service", service.Name),
-							log.String("id", serviceID),
-							log.String("error", err.Error()))
-					}
-				}
-			}
-		}()
+	if reg.Check != nil && reg.Check.TTL != "" {
+		go r.heartbeat(ttlCtx, service.Name, serviceID)
 	}
 
 	return nil
 }
 
+// buildCheck 根据选项构建健康检查
+func (r *Registry) buildCheck(serviceName string, u *url.URL) *api.AgentServiceCheck {
+	check := &api.AgentServiceCheck{
+		DeregisterCriticalServiceAfter: r.options.DeregisterCriticalServiceAfter.String(),
+	}
+
+	checkType := r.options.CheckType
+	if checkType == CheckAuto {
+		switch u.Scheme {
+		case "http", "https":
+			checkType = CheckHTTP
+		case "grpc", "grpcs":
+			checkType = CheckGRPC
+		default:
+			checkType = CheckTTL
+		}
+	}
+
+	switch checkType {
+	case CheckHTTP:
+		scheme := u.Scheme
+		if scheme != "https" {
+			scheme = "http"
+		}
+		check.HTTP = fmt.Sprintf("%s://%s%s", scheme, u.Host, r.options.HTTPCheckPath)
+		check.Interval = r.options.Interval.String()
+		check.Timeout = r.options.Timeout.String()
+	case CheckGRPC:
+		check.GRPC = fmt.Sprintf("%s/%s", u.Host, serviceName)
+		check.GRPCUseTLS = u.Scheme == "grpcs"
+		check.Interval = r.options.Interval.String()
+		check.Timeout = r.options.Timeout.String()
+	case CheckTCP:
+		check.TCP = u.Host
+		check.Interval = r.options.Interval.String()
+		check.Timeout = r.options.Timeout.String()
+	default:
+		check.TTL = r.options.TTL.String()
+	}
+	return check
+}
+
+// heartbeat 定期上报TTL检查的健康状态
+func (r *Registry) heartbeat(ctx context.Context, serviceName, serviceID string) {
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	update := func() {
+		opts := (&api.QueryOptions{Namespace: r.options.Namespace}).WithContext(ctx)
+		err := r.client.Agent().UpdateTTLOpts("service:"+serviceID, "健康", api.HealthPassing, opts)
+		if err != nil && ctx.Err() == nil {
+			r.logger.Error("更新服务TTL失败",
+				log.String("service", serviceName),
+				log.String("id", serviceID),
+				log.String("error", err.Error()))
+		}
+	}
+
+	update()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			update()
+		}
+	}
+}
+
 // Deregister 注销服务实例
 func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
 	serviceID := service.ID
-	// 注销服务
-	if err := r.client.Agent().ServiceDeregister(serviceID); err != nil {
-		return err
-	}
 
-	// 移除记录
+	// 停止TTL上报并移除记录
 	r.lock.Lock()
-	delete(r.registered, serviceID)
+	if cancel, ok := r.registered[serviceID]; ok {
+		cancel()
+		delete(r.registered, serviceID)
+	}
 	r.lock.Unlock()
 
-	return nil
+	// 注销服务
+	opts := (&api.QueryOptions{Namespace: r.options.Namespace}).WithContext(ctx)
+	return r.client.Agent().ServiceDeregisterOpts(serviceID, opts)
 }
 
 // GetService 获取服务实例列表
 func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
-	entries, _, err := r.client.Health().Service(serviceName, "", true, nil)
+	instances, _, err := r.service(ctx, serviceName, 0)
+	return instances, err
+}
+
+// service 查询健康的服务实例，index不为0时为阻塞查询
+func (r *Registry) service(ctx context.Context, serviceName string, index uint64) ([]*registry.ServiceInstance, uint64, error) {
+	opts := (&api.QueryOptions{
+		Datacenter: r.options.Datacenter,
+		Namespace:  r.options.Namespace,
+		WaitIndex:  index,
+		WaitTime:   r.options.WaitTime,
+	}).WithContext(ctx)
+	entries, meta, err := r.client.Health().Service(serviceName, "", true, opts)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	return entriesToInstances(entries), meta.LastIndex, nil
+}
+
+// schemeTags 返回端点协议组成的标签，便于在Consul界面中按协议筛选
+func schemeTags(endpoints []string) []string {
+	tags := make([]string, 0, len(endpoints))
+	seen := make(map[string]struct{}, len(endpoints))
+	for _, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil || u.Scheme == "" {
+			continue
+		}
+		if _, ok := seen[u.Scheme]; ok {
+			continue
+		}
+		seen[u.Scheme] = struct{}{}
+		tags = append(tags, u.Scheme)
 	}
+	return tags
+}
 
+// entriesToInstances 将Consul健康检查条目转换为服务实例
+func entriesToInstances(entries []*api.ServiceEntry) []*registry.ServiceInstance {
 	items := make([]*registry.ServiceInstance, 0, len(entries))
 	for _, entry := range entries {
 		service := entry.Service
-		if service.ID == "" || service.Service == "" {
+		if service == nil || service.ID == "" || service.Service == "" {
 			continue
 		}
 
-		// 构建端点列表
-		endpoints := make([]string, 0, len(service.Tags))
-		for _, tag := range service.Tags {
-			if tag == "http" || tag == "grpc" {
-				endpoint := fmt.Sprintf("%s://%s:%d", tag, service.Address, service.Port)
-				endpoints = append(endpoints, endpoint)
+		metadata := make(map[string]string, len(service.Meta))
+		for k, v := range service.Meta {
+			if k == metaEndpoints || k == metaVersion {
+				continue
 			}
+			metadata[k] = v
 		}
 
-		if len(endpoints) == 0 {
-			// 如果没有显式协议标签，默认使用http
-			endpoint := fmt.Sprintf("http://%s:%d", service.Address, service.Port)
-			endpoints = append(endpoints, endpoint)
+		var endpoints []string
+		if v := service.Meta[metaEndpoints]; v != "" {
+			endpoints = strings.Split(v, ",")
+		} else {
+			endpoints = legacyEndpoints(service)
 		}
 
-		// 解析版本信息
-		var version string
-		for _, tag := range service.Tags {
-			if tag != "http" && tag != "grpc" {
-				version = tag
-				break
-			}
+		version, ok := service.Meta[metaVersion]
+		if !ok {
+			version = legacyVersion(service.Tags)
 		}
 
 		// 构建服务实例
-		instance := &registry.ServiceInstance{
+		items = append(items, &registry.ServiceInstance{
 			ID:        service.ID,
 			Name:      service.Service,
 			Version:   version,
-			Metadata:  service.Meta,
+			Metadata:  metadata,
 			Endpoints: endpoints,
 			Status:    registry.StatusUp,
+		})
+	}
+	return items
+}
+
+// legacyEndpoints 从旧版本注册的协议标签中还原端点
+func legacyEndpoints(service *api.AgentService) []string {
+	endpoints := make([]string, 0, len(service.Tags))
+	for _, tag := range service.Tags {
+		if tag == "http" || tag == "grpc" {
+			endpoints = append(endpoints, fmt.Sprintf("%s://%s", tag, net.JoinHostPort(service.Address, strconv.Itoa(service.Port))))
 		}
+	}
+	if len(endpoints) == 0 {
+		// 如果没有显式协议标签，默认使用http
+		endpoints = append(endpoints, fmt.Sprintf("http://%s", net.JoinHostPort(service.Address, strconv.Itoa(service.Port))))
+	}
+	return endpoints
+}
 
-		items = append(items, instance)
+// legacyVersion 从旧版本注册的标签中还原版本
+func legacyVersion(tags []string) string {
+	for _, tag := range tags {
+		switch tag {
+		case "http", "https", "grpc", "grpcs":
+		default:
+			return tag
+		}
 	}
+	return ""
+}
 
-	return items, nil
+// serviceWatch 是同一服务共享的监视循环
+type serviceWatch struct {
+	hub    *fanout.Hub
+	cancel context.CancelFunc
 }
 
 // Watch 监视服务变更
+// 同一服务的所有观察者共享一个基于阻塞查询的监视循环，每个观察者在自己的ctx结束或调用Stop后停止
 func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
-	// 创建一个新的通道
 	r.lock.Lock()
-	ch := make(chan []*registry.ServiceInstance, 10)
-	r.watchChs[serviceName] = ch
+	if sw, ok := r.watchers[serviceName]; ok {
+		w := sw.hub.Subscribe(ctx)
+		r.lock.Unlock()
+		return w, nil
+	}
 	r.lock.Unlock()
 
-	// 先获取当前服务列表
-	services, err := r.GetService(ctx, serviceName)
+	// 先获取当前服务列表和索引
+	services, index, err := r.service(ctx, serviceName, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(services) > 0 {
-		select {
-		case ch <- services:
-		default:
-			// 避免阻塞
-		}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok {
+		loopCtx, cancel := context.WithCancel(r.ctx)
+		sw = &serviceWatch{cancel: cancel}
+		sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+			r.unwatch(serviceName, hub)
+		})
+		sw.hub.Publish(services)
+		r.watchers[serviceName] = sw
+		go r.watchLoop(loopCtx, serviceName, index, sw.hub)
 	}
+	return sw.hub.Subscribe(ctx), nil
+}
 
-	// 启动goroutine监视变更
-	go func() {
-		index := uint64(0)
-		for {
+// unwatch 在服务的最后一个观察者停止后结束共享的监视循环
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
+	}
+	sw.cancel()
+	delete(r.watchers, serviceName)
+}
+
+// watchLoop 通过阻塞查询（WaitIndex）监视服务变化，并分发给所有观察者
+func (r *Registry) watchLoop(ctx context.Context, serviceName string, index uint64, hub *fanout.Hub) {
+	for {
+		services, lastIndex, err := r.service(ctx, serviceName, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.logger.Error("监视服务变更失败",
+				log.String("service", serviceName),
+				log.String("error", err.Error()))
+			// 避免频繁重试
 			select {
-			case <-r.ctx.Done():
+			case <-ctx.Done():
 				return
-			default:
-				// 通过阻塞查询监视服务变化
-				entries, meta, err := r.client.Health().Service(serviceName, "", true, &api.QueryOptions{
-					WaitIndex: index,
-					WaitTime:  time.Minute,
-				})
-				if err != nil {
-					r.logger.Error("监视服务变更失败",
-						log.String("service", serviceName),
-						log.String("error", err.Error()))
-					time.Sleep(time.Second) // 避免频繁重试
-					continue
-				}
-
-				// 检查索引是否变化
-				if meta.LastIndex <= index {
-					continue
-				}
-				index = meta.LastIndex
-
-				// 构建服务实例列表
-				items := make([]*registry.ServiceInstance, 0, len(entries))
-				for _, entry := range entries {
-					service := entry.Service
-					if service.ID == "" || service.Service == "" {
-						continue
-					}
-
-					// 构建端点列表
-					endpoints := make([]string, 0, len(service.Tags))
-					for _, tag := range service.Tags {
-						if tag == "http" || tag == "grpc" {
-							endpoint := fmt.Sprintf("%s://%s:%d", tag, service.Address, service.Port)
-							endpoints = append(endpoints, endpoint)
-						}
-					}
-
-					if len(endpoints) == 0 {
-						endpoint := fmt.Sprintf("http://%s:%d", service.Address, service.Port)
-						endpoints = append(endpoints, endpoint)
-					}
-
-					// 解析版本信息
-					var version string
-					for _, tag := range service.Tags {
-						if tag != "http" && tag != "grpc" {
-							version = tag
-							break
-						}
-					}
-
-					// 构建服务实例
-					instance := &registry.ServiceInstance{
-						ID:        service.ID,
-						Name:      service.Service,
-						Version:   version,
-						Metadata:  service.Meta,
-						Endpoints: endpoints,
-						Status:    registry.StatusUp,
-					}
-
-					items = append(items, instance)
-				}
-
-				// 通知观察者
-				r.lock.RLock()
-				ch, ok := r.watchChs[serviceName]
-				r.lock.RUnlock()
-				if ok {
-					select {
-					case ch <- items:
-					default:
-						// 避免阻塞
-					}
-				}
+			case <-time.After(time.Second):
 			}
+			continue
+		}
+
+		// 索引为0时按官方建议视为1，避免阻塞查询立即返回造成忙循环
+		if lastIndex == 0 {
+			lastIndex = 1
+		}
+		switch {
+		case lastIndex < index:
+			// 索引回退（例如Consul重启），按官方建议重置索引
+			index = 0
+			continue
+		case lastIndex == index:
+			// 等待超时，没有变化
+			continue
 		}
-	}()
+		index = lastIndex
 
-	return &watcher{
-		registry: r,
-		ch:       ch,
-		service:  serviceName,
-	}, nil
+		hub.Publish(services)
+	}
 }
 
-// Stop 停止注册中心
+// Stop 停止注册中心，所有观察者随之停止
 func (r *Registry) Stop() error {
 	r.cancel()
-	return nil
-}
-
-// serviceKey 构建服务实例的key
-func (r *Registry) serviceKey(service *registry.ServiceInstance) string {
-	return fmt.Sprintf("service/%s/%s", service.Name, service.ID)
-}
-
-// watcher 是服务监视实现
-type watcher struct {
-	registry *Registry
-	ch       chan []*registry.ServiceInstance
-	service  string
-	done     bool
-}
 
-// Next 等待下一个服务更新
-func (w *watcher) Next() ([]*registry.ServiceInstance, error) {
-	if w.done {
-		return nil, fmt.Errorf("watcher已关闭")
-	}
-
-	select {
-	case services := <-w.ch:
-		return services, nil
-	case <-w.registry.ctx.Done():
-		return nil, w.registry.ctx.Err()
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.watchers))
+	for _, sw := range r.watchers {
+		hubs = append(hubs, sw.hub)
 	}
-}
+	r.lock.Unlock()
 
-// Stop 停止监视
-func (w *watcher) Stop() error {
-	if w.done {
-		return nil
+	for _, hub := range hubs {
+		hub.Close()
 	}
-
-	w.registry.lock.Lock()
-	delete(w.registry.watchChs, w.service)
-	w.registry.lock.Unlock()
-
-	w.done = true
-	close(w.ch)
 	return nil
 }
@@ -0,0 +1,289 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeAgent 是一个最小化的Consul HTTP API替身，支持服务注册、注销、TTL上报和阻塞查询
+type fakeAgent struct {
+	lock     sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string]*api.AgentServiceRegistration
+	ttl      map[string]int
+}
+
+func newFakeAgent() *fakeAgent {
+	return &fakeAgent{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]*api.AgentServiceRegistration),
+		ttl:      make(map[string]int),
+	}
+}
+
+// bump 增加索引并唤醒阻塞查询，调用方需持有锁
+func (a *fakeAgent) bump() {
+	a.index++
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/v1/agent/service/register":
+		reg := &api.AgentServiceRegistration{}
+		if err := json.NewDecoder(req.Body).Decode(reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.lock.Lock()
+		a.services[reg.ID] = reg
+		a.bump()
+		a.lock.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(req.URL.Path, "/v1/agent/service/deregister/")
+		a.lock.Lock()
+		delete(a.services, id)
+		a.bump()
+		a.lock.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/agent/check/update/"):
+		id := strings.TrimPrefix(req.URL.Path, "/v1/agent/check/update/service:")
+		a.lock.Lock()
+		a.ttl[id]++
+		a.lock.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/health/service/"):
+		a.health(w, req, strings.TrimPrefix(req.URL.Path, "/v1/health/service/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (a *fakeAgent) health(w http.ResponseWriter, req *http.Request, name string) {
+	wait, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+
+	a.lock.Lock()
+	if wait > 0 && wait >= a.index {
+		changed := a.changed
+		a.lock.Unlock()
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+		a.lock.Lock()
+	}
+	entries := make([]*api.ServiceEntry, 0)
+	for _, reg := range a.services {
+		if reg.Name != name {
+			continue
+		}
+		entries = append(entries, &api.ServiceEntry{Service: &api.AgentService{
+			ID:      reg.ID,
+			Service: reg.Name,
+			Address: reg.Address,
+			Port:    reg.Port,
+			Tags:    reg.Tags,
+			Meta:    reg.Meta,
+		}})
+	}
+	index := a.index
+	a.lock.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+func newTestRegistry(t *testing.T, agent *fakeAgent, opts ...Option) *Registry {
+	t.Helper()
+	srv := httptest.NewServer(agent)
+	t.Cleanup(srv.Close)
+
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	r := NewRegistry(client, opts...)
+	t.Cleanup(func() { _ = r.Stop() })
+	return r
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	agent := newFakeAgent()
+	r := newTestRegistry(t, agent,
+		WithCheckType(CheckHTTP),
+		WithHTTPCheckPath("/healthz"),
+		WithInterval(time.Second*3),
+		WithCheckTimeout(time.Second*2),
+		WithDeregisterCriticalServiceAfter(time.Minute*5),
+	)
+
+	ins := &registry.ServiceInstance{
+		ID:        "greeter-1",
+		Name:      "greeter",
+		Version:   "v1.2.0",
+		Metadata:  map[string]string{"zone": "a"},
+		Endpoints: []string{"http://127.0.0.1:8000", "grpc://127.0.0.1:9000", "grpcs://127.0.0.1:9443"},
+	}
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	reg := agent.services["greeter-1"]
+	if reg == nil || reg.Check == nil {
+		t.Fatalf("expected registration with check, got %+v", reg)
+	}
+	if reg.Check.HTTP != "http://127.0.0.1:8000/healthz" || reg.Check.Interval != "3s" ||
+		reg.Check.Timeout != "2s" || reg.Check.DeregisterCriticalServiceAfter != "5m0s" {
+		t.Errorf("unexpected check: %+v", reg.Check)
+	}
+
+	got, err := r.GetService(context.Background(), "greeter")
+	if err != nil {
+		t.Fatalf("get service: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(got))
+	}
+	if !reflect.DeepEqual(got[0].Endpoints, ins.Endpoints) {
+		t.Errorf("endpoints = %v, want %v", got[0].Endpoints, ins.Endpoints)
+	}
+	if got[0].Version != ins.Version {
+		t.Errorf("version = %q, want %q", got[0].Version, ins.Version)
+	}
+	if !reflect.DeepEqual(got[0].Metadata, ins.Metadata) {
+		t.Errorf("metadata = %v, want %v", got[0].Metadata, ins.Metadata)
+	}
+
+	if err := r.Deregister(context.Background(), ins); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	got, err = r.GetService(context.Background(), "greeter")
+	if err != nil || len(got) != 0 {
+		t.Fatalf("expected no instances after deregister, got %v, %v", got, err)
+	}
+}
+
+func TestHealthCheckDisabled(t *testing.T) {
+	agent := newFakeAgent()
+	r := newTestRegistry(t, agent, WithHealthCheck(false))
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"tcp://127.0.0.1:7000"}}
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if agent.services["a"].Check != nil {
+		t.Errorf("expected no check, got %+v", agent.services["a"].Check)
+	}
+}
+
+func TestTTLHeartbeat(t *testing.T) {
+	agent := newFakeAgent()
+	r := newTestRegistry(t, agent, WithCheckType(CheckTTL), WithInterval(time.Millisecond*20))
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	agent.lock.Lock()
+	beats := agent.ttl["a"]
+	agent.lock.Unlock()
+	if beats < 2 {
+		t.Errorf("expected repeated TTL updates, got %d", beats)
+	}
+}
+
+func TestWatchBlockingQuery(t *testing.T) {
+	agent := newFakeAgent()
+	r := newTestRegistry(t, agent)
+	ctx := context.Background()
+
+	first := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, first); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	w1, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	w2, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	for _, w := range []registry.Watcher{w1, w2} {
+		got, err := w.Next()
+		if err != nil || len(got) != 1 {
+			t.Fatalf("initial next = %v, %v", got, err)
+		}
+	}
+
+	second := &registry.ServiceInstance{ID: "b", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9001"}}
+	if err := r.Register(ctx, second); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for _, w := range []registry.Watcher{w1, w2} {
+		got, err := w.Next()
+		if err != nil || len(got) != 2 {
+			t.Fatalf("next after register = %v, %v", got, err)
+		}
+	}
+
+	if err := w1.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := w1.Next(); err == nil {
+		t.Error("expected error from Next after Stop")
+	}
+}
+
+func TestRegisterMetaLimit(t *testing.T) {
+	agent := newFakeAgent()
+	r := newTestRegistry(t, agent, WithHealthCheck(false))
+
+	endpoints := make([]string, 0, 40)
+	for i := 0; i < 40; i++ {
+		endpoints = append(endpoints, "grpc://127.0.0.1:"+strconv.Itoa(9000+i))
+	}
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: endpoints}
+	if err := r.Register(context.Background(), ins); err == nil || !strings.Contains(err.Error(), metaEndpoints) {
+		t.Fatalf("expected meta limit error, got %v", err)
+	}
+	if len(agent.services) != 0 {
+		t.Errorf("service registered despite oversized meta")
+	}
+
+	ins.Endpoints = endpoints[:10]
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	for _, check := range []string{"", "ttl", "http", "grpc", "tcp"} {
+		if _, err := registry.Open("consul://127.0.0.1:8500?check=" + check); err != nil {
+			t.Errorf("check %q: %v", check, err)
+		}
+	}
+	if _, err := registry.Open("consul://127.0.0.1:8500?check=htpp"); err == nil {
+		t.Error("expected unknown check to fail")
+	}
+}
@@ -0,0 +1,61 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	registry.RegisterFactory(registry.Consul, newFromConfig)
+}
+
+// newFromConfig 根据通用配置创建Consul注册中心，只使用第一个终端点，未设置时使用Consul客户端的默认地址
+// 支持的参数：token（ACL令牌）、datacenter、namespace、health（是否启用健康检查）、check（检查类型：ttl、http、grpc、tcp，未设置时按端点协议选择）、ttl
+func newFromConfig(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+	health, err := cfg.BoolParam("health", true)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := cfg.DurationParam("ttl")
+	if err != nil {
+		return nil, err
+	}
+	check := CheckType(cfg.Param("check"))
+	switch check {
+	case CheckAuto, CheckTTL, CheckHTTP, CheckGRPC, CheckTCP:
+	default:
+		return nil, fmt.Errorf("consul: unknown check %q", check)
+	}
+
+	clientCfg := api.DefaultConfig()
+	if len(cfg.Endpoints) > 0 {
+		clientCfg.Address = cfg.Endpoints[0]
+	}
+	if cfg.TLSEnabled {
+		clientCfg.Scheme = "https"
+	}
+	if cfg.Username != "" {
+		clientCfg.HttpAuth = &api.HttpBasicAuth{Username: cfg.Username, Password: cfg.Password}
+	}
+	if token := cfg.Param("token"); token != "" {
+		clientCfg.Token = token
+	}
+	client, err := api.NewClient(clientCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithHealthCheck(health),
+		WithCheckType(check),
+		WithDatacenter(cfg.Param("datacenter")),
+		WithNamespace(cfg.Param("namespace")),
+	}
+	if ttl > 0 {
+		opts = append(opts, WithTTL(ttl))
+	}
+	return NewRegistry(client, opts...), nil
+}
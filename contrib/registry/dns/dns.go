@@ -0,0 +1,324 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.Discovery = (*Registry)(nil)
+)
+
+const (
+	// MetadataWeight 是SRV记录权重对应的元数据键，与selector使用的键一致
+	MetadataWeight = "weight"
+	// MetadataPriority 是SRV记录优先级对应的元数据键
+	MetadataPriority = "priority"
+)
+
+// Registry 是基于DNS的服务发现
+// 以下划线开头的服务名称按SRV记录解析，例如_grpc._tcp.orders.example.com，协议取自服务标签；
+// 其他名称按A/AAAA记录解析，格式为[scheme://]host[:port]
+// 记录按TTL重新解析，TTL限制在MinInterval和MaxInterval之间
+type Registry struct {
+	resolver *net.Resolver
+	options  *Options
+	ctx      context.Context
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	watchers map[string]*serviceWatch // 服务名称到共享监视的映射
+	logger   log.Logger
+}
+
+// Options 是DNS服务发现的选项
+type Options struct {
+	Nameserver  string        // DNS服务器地址，为空时使用系统配置
+	Scheme      string        // 无法从名称推断协议时使用的协议
+	Port        int           // A/AAAA记录的默认端口
+	Interval    time.Duration // 无法获得TTL时（例如hosts文件）的重新解析间隔
+	MinInterval time.Duration // 重新解析的最小间隔
+	MaxInterval time.Duration // 重新解析的最大间隔
+	Logger      log.Logger
+}
+
+// Option 是DNS服务发现的选项函数
+type Option func(*Options)
+
+// WithNameserver 设置DNS服务器地址，格式为host:port
+func WithNameserver(addr string) Option {
+	return func(o *Options) {
+		o.Nameserver = addr
+	}
+}
+
+// WithScheme 设置默认协议
+func WithScheme(scheme string) Option {
+	return func(o *Options) {
+		o.Scheme = scheme
+	}
+}
+
+// WithPort 设置A/AAAA记录的默认端口
+func WithPort(port int) Option {
+	return func(o *Options) {
+		o.Port = port
+	}
+}
+
+// WithInterval 设置无法获得TTL时的重新解析间隔
+func WithInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.Interval = interval
+	}
+}
+
+// WithIntervalBounds 设置按TTL重新解析的最小和最大间隔
+func WithIntervalBounds(min, max time.Duration) Option {
+	return func(o *Options) {
+		o.MinInterval = min
+		o.MaxInterval = max
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewRegistry 创建DNS服务发现实例
+func NewRegistry(opts ...Option) *Registry {
+	options := &Options{
+		Scheme:      "grpc",
+		Interval:    time.Second * 30,
+		MinInterval: time.Second * 5,
+		MaxInterval: time.Minute * 5,
+		Logger:      log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	r := &Registry{
+		options:  options,
+		lock:     sync.Mutex{},
+		watchers: make(map[string]*serviceWatch),
+		logger:   options.Logger,
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.resolver = &net.Resolver{PreferGo: true, Dial: r.dial}
+	return r
+}
+
+// GetService 解析服务实例列表，名称不存在时返回空列表
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	instances, _, err := r.resolve(ctx, serviceName)
+	return instances, err
+}
+
+// resolve 解析服务名称，返回实例列表和下一次解析前的等待时间
+func (r *Registry) resolve(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, time.Duration, error) {
+	rec := &ttlRecorder{}
+	ctx = context.WithValue(ctx, ttlRecorderKey{}, rec)
+
+	var (
+		instances []*registry.ServiceInstance
+		err       error
+	)
+	if strings.HasPrefix(serviceName, "_") {
+		instances, err = r.lookupSRV(ctx, serviceName)
+	} else {
+		instances, err = r.lookupHost(ctx, serviceName)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		instances, err = []*registry.ServiceInstance{}, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, r.interval(rec), nil
+}
+
+// lookupSRV 按SRV记录解析，权重和优先级写入元数据
+func (r *Registry) lookupSRV(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	_, records, err := r.resolver.LookupSRV(ctx, "", "", serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := r.options.Scheme
+	label, _, _ := strings.Cut(serviceName, ".")
+	switch label = strings.TrimPrefix(label, "_"); label {
+	case "http", "https", "grpc", "grpcs":
+		scheme = label
+	}
+
+	instances := make([]*registry.ServiceInstance, 0, len(records))
+	for _, srv := range records {
+		addr := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		instances = append(instances, &registry.ServiceInstance{
+			ID:        addr,
+			Name:      serviceName,
+			Endpoints: []string{scheme + "://" + addr},
+			Status:    registry.StatusUp,
+			Metadata: map[string]string{
+				MetadataWeight:   strconv.Itoa(int(srv.Weight)),
+				MetadataPriority: strconv.Itoa(int(srv.Priority)),
+			},
+		})
+	}
+	return instances, nil
+}
+
+// lookupHost 按A/AAAA记录解析，每个地址是一个实例
+func (r *Registry) lookupHost(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	scheme, target := r.options.Scheme, serviceName
+	if s, rest, ok := strings.Cut(serviceName, "://"); ok {
+		scheme, target = s, rest
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		if r.options.Port == 0 {
+			return nil, errors.New("dns: missing port in " + serviceName)
+		}
+		host, port = target, strconv.Itoa(r.options.Port)
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*registry.ServiceInstance, 0, len(addrs))
+	for _, addr := range addrs {
+		hostPort := net.JoinHostPort(addr.String(), port)
+		instances = append(instances, &registry.ServiceInstance{
+			ID:        hostPort,
+			Name:      serviceName,
+			Endpoints: []string{scheme + "://" + hostPort},
+			Status:    registry.StatusUp,
+			Metadata:  map[string]string{},
+		})
+	}
+	return instances, nil
+}
+
+// interval 根据解析时观察到的最小TTL计算下一次解析前的等待时间
+func (r *Registry) interval(rec *ttlRecorder) time.Duration {
+	ttl, ok := rec.min()
+	if !ok {
+		return r.options.Interval
+	}
+	d := time.Duration(ttl) * time.Second
+	if d < r.options.MinInterval {
+		d = r.options.MinInterval
+	}
+	if r.options.MaxInterval > 0 && d > r.options.MaxInterval {
+		d = r.options.MaxInterval
+	}
+	return d
+}
+
+// serviceWatch 是同一服务共享的监视
+type serviceWatch struct {
+	hub    *fanout.Hub
+	cancel context.CancelFunc
+}
+
+// Watch 监视服务变更
+// 同一服务的所有观察者共享一个解析循环，解析结果变化时才会通知观察者
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if sw, ok := r.watchers[serviceName]; ok {
+		return sw.hub.Subscribe(ctx), nil
+	}
+
+	instances, wait, err := r.resolve(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	loopCtx, cancel := context.WithCancel(r.ctx)
+	sw := &serviceWatch{cancel: cancel}
+	sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+		r.unwatch(serviceName, hub)
+	})
+	sw.hub.Publish(instances)
+	r.watchers[serviceName] = sw
+
+	go r.watchLoop(loopCtx, serviceName, sw.hub, instances, wait)
+	return sw.hub.Subscribe(ctx), nil
+}
+
+// watchLoop 按TTL重新解析并发布变化，解析失败时保留上一次的结果
+func (r *Registry) watchLoop(ctx context.Context, serviceName string, hub *fanout.Hub, last []*registry.ServiceInstance, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		instances, next, err := r.resolve(ctx, serviceName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Warn("DNS解析失败", log.String("service", serviceName), log.Err(err))
+			timer.Reset(r.options.MinInterval)
+			continue
+		}
+		if !reflect.DeepEqual(last, instances) {
+			last = instances
+			hub.Publish(instances)
+		}
+		timer.Reset(next)
+	}
+}
+
+// unwatch 在服务的最后一个观察者停止后结束共享的监视
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
+	}
+	sw.cancel()
+	delete(r.watchers, serviceName)
+}
+
+// Stop 停止服务发现，所有观察者随之停止
+func (r *Registry) Stop() error {
+	r.cancel()
+
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.watchers))
+	for _, sw := range r.watchers {
+		hubs = append(hubs, sw.hub)
+	}
+	r.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.Close()
+	}
+	return nil
+}
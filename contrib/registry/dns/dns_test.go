@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeNameserver 是一个只支持A和SRV查询的UDP DNS服务器
+type fakeNameserver struct {
+	lock sync.Mutex
+	a    map[string][]string
+	srv  map[string][]dnsmessage.SRVResource
+	ttl  uint32
+}
+
+func newFakeNameserver(t *testing.T) (*fakeNameserver, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	f := &fakeNameserver{a: make(map[string][]string), srv: make(map[string][]dnsmessage.SRVResource), ttl: 60}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := f.answer(buf[:n]); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return f, conn.LocalAddr().String()
+}
+
+func (f *fakeNameserver) set(fn func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fn()
+}
+
+func (f *fakeNameserver) answer(req []byte) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: f.ttl}
+	name := q.Name.String()
+	found := false
+	switch q.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range f.a[name] {
+			var a [4]byte
+			copy(a[:], net.ParseIP(ip).To4())
+			_ = b.AResource(rh, dnsmessage.AResource{A: a})
+		}
+		_, found = f.a[name]
+	case dnsmessage.TypeSRV:
+		for _, srv := range f.srv[name] {
+			_ = b.SRVResource(rh, srv)
+		}
+		_, found = f.srv[name]
+	default:
+		_, ok1 := f.a[name]
+		_, ok2 := f.srv[name]
+		found = ok1 || ok2
+	}
+	if !found {
+		b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeNameError})
+		_ = b.StartQuestions()
+		_ = b.Question(q)
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+func srv(target string, port, priority, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Priority: priority, Weight: weight}
+}
+
+func TestLookupSRV(t *testing.T) {
+	f, addr := newFakeNameserver(t)
+	f.set(func() {
+		f.srv["_grpc._tcp.orders.test."] = []dnsmessage.SRVResource{
+			srv("b.orders.test.", 9000, 10, 20),
+			srv("a.orders.test.", 9000, 10, 80),
+		}
+	})
+	r := NewRegistry(WithNameserver(addr))
+	defer r.Stop()
+
+	got, err := r.GetService(context.Background(), "_grpc._tcp.orders.test.")
+	if err != nil || len(got) != 2 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	if !reflect.DeepEqual(got[0].Endpoints, []string{"grpc://a.orders.test:9000"}) {
+		t.Errorf("endpoints = %v", got[0].Endpoints)
+	}
+	if want := map[string]string{MetadataWeight: "80", MetadataPriority: "10"}; !reflect.DeepEqual(got[0].Metadata, want) {
+		t.Errorf("metadata = %v, want %v", got[0].Metadata, want)
+	}
+
+	// 名称不存在时返回空列表
+	if got, err := r.GetService(context.Background(), "_grpc._tcp.missing.test."); err != nil || len(got) != 0 {
+		t.Errorf("missing service = %v, %v", got, err)
+	}
+}
+
+func TestLookupHost(t *testing.T) {
+	f, addr := newFakeNameserver(t)
+	f.set(func() { f.a["orders.test."] = []string{"10.0.0.2", "10.0.0.1"} })
+	r := NewRegistry(WithNameserver(addr), WithPort(8000))
+	defer r.Stop()
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"orders.test.", []string{"grpc://10.0.0.1:8000", "grpc://10.0.0.2:8000"}},
+		{"http://orders.test.:8080", []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}},
+	}
+	for _, tt := range tests {
+		got, err := r.GetService(context.Background(), tt.name)
+		if err != nil {
+			t.Fatalf("get service %s: %v", tt.name, err)
+		}
+		var endpoints []string
+		for _, si := range got {
+			endpoints = append(endpoints, si.Endpoints...)
+		}
+		if !reflect.DeepEqual(endpoints, tt.want) {
+			t.Errorf("%s endpoints = %v, want %v", tt.name, endpoints, tt.want)
+		}
+	}
+}
+
+func TestWatchReresolvesOnTTL(t *testing.T) {
+	f, addr := newFakeNameserver(t)
+	f.set(func() {
+		f.ttl = 1
+		f.a["orders.test."] = []string{"10.0.0.1"}
+	})
+	r := NewRegistry(WithNameserver(addr), WithPort(8000), WithIntervalBounds(time.Millisecond*10, time.Minute))
+	defer r.Stop()
+
+	w, err := r.Watch(context.Background(), "orders.test.")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items, err := w.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("initial next = %v, %v", items, err)
+	}
+
+	f.set(func() { f.a["orders.test."] = []string{"10.0.0.1", "10.0.0.3"} })
+	start := time.Now()
+	items, err := w.Next()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("next = %v, %v", items, err)
+	}
+	// TTL为1秒，过期后应很快重新解析
+	if elapsed := time.Since(start); elapsed > time.Second*3 {
+		t.Errorf("re-resolved after %v", elapsed)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	r := NewRegistry(WithInterval(time.Second*7), WithIntervalBounds(time.Second*5, time.Minute))
+	tests := []struct {
+		ttl  uint32
+		seen bool
+		want time.Duration
+	}{
+		{0, false, time.Second * 7},
+		{1, true, time.Second * 5},
+		{30, true, time.Second * 30},
+		{3600, true, time.Minute},
+	}
+	for _, tt := range tests {
+		rec := &ttlRecorder{}
+		if tt.seen {
+			rec.observe(tt.ttl)
+		}
+		if got := r.interval(rec); got != tt.want {
+			t.Errorf("interval(%d) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 标准库的解析器不返回记录的TTL，这里在解析器的连接上读取响应中的TTL
+
+// ttlRecorderKey 是ttlRecorder在context中的键
+type ttlRecorderKey struct{}
+
+// ttlRecorder 记录一次解析中所有应答记录的最小TTL
+// A和AAAA查询可能并发进行，因此需要加锁
+type ttlRecorder struct {
+	lock sync.Mutex
+	ttl  uint32
+	seen bool
+}
+
+// observe 记录一个TTL
+func (t *ttlRecorder) observe(ttl uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.seen || ttl < t.ttl {
+		t.ttl, t.seen = ttl, true
+	}
+}
+
+// min 返回最小TTL，没有观察到应答记录时返回false
+func (t *ttlRecorder) min() (uint32, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.ttl, t.seen
+}
+
+// dial 是解析器使用的拨号函数，设置了Nameserver时替换DNS服务器地址
+func (r *Registry) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if r.options.Nameserver != "" {
+		address = r.options.Nameserver
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder)
+	if !ok {
+		return conn, nil
+	}
+	// 解析器根据连接是否实现PacketConn选择UDP或TCP的消息格式
+	if packet, ok := conn.(net.PacketConn); ok {
+		return &ttlPacketConn{ttlConn: &ttlConn{Conn: conn, rec: rec}, packet: packet}, nil
+	}
+	return &ttlConn{Conn: conn, rec: rec, stream: true}, nil
+}
+
+// ttlConn 在读取DNS响应时记录TTL
+// UDP每次读取一个完整的消息，TCP的消息带有两字节长度前缀，需要缓冲后按长度切分
+type ttlConn struct {
+	net.Conn
+	rec    *ttlRecorder
+	stream bool
+	buf    []byte
+}
+
+// Read 读取数据并解析其中完整的DNS消息
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 {
+		return n, err
+	}
+	if !c.stream {
+		c.parse(b[:n])
+		return n, err
+	}
+
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		size := int(c.buf[0])<<8 | int(c.buf[1])
+		if len(c.buf) < 2+size {
+			break
+		}
+		c.parse(c.buf[2 : 2+size])
+		c.buf = c.buf[2+size:]
+	}
+	return n, err
+}
+
+// parse 记录消息中应答记录的TTL，无法解析的消息交给解析器处理
+func (c *ttlConn) parse(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		c.rec.observe(h.TTL)
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// ttlPacketConn 是UDP连接上的ttlConn
+type ttlPacketConn struct {
+	*ttlConn
+	packet net.PacketConn
+}
+
+// ReadFrom 读取一个完整的DNS消息
+func (c *ttlPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.packet.ReadFrom(b)
+	if n > 0 {
+		c.parse(b[:n])
+	}
+	return n, addr, err
+}
+
+// WriteTo 发送一个DNS消息
+func (c *ttlPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.packet.WriteTo(b, addr)
+}
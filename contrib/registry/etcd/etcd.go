@@ -3,22 +3,30 @@ package etcd
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"path"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/dormoron/phantasm/internal/fanout"
 	"github.com/dormoron/phantasm/log"
 	"github.com/dormoron/phantasm/registry"
 
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
 var (
 	_ registry.ServiceRegistrar = (*Registry)(nil)
 )
 
+// ErrRegistryStopped 是注册中心停止后继续注册时返回的错误
+var ErrRegistryStopped = errors.New("etcd registry stopped")
+
 // Registry 是基于etcd的服务注册发现中心
+// 所有服务实例共享一个会话租约，会话失效后会自动创建新会话并重新注册全部实例
 type Registry struct {
 	client   *clientv3.Client
 	prefix   string // 服务注册的前缀
@@ -26,9 +34,13 @@ type Registry struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	lock     sync.RWMutex
-	leases   map[string]clientv3.LeaseID                 // 服务实例ID到租约ID的映射
-	watchChs map[string]chan []*registry.ServiceInstance // 服务名称到观察通道的映射
+	services map[string]*registry.ServiceInstance // 已注册的服务实例，用于会话失效后重新注册
+	watchers map[string]*serviceWatch             // 服务名称到共享监视循环的映射
 	logger   log.Logger
+
+	sessionLock sync.Mutex
+	session     *concurrency.Session
+	stopped     bool
 }
 
 // Options 是etcd注册中心的选项
@@ -74,16 +86,21 @@ func NewRegistry(client *clientv3.Client, opts ...Option) *Registry {
 		o(options)
 	}
 
+	ttl := int64(options.TTL.Seconds())
+	if ttl <= 0 {
+		ttl = 1
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Registry{
 		client:   client,
 		prefix:   options.Prefix,
-		ttl:      int64(options.TTL.Seconds()),
+		ttl:      ttl,
 		ctx:      ctx,
 		cancel:   cancel,
 		lock:     sync.RWMutex{},
-		leases:   make(map[string]clientv3.LeaseID),
-		watchChs: make(map[string]chan []*registry.ServiceInstance),
+		services: make(map[string]*registry.ServiceInstance),
+		watchers: make(map[string]*serviceWatch),
 		logger:   options.Logger,
 	}
 }
@@ -101,221 +118,345 @@ func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstan
 	}
 	service.UpdatedAt = now
 
-	val, err := json.Marshal(service)
+	session, err := r.ensureSession(ctx)
 	if err != nil {
 		return err
 	}
 
-	key := r.serviceKey(service)
+	// 写入前缓存服务实例，用于会话失效后重新注册；
+	// 会话在写入后立即失效时，keepSession 取到的快照中也已包含该实例
+	r.lock.Lock()
+	prev, registered := r.services[service.ID]
+	r.services[service.ID] = service
+	r.lock.Unlock()
 
-	// 创建租约
-	lease, err := r.client.Grant(ctx, r.ttl)
-	if err != nil {
+	if err := r.put(ctx, session, service); err != nil {
+		// 写入失败时恢复缓存，期间被其他调用替换的实例保持不变
+		r.lock.Lock()
+		if r.services[service.ID] == service {
+			if registered {
+				r.services[service.ID] = prev
+			} else {
+				delete(r.services, service.ID)
+			}
+		}
+		r.lock.Unlock()
 		return err
 	}
+	return nil
+}
 
-	// 使用租约注册服务
-	_, err = r.client.Put(ctx, key, string(val), clientv3.WithLease(lease.ID))
+// put 使用会话租约写入服务实例
+func (r *Registry) put(ctx context.Context, session *concurrency.Session, service *registry.ServiceInstance) error {
+	val, err := json.Marshal(service)
 	if err != nil {
 		return err
 	}
+	_, err = r.client.Put(ctx, r.serviceKey(service), string(val), clientv3.WithLease(session.Lease()))
+	return err
+}
+
+// ensureSession 返回当前会话，不存在时创建新会话
+func (r *Registry) ensureSession(ctx context.Context) (*concurrency.Session, error) {
+	r.sessionLock.Lock()
+	defer r.sessionLock.Unlock()
 
-	// 保持租约有效
-	ch, err := r.client.KeepAlive(r.ctx, lease.ID)
+	if r.stopped {
+		return nil, ErrRegistryStopped
+	}
+	if r.session != nil {
+		select {
+		case <-r.session.Done():
+		default:
+			return r.session, nil
+		}
+	}
+
+	// 授权请求使用调用方的ctx，续约使用注册中心的ctx
+	lease, err := r.client.Grant(ctx, r.ttl)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	session, err := concurrency.NewSession(r.client,
+		concurrency.WithLease(lease.ID),
+		concurrency.WithContext(r.ctx),
+	)
+	if err != nil {
+		return nil, err
 	}
+	r.session = session
+	go r.keepSession(session)
+	return session, nil
+}
 
-	// 启动goroutine接收keepalive响应
-	go func() {
-		for {
-			select {
-			case <-r.ctx.Done():
-				return
-			case _, ok := <-ch:
-				if !ok {
-					r.logger.Warn("续租失败，尝试重新注册", log.String("service", service.Name), log.String("id", service.ID))
-					// 尝试重新注册
-					if err := r.Register(context.Background(), service); err != nil {
-						r.logger.Error("服务重新注册失败", log.String("service", service.Name), log.String("id", service.ID), log.Err(err))
-					}
-					return
-				}
-			}
-		}
-	}()
+// keepSession 在会话失效后创建新会话并重新注册全部实例
+func (r *Registry) keepSession(session *concurrency.Session) {
+	select {
+	case <-r.ctx.Done():
+		return
+	case <-session.Done():
+	}
 
-	// 保存租约信息
-	r.lock.Lock()
-	r.leases[service.ID] = lease.ID
-	r.lock.Unlock()
+	r.sessionLock.Lock()
+	if r.stopped || r.session != session {
+		r.sessionLock.Unlock()
+		return
+	}
+	r.session = nil
+	r.sessionLock.Unlock()
 
-	return nil
+	r.logger.Warn("etcd会话已失效，重新注册服务实例", log.Int("lease", int(session.Lease())))
+
+	backoff := time.Second
+	for {
+		err := r.reregister()
+		if err == nil {
+			return
+		}
+		r.logger.Error("服务重新注册失败", log.Err(err))
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Second*30 {
+			backoff *= 2
+		}
+	}
 }
 
-// Deregister 注销服务实例
-func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
-	key := r.serviceKey(service)
+// reregister 使用新会话重新注册全部已缓存的实例
+func (r *Registry) reregister() error {
+	ctx, cancel := context.WithTimeout(r.ctx, time.Duration(r.ttl)*time.Second)
+	defer cancel()
 
-	// 获取租约并撤销
-	r.lock.Lock()
-	leaseID, ok := r.leases[service.ID]
-	if ok {
-		delete(r.leases, service.ID)
+	session, err := r.ensureSession(ctx)
+	if err != nil {
+		return err
 	}
-	r.lock.Unlock()
 
-	if ok {
-		_, err := r.client.Revoke(ctx, leaseID)
-		if err != nil {
+	r.lock.RLock()
+	services := make([]*registry.ServiceInstance, 0, len(r.services))
+	for _, s := range r.services {
+		services = append(services, s)
+	}
+	r.lock.RUnlock()
+
+	for _, s := range services {
+		if err := r.put(ctx, session, s); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// Deregister 注销服务实例
+func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	r.lock.Lock()
+	delete(r.services, service.ID)
+	r.lock.Unlock()
 
-	// 删除服务实例
-	_, err := r.client.Delete(ctx, key)
+	// 删除服务实例，会话租约由其余实例继续共享
+	_, err := r.client.Delete(ctx, r.serviceKey(service))
 	return err
 }
 
 // GetService 获取服务实例列表
 func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
-	prefix := path.Join(r.prefix, serviceName) + "/"
-	resp, err := r.client.Get(ctx, prefix, clientv3.WithPrefix())
+	instances, _, err := r.list(ctx, serviceName)
 	if err != nil {
 		return nil, err
 	}
+	return sortedInstances(instances), nil
+}
+
+// list 读取服务前缀下的全部实例，返回以key为索引的实例和读取时的revision
+func (r *Registry) list(ctx context.Context, serviceName string) (map[string]*registry.ServiceInstance, int64, error) {
+	resp, err := r.client.Get(ctx, r.servicePrefix(serviceName), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
 
-	items := make([]*registry.ServiceInstance, 0, len(resp.Kvs))
+	items := make(map[string]*registry.ServiceInstance, len(resp.Kvs))
 	for _, kv := range resp.Kvs {
-		si := &registry.ServiceInstance{}
-		if err := json.Unmarshal(kv.Value, si); err != nil {
-			r.logger.Warn("解析服务实例失败", log.String("key", string(kv.Key)), log.Err(err))
+		si, err := r.decode(kv.Key, kv.Value)
+		if err != nil {
 			continue
 		}
+		items[string(kv.Key)] = si
+	}
+	return items, resp.Header.Revision, nil
+}
+
+// decode 解析服务实例
+func (r *Registry) decode(key, value []byte) (*registry.ServiceInstance, error) {
+	si := &registry.ServiceInstance{}
+	if err := json.Unmarshal(value, si); err != nil {
+		r.logger.Warn("解析服务实例失败", log.String("key", string(key)), log.Err(err))
+		return nil, err
+	}
+	return si, nil
+}
+
+// sortedInstances 按ID排序并过滤已下线的实例
+func sortedInstances(items map[string]*registry.ServiceInstance) []*registry.ServiceInstance {
+	instances := make([]*registry.ServiceInstance, 0, len(items))
+	for _, si := range items {
 		if si.Status != registry.StatusDown {
-			items = append(items, si)
+			instances = append(instances, si)
 		}
 	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
 
-	return items, nil
+// serviceWatch 是同一服务共享的监视循环
+type serviceWatch struct {
+	hub    *fanout.Hub
+	cancel context.CancelFunc
 }
 
 // Watch 监视服务变更
+// 同一服务的所有观察者共享一个监视循环，每个观察者在自己的ctx结束或调用Stop后停止
 func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
-	prefix := path.Join(r.prefix, serviceName) + "/"
-
-	// 创建一个新的通道
 	r.lock.Lock()
-	ch := make(chan []*registry.ServiceInstance, 10)
-	r.watchChs[serviceName] = ch
+	if sw, ok := r.watchers[serviceName]; ok {
+		w := sw.hub.Subscribe(ctx)
+		r.lock.Unlock()
+		return w, nil
+	}
 	r.lock.Unlock()
 
-	// 先获取当前服务列表
-	services, err := r.GetService(ctx, serviceName)
+	// 先获取当前服务列表和revision
+	items, rev, err := r.list(ctx, serviceName)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(services) > 0 {
-		select {
-		case ch <- services:
-		default:
-			// 避免阻塞
-		}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok {
+		loopCtx, cancel := context.WithCancel(r.ctx)
+		sw = &serviceWatch{cancel: cancel}
+		sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+			r.unwatch(serviceName, hub)
+		})
+		sw.hub.Publish(sortedInstances(items))
+		r.watchers[serviceName] = sw
+		go r.watchLoop(loopCtx, serviceName, items, rev, sw.hub)
+	}
+	return sw.hub.Subscribe(ctx), nil
+}
+
+// unwatch 在服务的最后一个观察者停止后结束共享的监视循环
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
 	}
+	sw.cancel()
+	delete(r.watchers, serviceName)
+}
 
-	// 启动goroutine监视变更
-	watchCh := r.client.Watch(r.ctx, prefix, clientv3.WithPrefix())
-	go func() {
+// watchLoop 从初始读取的revision开始监视服务前缀，增量应用PUT/DELETE事件并分发给所有观察者
+// revision被压缩或监视中断时重新读取全量数据后继续监视
+func (r *Registry) watchLoop(ctx context.Context, serviceName string, items map[string]*registry.ServiceInstance, rev int64, hub *fanout.Hub) {
+	prefix := r.servicePrefix(serviceName)
+	for {
+		watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		watchCh := r.client.Watch(watchCtx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		rev = r.applyEvents(serviceName, watchCh, items, rev, hub)
+		cancel()
+
+		// 监视中断，重新读取全量数据
 		for {
 			select {
-			case <-r.ctx.Done():
+			case <-ctx.Done():
 				return
-			case resp, ok := <-watchCh:
-				if !ok {
-					return
-				}
-				if err := resp.Err(); err != nil {
-					r.logger.Error("监视错误", log.String("service", serviceName), log.Err(err))
-					continue
-				}
-				if len(resp.Events) == 0 {
-					continue
-				}
+			case <-time.After(time.Second):
+			}
+			latest, latestRev, err := r.list(ctx, serviceName)
+			if err != nil {
+				r.logger.Error("获取服务列表失败", log.String("service", serviceName), log.Err(err))
+				continue
+			}
+			items, rev = latest, latestRev
+			hub.Publish(sortedInstances(items))
+			break
+		}
+	}
+}
+
+// applyEvents 持续应用监视事件，监视通道关闭或出错时返回最后处理的revision
+func (r *Registry) applyEvents(serviceName string, watchCh clientv3.WatchChan, items map[string]*registry.ServiceInstance, rev int64, hub *fanout.Hub) int64 {
+	for resp := range watchCh {
+		if err := resp.Err(); err != nil {
+			if !errors.Is(err, rpctypes.ErrCompacted) {
+				r.logger.Error("监视错误", log.String("service", serviceName), log.Err(err))
+			}
+			return rev
+		}
+		if len(resp.Events) == 0 {
+			continue
+		}
 
-				// 获取最新的服务列表
-				services, err := r.GetService(context.Background(), serviceName)
+		for _, ev := range resp.Events {
+			key := string(ev.Kv.Key)
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				si, err := r.decode(ev.Kv.Key, ev.Kv.Value)
 				if err != nil {
-					r.logger.Error("获取服务列表失败", log.String("service", serviceName), log.Err(err))
 					continue
 				}
-
-				// 通知所有观察者
-				r.lock.RLock()
-				ch, ok := r.watchChs[serviceName]
-				r.lock.RUnlock()
-				if ok {
-					select {
-					case ch <- services:
-					default:
-						// 避免阻塞
-					}
-				}
+				items[key] = si
+			case clientv3.EventTypeDelete:
+				delete(items, key)
 			}
 		}
-	}()
-
-	return &watcher{
-		registry: r,
-		ch:       ch,
-		service:  serviceName,
-	}, nil
+		rev = resp.Header.Revision
+		hub.Publish(sortedInstances(items))
+	}
+	return rev
 }
 
-// Stop 停止注册中心
+// Stop 停止注册中心，撤销会话租约，所有观察者随之停止
 func (r *Registry) Stop() error {
+	r.sessionLock.Lock()
+	r.stopped = true
+	session := r.session
+	r.session = nil
+	r.sessionLock.Unlock()
+
+	// 撤销租约需要在取消注册中心ctx之前完成
+	var err error
+	if session != nil {
+		err = session.Close()
+	}
 	r.cancel()
-	return nil
-}
-
-// serviceKey 构建服务实例的key
-func (r *Registry) serviceKey(service *registry.ServiceInstance) string {
-	return path.Join(r.prefix, service.Name, service.ID)
-}
-
-// watcher 是服务监视实现
-type watcher struct {
-	registry *Registry
-	ch       chan []*registry.ServiceInstance
-	service  string
-	done     bool
-}
 
-// Next 等待下一个服务更新
-func (w *watcher) Next() ([]*registry.ServiceInstance, error) {
-	if w.done {
-		return nil, fmt.Errorf("watcher已关闭")
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.watchers))
+	for _, sw := range r.watchers {
+		hubs = append(hubs, sw.hub)
 	}
+	r.lock.Unlock()
 
-	select {
-	case services := <-w.ch:
-		return services, nil
-	case <-w.registry.ctx.Done():
-		return nil, w.registry.ctx.Err()
+	for _, hub := range hubs {
+		hub.Close()
 	}
+	return err
 }
 
-// Stop 停止监视
-func (w *watcher) Stop() error {
-	if w.done {
-		return nil
-	}
-
-	w.registry.lock.Lock()
-	delete(w.registry.watchChs, w.service)
-	w.registry.lock.Unlock()
+// servicePrefix 构建服务的key前缀
+func (r *Registry) servicePrefix(serviceName string) string {
+	return path.Join(r.prefix, serviceName) + "/"
+}
 
-	w.done = true
-	close(w.ch)
-	return nil
+// serviceKey 构建服务实例的key
+func (r *Registry) serviceKey(service *registry.ServiceInstance) string {
+	return path.Join(r.prefix, service.Name, service.ID)
 }
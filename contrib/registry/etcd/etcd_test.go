@@ -0,0 +1,220 @@
+package etcd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/etcdtest"
+	"github.com/dormoron/phantasm/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newTestRegistry(t *testing.T) (*Registry, *etcdtest.Server) {
+	t.Helper()
+	srv := etcdtest.NewServer(t)
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{srv.Endpoint()},
+		DialTimeout: time.Second * 5,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return NewRegistry(client, WithTTL(time.Second*2)), srv
+}
+
+// next 在超时时间内读取观察者的下一次更新
+func next(t *testing.T, w registry.Watcher) []*registry.ServiceInstance {
+	t.Helper()
+	type result struct {
+		items []*registry.ServiceInstance
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		items, err := w.Next()
+		ch <- result{items, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("next: %v", r.err)
+		}
+		return r.items
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for watch update")
+	}
+	return nil
+}
+
+func TestSharedLease(t *testing.T) {
+	r, srv := newTestRegistry(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c"} {
+		ins := &registry.ServiceInstance{ID: id, Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+		if err := r.Register(ctx, ins); err != nil {
+			t.Fatalf("register %s: %v", id, err)
+		}
+	}
+	if n := srv.LeaseCount(t); n != 1 {
+		t.Errorf("expected 1 shared lease, got %d", n)
+	}
+
+	items, err := r.GetService(ctx, "svc")
+	if err != nil || len(items) != 3 {
+		t.Fatalf("get service = %v, %v", items, err)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if n := srv.LeaseCount(t); n != 0 {
+		t.Errorf("expected lease revoked on stop, got %d", n)
+	}
+}
+
+func TestRegisterPutFailure(t *testing.T) {
+	r, _ := newTestRegistry(t)
+	defer r.Stop()
+
+	a := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(context.Background(), a); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// 会话已存在，写入因ctx取消而失败，缓存中不应留下未写入的实例
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := &registry.ServiceInstance{ID: "b", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9001"}}
+	if err := r.Register(ctx, b); err == nil {
+		t.Fatal("register with canceled ctx succeeded")
+	}
+	a2 := &registry.ServiceInstance{ID: "a", Name: "svc", Version: "v2", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, a2); err == nil {
+		t.Fatal("re-register with canceled ctx succeeded")
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if _, ok := r.services["b"]; ok {
+		t.Error("failed registration kept in services")
+	}
+	if r.services["a"] != a {
+		t.Errorf("previous registration not restored: %+v", r.services["a"])
+	}
+}
+
+func TestReregisterAfterSessionLoss(t *testing.T) {
+	r, srv := newTestRegistry(t)
+	defer r.Stop()
+	ctx := context.Background()
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items := next(t, w); len(items) != 1 {
+		t.Fatalf("initial = %v", items)
+	}
+
+	srv.ExpireLeases(t)
+	// 观察者会合并更新，因此只要求最终看到实例被重新注册
+	removed := false
+	for i := 0; i < 10; i++ {
+		items := next(t, w)
+		if len(items) == 0 {
+			removed = true
+			continue
+		}
+		if removed && len(items) == 1 && items[0].ID == "a" {
+			if n := srv.LeaseCount(t); n != 1 {
+				t.Errorf("expected a single new lease, got %d", n)
+			}
+			return
+		}
+	}
+	t.Fatal("instance was not re-registered after session loss")
+}
+
+func TestWatchIncremental(t *testing.T) {
+	r, _ := newTestRegistry(t)
+	defer r.Stop()
+	ctx := context.Background()
+
+	a := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, a); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	w1, err := r.Watch(watchCtx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	w2, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w2.Stop()
+	next(t, w1)
+	next(t, w2)
+
+	b := &registry.ServiceInstance{ID: "b", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9001"}}
+	if err := r.Register(ctx, b); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if items := next(t, w1); len(items) != 2 {
+		t.Fatalf("w1 after put = %v", items)
+	}
+	if items := next(t, w2); len(items) != 2 {
+		t.Fatalf("w2 after put = %v", items)
+	}
+
+	cancel()
+	if _, err := w1.Next(); err == nil {
+		t.Error("expected error after watch ctx canceled")
+	}
+
+	if err := r.Deregister(ctx, a); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if items := next(t, w2); len(items) != 1 || items[0].ID != "b" {
+		t.Fatalf("w2 after delete = %v", items)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	srv := etcdtest.NewServer(t)
+	r, err := registry.Open("etcd://" + srv.Endpoint() + "/custom?ttl=3s&timeout=5s")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	owned := r.(ownedRegistry)
+	if owned.prefix != "/custom" || owned.ttl != 3 {
+		t.Errorf("prefix = %q, ttl = %d", owned.prefix, owned.ttl)
+	}
+
+	ctx := context.Background()
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if got, err := r.GetService(ctx, "svc"); err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	if err := owned.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := owned.client.Get(ctx, "/custom"); err == nil {
+		t.Error("expected client to be closed")
+	}
+}
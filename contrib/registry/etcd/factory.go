@@ -0,0 +1,61 @@
+package etcd
+
+import (
+	"crypto/tls"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	registry.RegisterFactory(registry.Etcd, newFromConfig)
+}
+
+// ownedRegistry 是由工厂创建的注册中心，停止时关闭工厂创建的客户端
+type ownedRegistry struct {
+	*Registry
+}
+
+// Stop 停止注册中心并关闭客户端
+func (r ownedRegistry) Stop() error {
+	err := r.Registry.Stop()
+	if cerr := r.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newFromConfig 根据通用配置创建etcd注册中心，支持的参数：ttl（租约有效期）
+func newFromConfig(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, registry.ErrNoEndpoints
+	}
+	ttl, err := cfg.DurationParam("ttl")
+	if err != nil {
+		return nil, err
+	}
+
+	clientCfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.Timeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+	if cfg.TLSEnabled {
+		clientCfg.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client, err := clientv3.New(clientCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []Option
+	if cfg.Prefix != "" && cfg.Prefix != "/" {
+		opts = append(opts, WithPrefix(cfg.Prefix))
+	}
+	if ttl > 0 {
+		opts = append(opts, WithTTL(ttl))
+	}
+	return ownedRegistry{NewRegistry(client, opts...)}, nil
+}
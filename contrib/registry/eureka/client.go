@@ -0,0 +1,159 @@
+package eureka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Eureka的REST API使用XStream风格的JSON：
+// 端口写作{"$": 8080, "@enabled": "true"}，标量可能是字符串或数字，只有一个元素的列表可能直接是对象
+
+// dataCenterClass 是Eureka默认数据中心信息的类型
+const dataCenterClass = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
+
+// scalar 接受字符串、数字或布尔值，统一保存为字符串
+type scalar string
+
+// UnmarshalJSON 实现json.Unmarshaler
+func (s *scalar) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*s = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var v string
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*s = scalar(v)
+		return nil
+	}
+	*s = scalar(data)
+	return nil
+}
+
+// Int64 将标量解析为整数，解析失败时返回0
+func (s scalar) Int64() int64 {
+	v, _ := strconv.ParseInt(string(s), 10, 64)
+	return v
+}
+
+// list 接受JSON数组或单个对象
+type list[T any] []T
+
+// UnmarshalJSON 实现json.Unmarshaler
+func (l *list[T]) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		*l = nil
+		return nil
+	}
+	if data[0] == '[' {
+		var items []T
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		*l = items
+		return nil
+	}
+	var item T
+	if err := json.Unmarshal(data, &item); err != nil {
+		return err
+	}
+	*l = list[T]{item}
+	return nil
+}
+
+// portInfo 是Eureka实例的端口
+type portInfo struct {
+	Port    scalar `json:"$"`
+	Enabled scalar `json:"@enabled"`
+}
+
+// enabled 返回端口是否启用
+func (p *portInfo) enabled() bool {
+	return p != nil && p.Enabled == "true" && p.Port.Int64() > 0
+}
+
+// dataCenterInfo 是Eureka实例的数据中心信息
+type dataCenterInfo struct {
+	Class string `json:"@class"`
+	Name  string `json:"name"`
+}
+
+// leaseInfo 是Eureka实例的租约信息
+type leaseInfo struct {
+	RenewalIntervalInSecs int    `json:"renewalIntervalInSecs,omitempty"`
+	DurationInSecs        int    `json:"durationInSecs,omitempty"`
+	RegistrationTimestamp scalar `json:"registrationTimestamp,omitempty"`
+}
+
+// instanceInfo 是Eureka的实例信息
+type instanceInfo struct {
+	InstanceID           string            `json:"instanceId"`
+	HostName             string            `json:"hostName"`
+	App                  string            `json:"app"`
+	IPAddr               string            `json:"ipAddr"`
+	Status               string            `json:"status"`
+	OverriddenStatus     string            `json:"overriddenStatus,omitempty"`
+	Port                 *portInfo         `json:"port,omitempty"`
+	SecurePort           *portInfo         `json:"securePort,omitempty"`
+	CountryID            int               `json:"countryId"`
+	DataCenterInfo       dataCenterInfo    `json:"dataCenterInfo"`
+	LeaseInfo            *leaseInfo        `json:"leaseInfo,omitempty"`
+	Metadata             map[string]string `json:"metadata,omitempty"`
+	HomePageURL          string            `json:"homePageUrl,omitempty"`
+	VipAddress           string            `json:"vipAddress,omitempty"`
+	SecureVipAddress     string            `json:"secureVipAddress,omitempty"`
+	LastUpdatedTimestamp scalar            `json:"lastUpdatedTimestamp,omitempty"`
+	LastDirtyTimestamp   scalar            `json:"lastDirtyTimestamp,omitempty"`
+	ActionType           string            `json:"actionType,omitempty"`
+}
+
+// application 是Eureka的应用，包含该应用的全部实例
+type application struct {
+	Name     string             `json:"name"`
+	Instance list[instanceInfo] `json:"instance"`
+}
+
+// applications 是全量或增量拉取的结果
+type applications struct {
+	VersionsDelta scalar            `json:"versions__delta"`
+	AppsHashcode  string            `json:"apps__hashcode"`
+	Application   list[application] `json:"application"`
+}
+
+// applicationsResponse 是/apps和/apps/delta的响应
+type applicationsResponse struct {
+	Applications applications `json:"applications"`
+}
+
+// instanceRequest 是注册请求体
+type instanceRequest struct {
+	Instance *instanceInfo `json:"instance"`
+}
+
+// hashcode 按Eureka的规则计算实例状态的校验码，例如DOWN_1_UP_3_
+func hashcode(apps map[string]map[string]*instanceInfo) string {
+	counts := make(map[string]int)
+	for _, instances := range apps {
+		for _, info := range instances {
+			counts[info.Status]++
+		}
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	var b strings.Builder
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "%s_%d_", status, counts[status])
+	}
+	return b.String()
+}
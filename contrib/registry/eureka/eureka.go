@@ -0,0 +1,673 @@
+package eureka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.ServiceRegistrar = (*Registry)(nil)
+)
+
+const (
+	// metaEndpoints 是元数据中保存全部端点的键，多个端点以逗号分隔
+	metaEndpoints = "phantasm-endpoints"
+	// metaVersion 是元数据中保存服务版本的键
+	metaVersion = "phantasm-version"
+)
+
+// Registry 是基于Eureka REST API的服务注册发现中心
+// 注册的实例定期续约，服务发现在本地维护全量注册表并通过增量拉取更新
+type Registry struct {
+	servers    []string
+	client     *http.Client
+	options    *Options
+	ctx        context.Context
+	cancel     context.CancelFunc
+	lock       sync.RWMutex
+	heartbeats map[string]context.CancelFunc       // 已注册实例到续约循环的映射
+	watchers   map[string]*serviceWatch            // 服务名称到观察者分发器的映射
+	apps       map[string]map[string]*instanceInfo // 本地注册表，应用名称到实例ID到实例的映射
+	fetchLock  sync.Mutex                          // 串行化拉取操作
+	logger     log.Logger
+}
+
+// Options 是Eureka注册中心的选项
+type Options struct {
+	RenewalInterval time.Duration // 续约间隔
+	LeaseDuration   time.Duration // 租约有效期，超过该时间未续约的实例会被Eureka剔除
+	FetchInterval   time.Duration // 增量拉取间隔
+	HTTPClient      *http.Client
+	Logger          log.Logger
+}
+
+// Option 是Eureka注册中心的选项函数
+type Option func(*Options)
+
+// WithRenewalInterval 设置续约间隔
+func WithRenewalInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.RenewalInterval = interval
+	}
+}
+
+// WithLeaseDuration 设置租约有效期
+func WithLeaseDuration(duration time.Duration) Option {
+	return func(o *Options) {
+		o.LeaseDuration = duration
+	}
+}
+
+// WithFetchInterval 设置增量拉取间隔
+func WithFetchInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.FetchInterval = interval
+	}
+}
+
+// WithHTTPClient 设置HTTP客户端
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *Options) {
+		o.HTTPClient = client
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewRegistry 创建Eureka注册中心实例
+// servers是Eureka服务端的地址，例如http://127.0.0.1:8761/eureka，请求失败时依次尝试下一个地址
+func NewRegistry(servers []string, opts ...Option) *Registry {
+	options := &Options{
+		RenewalInterval: time.Second * 30,
+		LeaseDuration:   time.Second * 90,
+		FetchInterval:   time.Second * 30,
+		HTTPClient:      &http.Client{Timeout: time.Second * 10},
+		Logger:          log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	trimmed := make([]string, 0, len(servers))
+	for _, s := range servers {
+		trimmed = append(trimmed, strings.TrimRight(s, "/"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Registry{
+		servers:    trimmed,
+		client:     options.HTTPClient,
+		options:    options,
+		ctx:        ctx,
+		cancel:     cancel,
+		lock:       sync.RWMutex{},
+		heartbeats: make(map[string]context.CancelFunc),
+		watchers:   make(map[string]*serviceWatch),
+		logger:     options.Logger,
+	}
+}
+
+// Register 注册服务实例并启动续约循环
+func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	if service.Status == "" {
+		service.Status = registry.StatusUp
+	}
+	if err := r.register(ctx, service); err != nil {
+		return err
+	}
+
+	key := instanceKey(service)
+	hbCtx, cancel := context.WithCancel(r.ctx)
+	r.lock.Lock()
+	if stop, ok := r.heartbeats[key]; ok {
+		stop()
+	}
+	r.heartbeats[key] = cancel
+	r.lock.Unlock()
+
+	go r.heartbeat(hbCtx, service)
+	return nil
+}
+
+// register 向Eureka提交实例信息，OUT_OF_SERVICE状态需要额外设置覆盖状态才会生效
+func (r *Registry) register(ctx context.Context, service *registry.ServiceInstance) error {
+	info, err := r.toInstanceInfo(service)
+	if err != nil {
+		return err
+	}
+	app := appName(service.Name)
+	code, err := r.request(ctx, http.MethodPost, "/apps/"+app, &instanceRequest{Instance: info}, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("eureka: register %s/%s: unexpected status %d", app, service.ID, code)
+	}
+
+	if service.Status == registry.StatusOutOfService {
+		return r.setStatus(ctx, service, "OUT_OF_SERVICE")
+	}
+	return nil
+}
+
+// setStatus 设置实例的覆盖状态
+func (r *Registry) setStatus(ctx context.Context, service *registry.ServiceInstance, status string) error {
+	path := fmt.Sprintf("/apps/%s/%s/status?value=%s", appName(service.Name), url.PathEscape(service.ID), status)
+	code, err := r.request(ctx, http.MethodPut, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 {
+		return fmt.Errorf("eureka: set status of %s: unexpected status %d", service.ID, code)
+	}
+	return nil
+}
+
+// heartbeat 定期续约，Eureka返回404时说明实例已被剔除，需要重新注册
+func (r *Registry) heartbeat(ctx context.Context, service *registry.ServiceInstance) {
+	ticker := time.NewTicker(r.options.RenewalInterval)
+	defer ticker.Stop()
+
+	path := fmt.Sprintf("/apps/%s/%s?status=%s", appName(service.Name), url.PathEscape(service.ID), toEurekaStatus(service.Status))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		code, err := r.request(ctx, http.MethodPut, path, nil, nil)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Warn("续约失败", log.String("service", service.Name), log.String("id", service.ID), log.Err(err))
+			}
+			continue
+		}
+		if code == http.StatusNotFound {
+			r.logger.Info("实例已被Eureka剔除，重新注册", log.String("service", service.Name), log.String("id", service.ID))
+			if err := r.register(ctx, service); err != nil && ctx.Err() == nil {
+				r.logger.Error("重新注册失败", log.String("service", service.Name), log.String("id", service.ID), log.Err(err))
+			}
+		}
+	}
+}
+
+// Deregister 停止续约并注销服务实例
+func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	key := instanceKey(service)
+	r.lock.Lock()
+	if stop, ok := r.heartbeats[key]; ok {
+		stop()
+		delete(r.heartbeats, key)
+	}
+	r.lock.Unlock()
+
+	path := fmt.Sprintf("/apps/%s/%s", appName(service.Name), url.PathEscape(service.ID))
+	code, err := r.request(ctx, http.MethodDelete, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	if code/100 != 2 && code != http.StatusNotFound {
+		return fmt.Errorf("eureka: deregister %s: unexpected status %d", service.ID, code)
+	}
+	return nil
+}
+
+// GetService 获取服务实例列表
+// 第一次调用时全量拉取注册表并启动增量拉取循环，之后直接读取本地注册表
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	if err := r.ensureFetched(ctx); err != nil {
+		return nil, err
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.instancesOf(serviceName), nil
+}
+
+// ensureFetched 确保本地注册表已初始化
+func (r *Registry) ensureFetched(ctx context.Context) error {
+	r.fetchLock.Lock()
+	defer r.fetchLock.Unlock()
+
+	r.lock.RLock()
+	fetched := r.apps != nil
+	r.lock.RUnlock()
+	if fetched {
+		return nil
+	}
+
+	if err := r.fullFetch(ctx); err != nil {
+		return err
+	}
+	go r.fetchLoop()
+	return nil
+}
+
+// fetchLoop 定期增量拉取注册表
+func (r *Registry) fetchLoop() {
+	ticker := time.NewTicker(r.options.FetchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.fetchLock.Lock()
+		err := r.deltaFetch(r.ctx)
+		r.fetchLock.Unlock()
+		if err != nil && r.ctx.Err() == nil {
+			r.logger.Warn("增量拉取注册表失败", log.Err(err))
+		}
+	}
+}
+
+// fullFetch 全量拉取注册表，调用方需持有fetchLock
+func (r *Registry) fullFetch(ctx context.Context) error {
+	resp := &applicationsResponse{}
+	code, err := r.request(ctx, http.MethodGet, "/apps", nil, resp)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("eureka: fetch registry: unexpected status %d", code)
+	}
+
+	apps := make(map[string]map[string]*instanceInfo)
+	for _, app := range resp.Applications.Application {
+		instances := make(map[string]*instanceInfo, len(app.Instance))
+		for i := range app.Instance {
+			info := &app.Instance[i]
+			instances[instanceID(info)] = info
+		}
+		apps[strings.ToUpper(app.Name)] = instances
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.apps = apps
+	r.notify(nil)
+	return nil
+}
+
+// deltaFetch 增量拉取注册表并应用变更，校验码不一致时退回全量拉取，调用方需持有fetchLock
+func (r *Registry) deltaFetch(ctx context.Context) error {
+	resp := &applicationsResponse{}
+	code, err := r.request(ctx, http.MethodGet, "/apps/delta", nil, resp)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("eureka: fetch delta: unexpected status %d", code)
+	}
+
+	r.lock.Lock()
+	touched := make(map[string]bool)
+	for _, app := range resp.Applications.Application {
+		for i := range app.Instance {
+			info := &app.Instance[i]
+			name := strings.ToUpper(info.App)
+			if name == "" {
+				name = strings.ToUpper(app.Name)
+			}
+			touched[name] = true
+
+			instances, ok := r.apps[name]
+			if !ok {
+				instances = make(map[string]*instanceInfo)
+				r.apps[name] = instances
+			}
+			switch info.ActionType {
+			case "DELETED":
+				delete(instances, instanceID(info))
+				if len(instances) == 0 {
+					delete(r.apps, name)
+				}
+			default:
+				instances[instanceID(info)] = info
+			}
+		}
+	}
+	consistent := resp.Applications.AppsHashcode == "" || resp.Applications.AppsHashcode == hashcode(r.apps)
+	if consistent {
+		r.notify(touched)
+	}
+	r.lock.Unlock()
+
+	if !consistent {
+		// 本地注册表与服务端不一致，重新全量拉取
+		return r.fullFetch(ctx)
+	}
+	return nil
+}
+
+// notify 向变更应用的观察者发布最新实例列表，touched为nil时检查全部观察者，调用方需持有锁
+func (r *Registry) notify(touched map[string]bool) {
+	for serviceName, sw := range r.watchers {
+		if touched != nil && !touched[appName(serviceName)] {
+			continue
+		}
+		instances := r.instancesOf(serviceName)
+		if sw.published && reflect.DeepEqual(sw.last, instances) {
+			continue
+		}
+		sw.last, sw.published = instances, true
+		sw.hub.Publish(instances)
+	}
+}
+
+// instancesOf 从本地注册表读取服务的可用实例，只保留UP状态的实例，调用方需持有锁
+// OUT_OF_SERVICE、DOWN、STARTING等状态的实例不接收流量，与Eureka客户端默认只返回UP实例一致
+func (r *Registry) instancesOf(serviceName string) []*registry.ServiceInstance {
+	infos := r.apps[appName(serviceName)]
+	instances := make([]*registry.ServiceInstance, 0, len(infos))
+	for _, info := range infos {
+		si := toServiceInstance(serviceName, info)
+		if si.Status != registry.StatusUp {
+			continue
+		}
+		instances = append(instances, si)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
+
+// serviceWatch 是同一服务共享的观察者分发器
+type serviceWatch struct {
+	hub       *fanout.Hub
+	last      []*registry.ServiceInstance
+	published bool
+}
+
+// Watch 监视服务变更
+// 所有观察者共享一个增量拉取循环，实例列表变化时才会通知观察者
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	if err := r.ensureFetched(ctx); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok {
+		sw = &serviceWatch{}
+		sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+			r.unwatch(serviceName, hub)
+		})
+		r.watchers[serviceName] = sw
+		sw.last, sw.published = r.instancesOf(serviceName), true
+		sw.hub.Publish(sw.last)
+	}
+	return sw.hub.Subscribe(ctx), nil
+}
+
+// unwatch 在服务的最后一个观察者停止后移除分发器
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
+	}
+	delete(r.watchers, serviceName)
+}
+
+// Stop 停止注册中心，停止续约和增量拉取，所有观察者随之停止
+func (r *Registry) Stop() error {
+	r.cancel()
+
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.watchers))
+	for _, sw := range r.watchers {
+		hubs = append(hubs, sw.hub)
+	}
+	r.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.Close()
+	}
+	return nil
+}
+
+// request 发送请求，网络错误或5xx响应时依次尝试下一个服务端，out不为nil时解析2xx响应体
+func (r *Registry) request(ctx context.Context, method, path string, body, out interface{}) (int, error) {
+	var payload []byte
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		payload = data
+	}
+
+	lastErr := errors.New("eureka: no server available")
+	for _, server := range r.servers {
+		var reader io.Reader
+		if payload != nil {
+			reader = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, server+path, reader)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return 0, err
+			}
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			lastErr = fmt.Errorf("eureka: %s %s%s: %s", method, server, path, resp.Status)
+			continue
+		}
+
+		if out != nil && resp.StatusCode/100 == 2 {
+			err = json.NewDecoder(resp.Body).Decode(out)
+		} else {
+			_, _ = io.Copy(io.Discard, resp.Body)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, err
+	}
+	return 0, lastErr
+}
+
+// toInstanceInfo 将服务实例转换为Eureka实例
+// Eureka只能表达一个非安全端口和一个安全端口，全部端点和版本保存在元数据中以便完整还原
+func (r *Registry) toInstanceInfo(service *registry.ServiceInstance) (*instanceInfo, error) {
+	if len(service.Endpoints) == 0 {
+		return nil, fmt.Errorf("eureka: service %s has no endpoints", service.ID)
+	}
+
+	var host string
+	var port, securePort int
+	for _, e := range service.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, err
+		}
+		h, p, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("eureka: invalid endpoint %s: %w", e, err)
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("eureka: invalid endpoint %s: %w", e, err)
+		}
+		if host == "" {
+			host = h
+		}
+		switch {
+		case u.Scheme == "https" && securePort == 0:
+			securePort = n
+		case u.Scheme == "http" && port == 0:
+			port = n
+		}
+	}
+	if port == 0 && securePort == 0 {
+		// 没有http(s)端点时使用第一个端点的端口
+		u, _ := url.Parse(service.Endpoints[0])
+		port, _ = strconv.Atoi(u.Port())
+	}
+
+	metadata := make(map[string]string, len(service.Metadata)+2)
+	for k, v := range service.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaEndpoints] = strings.Join(service.Endpoints, ",")
+	if service.Version != "" {
+		metadata[metaVersion] = service.Version
+	}
+
+	now := scalar(strconv.FormatInt(time.Now().UnixMilli(), 10))
+	info := &instanceInfo{
+		InstanceID:       service.ID,
+		HostName:         host,
+		App:              appName(service.Name),
+		IPAddr:           host,
+		Status:           toEurekaStatus(service.Status),
+		OverriddenStatus: "UNKNOWN",
+		Port:             &portInfo{Port: scalar(strconv.Itoa(port)), Enabled: scalar(strconv.FormatBool(port > 0))},
+		SecurePort:       &portInfo{Port: scalar(strconv.Itoa(securePort)), Enabled: scalar(strconv.FormatBool(securePort > 0))},
+		CountryID:        1,
+		DataCenterInfo:   dataCenterInfo{Class: dataCenterClass, Name: "MyOwn"},
+		LeaseInfo: &leaseInfo{
+			RenewalIntervalInSecs: int(r.options.RenewalInterval.Seconds()),
+			DurationInSecs:        int(r.options.LeaseDuration.Seconds()),
+		},
+		Metadata:           metadata,
+		VipAddress:         service.Name,
+		SecureVipAddress:   service.Name,
+		LastDirtyTimestamp: now,
+	}
+	if port > 0 {
+		info.HomePageURL = "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/"
+	}
+	return info, nil
+}
+
+// toServiceInstance 将Eureka实例转换为服务实例
+// 非Phantasm注册的实例根据启用的端口还原http/https端点
+func toServiceInstance(serviceName string, info *instanceInfo) *registry.ServiceInstance {
+	si := &registry.ServiceInstance{
+		ID:       instanceID(info),
+		Name:     serviceName,
+		Metadata: make(map[string]string, len(info.Metadata)),
+		Status:   fromEurekaStatus(info.Status),
+	}
+	for k, v := range info.Metadata {
+		switch {
+		case k == metaEndpoints:
+			si.Endpoints = strings.Split(v, ",")
+		case k == metaVersion:
+			si.Version = v
+		case strings.HasPrefix(k, "@"):
+			// Java序列化的类型信息
+		default:
+			si.Metadata[k] = v
+		}
+	}
+
+	if len(si.Endpoints) == 0 {
+		host := info.IPAddr
+		if host == "" {
+			host = info.HostName
+		}
+		if info.Port.enabled() {
+			si.Endpoints = append(si.Endpoints, "http://"+net.JoinHostPort(host, string(info.Port.Port)))
+		}
+		if info.SecurePort.enabled() {
+			si.Endpoints = append(si.Endpoints, "https://"+net.JoinHostPort(host, string(info.SecurePort.Port)))
+		}
+	}
+
+	if info.LeaseInfo != nil {
+		if ts := info.LeaseInfo.RegistrationTimestamp.Int64(); ts > 0 {
+			si.CreatedAt = time.UnixMilli(ts)
+		}
+	}
+	if ts := info.LastUpdatedTimestamp.Int64(); ts > 0 {
+		si.UpdatedAt = time.UnixMilli(ts)
+	}
+	return si
+}
+
+// toEurekaStatus 将服务实例状态转换为Eureka状态
+func toEurekaStatus(status registry.ServiceInstanceStatus) string {
+	switch status {
+	case registry.StatusDown:
+		return "DOWN"
+	case registry.StatusOutOfService:
+		return "OUT_OF_SERVICE"
+	case registry.StatusUnknown:
+		return "UNKNOWN"
+	default:
+		return "UP"
+	}
+}
+
+// fromEurekaStatus 将Eureka状态转换为服务实例状态，STARTING等其他状态视为未知
+func fromEurekaStatus(status string) registry.ServiceInstanceStatus {
+	switch status {
+	case "UP":
+		return registry.StatusUp
+	case "DOWN":
+		return registry.StatusDown
+	case "OUT_OF_SERVICE":
+		return registry.StatusOutOfService
+	default:
+		return registry.StatusUnknown
+	}
+}
+
+// appName 返回服务对应的Eureka应用名称，Eureka的应用名称不区分大小写并以大写保存
+func appName(serviceName string) string {
+	return strings.ToUpper(serviceName)
+}
+
+// instanceID 返回Eureka实例的ID，旧版本的实例没有instanceId时使用主机名
+func instanceID(info *instanceInfo) string {
+	if info.InstanceID != "" {
+		return info.InstanceID
+	}
+	return info.HostName
+}
+
+// instanceKey 返回服务实例在续约表中的键
+func instanceKey(service *registry.ServiceInstance) string {
+	return appName(service.Name) + "/" + service.ID
+}
@@ -0,0 +1,350 @@
+package eureka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+// fakeServer 是一个最小化的Eureka REST API替身
+type fakeServer struct {
+	lock       sync.Mutex
+	apps       map[string]map[string]*instanceInfo
+	recent     []instanceInfo // 上次增量拉取后的变更
+	heartbeats map[string]int
+	fullFetch  int
+	badHash    bool // 下一次增量拉取返回错误的校验码
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, string) {
+	f := &fakeServer{
+		apps:       make(map[string]map[string]*instanceInfo),
+		heartbeats: make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL + "/eureka"
+}
+
+// put 保存实例并记录变更，调用方需持有锁
+func (f *fakeServer) put(info *instanceInfo, action string) {
+	if f.apps[info.App] == nil {
+		f.apps[info.App] = make(map[string]*instanceInfo)
+	}
+	f.apps[info.App][info.InstanceID] = info
+	change := *info
+	change.ActionType = action
+	f.recent = append(f.recent, change)
+}
+
+func (f *fakeServer) setStatus(app, id, status string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	info := *f.apps[app][id]
+	info.Status = status
+	f.put(&info, "MODIFIED")
+}
+
+func (f *fakeServer) evict(app, id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	info := f.apps[app][id]
+	delete(f.apps[app], id)
+	change := *info
+	change.ActionType = "DELETED"
+	f.recent = append(f.recent, change)
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/eureka/apps"), "/")
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/eureka/apps":
+		f.fullFetch++
+		f.writeApps(w, f.all(), hashcode(f.apps))
+	case req.Method == http.MethodGet && req.URL.Path == "/eureka/apps/delta":
+		hash := hashcode(f.apps)
+		if f.badHash {
+			hash, f.badHash = "UP_999_", false
+		}
+		f.writeApps(w, f.recent, hash)
+		f.recent = nil
+	case req.Method == http.MethodPost && len(parts) == 2:
+		body := &instanceRequest{}
+		if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.put(body.Instance, "ADDED")
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPut && len(parts) == 3:
+		if f.apps[parts[1]][parts[2]] == nil {
+			http.NotFound(w, req)
+			return
+		}
+		f.heartbeats[parts[2]]++
+	case req.Method == http.MethodPut && len(parts) == 4 && parts[3] == "status":
+		info := *f.apps[parts[1]][parts[2]]
+		info.Status = req.URL.Query().Get("value")
+		f.put(&info, "MODIFIED")
+	case req.Method == http.MethodDelete && len(parts) == 3:
+		info, ok := f.apps[parts[1]][parts[2]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		delete(f.apps[parts[1]], parts[2])
+		change := *info
+		change.ActionType = "DELETED"
+		f.recent = append(f.recent, change)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeServer) all() []instanceInfo {
+	var all []instanceInfo
+	for _, instances := range f.apps {
+		for _, info := range instances {
+			all = append(all, *info)
+		}
+	}
+	return all
+}
+
+func (f *fakeServer) writeApps(w http.ResponseWriter, instances []instanceInfo, hash string) {
+	grouped := make(map[string]*application)
+	var apps list[application]
+	for _, info := range instances {
+		app, ok := grouped[info.App]
+		if !ok {
+			apps = append(apps, application{Name: info.App})
+			app = &apps[len(apps)-1]
+			grouped[info.App] = app
+		}
+		app.Instance = append(app.Instance, info)
+	}
+	resp := applicationsResponse{Applications: applications{VersionsDelta: "1", AppsHashcode: hash, Application: apps}}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeServer) count(id string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.heartbeats[id]
+}
+
+func (f *fakeServer) has(app, id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.apps[app][id] != nil
+}
+
+// eventually 在超时前反复检查条件
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal(msg)
+}
+
+func TestRegisterRenewDeregister(t *testing.T) {
+	f, addr := newFakeServer(t)
+	r := NewRegistry([]string{addr}, WithRenewalInterval(time.Millisecond*20))
+	defer r.Stop()
+	ctx := context.Background()
+
+	ins := &registry.ServiceInstance{ID: "greeter-1", Name: "greeter", Endpoints: []string{"http://10.0.0.1:8000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	eventually(t, func() bool { return f.count("greeter-1") >= 2 }, "expected repeated renewals")
+
+	// 实例被剔除后续约返回404，应当重新注册
+	f.evict("GREETER", "greeter-1")
+	eventually(t, func() bool { return f.has("GREETER", "greeter-1") }, "expected re-registration after eviction")
+
+	if err := r.Deregister(ctx, ins); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if f.has("GREETER", "greeter-1") {
+		t.Fatal("expected instance removed")
+	}
+	beats := f.count("greeter-1")
+	time.Sleep(time.Millisecond * 60)
+	if f.count("greeter-1") != beats {
+		t.Error("expected renewals to stop after deregister")
+	}
+}
+
+func TestDeltaWatch(t *testing.T) {
+	f, addr := newFakeServer(t)
+	// Java服务注册的实例
+	f.lock.Lock()
+	f.put(&instanceInfo{
+		InstanceID: "orders-java", App: "ORDERS", IPAddr: "10.0.0.2", Status: "UP",
+		Port:       &portInfo{Port: "8080", Enabled: "true"},
+		SecurePort: &portInfo{Port: "8443", Enabled: "true"},
+		Metadata:   map[string]string{"@class": "java.util.Collections$EmptyMap", "zone": "b"},
+	}, "ADDED")
+	f.recent = nil
+	f.lock.Unlock()
+
+	r := NewRegistry([]string{addr}, WithFetchInterval(time.Millisecond*20), WithRenewalInterval(time.Hour))
+	defer r.Stop()
+	ctx := context.Background()
+
+	got, err := r.GetService(ctx, "orders")
+	if err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	if want := []string{"http://10.0.0.2:8080", "https://10.0.0.2:8443"}; !reflect.DeepEqual(got[0].Endpoints, want) {
+		t.Errorf("endpoints = %v, want %v", got[0].Endpoints, want)
+	}
+	if !reflect.DeepEqual(got[0].Metadata, map[string]string{"zone": "b"}) {
+		t.Errorf("metadata = %v", got[0].Metadata)
+	}
+
+	w, err := r.Watch(ctx, "orders")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items, err := w.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("initial next = %v, %v", items, err)
+	}
+
+	ins := &registry.ServiceInstance{
+		ID: "orders-go", Name: "orders", Version: "v2",
+		Endpoints: []string{"grpc://10.0.0.3:9000", "http://10.0.0.3:8000"},
+	}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	items, err := w.Next()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("next after register = %v, %v", items, err)
+	}
+	if items[0].Version != "v2" || !reflect.DeepEqual(items[0].Endpoints, ins.Endpoints) {
+		t.Errorf("registered instance = %+v", items[0])
+	}
+
+	// 停止接收流量的实例从列表中移除，恢复UP后重新出现
+	f.setStatus("ORDERS", "orders-java", "OUT_OF_SERVICE")
+	items, err = w.Next()
+	if err != nil || len(items) != 1 || items[0].ID != "orders-go" {
+		t.Fatalf("next after out of service = %v, %v", items, err)
+	}
+
+	f.setStatus("ORDERS", "orders-java", "UP")
+	items, err = w.Next()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("next after up = %v, %v", items, err)
+	}
+
+	f.setStatus("ORDERS", "orders-java", "DOWN")
+	items, err = w.Next()
+	if err != nil || len(items) != 1 || items[0].ID != "orders-go" {
+		t.Fatalf("next after down = %v, %v", items, err)
+	}
+}
+
+func TestHashMismatchRefetches(t *testing.T) {
+	f, addr := newFakeServer(t)
+	r := NewRegistry([]string{addr}, WithFetchInterval(time.Millisecond*20))
+	defer r.Stop()
+
+	if _, err := r.GetService(context.Background(), "svc"); err != nil {
+		t.Fatalf("get service: %v", err)
+	}
+	f.lock.Lock()
+	f.badHash = true
+	f.lock.Unlock()
+
+	eventually(t, func() bool {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.fullFetch >= 2
+	}, "expected full fetch after hashcode mismatch")
+}
+
+func TestRegisterStatus(t *testing.T) {
+	f, addr := newFakeServer(t)
+	r := NewRegistry([]string{addr}, WithRenewalInterval(time.Hour))
+	defer r.Stop()
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Status: registry.StatusOutOfService, Endpoints: []string{"https://10.0.0.1:443"}}
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	f.lock.Lock()
+	info := f.apps["SVC"]["a"]
+	f.lock.Unlock()
+	if info.Status != "OUT_OF_SERVICE" || !info.SecurePort.enabled() || info.Port.enabled() {
+		t.Errorf("unexpected instance: %+v", info)
+	}
+}
+
+func TestDecodeSingleElementLists(t *testing.T) {
+	data := []byte(`{"applications":{"apps__hashcode":"UP_1_","application":{"name":"ORDERS",
+		"instance":{"instanceId":"a","app":"ORDERS","ipAddr":"10.0.0.1","status":"UP",
+		"port":{"$":"8080","@enabled":true},"lastUpdatedTimestamp":"1700000000000"}}}}`)
+	resp := &applicationsResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	apps := resp.Applications.Application
+	if len(apps) != 1 || len(apps[0].Instance) != 1 {
+		t.Fatalf("applications = %+v", apps)
+	}
+	si := toServiceInstance("orders", &apps[0].Instance[0])
+	if !reflect.DeepEqual(si.Endpoints, []string{"http://10.0.0.1:8080"}) || si.UpdatedAt.UnixMilli() != 1700000000000 {
+		t.Errorf("instance = %+v", si)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	var (
+		lock sync.Mutex
+		user string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		user, _, _ = req.BasicAuth()
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	r, err := registry.Open("eureka://admin:secret@" + strings.TrimPrefix(srv.URL, "http://") + "?renew=1h")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.(*Registry).Stop()
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"http://10.0.0.1:8000"}}
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if user != "admin" {
+		t.Errorf("basic auth user = %q", user)
+	}
+}
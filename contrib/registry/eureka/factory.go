@@ -0,0 +1,57 @@
+package eureka
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	registry.RegisterFactory(registry.Eureka, newFromConfig)
+}
+
+// newFromConfig 根据通用配置创建Eureka注册中心，前缀是Eureka服务的上下文路径，默认为/eureka
+// 支持的参数：renew（续约间隔）、fetch（拉取间隔）
+func newFromConfig(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, registry.ErrNoEndpoints
+	}
+	renew, err := cfg.DurationParam("renew")
+	if err != nil {
+		return nil, err
+	}
+	fetch, err := cfg.DurationParam("fetch")
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, path := "http", cfg.Prefix
+	if cfg.TLSEnabled {
+		scheme = "https"
+	}
+	if path == "" || path == "/" {
+		path = "/eureka"
+	}
+	servers := make([]string, 0, len(cfg.Endpoints))
+	for _, endpoint := range cfg.Endpoints {
+		u := &url.URL{Scheme: scheme, Host: endpoint, Path: path}
+		if cfg.Username != "" {
+			// http.Client会将URL中的用户信息作为Basic认证发送
+			u.User = url.UserPassword(cfg.Username, cfg.Password)
+		}
+		servers = append(servers, u.String())
+	}
+
+	var opts []Option
+	if cfg.Timeout > 0 {
+		opts = append(opts, WithHTTPClient(&http.Client{Timeout: cfg.Timeout}))
+	}
+	if renew > 0 {
+		opts = append(opts, WithRenewalInterval(renew))
+	}
+	if fetch > 0 {
+		opts = append(opts, WithFetchInterval(fetch))
+	}
+	return NewRegistry(servers, opts...), nil
+}
@@ -0,0 +1,247 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.Discovery = (*Registry)(nil)
+)
+
+// instance 是文件中的一个服务实例
+type instance struct {
+	ID        string            `yaml:"id" json:"id"`
+	Version   string            `yaml:"version" json:"version"`
+	Endpoints []string          `yaml:"endpoints" json:"endpoints"`
+	Metadata  map[string]string `yaml:"metadata" json:"metadata"`
+	Status    string            `yaml:"status" json:"status"`
+}
+
+// Registry 是基于静态文件的服务发现
+// 文件为YAML或JSON格式，顶层是服务名称到实例列表的映射，例如：
+//
+//	orders:
+//	  - id: orders-1
+//	    version: v1
+//	    endpoints: ["grpc://127.0.0.1:9000"]
+//	    metadata: {weight: "10"}
+//
+// 文件变化时重新读取，只通知实例列表发生变化的服务；内容无效时保留上一次的结果
+type Registry struct {
+	path     string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	fsw      *fsnotify.Watcher
+	lock     sync.Mutex
+	services map[string][]*registry.ServiceInstance
+	hubs     map[string]*fanout.Hub // 服务名称到观察者分发器的映射
+	logger   log.Logger
+}
+
+// Options 是文件服务发现的选项
+type Options struct {
+	Logger log.Logger
+}
+
+// Option 是文件服务发现的选项函数
+type Option func(*Options)
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewRegistry 读取文件并开始监视文件变化
+func NewRegistry(path string, opts ...Option) (*Registry, error) {
+	options := &Options{
+		Logger: log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	services, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// 监视所在目录而不是文件本身，这样编辑器的原子替换和Kubernetes ConfigMap的符号链接切换也能被感知
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsw.Add(filepath.Dir(path)); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Registry{
+		path:     path,
+		ctx:      ctx,
+		cancel:   cancel,
+		fsw:      fsw,
+		lock:     sync.Mutex{},
+		services: services,
+		hubs:     make(map[string]*fanout.Hub),
+		logger:   options.Logger,
+	}
+	go r.watchLoop()
+	return r, nil
+}
+
+// load 读取并解析文件，YAML解析器同时支持JSON
+func load(path string) (map[string][]*registry.ServiceInstance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string][]instance)
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("file registry: parse %s: %w", path, err)
+	}
+
+	services := make(map[string][]*registry.ServiceInstance, len(raw))
+	for name, items := range raw {
+		instances := make([]*registry.ServiceInstance, 0, len(items))
+		for i, item := range items {
+			if len(item.Endpoints) == 0 {
+				return nil, fmt.Errorf("file registry: instance %d of %s has no endpoints", i, name)
+			}
+			si := &registry.ServiceInstance{
+				ID:        item.ID,
+				Name:      name,
+				Version:   item.Version,
+				Metadata:  item.Metadata,
+				Endpoints: item.Endpoints,
+				Status:    registry.ServiceInstanceStatus(item.Status),
+			}
+			if si.ID == "" {
+				si.ID = item.Endpoints[0]
+			}
+			if si.Metadata == nil {
+				si.Metadata = map[string]string{}
+			}
+			if si.Status == "" {
+				si.Status = registry.StatusUp
+			}
+			instances = append(instances, si)
+		}
+		sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+		services[name] = instances
+	}
+	return services, nil
+}
+
+// watchLoop 在文件所在目录发生变化时重新读取文件
+func (r *Registry) watchLoop() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case err, ok := <-r.fsw.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Warn("监视服务文件失败", log.String("path", r.path), log.Err(err))
+		case ev, ok := <-r.fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			r.reload()
+		}
+	}
+}
+
+// reload 重新读取文件并通知实例列表发生变化的服务
+func (r *Registry) reload() {
+	services, err := load(r.path)
+	if err != nil {
+		// 文件可能正在写入或被临时删除，保留上一次的结果
+		if !os.IsNotExist(err) {
+			r.logger.Warn("读取服务文件失败", log.String("path", r.path), log.Err(err))
+		}
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for name, hub := range r.hubs {
+		if !reflect.DeepEqual(r.services[name], services[name]) {
+			hub.Publish(services[name])
+		}
+	}
+	r.services = services
+}
+
+// GetService 获取服务实例列表
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return fanout.Copy(r.services[serviceName]), nil
+}
+
+// Watch 监视服务变更，观察者的第一次Next返回当前的实例列表
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	hub, ok := r.hubs[serviceName]
+	if !ok {
+		hub = fanout.NewHub(func(hub *fanout.Hub) {
+			r.unwatch(serviceName, hub)
+		})
+		hub.Publish(r.services[serviceName])
+		r.hubs[serviceName] = hub
+	}
+	return hub.Subscribe(ctx), nil
+}
+
+// unwatch 在服务的最后一个观察者停止后移除分发器
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.hubs[serviceName] == hub && hub.Len() == 0 {
+		delete(r.hubs, serviceName)
+	}
+}
+
+// Stop 停止监视文件，所有观察者随之停止
+func (r *Registry) Stop() error {
+	r.cancel()
+	err := r.fsw.Close()
+
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.hubs))
+	for _, hub := range r.hubs {
+		hubs = append(hubs, hub)
+	}
+	r.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.Close()
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+// writeFile 原子地替换文件内容
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+}
+
+func TestGetService(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	writeFile(t, path, `{"orders": [
+		{"id": "orders-1", "version": "v1", "endpoints": ["grpc://127.0.0.1:9000"], "metadata": {"weight": "10"}},
+		{"endpoints": ["http://127.0.0.1:8001"], "status": "OUT_OF_SERVICE"}
+	]}`)
+
+	r, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	defer r.Stop()
+
+	got, err := r.GetService(context.Background(), "orders")
+	if err != nil || len(got) != 2 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	want := []*registry.ServiceInstance{
+		{ID: "http://127.0.0.1:8001", Name: "orders", Metadata: map[string]string{}, Endpoints: []string{"http://127.0.0.1:8001"}, Status: registry.StatusOutOfService},
+		{ID: "orders-1", Name: "orders", Version: "v1", Metadata: map[string]string{"weight": "10"}, Endpoints: []string{"grpc://127.0.0.1:9000"}, Status: registry.StatusUp},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("instances = %+v, want %+v", got, want)
+	}
+
+	if got, err := r.GetService(context.Background(), "missing"); err != nil || len(got) != 0 {
+		t.Errorf("missing service = %v, %v", got, err)
+	}
+}
+
+func TestInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, path, "orders:\n  - id: a\n")
+	if _, err := NewRegistry(path); err == nil {
+		t.Fatal("expected error for instance without endpoints")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, path, `
+orders:
+  - id: orders-1
+    endpoints: ["grpc://127.0.0.1:9000"]
+users:
+  - id: users-1
+    endpoints: ["grpc://127.0.0.1:9100"]
+`)
+
+	r, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	defer r.Stop()
+
+	ctx := context.Background()
+	orders, err := r.Watch(ctx, "orders")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer orders.Stop()
+	if items, err := orders.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("initial next = %v, %v", items, err)
+	}
+
+	// 无效内容不应影响当前的实例列表
+	writeFile(t, path, "orders: [")
+	writeFile(t, path, `
+orders:
+  - id: orders-1
+    endpoints: ["grpc://127.0.0.1:9000"]
+  - id: orders-2
+    endpoints: ["grpc://127.0.0.1:9001"]
+users:
+  - id: users-1
+    endpoints: ["grpc://127.0.0.1:9100"]
+`)
+	items, err := orders.Next()
+	if err != nil || len(items) != 2 || items[1].ID != "orders-2" {
+		t.Fatalf("next after change = %v, %v", items, err)
+	}
+
+	// 服务被移除时通知空列表
+	writeFile(t, path, "users: []\n")
+	items, err = orders.Next()
+	if err != nil || len(items) != 0 {
+		t.Fatalf("next after removal = %v, %v", items, err)
+	}
+}
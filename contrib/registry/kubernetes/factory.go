@@ -0,0 +1,38 @@
+package kubernetes
+
+import (
+	"net/url"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	registry.RegisterFactory(registry.Kubernetes, newFromConfig)
+}
+
+// newFromConfig 根据通用配置创建Kubernetes服务发现，未设置终端点时使用集群内的服务账号
+// 支持的参数：namespace、token（集群外访问的令牌）、version_label、pod（Register时写入注解的Pod名称，为self时自动识别当前Pod）
+func newFromConfig(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+	var opts []Option
+	if len(cfg.Endpoints) > 0 {
+		u := &url.URL{Scheme: "http", Host: cfg.Endpoints[0]}
+		if cfg.TLSEnabled {
+			u.Scheme = "https"
+		}
+		opts = append(opts, WithAPIServer(u.String(), cfg.Param("token")))
+	}
+	if namespace := cfg.Param("namespace"); namespace != "" {
+		opts = append(opts, WithNamespace(namespace))
+	}
+	if label := cfg.Param("version_label"); label != "" {
+		opts = append(opts, WithVersionLabel(label))
+	}
+	switch pod := cfg.Param("pod"); pod {
+	case "":
+	case "self":
+		opts = append(opts, WithPodAnnotations(""))
+	default:
+		opts = append(opts, WithPodAnnotations(pod))
+	}
+	return NewRegistry(opts...)
+}
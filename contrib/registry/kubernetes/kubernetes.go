@@ -0,0 +1,590 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/internal/kubeapi"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.ServiceRegistrar = (*Registry)(nil)
+)
+
+const (
+	// AnnotationPrefix 是保存服务实例元数据的Pod注解前缀，发现时去掉前缀后作为元数据
+	AnnotationPrefix = "phantasm/"
+	// AnnotationVersion 是保存服务版本的Pod注解
+	AnnotationVersion = AnnotationPrefix + "version"
+	// DefaultVersionLabel 是未设置版本注解时读取版本的Pod标签
+	DefaultVersionLabel = "app.kubernetes.io/version"
+
+	// metadataZone 是元数据中表示可用区的键，与selector使用的键一致
+	metadataZone = "zone"
+)
+
+// annotationName 是合法的注解名称（不含前缀）
+var annotationName = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+
+// Registry 是基于Kubernetes EndpointSlice的服务发现
+// 服务名称对应同一命名空间中的Service，就绪的Pod地址按端口名称转换为端点，Pod的标签和注解作为元数据
+type Registry struct {
+	client   *kubeapi.Client
+	options  *Options
+	ctx      context.Context
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	watchers map[string]*serviceWatch // 服务名称到共享监视的映射
+	logger   log.Logger
+}
+
+// Options 是Kubernetes服务发现的选项
+type Options struct {
+	Namespace    string       // 命名空间，为空时使用Pod所在的命名空间
+	Host         string       // API Server地址，为空时使用集群内的服务账号配置
+	Token        string       // 访问API Server的令牌
+	HTTPClient   *http.Client // 访问API Server的HTTP客户端
+	VersionLabel string       // 读取版本的Pod标签
+	PodName      string       // Register时写入注解的Pod名称，为空时不写入
+	Logger       log.Logger
+}
+
+// Option 是Kubernetes服务发现的选项函数
+type Option func(*Options)
+
+// WithNamespace 设置命名空间
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithAPIServer 设置API Server地址和令牌，用于集群外访问
+func WithAPIServer(host, token string) Option {
+	return func(o *Options) {
+		o.Host = host
+		o.Token = token
+	}
+}
+
+// WithHTTPClient 设置访问API Server的HTTP客户端
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *Options) {
+		o.HTTPClient = client
+	}
+}
+
+// WithVersionLabel 设置读取版本的Pod标签
+func WithVersionLabel(label string) Option {
+	return func(o *Options) {
+		o.VersionLabel = label
+	}
+}
+
+// WithPodAnnotations 设置Register时将版本和元数据写入注解的Pod，为空时使用POD_NAME环境变量或主机名
+// 需要服务账号具有patch pods的权限
+func WithPodAnnotations(podName string) Option {
+	return func(o *Options) {
+		if podName == "" {
+			podName = os.Getenv("POD_NAME")
+		}
+		if podName == "" {
+			podName, _ = os.Hostname()
+		}
+		o.PodName = podName
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewRegistry 创建Kubernetes服务发现实例
+func NewRegistry(opts ...Option) (*Registry, error) {
+	options := &Options{
+		VersionLabel: DefaultVersionLabel,
+		Logger:       log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	if options.Namespace == "" {
+		options.Namespace = "default"
+		if data, err := os.ReadFile(kubeapi.ServiceAccountPath + "/namespace"); err == nil {
+			options.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+
+	var client *kubeapi.Client
+	if options.Host == "" {
+		c, err := kubeapi.InClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	} else {
+		client = &kubeapi.Client{Host: strings.TrimRight(options.Host, "/"), HTTPClient: http.DefaultClient, Token: options.Token}
+	}
+	if options.HTTPClient != nil {
+		client.HTTPClient = options.HTTPClient
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Registry{
+		client:   client,
+		options:  options,
+		ctx:      ctx,
+		cancel:   cancel,
+		lock:     sync.Mutex{},
+		watchers: make(map[string]*serviceWatch),
+		logger:   options.Logger,
+	}, nil
+}
+
+// Register 服务实例由Kubernetes根据Pod就绪状态自动注册
+// 设置了WithPodAnnotations时，将版本和元数据写入当前Pod的注解，供其他服务发现时读取
+func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	if r.options.PodName == "" {
+		return nil
+	}
+
+	annotations := make(map[string]string, len(service.Metadata)+1)
+	for k, v := range service.Metadata {
+		if !annotationName.MatchString(k) {
+			r.logger.Warn("元数据键不是合法的注解名称，已跳过", log.String("key", k))
+			continue
+		}
+		annotations[AnnotationPrefix+k] = v
+	}
+	if service.Version != "" {
+		annotations[AnnotationVersion] = service.Version
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(ctx, http.MethodPatch, r.path("/api/v1", "pods")+"/"+url.PathEscape(r.options.PodName), nil, patch, "application/merge-patch+json")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Deregister Pod删除或未就绪时Kubernetes会自动移除端点，因此无需操作
+func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	return nil
+}
+
+// GetService 获取服务实例列表
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	slices := &kubeapi.ObjectList[endpointSlice]{}
+	if err := r.client.Get(ctx, r.slicesPath(), sliceSelector(serviceName), slices); err != nil {
+		return nil, err
+	}
+
+	pods := make(map[string]pod)
+	selector, err := r.podSelector(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if selector != "" {
+		list := &kubeapi.ObjectList[pod]{}
+		if err := r.client.Get(ctx, r.path("/api/v1", "pods"), url.Values{"labelSelector": {selector}}, list); err != nil {
+			return nil, err
+		}
+		for _, p := range list.Items {
+			pods[p.Metadata.Name] = p
+		}
+	}
+
+	return r.buildInstances(serviceName, slices.Items, pods), nil
+}
+
+// podSelector 返回Service的Pod标签选择器，Service不存在或没有选择器时返回空
+func (r *Registry) podSelector(ctx context.Context, serviceName string) (string, error) {
+	svc := &service{}
+	err := r.client.Get(ctx, r.path("/api/v1", "services")+"/"+url.PathEscape(serviceName), nil, svc)
+	if err != nil {
+		if kubeapi.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return labelSelector(svc.Spec.Selector), nil
+}
+
+// buildInstances 将EndpointSlice中就绪的端点按Pod合并为服务实例
+func (r *Registry) buildInstances(serviceName string, slices []endpointSlice, pods map[string]pod) []*registry.ServiceInstance {
+	grouped := make(map[string]*registry.ServiceInstance)
+	for _, slice := range slices {
+		type schemePort struct {
+			scheme string
+			port   int
+		}
+		var ports []schemePort
+		for _, p := range slice.Ports {
+			if scheme := portScheme(p); scheme != "" && p.Port > 0 {
+				ports = append(ports, schemePort{scheme: scheme, port: p.Port})
+			}
+		}
+		if len(ports) == 0 {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			if (ep.Conditions.Ready != nil && !*ep.Conditions.Ready) ||
+				(ep.Conditions.Terminating != nil && *ep.Conditions.Terminating) || len(ep.Addresses) == 0 {
+				continue
+			}
+
+			id := ep.Addresses[0]
+			var owner *pod
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				id = ep.TargetRef.Name
+				if p, ok := pods[id]; ok {
+					owner = &p
+				}
+			}
+
+			si, ok := grouped[id]
+			if !ok {
+				si = &registry.ServiceInstance{
+					ID:       id,
+					Name:     serviceName,
+					Metadata: make(map[string]string),
+					Status:   registry.StatusUp,
+				}
+				if owner != nil {
+					si.Version, si.Metadata = r.podMetadata(owner)
+				}
+				if ep.Zone != "" {
+					if _, ok := si.Metadata[metadataZone]; !ok {
+						si.Metadata[metadataZone] = ep.Zone
+					}
+				}
+				grouped[id] = si
+			}
+
+			for _, addr := range ep.Addresses {
+				for _, p := range ports {
+					si.Endpoints = append(si.Endpoints, p.scheme+"://"+net.JoinHostPort(addr, strconv.Itoa(p.port)))
+				}
+			}
+		}
+	}
+
+	instances := make([]*registry.ServiceInstance, 0, len(grouped))
+	for _, si := range grouped {
+		sort.Strings(si.Endpoints)
+		si.Endpoints = compact(si.Endpoints)
+		instances = append(instances, si)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
+
+// podMetadata 从Pod的标签和带前缀的注解中读取版本和元数据，注解优先于同名标签
+func (r *Registry) podMetadata(p *pod) (string, map[string]string) {
+	metadata := make(map[string]string, len(p.Metadata.Labels)+len(p.Metadata.Annotations))
+	for k, v := range p.Metadata.Labels {
+		metadata[k] = v
+	}
+	version := p.Metadata.Labels[r.options.VersionLabel]
+	for k, v := range p.Metadata.Annotations {
+		switch {
+		case k == AnnotationVersion:
+			version = v
+		case strings.HasPrefix(k, AnnotationPrefix):
+			metadata[strings.TrimPrefix(k, AnnotationPrefix)] = v
+		}
+	}
+	return version, metadata
+}
+
+// portScheme 根据appProtocol或端口名称推断协议，名称可以带后缀，例如grpc-internal
+// 无法识别的端口不会生成端点
+func portScheme(p endpointPort) string {
+	if p.Protocol != "" && p.Protocol != "TCP" {
+		return ""
+	}
+	for _, name := range []string{p.AppProtocol, p.Name} {
+		name = strings.ToLower(name)
+		if i := strings.IndexByte(name, '-'); i >= 0 {
+			name = name[:i]
+		}
+		switch name {
+		case "http", "https", "grpc", "grpcs":
+			return name
+		}
+	}
+	return ""
+}
+
+// compact 去除已排序切片中的重复元素
+func compact(items []string) []string {
+	result := items[:0]
+	for i, item := range items {
+		if i == 0 || item != items[i-1] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// labelSelector 将标签映射转换为选择器字符串
+func labelSelector(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// sliceSelector 返回选择服务EndpointSlice的查询参数
+func sliceSelector(serviceName string) url.Values {
+	return url.Values{"labelSelector": {"kubernetes.io/service-name=" + serviceName}}
+}
+
+// path 返回命名空间内资源的路径
+func (r *Registry) path(group, resource string) string {
+	return group + "/namespaces/" + url.PathEscape(r.options.Namespace) + "/" + resource
+}
+
+// slicesPath 返回EndpointSlice的路径
+func (r *Registry) slicesPath() string {
+	return r.path("/apis/discovery.k8s.io/v1", "endpointslices")
+}
+
+// serviceWatch 是同一服务共享的监视，合并EndpointSlice和Pod两个informer的缓存
+type serviceWatch struct {
+	hub    *fanout.Hub
+	cancel context.CancelFunc
+	ctx    context.Context // 共享监视的ctx，Pod的informer在它结束时停止
+
+	lock       sync.Mutex
+	slices     []endpointSlice
+	pods       map[string]pod
+	last       []*registry.ServiceInstance
+	ready      bool               // 初始列出完成后才发布
+	selector   string             // 当前使用的Pod标签选择器
+	podsCancel context.CancelFunc // 停止当前Pod的informer
+	podsGen    int                // Pod选择器的变更次数，旧informer的更新会被忽略
+}
+
+// Watch 监视服务变更
+// 同一服务的所有观察者共享Service、EndpointSlice和Pod的informer，实例列表变化时才会通知观察者；
+// Service的Pod选择器变化（包括Service在监视开始后才创建或被删除）时按新的选择器重新监视Pod
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	r.lock.Lock()
+	if sw, ok := r.watchers[serviceName]; ok {
+		w := sw.hub.Subscribe(ctx)
+		r.lock.Unlock()
+		return w, nil
+	}
+	r.lock.Unlock()
+
+	loopCtx, cancel := context.WithCancel(r.ctx)
+	sw := &serviceWatch{cancel: cancel, ctx: loopCtx, pods: make(map[string]pod)}
+	sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+		r.unwatch(serviceName, hub)
+	})
+
+	// 列出对象需要访问API Server，不持有锁，避免阻塞其他服务的监视和Stop
+	services := &kubeapi.Informer[service]{
+		Client: r.client,
+		Path:   r.path("/api/v1", "services"),
+		Fields: "metadata.name=" + serviceName,
+		Logger: r.logger,
+		OnChange: func(items map[string]service) {
+			selector := ""
+			if svc, ok := items[serviceName]; ok {
+				selector = labelSelector(svc.Spec.Selector)
+			}
+			sw.lock.Lock()
+			defer sw.lock.Unlock()
+			if !sw.ready {
+				// 初始列出时由Watch同步列出Pod
+				sw.selector = selector
+				return
+			}
+			r.watchPods(serviceName, sw, selector)
+		},
+	}
+	if err := services.List(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	slices := &kubeapi.Informer[endpointSlice]{
+		Client:   r.client,
+		Path:     r.slicesPath(),
+		Selector: sliceSelector(serviceName).Get("labelSelector"),
+		Logger:   r.logger,
+		OnChange: func(items map[string]endpointSlice) {
+			sw.lock.Lock()
+			defer sw.lock.Unlock()
+			sw.slices = make([]endpointSlice, 0, len(items))
+			for _, s := range items {
+				sw.slices = append(sw.slices, s)
+			}
+			r.rebuild(serviceName, sw)
+		},
+	}
+	if err := slices.List(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var pods *kubeapi.Informer[pod]
+	if sw.selector != "" {
+		pods = r.podInformer(serviceName, sw, sw.selector, sw.podsGen)
+		if err := pods.List(ctx); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	sw.lock.Lock()
+	sw.ready = true
+	r.rebuild(serviceName, sw)
+	sw.lock.Unlock()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.ctx.Err(); err != nil {
+		// 列出期间服务发现已经停止
+		cancel()
+		return nil, err
+	}
+	if other, ok := r.watchers[serviceName]; ok {
+		// 并发的Watch已经建立了共享的监视
+		cancel()
+		return other.hub.Subscribe(ctx), nil
+	}
+
+	if pods != nil {
+		// 在Service的informer启动前记录，选择器变化时才能停止初始的Pod informer
+		podsCtx, podsCancel := context.WithCancel(loopCtx)
+		sw.lock.Lock()
+		sw.podsCancel = podsCancel
+		sw.lock.Unlock()
+		go pods.Run(podsCtx)
+	}
+	go services.Run(loopCtx)
+	go slices.Run(loopCtx)
+
+	r.watchers[serviceName] = sw
+	return sw.hub.Subscribe(ctx), nil
+}
+
+// watchPods 在Pod选择器变化时停止旧的Pod informer并在后台按新的选择器列出和监视Pod，调用方需持有sw.lock
+// 选择器为空（Service不存在或没有选择器）时不再关联Pod
+func (r *Registry) watchPods(serviceName string, sw *serviceWatch, selector string) {
+	if selector == sw.selector {
+		return
+	}
+	if sw.podsCancel != nil {
+		sw.podsCancel()
+		sw.podsCancel = nil
+	}
+	sw.selector = selector
+	sw.podsGen++
+	if selector == "" {
+		sw.pods = make(map[string]pod)
+		r.rebuild(serviceName, sw)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(sw.ctx)
+	sw.podsCancel = cancel
+	go r.podInformer(serviceName, sw, selector, sw.podsGen).ListAndRun(ctx)
+}
+
+// podInformer 创建按选择器监视Pod的informer，选择器再次变化后它的更新会被忽略
+func (r *Registry) podInformer(serviceName string, sw *serviceWatch, selector string, gen int) *kubeapi.Informer[pod] {
+	return &kubeapi.Informer[pod]{
+		Client:   r.client,
+		Path:     r.path("/api/v1", "pods"),
+		Selector: selector,
+		Logger:   r.logger,
+		OnChange: func(items map[string]pod) {
+			sw.lock.Lock()
+			defer sw.lock.Unlock()
+			if sw.podsGen != gen {
+				return
+			}
+			sw.pods = make(map[string]pod, len(items))
+			for name, p := range items {
+				sw.pods[name] = p
+			}
+			r.rebuild(serviceName, sw)
+		},
+	}
+}
+
+// rebuild 重新生成服务实例列表，变化时通知观察者，调用方需持有sw.lock
+func (r *Registry) rebuild(serviceName string, sw *serviceWatch) {
+	if !sw.ready {
+		return
+	}
+	instances := r.buildInstances(serviceName, sw.slices, sw.pods)
+	if sw.last != nil && reflect.DeepEqual(sw.last, instances) {
+		return
+	}
+	sw.last = instances
+	sw.hub.Publish(instances)
+}
+
+// unwatch 在服务的最后一个观察者停止后结束共享的监视
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
+	}
+	sw.cancel()
+	delete(r.watchers, serviceName)
+}
+
+// Stop 停止服务发现，所有观察者随之停止
+func (r *Registry) Stop() error {
+	r.cancel()
+
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.watchers))
+	for _, sw := range r.watchers {
+		hubs = append(hubs, sw.hub)
+	}
+	r.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.Close()
+	}
+	return nil
+}
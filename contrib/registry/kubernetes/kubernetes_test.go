@@ -0,0 +1,447 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/kubeapi"
+	"github.com/dormoron/phantasm/registry"
+)
+
+// fakeAPIServer 是一个最小化的Kubernetes API Server替身，支持list、watch和merge patch
+type fakeAPIServer struct {
+	lock    sync.Mutex
+	rv      int
+	objects map[string]map[string]json.RawMessage // 资源类型到对象的映射
+	history map[string][]kubeapi.WatchEvent       // 按resourceVersion递增的事件
+	streams map[string][]chan kubeapi.WatchEvent
+	gone    map[string]bool // 下一次监视返回410 Gone
+	patches map[string]map[string]string
+	entered chan struct{} // 非空时查询Service前发送通知
+	block   chan struct{} // 非空时查询Service前等待关闭
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, string) {
+	f := &fakeAPIServer{
+		objects: map[string]map[string]json.RawMessage{"services": {}, "pods": {}, "endpointslices": {}},
+		history: make(map[string][]kubeapi.WatchEvent),
+		streams: make(map[string][]chan kubeapi.WatchEvent),
+		gone:    make(map[string]bool),
+		patches: make(map[string]map[string]string),
+	}
+	f.put("services", "orders", ordersService(map[string]string{"app": "orders"}))
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+// put 保存对象并通知监视流
+func (f *fakeAPIServer) put(kind, name string, obj interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rv++
+	data, _ := json.Marshal(obj)
+	raw := map[string]interface{}{}
+	_ = json.Unmarshal(data, &raw)
+	meta, _ := raw["metadata"].(map[string]interface{})
+	meta["name"], meta["resourceVersion"] = name, strconv.Itoa(f.rv)
+	data, _ = json.Marshal(raw)
+
+	typ := "ADDED"
+	if _, ok := f.objects[kind][name]; ok {
+		typ = "MODIFIED"
+	}
+	f.objects[kind][name] = data
+	ev := kubeapi.WatchEvent{Type: typ, Object: data}
+	f.history[kind] = append(f.history[kind], ev)
+	for _, ch := range f.streams[kind] {
+		ch <- ev
+	}
+}
+
+// remove 删除对象并通知监视流
+func (f *fakeAPIServer) remove(kind, name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, ok := f.objects[kind][name]
+	if !ok {
+		return
+	}
+	delete(f.objects[kind], name)
+	ev := kubeapi.WatchEvent{Type: "DELETED", Object: data}
+	f.history[kind] = append(f.history[kind], ev)
+	for _, ch := range f.streams[kind] {
+		ch <- ev
+	}
+}
+
+// expire 断开当前的监视流，下一次监视时resourceVersion已过期
+func (f *fakeAPIServer) expire(kind string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.gone[kind] = true
+	for _, ch := range f.streams[kind] {
+		close(ch)
+	}
+	f.streams[kind] = nil
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(req.URL.Path, "/namespaces/default/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	resource := strings.Split(parts[1], "/")
+	kind := resource[0]
+	w.Header().Set("Content-Type", "application/json")
+	if kind == "services" && f.block != nil {
+		f.entered <- struct{}{}
+		<-f.block
+	}
+
+	f.lock.Lock()
+	switch {
+	case kind == "services" && len(resource) == 2:
+		defer f.lock.Unlock()
+		svc, ok := f.objects[kind][resource[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(kubeapi.Status{Code: http.StatusNotFound, Reason: "NotFound"})
+			return
+		}
+		_, _ = w.Write(svc)
+	case kind == "pods" && len(resource) == 2 && req.Method == http.MethodPatch:
+		defer f.lock.Unlock()
+		if req.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.Error(w, "unsupported patch", http.StatusUnsupportedMediaType)
+			return
+		}
+		patch := &pod{}
+		_ = json.NewDecoder(req.Body).Decode(patch)
+		f.patches[resource[1]] = patch.Metadata.Annotations
+		_ = json.NewEncoder(w).Encode(patch)
+	case len(resource) == 1 && req.URL.Query().Get("watch") == "" && f.objects[kind] != nil:
+		defer f.lock.Unlock()
+		list := kubeapi.ObjectList[json.RawMessage]{Metadata: kubeapi.ListMeta{ResourceVersion: strconv.Itoa(f.rv)}}
+		for _, obj := range f.objects[kind] {
+			if matches(obj, req.URL.Query()) {
+				list.Items = append(list.Items, obj)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	case len(resource) == 1 && f.objects[kind] != nil:
+		if f.gone[kind] {
+			f.gone[kind] = false
+			f.lock.Unlock()
+			data, _ := json.Marshal(kubeapi.Status{Code: http.StatusGone, Reason: "Expired"})
+			_ = json.NewEncoder(w).Encode(kubeapi.WatchEvent{Type: "ERROR", Object: data})
+			return
+		}
+		// 先补发请求的resourceVersion之后的事件
+		from, _ := strconv.Atoi(req.URL.Query().Get("resourceVersion"))
+		ch := make(chan kubeapi.WatchEvent, 16+len(f.history[kind]))
+		for _, ev := range f.history[kind] {
+			_, rv, _, _ := kubeapi.DecodeObject[pod](ev.Object)
+			if n, _ := strconv.Atoi(rv); n > from && matches(ev.Object, req.URL.Query()) {
+				ch <- ev
+			}
+		}
+		f.streams[kind] = append(f.streams[kind], ch)
+		f.lock.Unlock()
+
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				_ = json.NewEncoder(w).Encode(ev)
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		f.lock.Unlock()
+		http.NotFound(w, req)
+	}
+}
+
+// matches 判断对象是否满足等值的标签选择器和metadata.name字段选择器
+func matches(raw json.RawMessage, query url.Values) bool {
+	name, _, obj, _ := kubeapi.DecodeObject[pod](raw)
+	for _, pair := range strings.Split(query.Get("labelSelector"), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok && obj.Metadata.Labels[k] != v {
+			return false
+		}
+	}
+	if k, v, ok := strings.Cut(query.Get("fieldSelector"), "="); ok && k == "metadata.name" && name != v {
+		return false
+	}
+	return true
+}
+
+func ordersService(selector map[string]string) service {
+	svc := service{}
+	svc.Spec.Selector = selector
+	return svc
+}
+
+func ready(v bool) *bool {
+	return &v
+}
+
+func ordersSlice(endpoints ...endpoint) endpointSlice {
+	return endpointSlice{
+		Metadata:    kubeapi.ObjectMeta{Labels: map[string]string{"kubernetes.io/service-name": "orders"}},
+		AddressType: "IPv4",
+		Endpoints:   endpoints,
+		Ports: []endpointPort{
+			{Name: "http", Port: 8000, Protocol: "TCP"},
+			{Name: "api", Port: 9000, Protocol: "TCP", AppProtocol: "grpc"},
+			{Name: "metrics", Port: 9100, Protocol: "TCP"},
+		},
+	}
+}
+
+func podEndpoint(name, addr string) endpoint {
+	return endpoint{
+		Addresses:  []string{addr},
+		Conditions: endpointConditions{Ready: ready(true)},
+		TargetRef:  &objectReference{Kind: "Pod", Name: name},
+		Zone:       "zone-a",
+	}
+}
+
+func ordersPod(version string, annotations map[string]string) pod {
+	return pod{Metadata: kubeapi.ObjectMeta{
+		Labels:      map[string]string{"app": "orders", DefaultVersionLabel: version},
+		Annotations: annotations,
+	}}
+}
+
+func TestGetService(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+	notReady := podEndpoint("orders-b", "10.0.0.2")
+	notReady.Conditions.Ready = ready(false)
+	terminating := podEndpoint("orders-c", "10.0.0.3")
+	terminating.Conditions.Terminating = ready(true)
+	f.put("endpointslices", "orders-x1", ordersSlice(podEndpoint("orders-a", "10.0.0.1"), notReady, terminating))
+	f.put("pods", "orders-a", ordersPod("v1", map[string]string{"phantasm/weight": "20", "other/ignored": "x"}))
+
+	r, err := NewRegistry(WithAPIServer(addr, "token"), WithNamespace("default"))
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	defer r.Stop()
+
+	got, err := r.GetService(context.Background(), "orders")
+	if err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	if want := []string{"grpc://10.0.0.1:9000", "http://10.0.0.1:8000"}; !reflect.DeepEqual(got[0].Endpoints, want) {
+		t.Errorf("endpoints = %v, want %v", got[0].Endpoints, want)
+	}
+	if got[0].ID != "orders-a" || got[0].Version != "v1" {
+		t.Errorf("instance = %+v", got[0])
+	}
+	md := got[0].Metadata
+	if md["weight"] != "20" || md["zone"] != "zone-a" || md["app"] != "orders" || md["other/ignored"] != "" {
+		t.Errorf("metadata = %v", md)
+	}
+
+	// 没有对应Service时返回空列表
+	if got, err := r.GetService(context.Background(), "unknown"); err != nil || len(got) != 0 {
+		t.Errorf("unknown service = %v, %v", got, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+	f.put("endpointslices", "orders-x1", ordersSlice(podEndpoint("orders-a", "10.0.0.1")))
+	f.put("pods", "orders-a", ordersPod("v1", nil))
+
+	r, err := NewRegistry(WithAPIServer(addr, ""), WithNamespace("default"))
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	defer r.Stop()
+
+	ctx := context.Background()
+	w, err := r.Watch(ctx, "orders")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items, err := w.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("initial next = %v, %v", items, err)
+	}
+
+	f.put("pods", "orders-b", ordersPod("v1", nil))
+	f.put("endpointslices", "orders-x1", ordersSlice(podEndpoint("orders-a", "10.0.0.1"), podEndpoint("orders-b", "10.0.0.2")))
+	next := func(cond func([]*registry.ServiceInstance) bool, msg string) {
+		t.Helper()
+		for {
+			items, err := w.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", msg, err)
+			}
+			if cond(items) {
+				return
+			}
+		}
+	}
+	next(func(items []*registry.ServiceInstance) bool { return len(items) == 2 }, "pod added")
+
+	f.put("pods", "orders-b", ordersPod("v1", map[string]string{AnnotationVersion: "v2"}))
+	next(func(items []*registry.ServiceInstance) bool {
+		return len(items) == 2 && items[1].Version == "v2"
+	}, "annotation changed")
+
+	// resourceVersion过期后应重新列出，期间的变更不会丢失
+	f.expire("endpointslices")
+	f.put("endpointslices", "orders-x1", ordersSlice(podEndpoint("orders-b", "10.0.0.2")))
+	next(func(items []*registry.ServiceInstance) bool {
+		return len(items) == 1 && items[0].ID == "orders-b"
+	}, "relist after gone")
+}
+
+func TestWatchServiceSelector(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+	f.remove("services", "orders")
+	f.put("endpointslices", "orders-x1", ordersSlice(podEndpoint("orders-a", "10.0.0.1")))
+	f.put("pods", "orders-a", ordersPod("v1", nil))
+
+	r, err := NewRegistry(WithAPIServer(addr, ""), WithNamespace("default"))
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	defer r.Stop()
+
+	w, err := r.Watch(context.Background(), "orders")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	version := func(want, msg string) {
+		t.Helper()
+		for {
+			items, err := w.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", msg, err)
+			}
+			if len(items) == 1 && items[0].Version == want {
+				return
+			}
+		}
+	}
+	version("", "no service")
+
+	// Service在监视开始后创建，按它的选择器关联Pod
+	f.put("services", "orders", ordersService(map[string]string{"app": "orders"}))
+	version("v1", "service created")
+
+	// 选择器变化后按新的选择器重新列出Pod
+	f.put("services", "orders", ordersService(map[string]string{"app": "other"}))
+	version("", "selector changed")
+	f.put("services", "orders", ordersService(map[string]string{"app": "orders"}))
+	version("v1", "selector restored")
+
+	f.remove("services", "orders")
+	version("", "service deleted")
+}
+
+func TestWatchDoesNotHoldLock(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+	f.put("endpointslices", "orders-x1", ordersSlice(podEndpoint("orders-a", "10.0.0.1")))
+	f.put("pods", "orders-a", ordersPod("v1", nil))
+	f.entered, f.block = make(chan struct{}, 1), make(chan struct{})
+
+	r, err := NewRegistry(WithAPIServer(addr, ""), WithNamespace("default"))
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		w, err := r.Watch(context.Background(), "orders")
+		if err == nil {
+			_, err = w.Next()
+		}
+		errc <- err
+	}()
+	<-f.entered
+
+	// Watch在访问API Server时不持有锁，Stop不会被阻塞
+	stopped := make(chan struct{})
+	go func() {
+		_ = r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked by Watch listing objects")
+	}
+	close(f.block)
+	if err := <-errc; err == nil {
+		t.Error("expected error from watch after Stop")
+	}
+}
+
+func TestRegisterAnnotatesPod(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+	ins := &registry.ServiceInstance{
+		ID: "orders-a", Name: "orders", Version: "v3",
+		Metadata: map[string]string{"weight": "5", "bad key": "x"},
+	}
+
+	r, err := NewRegistry(WithAPIServer(addr, ""), WithNamespace("default"))
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	if err := r.Register(context.Background(), ins); err != nil || len(f.patches) != 0 {
+		t.Fatalf("register without annotations = %v, patches %v", err, f.patches)
+	}
+
+	r, err = NewRegistry(WithAPIServer(addr, ""), WithNamespace("default"), WithPodAnnotations("orders-a"))
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	if err := r.Register(context.Background(), ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	want := map[string]string{AnnotationVersion: "v3", "phantasm/weight": "5"}
+	if !reflect.DeepEqual(f.patches["orders-a"], want) {
+		t.Errorf("annotations = %v, want %v", f.patches["orders-a"], want)
+	}
+}
+
+func TestPortScheme(t *testing.T) {
+	tests := []struct {
+		port endpointPort
+		want string
+	}{
+		{endpointPort{Name: "http"}, "http"},
+		{endpointPort{Name: "grpc-internal", Protocol: "TCP"}, "grpc"},
+		{endpointPort{Name: "web", AppProtocol: "https"}, "https"},
+		{endpointPort{Name: "grpc", Protocol: "UDP"}, ""},
+		{endpointPort{Name: "metrics"}, ""},
+	}
+	for _, tt := range tests {
+		if got := portScheme(tt.port); got != tt.want {
+			t.Errorf("portScheme(%+v) = %q, want %q", tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package kubernetes
+
+import "github.com/dormoron/phantasm/internal/kubeapi"
+
+// 这里只定义服务发现用到的Kubernetes API字段
+
+// service 是Kubernetes Service
+type service struct {
+	Metadata kubeapi.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Selector map[string]string `json:"selector"`
+	} `json:"spec"`
+}
+
+// pod 是Kubernetes Pod
+type pod struct {
+	Metadata kubeapi.ObjectMeta `json:"metadata"`
+}
+
+// endpointSlice 是discovery.k8s.io/v1 EndpointSlice
+type endpointSlice struct {
+	Metadata    kubeapi.ObjectMeta `json:"metadata"`
+	AddressType string             `json:"addressType"`
+	Endpoints   []endpoint         `json:"endpoints"`
+	Ports       []endpointPort     `json:"ports"`
+}
+
+// endpoint 是EndpointSlice中的一个端点
+type endpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions endpointConditions `json:"conditions"`
+	TargetRef  *objectReference   `json:"targetRef,omitempty"`
+	NodeName   string             `json:"nodeName,omitempty"`
+	Zone       string             `json:"zone,omitempty"`
+}
+
+// endpointConditions 是端点的状态，ready为空时视为就绪
+type endpointConditions struct {
+	Ready       *bool `json:"ready,omitempty"`
+	Terminating *bool `json:"terminating,omitempty"`
+}
+
+// objectReference 是端点指向的对象
+type objectReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// endpointPort 是EndpointSlice的端口
+type endpointPort struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol"`
+	AppProtocol string `json:"appProtocol,omitempty"`
+}
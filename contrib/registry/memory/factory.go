@@ -0,0 +1,19 @@
+package memory
+
+import (
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	// 参数socket指定时连接到该Unix套接字上的内存注册中心，ttl设置服务实例的存活时间
+	registry.RegisterFactory(registry.Memory, func(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+		if socket := cfg.Param("socket"); socket != "" {
+			return NewClient(socket)
+		}
+		ttl, err := cfg.DurationParam("ttl")
+		if err != nil {
+			return nil, err
+		}
+		return NewRegistry(WithTTL(ttl)), nil
+	})
+}
@@ -2,30 +2,99 @@ package memory
 
 import (
 	"context"
+	"errors"
+	"net"
 	"sync"
 	"time"
 
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
 	"github.com/dormoron/phantasm/registry"
 )
 
-type memRegistry struct {
-	sync.RWMutex
-	services map[string][]*registry.ServiceInstance
-	watchers map[string][]chan []*registry.ServiceInstance
+var (
+	_ registry.ServiceRegistrar = (*Registry)(nil)
+)
+
+// ErrNotFound 是续约不存在（或已过期）的服务实例时返回的错误
+var ErrNotFound = errors.New("memory: instance not found")
+
+// Registry 是内存注册中心，常用于测试和单机部署
+// 设置TTL后服务实例需要定期通过Renew或重新注册续约，否则过期移除；
+// 通过Serve在Unix套接字上提供服务后，同一台机器上的其他进程可以用NewClient共享这个注册中心
+type Registry struct {
+	options *Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	lock      sync.Mutex
+	services  map[string][]*record
+	hubs      map[string]*fanout.Hub // 服务名称到共享监视的映射
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	logger    log.Logger
+}
+
+// record 是注册的服务实例及其过期时间
+type record struct {
+	instance  *registry.ServiceInstance
+	expiresAt time.Time // 为零时不过期
+}
+
+// Options 是内存注册中心的选项
+type Options struct {
+	TTL    time.Duration // 服务实例的存活时间，为0时不过期
+	Logger log.Logger
+}
+
+// Option 是内存注册中心的选项函数
+type Option func(*Options)
+
+// WithTTL 设置服务实例的存活时间，超过TTL未续约的实例会被移除
+func WithTTL(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = ttl
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
 }
 
 // NewRegistry 创建内存注册中心
-func NewRegistry() registry.ServiceRegistrar {
-	return &memRegistry{
-		services: make(map[string][]*registry.ServiceInstance),
-		watchers: make(map[string][]chan []*registry.ServiceInstance),
+func NewRegistry(opts ...Option) *Registry {
+	options := &Options{
+		Logger: log.DefaultLogger,
 	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Registry{
+		options:   options,
+		ctx:       ctx,
+		cancel:    cancel,
+		services:  make(map[string][]*record),
+		hubs:      make(map[string]*fanout.Hub),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		logger:    options.Logger,
+	}
+	if options.TTL > 0 {
+		go r.expireLoop()
+	}
+	return r
 }
 
-// Register 注册服务实例
-func (m *memRegistry) Register(ctx context.Context, service *registry.ServiceInstance) error {
-	m.Lock()
-	defer m.Unlock()
+// Register 注册服务实例，已存在的同ID实例会被替换，同时完成续约
+func (m *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	if service.Status == "" {
 		service.Status = registry.StatusUp
@@ -38,47 +107,41 @@ func (m *memRegistry) Register(ctx context.Context, service *registry.ServiceIns
 	}
 	service.UpdatedAt = now
 
-	// 移除已存在的同ID实例
-	services := m.services[service.Name]
-	for i, s := range services {
-		if s.ID == service.ID {
-			services = append(services[:i], services[i+1:]...)
-			break
-		}
+	// 保存副本，调用方之后修改实例不会影响注册中心
+	rec := &record{instance: fanout.Copy([]*registry.ServiceInstance{service})[0]}
+	if m.options.TTL > 0 {
+		rec.expiresAt = now.Add(m.options.TTL)
 	}
 
-	// 添加服务实例
-	m.services[service.Name] = append(services, service)
-
-	// 通知所有监视者
-	for _, ch := range m.watchers[service.Name] {
-		select {
-		case ch <- m.services[service.Name]:
-		default:
-			// 避免阻塞
+	// 替换已存在的同ID实例
+	records := m.services[service.Name]
+	replaced := false
+	for i, r := range records {
+		if r.instance.ID == service.ID {
+			records[i] = rec
+			replaced = true
+			break
 		}
 	}
+	if !replaced {
+		records = append(records, rec)
+	}
+	m.services[service.Name] = records
 
+	m.notify(service.Name)
 	return nil
 }
 
 // Deregister 注销服务实例
-func (m *memRegistry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
-	m.Lock()
-	defer m.Unlock()
-
-	services := m.services[service.Name]
-	for i, s := range services {
-		if s.ID == service.ID {
-			m.services[service.Name] = append(services[:i], services[i+1:]...)
-			// 通知所有监视者
-			for _, ch := range m.watchers[service.Name] {
-				select {
-				case ch <- m.services[service.Name]:
-				default:
-					// 避免阻塞
-				}
-			}
+func (m *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	records := m.services[service.Name]
+	for i, r := range records {
+		if r.instance.ID == service.ID {
+			m.remove(service.Name, i)
+			m.notify(service.Name)
 			return nil
 		}
 	}
@@ -86,87 +149,147 @@ func (m *memRegistry) Deregister(ctx context.Context, service *registry.ServiceI
 	return nil
 }
 
-// GetService 获取服务实例列表
-func (m *memRegistry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
-	m.RLock()
-	defer m.RUnlock()
+// Renew 续约服务实例，实例不存在或已过期时返回ErrNotFound
+func (m *Registry) Renew(ctx context.Context, service *registry.ServiceInstance) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	services := m.services[serviceName]
-	if len(services) == 0 {
-		return nil, nil
+	for _, r := range m.services[service.Name] {
+		if r.instance.ID == service.ID {
+			if m.options.TTL > 0 {
+				r.expiresAt = time.Now().Add(m.options.TTL)
+			}
+			return nil
+		}
 	}
+	return ErrNotFound
+}
 
-	// 返回服务列表的副本
-	instances := make([]*registry.ServiceInstance, len(services))
-	for i, service := range services {
-		s := *service
-		instances[i] = &s
+// remove 移除服务的第i个实例，调用方需持有锁
+func (m *Registry) remove(serviceName string, i int) {
+	records := m.services[serviceName]
+	records = append(records[:i], records[i+1:]...)
+	if len(records) == 0 {
+		delete(m.services, serviceName)
+		return
 	}
-
-	return instances, nil
+	m.services[serviceName] = records
 }
 
-// Watch 监视服务变化
-func (m *memRegistry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
-	m.Lock()
-	defer m.Unlock()
+// list 返回服务实例列表的副本，调用方需持有锁
+func (m *Registry) list(serviceName string) []*registry.ServiceInstance {
+	records := m.services[serviceName]
+	if len(records) == 0 {
+		return nil
+	}
+	instances := make([]*registry.ServiceInstance, len(records))
+	for i, r := range records {
+		instances[i] = r.instance
+	}
+	return fanout.Copy(instances)
+}
 
-	// 为服务创建一个新的通知通道
-	ch := make(chan []*registry.ServiceInstance, 10)
-	m.watchers[serviceName] = append(m.watchers[serviceName], ch)
+// notify 向服务的观察者发布最新的实例列表，调用方需持有锁
+func (m *Registry) notify(serviceName string) {
+	if hub, ok := m.hubs[serviceName]; ok {
+		hub.Publish(m.list(serviceName))
+	}
+}
 
-	// 立即发送当前服务列表
-	if services, ok := m.services[serviceName]; ok && len(services) > 0 {
-		ch <- services
+// expireLoop 定期移除过期的服务实例
+func (m *Registry) expireLoop() {
+	ticker := time.NewTicker(m.options.TTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.expire(now)
+		}
 	}
+}
 
-	return &memWatcher{
-		registry: m,
-		ch:       ch,
-		service:  serviceName,
-	}, nil
+// expire 移除在now之前过期的服务实例
+func (m *Registry) expire(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, records := range m.services {
+		changed := false
+		for i := len(records) - 1; i >= 0; i-- {
+			if r := records[i]; !r.expiresAt.IsZero() && now.After(r.expiresAt) {
+				m.logger.Warn("服务实例已过期", log.String("service", name), log.String("id", r.instance.ID))
+				m.remove(name, i)
+				records = m.services[name]
+				changed = true
+			}
+		}
+		if changed {
+			m.notify(name)
+		}
+	}
 }
 
-type memWatcher struct {
-	registry *memRegistry
-	ch       chan []*registry.ServiceInstance
-	service  string
-	done     bool
+// GetService 获取服务实例列表
+func (m *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.list(serviceName), nil
 }
 
-// Next 等待下一个服务更新
-func (w *memWatcher) Next() ([]*registry.ServiceInstance, error) {
-	if w.done {
-		return nil, context.Canceled
+// Watch 监视服务变化，观察者立即收到当前的实例列表（可能为空），ctx结束时观察者停止
+func (m *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.ctx.Err(); err != nil {
+		return nil, err
+	}
+	hub, ok := m.hubs[serviceName]
+	if !ok {
+		hub = fanout.NewHub(func(hub *fanout.Hub) {
+			m.unwatch(serviceName, hub)
+		})
+		hub.Publish(m.list(serviceName))
+		m.hubs[serviceName] = hub
 	}
+	return hub.Subscribe(ctx), nil
+}
 
-	select {
-	case services := <-w.ch:
-		return services, nil
+// unwatch 在服务的最后一个观察者停止后移除共享的监视
+func (m *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.hubs[serviceName] != hub || hub.Len() > 0 {
+		return
 	}
+	delete(m.hubs, serviceName)
 }
 
-// Stop 停止监视
-func (w *memWatcher) Stop() error {
-	w.registry.Lock()
-	defer w.registry.Unlock()
+// Stop 停止过期检查和套接字服务，所有观察者随之停止
+func (m *Registry) Stop() error {
+	m.cancel()
 
-	if w.done {
-		return nil
+	m.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(m.hubs))
+	for _, hub := range m.hubs {
+		hubs = append(hubs, hub)
 	}
-
-	w.done = true
-	// 从注册表中移除此监视器
-	for i, ch := range w.registry.watchers[w.service] {
-		if ch == w.ch {
-			w.registry.watchers[w.service] = append(
-				w.registry.watchers[w.service][:i],
-				w.registry.watchers[w.service][i+1:]...,
-			)
-			break
-		}
+	var closers []interface{ Close() error }
+	for l := range m.listeners {
+		closers = append(closers, l)
 	}
+	for c := range m.conns {
+		closers = append(closers, c)
+	}
+	m.lock.Unlock()
 
-	close(w.ch)
+	for _, c := range closers {
+		_ = c.Close()
+	}
+	for _, hub := range hubs {
+		hub.Close()
+	}
 	return nil
 }
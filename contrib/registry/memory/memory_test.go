@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func instance(id string) *registry.ServiceInstance {
+	return &registry.ServiceInstance{ID: id, Name: "svc", Endpoints: []string{"grpc://" + id + ":9000"}, Metadata: map[string]string{"zone": "a"}}
+}
+
+func TestWatchCopiesInstances(t *testing.T) {
+	ctx := context.Background()
+	r := NewRegistry()
+	defer r.Stop()
+
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	// 空服务也会立即收到初始结果
+	if items, err := w.Next(); err != nil || len(items) != 0 {
+		t.Fatalf("initial next = %v, %v", items, err)
+	}
+
+	ins := instance("a")
+	_ = r.Register(ctx, ins)
+	ins.Metadata["zone"] = "b"
+	items, err := w.Next()
+	if err != nil || len(items) != 1 || items[0].Metadata["zone"] != "a" {
+		t.Fatalf("next = %v, %v", items, err)
+	}
+
+	items[0].Endpoints[0] = "mutated"
+	got, _ := r.GetService(ctx, "svc")
+	if got[0].Endpoints[0] != "grpc://a:9000" {
+		t.Errorf("registry state mutated through watcher: %v", got[0].Endpoints)
+	}
+}
+
+func TestWatchContext(t *testing.T) {
+	r := NewRegistry()
+	defer r.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, _ := r.Watch(ctx, "svc")
+	_, _ = w.Next()
+
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		cancel()
+	}()
+	if _, err := w.Next(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+
+	w, _ = r.Watch(context.Background(), "svc")
+	_ = w.Stop()
+	if _, err := w.Next(); err == nil {
+		t.Error("expected error after stop")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	r := NewRegistry(WithTTL(time.Millisecond * 100))
+	defer r.Stop()
+
+	w, _ := r.Watch(ctx, "svc")
+	defer w.Stop()
+	_, _ = w.Next()
+
+	a, b := instance("a"), instance("b")
+	_ = r.Register(ctx, a)
+	_ = r.Register(ctx, b)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 30)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_ = r.Renew(ctx, a)
+			}
+		}
+	}()
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case <-deadline:
+			t.Fatal("instance without heartbeat did not expire")
+		default:
+		}
+		items, err := w.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if len(items) == 1 && items[0].ID == "a" {
+			break
+		}
+	}
+
+	if err := r.Renew(ctx, b); !errors.Is(err, ErrNotFound) {
+		t.Errorf("renew expired instance = %v", err)
+	}
+}
@@ -0,0 +1,411 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.ServiceRegistrar = (*Client)(nil)
+)
+
+// 套接字协议的操作，请求和响应都是一行JSON
+const (
+	opRegister   = "register"
+	opDeregister = "deregister"
+	opRenew      = "renew"
+	opGet        = "get"
+	opWatch      = "watch" // 之后服务端在同一连接上持续推送实例列表，直到连接关闭
+)
+
+// request 是套接字协议的请求
+type request struct {
+	Op       string                    `json:"op"`
+	Name     string                    `json:"name,omitempty"`
+	Instance *registry.ServiceInstance `json:"instance,omitempty"`
+}
+
+// response 是套接字协议的响应
+type response struct {
+	Instances []*registry.ServiceInstance `json:"instances,omitempty"`
+	TTL       time.Duration               `json:"ttl,omitempty"`
+	NotFound  bool                        `json:"not_found,omitempty"`
+	Error     string                      `json:"error,omitempty"`
+}
+
+// ListenAndServe 在Unix套接字path上提供注册中心服务，已存在的套接字文件会被删除
+// 阻塞直到Stop被调用
+func (m *Registry) ListenAndServe(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return m.Serve(l)
+}
+
+// Serve 在l上提供注册中心服务，阻塞直到Stop被调用或l出错
+func (m *Registry) Serve(l net.Listener) error {
+	m.lock.Lock()
+	if err := m.ctx.Err(); err != nil {
+		m.lock.Unlock()
+		_ = l.Close()
+		return err
+	}
+	m.listeners[l] = struct{}{}
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		delete(m.listeners, l)
+		m.lock.Unlock()
+		_ = l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if m.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		m.lock.Lock()
+		m.conns[conn] = struct{}{}
+		m.lock.Unlock()
+		go m.serveConn(conn)
+	}
+}
+
+// serveConn 处理一个客户端连接
+func (m *Registry) serveConn(conn net.Conn) {
+	defer func() {
+		m.lock.Lock()
+		delete(m.conns, conn)
+		m.lock.Unlock()
+		_ = conn.Close()
+	}()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) && m.ctx.Err() == nil {
+				m.logger.Warn("读取注册中心请求失败", log.Err(err))
+			}
+			return
+		}
+
+		if req.Op == opWatch {
+			m.serveWatch(conn, dec, enc, req.Name)
+			return
+		}
+
+		var resp response
+		var err error
+		switch req.Op {
+		case opRegister, opDeregister, opRenew:
+			if req.Instance == nil {
+				err = errors.New("memory: missing instance")
+				break
+			}
+			switch req.Op {
+			case opRegister:
+				err = m.Register(m.ctx, req.Instance)
+				resp.TTL = m.options.TTL
+			case opDeregister:
+				err = m.Deregister(m.ctx, req.Instance)
+			case opRenew:
+				err = m.Renew(m.ctx, req.Instance)
+			}
+		case opGet:
+			resp.Instances, err = m.GetService(m.ctx, req.Name)
+		default:
+			err = errors.New("memory: unknown op " + req.Op)
+		}
+		if err != nil {
+			resp.NotFound = errors.Is(err, ErrNotFound)
+			resp.Error = err.Error()
+		}
+		if err := enc.Encode(&resp); err != nil {
+			return
+		}
+	}
+}
+
+// serveWatch 向客户端持续推送服务的实例列表，客户端关闭连接后停止
+func (m *Registry) serveWatch(conn net.Conn, dec *json.Decoder, enc *json.Encoder, serviceName string) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	w, err := m.Watch(ctx, serviceName)
+	if err != nil {
+		_ = enc.Encode(&response{Error: err.Error()})
+		return
+	}
+	defer w.Stop()
+
+	// 客户端不会再发送请求，读取出错说明连接已关闭
+	go func() {
+		_, _ = io.Copy(io.Discard, dec.Buffered())
+		_, _ = io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	for {
+		instances, err := w.Next()
+		if err != nil {
+			return
+		}
+		if err := enc.Encode(&response{Instances: instances}); err != nil {
+			return
+		}
+	}
+}
+
+// Client 是通过Unix套接字访问其他进程中内存注册中心的客户端
+// 注册的服务实例在服务端设置了TTL时由客户端自动续约，客户端进程退出后实例随TTL过期
+type Client struct {
+	path   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger log.Logger
+
+	lock sync.Mutex // 串行化请求
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+
+	keepaliveLock sync.Mutex
+	keepalives    map[string]context.CancelFunc // 服务名称/ID到续约循环的映射
+}
+
+// NewClient 创建连接到Unix套接字path上的内存注册中心的客户端
+func NewClient(path string, opts ...Option) (*Client, error) {
+	options := &Options{
+		Logger: log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		path:       path,
+		ctx:        ctx,
+		cancel:     cancel,
+		logger:     options.Logger,
+		keepalives: make(map[string]context.CancelFunc),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.connect(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect 建立连接，调用方需持有锁
+func (c *Client) connect() error {
+	var d net.Dialer
+	conn, err := d.DialContext(c.ctx, "unix", c.path)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.enc = json.NewEncoder(conn)
+	c.dec = json.NewDecoder(conn)
+	return nil
+}
+
+// call 发送请求并读取响应，连接断开后在下一次请求时重新连接
+func (c *Client) call(ctx context.Context, req *request) (*response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+	} else {
+		_ = c.conn.SetDeadline(time.Time{})
+	}
+	var resp response
+	err := c.enc.Encode(req)
+	if err == nil {
+		err = c.dec.Decode(&resp)
+	}
+	if err != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	if resp.NotFound {
+		return &resp, ErrNotFound
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// Register 注册服务实例，服务端设置了TTL时启动续约
+func (c *Client) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	resp, err := c.call(ctx, &request{Op: opRegister, Instance: service})
+	if err != nil {
+		return err
+	}
+	if resp.TTL > 0 {
+		c.keepalive(service, resp.TTL)
+	}
+	return nil
+}
+
+// keepalive 启动服务实例的续约循环，实例已过期时重新注册
+func (c *Client) keepalive(service *registry.ServiceInstance, ttl time.Duration) {
+	key := service.Name + "/" + service.ID
+	ctx, cancel := context.WithCancel(c.ctx)
+	copied := *service
+	service = &copied
+
+	c.keepaliveLock.Lock()
+	if stop, ok := c.keepalives[key]; ok {
+		stop()
+	}
+	c.keepalives[key] = cancel
+	c.keepaliveLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, err := c.call(ctx, &request{Op: opRenew, Instance: service})
+			if errors.Is(err, ErrNotFound) {
+				_, err = c.call(ctx, &request{Op: opRegister, Instance: service})
+			}
+			if err != nil && ctx.Err() == nil {
+				c.logger.Warn("续约服务实例失败", log.String("service", service.Name), log.String("id", service.ID), log.Err(err))
+			}
+		}
+	}()
+}
+
+// Deregister 注销服务实例并停止续约
+func (c *Client) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	key := service.Name + "/" + service.ID
+	c.keepaliveLock.Lock()
+	if stop, ok := c.keepalives[key]; ok {
+		stop()
+		delete(c.keepalives, key)
+	}
+	c.keepaliveLock.Unlock()
+
+	_, err := c.call(ctx, &request{Op: opDeregister, Instance: service})
+	return err
+}
+
+// GetService 获取服务实例列表
+func (c *Client) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	resp, err := c.call(ctx, &request{Op: opGet, Name: serviceName})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Instances, nil
+}
+
+// Watch 监视服务变化，每个观察者使用独立的连接，ctx结束时观察者停止
+func (c *Client) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(conn).Encode(&request{Op: opWatch, Name: serviceName}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	w := &socketWatcher{ctx: ctx, conn: conn, dec: json.NewDecoder(conn)}
+	w.stop = context.AfterFunc(ctx, func() { _ = conn.Close() })
+	return w, nil
+}
+
+// socketWatcher 是通过套接字接收服务更新的观察者
+type socketWatcher struct {
+	ctx  context.Context
+	conn net.Conn
+	dec  *json.Decoder
+	stop func() bool
+}
+
+// Next 等待下一个服务更新，观察者停止或连接断开后返回错误
+func (w *socketWatcher) Next() ([]*registry.ServiceInstance, error) {
+	var resp response
+	if err := w.dec.Decode(&resp); err != nil {
+		if ctxErr := w.ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Instances, nil
+}
+
+// Stop 停止观察
+func (w *socketWatcher) Stop() error {
+	w.stop()
+	_ = w.conn.Close()
+	return nil
+}
+
+// Stop 停止所有续约并关闭连接，已注册的实例在服务端随TTL过期
+func (c *Client) Stop() error {
+	c.cancel()
+
+	c.keepaliveLock.Lock()
+	for key, stop := range c.keepalives {
+		stop()
+		delete(c.keepalives, key)
+	}
+	c.keepaliveLock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		err := c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
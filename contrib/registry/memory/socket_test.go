@@ -0,0 +1,145 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+const (
+	envSocket = "MEMORY_REGISTRY_SOCKET"
+	envID     = "MEMORY_REGISTRY_ID"
+	envPeers  = "MEMORY_REGISTRY_PEERS"
+)
+
+// TestMain 在设置了套接字环境变量时作为子进程运行：注册自己并等待看到所有进程
+func TestMain(m *testing.M) {
+	if path := os.Getenv(envSocket); path != "" {
+		os.Exit(runPeer(path, os.Getenv(envID), os.Getenv(envPeers)))
+	}
+	os.Exit(m.Run())
+}
+
+func runPeer(path, id, peers string) int {
+	n, _ := strconv.Atoi(peers)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	c, err := NewClient(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer c.Stop()
+	if err := c.Register(ctx, instance(id)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w, err := c.Watch(ctx, "svc")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer w.Stop()
+	for {
+		items, err := w.Next()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(items) == n {
+			return 0
+		}
+	}
+}
+
+func TestMultiProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.sock")
+	r := NewRegistry(WithTTL(time.Second))
+	defer r.Stop()
+	go func() { _ = r.ListenAndServe(path) }()
+	waitSocket(t, path)
+
+	const peers = 3
+	errs := make(chan error, peers)
+	for i := 0; i < peers; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), envSocket+"="+path, envID+"="+strconv.Itoa(i), envPeers+"="+strconv.Itoa(peers))
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start peer: %v", err)
+		}
+		go func() { errs <- cmd.Wait() }()
+	}
+	for i := 0; i < peers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("peer failed: %v", err)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.sock")
+	r := NewRegistry(WithTTL(time.Millisecond * 150))
+	defer r.Stop()
+	go func() { _ = r.ListenAndServe(path) }()
+	waitSocket(t, path)
+
+	c, err := NewClient(path)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if err := c.Register(ctx, instance("a")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// 客户端自动续约，超过TTL后实例仍然存在
+	time.Sleep(time.Millisecond * 400)
+	if got, err := c.GetService(ctx, "svc"); err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	w, err := c.Watch(wctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if items, err := w.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("next = %v, %v", items, err)
+	}
+
+	// 客户端停止续约后实例过期
+	_ = c.Stop()
+	if items, err := w.Next(); err != nil || len(items) != 0 {
+		t.Fatalf("next after client stop = %v, %v", items, err)
+	}
+	cancel()
+	if _, err := w.Next(); err == nil {
+		t.Error("expected error after ctx canceled")
+	}
+
+	c, _ = NewClient(path)
+	defer c.Stop()
+	if err := c.Deregister(ctx, &registry.ServiceInstance{ID: "b", Name: "svc"}); err != nil {
+		t.Errorf("deregister unknown instance: %v", err)
+	}
+}
+
+func waitSocket(t *testing.T, path string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("socket not ready")
+}
@@ -0,0 +1,93 @@
+package nacos
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	registry.RegisterFactory(registry.Nacos, newFromConfig)
+}
+
+// ownedRegistry 是由工厂创建的注册中心，停止时关闭工厂创建的客户端
+type ownedRegistry struct {
+	*Registry
+}
+
+// Stop 停止注册中心并关闭客户端
+func (r ownedRegistry) Stop() error {
+	err := r.Registry.Stop()
+	r.client.CloseClient()
+	return err
+}
+
+// newFromConfig 根据通用配置创建Nacos注册中心，终端点格式为host:port，前缀是Nacos服务的上下文路径
+// 支持的参数：namespace、group、cluster、ephemeral、cache_dir、log_dir
+func newFromConfig(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, registry.ErrNoEndpoints
+	}
+	ephemeral, err := cfg.BoolParam("ephemeral", true)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if cfg.TLSEnabled {
+		scheme = "https"
+	}
+	servers := make([]constant.ServerConfig, 0, len(cfg.Endpoints))
+	for _, endpoint := range cfg.Endpoints {
+		host, portStr, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		serverOpts := []constant.ServerOption{constant.WithScheme(scheme)}
+		if cfg.Prefix != "" && cfg.Prefix != "/" {
+			serverOpts = append(serverOpts, constant.WithContextPath(cfg.Prefix))
+		}
+		servers = append(servers, *constant.NewServerConfig(host, port, serverOpts...))
+	}
+
+	clientOpts := []constant.ClientOption{
+		constant.WithNamespaceId(cfg.Param("namespace")),
+		constant.WithUsername(cfg.Username),
+		constant.WithPassword(cfg.Password),
+		constant.WithNotLoadCacheAtStart(true),
+	}
+	if cfg.Timeout > 0 {
+		clientOpts = append(clientOpts, constant.WithTimeoutMs(uint64(cfg.Timeout.Milliseconds())))
+	}
+	if dir := cfg.Param("cache_dir"); dir != "" {
+		clientOpts = append(clientOpts, constant.WithCacheDir(dir))
+	}
+	if dir := cfg.Param("log_dir"); dir != "" {
+		clientOpts = append(clientOpts, constant.WithLogDir(dir))
+	}
+	client, err := clients.NewNamingClient(vo.NacosClientParam{
+		ClientConfig:  constant.NewClientConfig(clientOpts...),
+		ServerConfigs: servers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{WithEphemeral(ephemeral)}
+	if group := cfg.Param("group"); group != "" {
+		opts = append(opts, WithGroup(group))
+	}
+	if cluster := cfg.Param("cluster"); cluster != "" {
+		opts = append(opts, WithCluster(cluster))
+	}
+	return ownedRegistry{NewRegistry(client, opts...)}, nil
+}
@@ -0,0 +1,474 @@
+package nacos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+)
+
+var (
+	_ registry.ServiceRegistrar = (*Registry)(nil)
+)
+
+const (
+	// metaID 是元数据中保存服务实例ID的键，同一服务实例的多个Nacos实例共享该ID
+	metaID = "phantasm-id"
+	// metaScheme 是元数据中保存端点协议的键
+	metaScheme = "phantasm-scheme"
+	// metaVersion 是元数据中保存服务版本的键
+	metaVersion = "phantasm-version"
+	// metaWeight 是服务实例元数据中表示权重的键
+	metaWeight = "weight"
+)
+
+// Registry 是基于Nacos的服务注册发现中心
+// 每个端点注册为一个Nacos实例，发现时按服务实例ID合并还原
+type Registry struct {
+	client   naming_client.INamingClient
+	options  *Options
+	lock     sync.RWMutex
+	watchers map[string]*serviceWatch // 服务名称到共享订阅的映射
+	logger   log.Logger
+
+	ephemeraLock sync.Mutex                                       // 保护ephemera，调用Nacos前释放
+	submitLock   sync.Mutex                                       // 串行化临时实例的提交，保证最后提交的是最新的实例列表
+	ephemera     map[string]map[string][]vo.RegisterInstanceParam // 服务名称到本客户端注册的临时实例，按服务实例ID分组
+}
+
+// Options 是Nacos注册中心的选项
+type Options struct {
+	Group     string  // 服务分组
+	Cluster   string  // 注册使用的集群
+	Weight    float64 // 默认权重，服务实例元数据中的weight优先
+	Ephemeral bool    // 是否注册为临时实例
+	Logger    log.Logger
+}
+
+// Option 是Nacos注册中心的选项函数
+type Option func(*Options)
+
+// WithGroup 设置服务分组
+func WithGroup(group string) Option {
+	return func(o *Options) {
+		o.Group = group
+	}
+}
+
+// WithCluster 设置注册使用的集群
+func WithCluster(cluster string) Option {
+	return func(o *Options) {
+		o.Cluster = cluster
+	}
+}
+
+// WithWeight 设置默认权重
+func WithWeight(weight float64) Option {
+	return func(o *Options) {
+		o.Weight = weight
+	}
+}
+
+// WithEphemeral 设置是否注册为临时实例，临时实例随客户端连接断开而下线
+func WithEphemeral(ephemeral bool) Option {
+	return func(o *Options) {
+		o.Ephemeral = ephemeral
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewRegistry 创建Nacos注册中心实例
+func NewRegistry(client naming_client.INamingClient, opts ...Option) *Registry {
+	options := &Options{
+		Group:     constant.DEFAULT_GROUP,
+		Cluster:   "DEFAULT",
+		Weight:    1,
+		Ephemeral: true,
+		Logger:    log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Registry{
+		client:   client,
+		options:  options,
+		lock:     sync.RWMutex{},
+		watchers: make(map[string]*serviceWatch),
+		ephemera: make(map[string]map[string][]vo.RegisterInstanceParam),
+		logger:   options.Logger,
+	}
+}
+
+// Register 注册服务实例
+// Nacos 2.x中同一客户端对同一服务只保留一次临时实例注册，因此多个临时实例通过批量注册一起提交
+func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	if service.Status == "" {
+		service.Status = registry.StatusUp
+	}
+
+	params, err := r.instanceParams(service)
+	if err != nil {
+		return err
+	}
+
+	if !r.options.Ephemeral {
+		for _, p := range params {
+			if _, err := r.client.RegisterInstance(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r.ephemeraLock.Lock()
+	registered, ok := r.ephemera[service.Name]
+	if !ok {
+		registered = make(map[string][]vo.RegisterInstanceParam)
+		r.ephemera[service.Name] = registered
+	}
+	previous, existed := registered[service.ID]
+	registered[service.ID] = params
+	r.ephemeraLock.Unlock()
+
+	if err := r.submit(service.Name); err != nil {
+		// 提交失败时恢复记录，期间被其他调用替换的记录保持不变
+		r.ephemeraLock.Lock()
+		if current := r.ephemera[service.Name][service.ID]; len(current) > 0 && &current[0] == &params[0] {
+			if existed {
+				r.ephemera[service.Name][service.ID] = previous
+			} else {
+				delete(r.ephemera[service.Name], service.ID)
+			}
+		}
+		r.ephemeraLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// submit 提交服务在本客户端的全部临时实例
+// 提交串行进行，并在取得 submitLock 后读取实例列表，并发的注册和注销不会被较早的列表覆盖
+func (r *Registry) submit(serviceName string) error {
+	r.submitLock.Lock()
+	defer r.submitLock.Unlock()
+
+	r.ephemeraLock.Lock()
+	all := make([]vo.RegisterInstanceParam, 0, len(r.ephemera[serviceName]))
+	for _, params := range r.ephemera[serviceName] {
+		all = append(all, params...)
+	}
+	r.ephemeraLock.Unlock()
+
+	switch len(all) {
+	case 0:
+		// 实例已全部被并发注销，由注销流程移除
+		return nil
+	case 1:
+		_, err := r.client.RegisterInstance(all[0])
+		return err
+	}
+	_, err := r.client.BatchRegisterInstance(vo.BatchRegisterInstanceParam{
+		ServiceName: serviceName,
+		GroupName:   r.options.Group,
+		Instances:   all,
+	})
+	return err
+}
+
+// instanceParams 将服务实例的每个端点转换为一个Nacos实例
+// Nacos以IP、端口和集群标识实例，同一地址上的其他协议（例如同一端口上的HTTP和gRPC）注册到"集群-协议"集群，
+// 避免后注册的端点覆盖之前的端点；发现时按服务实例ID合并，不区分集群
+func (r *Registry) instanceParams(service *registry.ServiceInstance) ([]vo.RegisterInstanceParam, error) {
+	if len(service.Endpoints) == 0 {
+		return nil, fmt.Errorf("nacos: service %s has no endpoints", service.ID)
+	}
+
+	weight := r.options.Weight
+	if w, err := strconv.ParseFloat(service.Metadata[metaWeight], 64); err == nil && w > 0 {
+		weight = w
+	}
+
+	params := make([]vo.RegisterInstanceParam, 0, len(service.Endpoints))
+	hosts := make(map[string]bool, len(service.Endpoints))
+	for _, e := range service.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, err
+		}
+		host, portStr, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("nacos: invalid endpoint %s: %w", e, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("nacos: invalid endpoint %s: %w", e, err)
+		}
+
+		cluster := r.options.Cluster
+		if hosts[u.Host] {
+			cluster += "-" + u.Scheme
+		}
+		hosts[u.Host] = true
+
+		metadata := make(map[string]string, len(service.Metadata)+3)
+		for k, v := range service.Metadata {
+			metadata[k] = v
+		}
+		metadata[metaID] = service.ID
+		metadata[metaScheme] = u.Scheme
+		if service.Version != "" {
+			metadata[metaVersion] = service.Version
+		}
+
+		params = append(params, vo.RegisterInstanceParam{
+			Ip:          host,
+			Port:        port,
+			Weight:      weight,
+			Enable:      service.Status != registry.StatusDown,
+			Healthy:     true,
+			Metadata:    metadata,
+			ClusterName: cluster,
+			ServiceName: service.Name,
+			GroupName:   r.options.Group,
+			Ephemeral:   r.options.Ephemeral,
+		})
+	}
+	return params, nil
+}
+
+// Deregister 注销服务实例
+func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	params, err := r.instanceParams(service)
+	if err != nil {
+		return err
+	}
+
+	if r.options.Ephemeral {
+		r.ephemeraLock.Lock()
+		registered := r.ephemera[service.Name]
+		delete(registered, service.ID)
+		remaining := len(registered) > 0
+		if !remaining {
+			delete(r.ephemera, service.Name)
+		}
+		r.ephemeraLock.Unlock()
+		if remaining {
+			// 重新提交其余实例即可移除当前实例
+			return r.submit(service.Name)
+		}
+		// 与临时实例的提交串行，避免注销与并发的批量注册交错
+		r.submitLock.Lock()
+		defer r.submitLock.Unlock()
+	}
+
+	var errs []error
+	for _, p := range params {
+		_, err := r.client.DeregisterInstance(vo.DeregisterInstanceParam{
+			Ip:          p.Ip,
+			Port:        p.Port,
+			Cluster:     p.ClusterName,
+			ServiceName: p.ServiceName,
+			GroupName:   p.GroupName,
+			Ephemeral:   p.Ephemeral,
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetService 获取服务实例列表
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	instances, err := r.client.SelectAllInstances(vo.SelectAllInstancesParam{
+		ServiceName: serviceName,
+		GroupName:   r.options.Group,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toServiceInstances(serviceName, instances), nil
+}
+
+// toServiceInstances 将Nacos实例按服务实例ID合并为服务实例，过滤不可用的实例
+// 非Phantasm注册的实例以Nacos实例ID作为服务实例ID，根据secure元数据推断协议
+func toServiceInstances(serviceName string, instances []model.Instance) []*registry.ServiceInstance {
+	grouped := make(map[string]*registry.ServiceInstance, len(instances))
+	for _, in := range instances {
+		if !in.Enable || !in.Healthy || in.Weight <= 0 {
+			continue
+		}
+
+		id := in.Metadata[metaID]
+		if id == "" {
+			id = in.InstanceId
+		}
+		if id == "" {
+			id = net.JoinHostPort(in.Ip, strconv.FormatUint(in.Port, 10))
+		}
+
+		si, ok := grouped[id]
+		if !ok {
+			si = &registry.ServiceInstance{
+				ID:       id,
+				Name:     serviceName,
+				Version:  in.Metadata[metaVersion],
+				Metadata: make(map[string]string, len(in.Metadata)),
+				Status:   registry.StatusUp,
+			}
+			for k, v := range in.Metadata {
+				switch k {
+				case metaID, metaScheme, metaVersion:
+				default:
+					si.Metadata[k] = v
+				}
+			}
+			grouped[id] = si
+		}
+
+		scheme := in.Metadata[metaScheme]
+		if scheme == "" {
+			scheme = "http"
+			if in.Metadata["secure"] == "true" {
+				scheme = "https"
+			}
+		}
+		si.Endpoints = append(si.Endpoints, scheme+"://"+net.JoinHostPort(in.Ip, strconv.FormatUint(in.Port, 10)))
+	}
+
+	result := make([]*registry.ServiceInstance, 0, len(grouped))
+	for _, si := range grouped {
+		sort.Strings(si.Endpoints)
+		result = append(result, si)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// serviceWatch 是同一服务共享的订阅
+type serviceWatch struct {
+	hub       *fanout.Hub
+	param     *vo.SubscribeParam
+	lock      sync.Mutex
+	published bool // 订阅回调是否已发布过实例列表
+}
+
+// Watch 监视服务变更
+// 同一服务的所有观察者共享一个Nacos订阅，每个观察者在自己的ctx结束或调用Stop后停止
+// 订阅和读取实例列表不持有锁，并发创建同一服务的订阅时保留先完成的订阅
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	// 在锁内订阅共享的分发器，避免与最后一个观察者停止后的取消订阅交错
+	r.lock.Lock()
+	if sw, ok := r.watchers[serviceName]; ok {
+		w := sw.hub.Subscribe(ctx)
+		r.lock.Unlock()
+		return w, nil
+	}
+	r.lock.Unlock()
+
+	sw := &serviceWatch{}
+	sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+		r.unwatch(serviceName, hub)
+	})
+	sw.param = &vo.SubscribeParam{
+		ServiceName: serviceName,
+		GroupName:   r.options.Group,
+		SubscribeCallback: func(instances []model.Instance, err error) {
+			if err != nil {
+				r.logger.Error("订阅服务变更失败", log.String("service", serviceName), log.Err(err))
+				return
+			}
+			sw.lock.Lock()
+			sw.published = true
+			sw.hub.Publish(toServiceInstances(serviceName, instances))
+			sw.lock.Unlock()
+		},
+	}
+	if err := r.client.Subscribe(sw.param); err != nil {
+		return nil, err
+	}
+
+	// 订阅不一定立即回调，先发布当前的实例列表；已有回调时以回调的数据为准
+	instances, err := r.client.SelectAllInstances(vo.SelectAllInstancesParam{
+		ServiceName: serviceName,
+		GroupName:   r.options.Group,
+	})
+	if err != nil {
+		_ = r.client.Unsubscribe(sw.param)
+		return nil, err
+	}
+	sw.lock.Lock()
+	if !sw.published {
+		sw.hub.Publish(toServiceInstances(serviceName, instances))
+	}
+	sw.lock.Unlock()
+
+	r.lock.Lock()
+	if existing, ok := r.watchers[serviceName]; ok {
+		w := existing.hub.Subscribe(ctx)
+		r.lock.Unlock()
+		_ = r.client.Unsubscribe(sw.param)
+		return w, nil
+	}
+	r.watchers[serviceName] = sw
+	w := sw.hub.Subscribe(ctx)
+	r.lock.Unlock()
+	return w, nil
+}
+
+// unwatch 在服务的最后一个观察者停止后取消订阅
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		r.lock.Unlock()
+		return
+	}
+	delete(r.watchers, serviceName)
+	r.lock.Unlock()
+
+	if err := r.client.Unsubscribe(sw.param); err != nil {
+		r.logger.Warn("取消订阅失败", log.String("service", serviceName), log.Err(err))
+	}
+}
+
+// Stop 停止注册中心，取消所有订阅，所有观察者随之停止
+func (r *Registry) Stop() error {
+	r.lock.Lock()
+	watchers := make([]*serviceWatch, 0, len(r.watchers))
+	for name, sw := range r.watchers {
+		watchers = append(watchers, sw)
+		delete(r.watchers, name)
+	}
+	r.lock.Unlock()
+
+	var errs []error
+	for _, sw := range watchers {
+		if err := r.client.Unsubscribe(sw.param); err != nil {
+			errs = append(errs, err)
+		}
+		sw.hub.Close()
+	}
+	return errors.Join(errs...)
+}
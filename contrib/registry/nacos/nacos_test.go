@@ -0,0 +1,401 @@
+package nacos
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+)
+
+// fakeNaming 是一个内存中的Nacos命名客户端
+// 与Nacos 2.x一致，同一客户端对同一服务的临时实例注册会整体替换之前的注册
+type fakeNaming struct {
+	naming_client.INamingClient
+
+	lock       sync.Mutex
+	ephemeral  map[string][]model.Instance
+	persistent map[string][]model.Instance
+	subs       map[string][]*vo.SubscribeParam
+	entered    chan struct{} // 不为nil时Subscribe进入后发送通知
+	block      chan struct{} // 不为nil时Subscribe阻塞到它关闭
+	registerIn chan struct{} // 不为nil时注册请求进入后发送通知
+	registerAt chan struct{} // 不为nil时注册请求阻塞到它关闭
+}
+
+// waitRegister 在设置了 registerAt 时阻塞注册请求
+func (f *fakeNaming) waitRegister() {
+	if f.registerAt != nil {
+		f.registerIn <- struct{}{}
+		<-f.registerAt
+	}
+}
+
+func newFakeNaming() *fakeNaming {
+	return &fakeNaming{
+		ephemeral:  make(map[string][]model.Instance),
+		persistent: make(map[string][]model.Instance),
+		subs:       make(map[string][]*vo.SubscribeParam),
+	}
+}
+
+func toModel(p vo.RegisterInstanceParam) model.Instance {
+	return model.Instance{
+		InstanceId:  net.JoinHostPort(p.Ip, strconv.FormatUint(p.Port, 10)),
+		Ip:          p.Ip,
+		Port:        p.Port,
+		Weight:      p.Weight,
+		Healthy:     p.Healthy,
+		Enable:      p.Enable,
+		Ephemeral:   p.Ephemeral,
+		ClusterName: p.ClusterName,
+		ServiceName: p.ServiceName,
+		Metadata:    p.Metadata,
+	}
+}
+
+func (f *fakeNaming) RegisterInstance(p vo.RegisterInstanceParam) (bool, error) {
+	f.waitRegister()
+	f.lock.Lock()
+	if p.Ephemeral {
+		f.ephemeral[p.ServiceName] = []model.Instance{toModel(p)}
+	} else {
+		f.persistent[p.ServiceName] = append(f.persistent[p.ServiceName], toModel(p))
+	}
+	f.lock.Unlock()
+	f.notify(p.ServiceName)
+	return true, nil
+}
+
+func (f *fakeNaming) BatchRegisterInstance(p vo.BatchRegisterInstanceParam) (bool, error) {
+	f.waitRegister()
+	instances := make([]model.Instance, 0, len(p.Instances))
+	for _, in := range p.Instances {
+		instances = append(instances, toModel(in))
+	}
+	f.lock.Lock()
+	f.ephemeral[p.ServiceName] = instances
+	f.lock.Unlock()
+	f.notify(p.ServiceName)
+	return true, nil
+}
+
+func (f *fakeNaming) DeregisterInstance(p vo.DeregisterInstanceParam) (bool, error) {
+	f.lock.Lock()
+	for _, m := range []map[string][]model.Instance{f.ephemeral, f.persistent} {
+		kept := m[p.ServiceName][:0]
+		for _, in := range m[p.ServiceName] {
+			if in.Ip != p.Ip || in.Port != p.Port || in.ClusterName != p.Cluster {
+				kept = append(kept, in)
+			}
+		}
+		m[p.ServiceName] = kept
+	}
+	f.lock.Unlock()
+	f.notify(p.ServiceName)
+	return true, nil
+}
+
+func (f *fakeNaming) SelectAllInstances(p vo.SelectAllInstancesParam) ([]model.Instance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.all(p.ServiceName), nil
+}
+
+func (f *fakeNaming) all(serviceName string) []model.Instance {
+	all := append([]model.Instance{}, f.ephemeral[serviceName]...)
+	return append(all, f.persistent[serviceName]...)
+}
+
+func (f *fakeNaming) Subscribe(p *vo.SubscribeParam) error {
+	if f.block != nil {
+		f.entered <- struct{}{}
+		<-f.block
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.subs[p.ServiceName] = append(f.subs[p.ServiceName], p)
+	return nil
+}
+
+func (f *fakeNaming) Unsubscribe(p *vo.SubscribeParam) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	subs := f.subs[p.ServiceName][:0]
+	for _, s := range f.subs[p.ServiceName] {
+		if s != p {
+			subs = append(subs, s)
+		}
+	}
+	f.subs[p.ServiceName] = subs
+	return nil
+}
+
+func (f *fakeNaming) notify(serviceName string) {
+	f.lock.Lock()
+	subs := append([]*vo.SubscribeParam{}, f.subs[serviceName]...)
+	instances := f.all(serviceName)
+	f.lock.Unlock()
+	for _, s := range subs {
+		s.SubscribeCallback(instances, nil)
+	}
+}
+
+func TestMultiSchemeRoundTrip(t *testing.T) {
+	client := newFakeNaming()
+	r := NewRegistry(client)
+	ctx := context.Background()
+
+	ins := &registry.ServiceInstance{
+		ID:        "greeter-1",
+		Name:      "greeter",
+		Version:   "v1.0.0",
+		Metadata:  map[string]string{"zone": "a", "weight": "20"},
+		Endpoints: []string{"grpc://10.0.0.1:9000", "http://10.0.0.1:8000"},
+	}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	raw := client.all("greeter")
+	if len(raw) != 2 {
+		t.Fatalf("expected one Nacos instance per scheme, got %d", len(raw))
+	}
+	for _, in := range raw {
+		if in.Weight != 20 || in.ClusterName != "DEFAULT" || !in.Ephemeral {
+			t.Errorf("unexpected nacos instance: %+v", in)
+		}
+	}
+
+	got, err := r.GetService(ctx, "greeter")
+	if err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	want := []string{"grpc://10.0.0.1:9000", "http://10.0.0.1:8000"}
+	if !reflect.DeepEqual(got[0].Endpoints, want) {
+		t.Errorf("endpoints = %v, want %v", got[0].Endpoints, want)
+	}
+	if got[0].ID != ins.ID || got[0].Version != ins.Version || !reflect.DeepEqual(got[0].Metadata, ins.Metadata) {
+		t.Errorf("instance = %+v", got[0])
+	}
+}
+
+func TestSharedAddress(t *testing.T) {
+	client := newFakeNaming()
+	r := NewRegistry(client, WithEphemeral(false))
+	ctx := context.Background()
+
+	// 同一端口上的gRPC和HTTP注册为两个Nacos实例
+	ins := &registry.ServiceInstance{
+		ID:        "a",
+		Name:      "svc",
+		Endpoints: []string{"grpc://10.0.0.1:9000", "http://10.0.0.1:9000"},
+	}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	raw := client.all("svc")
+	if len(raw) != 2 {
+		t.Fatalf("expected one Nacos instance per scheme, got %+v", raw)
+	}
+	clusters := map[string]string{}
+	for _, in := range raw {
+		clusters[in.Metadata[metaScheme]] = in.ClusterName
+	}
+	if clusters["grpc"] != "DEFAULT" || clusters["http"] != "DEFAULT-http" {
+		t.Errorf("clusters = %v", clusters)
+	}
+
+	got, err := r.GetService(ctx, "svc")
+	if err != nil || len(got) != 1 || !reflect.DeepEqual(got[0].Endpoints, ins.Endpoints) {
+		t.Fatalf("get service = %+v, %v", got, err)
+	}
+
+	if err := r.Deregister(ctx, ins); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if raw := client.all("svc"); len(raw) != 0 {
+		t.Errorf("instances left after deregister: %+v", raw)
+	}
+}
+
+func TestEphemeralInstancesShareRegistration(t *testing.T) {
+	client := newFakeNaming()
+	r := NewRegistry(client)
+	ctx := context.Background()
+
+	a := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://10.0.0.1:9000"}}
+	b := &registry.ServiceInstance{ID: "b", Name: "svc", Endpoints: []string{"grpc://10.0.0.2:9000"}}
+	for _, ins := range []*registry.ServiceInstance{a, b} {
+		if err := r.Register(ctx, ins); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	if got, _ := r.GetService(ctx, "svc"); len(got) != 2 {
+		t.Fatalf("expected both instances registered, got %v", got)
+	}
+
+	if err := r.Deregister(ctx, a); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	got, _ := r.GetService(ctx, "svc")
+	if len(got) != 1 || got[0].ID != "b" {
+		t.Fatalf("expected only b, got %v", got)
+	}
+
+	if err := r.Deregister(ctx, b); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if got, _ := r.GetService(ctx, "svc"); len(got) != 0 {
+		t.Fatalf("expected no instances, got %v", got)
+	}
+}
+
+func TestWatchSubscribe(t *testing.T) {
+	client := newFakeNaming()
+	r := NewRegistry(client, WithEphemeral(false))
+	ctx := context.Background()
+
+	w1, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	w2, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if n := len(client.subs["svc"]); n != 1 {
+		t.Fatalf("expected one shared subscription, got %d", n)
+	}
+	for _, w := range []registry.Watcher{w1, w2} {
+		if got, err := w.Next(); err != nil || len(got) != 0 {
+			t.Fatalf("initial next = %v, %v", got, err)
+		}
+	}
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://10.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for _, w := range []registry.Watcher{w1, w2} {
+		if got, err := w.Next(); err != nil || len(got) != 1 || got[0].ID != "a" {
+			t.Fatalf("next after register = %v, %v", got, err)
+		}
+	}
+
+	_ = w1.Stop()
+	_ = w2.Stop()
+	deadline := time.Now().Add(time.Second)
+	for len(client.subs["svc"]) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := len(client.subs["svc"]); n != 0 {
+		t.Errorf("expected unsubscribe after last watcher stopped, got %d", n)
+	}
+}
+
+func TestForeignInstances(t *testing.T) {
+	got := toServiceInstances("orders", []model.Instance{
+		{InstanceId: "10.0.0.3#8443#DEFAULT#DEFAULT_GROUP@@orders", Ip: "10.0.0.3", Port: 8443, Weight: 1, Healthy: true, Enable: true,
+			Metadata: map[string]string{"secure": "true"}},
+		{InstanceId: "10.0.0.4#8080#DEFAULT#DEFAULT_GROUP@@orders", Ip: "10.0.0.4", Port: 8080, Weight: 1, Healthy: false, Enable: true},
+	})
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Endpoints, []string{"https://10.0.0.3:8443"}) {
+		t.Fatalf("instances = %+v", got)
+	}
+}
+
+func TestWatchDoesNotHoldLock(t *testing.T) {
+	client := newFakeNaming()
+	client.entered = make(chan struct{}, 1)
+	client.block = make(chan struct{})
+	r := NewRegistry(client)
+	ctx := context.Background()
+
+	watched := make(chan registry.Watcher, 1)
+	go func() {
+		w, err := r.Watch(ctx, "svc")
+		if err != nil {
+			t.Errorf("watch: %v", err)
+		}
+		watched <- w
+	}()
+
+	// 订阅阻塞时仍可以注册实例
+	<-client.entered
+	registered := make(chan error, 1)
+	go func() {
+		registered <- r.Register(ctx, &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://10.0.0.1:9000"}})
+	}()
+	select {
+	case err := <-registered:
+		if err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("register blocked by an in-flight subscribe")
+	}
+
+	close(client.block)
+	w := <-watched
+	defer w.Stop()
+	if got, err := w.Next(); err != nil || len(got) != 1 {
+		t.Fatalf("next = %v, %v", got, err)
+	}
+}
+
+func TestRegisterDoesNotHoldLock(t *testing.T) {
+	client := newFakeNaming()
+	client.registerIn = make(chan struct{}, 1)
+	client.registerAt = make(chan struct{})
+	r := NewRegistry(client)
+	ctx := context.Background()
+
+	a := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://10.0.0.1:9000"}}
+	registered := make(chan error, 1)
+	go func() {
+		registered <- r.Register(ctx, a)
+	}()
+
+	// 注册请求阻塞时仍可以观察服务
+	<-client.registerIn
+	watched := make(chan error, 1)
+	go func() {
+		w, err := r.Watch(ctx, "svc")
+		if err == nil {
+			_ = w.Stop()
+		}
+		watched <- err
+	}()
+	select {
+	case err := <-watched:
+		if err != nil {
+			t.Fatalf("watch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch blocked by an in-flight register")
+	}
+
+	// 并发注册的实例在前一次提交完成后一起提交
+	b := &registry.ServiceInstance{ID: "b", Name: "svc", Endpoints: []string{"grpc://10.0.0.2:9000"}}
+	go func() {
+		registered <- r.Register(ctx, b)
+	}()
+	close(client.registerAt)
+	for i := 0; i < 2; i++ {
+		if err := <-registered; err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+	if got, _ := r.GetService(ctx, "svc"); len(got) != 2 {
+		t.Fatalf("expected both instances registered, got %v", got)
+	}
+}
@@ -0,0 +1,209 @@
+package zookeeper
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+const (
+	// metaEndpoints 是Curator格式中保存全部端点的元数据键
+	metaEndpoints = "phantasm-endpoints"
+	// metaVersion 是Curator格式中保存服务版本的元数据键
+	metaVersion = "phantasm-version"
+
+	// curatorPayloadClass 是Spring Cloud Zookeeper使用的payload类型，Java服务可直接反序列化
+	curatorPayloadClass = "org.springframework.cloud.zookeeper.discovery.ZookeeperInstance"
+)
+
+// curatorInstance 是Curator ServiceDiscovery的实例节点数据
+type curatorInstance struct {
+	Name                string          `json:"name"`
+	ID                  string          `json:"id"`
+	Address             string          `json:"address"`
+	Port                *int            `json:"port"`
+	SSLPort             *int            `json:"sslPort"`
+	Payload             *curatorPayload `json:"payload"`
+	RegistrationTimeUTC int64           `json:"registrationTimeUTC"`
+	ServiceType         string          `json:"serviceType"`
+	URISpec             *curatorURISpec `json:"uriSpec,omitempty"`
+	Enabled             *bool           `json:"enabled,omitempty"`
+}
+
+// curatorPayload 是实例节点的自定义数据
+type curatorPayload struct {
+	Class    string            `json:"@class,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// curatorURISpec 是Curator用于拼接服务地址的模板
+type curatorURISpec struct {
+	Parts []curatorURIPart `json:"parts"`
+}
+
+// curatorURIPart 是地址模板的一部分
+type curatorURIPart struct {
+	Value    string `json:"value"`
+	Variable bool   `json:"variable"`
+}
+
+// defaultURISpec 对应模板 {scheme}://{address}:{port}
+var defaultURISpec = &curatorURISpec{Parts: []curatorURIPart{
+	{Value: "scheme", Variable: true},
+	{Value: "://"},
+	{Value: "address", Variable: true},
+	{Value: ":"},
+	{Value: "port", Variable: true},
+}}
+
+// encode 按节点格式序列化服务实例
+func encode(layout Layout, service *registry.ServiceInstance) ([]byte, error) {
+	if layout != LayoutCurator {
+		return json.Marshal(service)
+	}
+
+	metadata := make(map[string]string, len(service.Metadata)+2)
+	for k, v := range service.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaEndpoints] = strings.Join(service.Endpoints, ",")
+	if service.Version != "" {
+		metadata[metaVersion] = service.Version
+	}
+
+	enabled := service.Status != registry.StatusDown
+	ci := &curatorInstance{
+		Name: service.Name,
+		ID:   service.ID,
+		Payload: &curatorPayload{
+			Class:    curatorPayloadClass,
+			ID:       service.ID,
+			Name:     service.Name,
+			Metadata: metadata,
+		},
+		RegistrationTimeUTC: service.CreatedAt.UnixMilli(),
+		ServiceType:         "DYNAMIC",
+		URISpec:             defaultURISpec,
+		Enabled:             &enabled,
+	}
+
+	// Curator只能表达一个地址，优先使用http/https端点，都没有时使用第一个端点
+	var first, plain, secure *hostPort
+	for _, e := range service.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			continue
+		}
+		hp, ok := splitHostPort(u.Host)
+		if !ok {
+			continue
+		}
+		if first == nil {
+			first = hp
+		}
+		if u.Scheme == "http" && plain == nil {
+			plain = hp
+		}
+		if u.Scheme == "https" && secure == nil {
+			secure = hp
+		}
+	}
+	switch {
+	case plain != nil || secure != nil:
+		if plain != nil {
+			ci.Address, ci.Port = plain.host, &plain.port
+		}
+		if secure != nil {
+			ci.SSLPort = &secure.port
+			if ci.Address == "" {
+				ci.Address = secure.host
+			}
+		}
+	case first != nil:
+		ci.Address, ci.Port = first.host, &first.port
+	}
+
+	return json.Marshal(ci)
+}
+
+// hostPort 是端点的主机和端口
+type hostPort struct {
+	host string
+	port int
+}
+
+// decode 解析实例节点数据，Curator格式通过registrationTimeUTC和serviceType字段识别
+func decode(data []byte) (*registry.ServiceInstance, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	_, hasType := probe["serviceType"]
+	_, hasTime := probe["registrationTimeUTC"]
+	if !hasType || !hasTime {
+		si := &registry.ServiceInstance{}
+		if err := json.Unmarshal(data, si); err != nil {
+			return nil, err
+		}
+		return si, nil
+	}
+
+	ci := &curatorInstance{}
+	if err := json.Unmarshal(data, ci); err != nil {
+		return nil, err
+	}
+
+	si := &registry.ServiceInstance{
+		ID:        ci.ID,
+		Name:      ci.Name,
+		Status:    registry.StatusUp,
+		CreatedAt: time.UnixMilli(ci.RegistrationTimeUTC),
+		Metadata:  make(map[string]string),
+	}
+	if ci.Enabled != nil && !*ci.Enabled {
+		si.Status = registry.StatusDown
+	}
+	if ci.Payload != nil {
+		for k, v := range ci.Payload.Metadata {
+			switch k {
+			case metaEndpoints:
+				si.Endpoints = strings.Split(v, ",")
+			case metaVersion:
+				si.Version = v
+			default:
+				si.Metadata[k] = v
+			}
+		}
+	}
+
+	// Java服务注册的实例没有端点元数据，从地址和端口还原
+	if len(si.Endpoints) == 0 && ci.Address != "" {
+		if ci.Port != nil {
+			si.Endpoints = append(si.Endpoints, "http://"+net.JoinHostPort(ci.Address, strconv.Itoa(*ci.Port)))
+		}
+		if ci.SSLPort != nil {
+			si.Endpoints = append(si.Endpoints, "https://"+net.JoinHostPort(ci.Address, strconv.Itoa(*ci.SSLPort)))
+		}
+	}
+	return si, nil
+}
+
+// splitHostPort 拆分主机和端口
+func splitHostPort(hostport string) (*hostPort, bool) {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, false
+	}
+	return &hostPort{host: host, port: port}, true
+}
@@ -0,0 +1,38 @@
+package zookeeper
+
+import (
+	"fmt"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func init() {
+	registry.RegisterFactory(registry.Zookeeper, newFromConfig)
+}
+
+// newFromConfig 根据通用配置创建ZooKeeper注册中心，用户名和密码用于digest认证
+// 支持的参数：layout（native或curator）
+func newFromConfig(cfg *registry.RegistryConfig) (registry.ServiceRegistrar, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, registry.ErrNoEndpoints
+	}
+
+	var opts []Option
+	if cfg.Prefix != "" && cfg.Prefix != "/" {
+		opts = append(opts, WithPrefix(cfg.Prefix))
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts, WithSessionTimeout(cfg.Timeout))
+	}
+	if cfg.Username != "" {
+		opts = append(opts, WithDigestAuth(cfg.Username, cfg.Password))
+	}
+	switch layout := Layout(cfg.Param("layout")); layout {
+	case "":
+	case LayoutNative, LayoutCurator:
+		opts = append(opts, WithLayout(layout))
+	default:
+		return nil, fmt.Errorf("zookeeper: unknown layout %q", layout)
+	}
+	return NewRegistry(cfg.Endpoints, opts...)
+}
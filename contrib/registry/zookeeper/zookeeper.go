@@ -2,13 +2,15 @@ package zookeeper
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dormoron/phantasm/internal/fanout"
 	"github.com/dormoron/phantasm/log"
 	"github.com/dormoron/phantasm/registry"
 
@@ -19,22 +21,60 @@ var (
 	_ registry.ServiceRegistrar = (*Registry)(nil)
 )
 
+// Layout 是服务实例节点数据的格式
+type Layout string
+
+const (
+	// LayoutNative 以ServiceInstance的JSON格式保存实例数据
+	LayoutNative Layout = "native"
+	// LayoutCurator 以Curator ServiceDiscovery兼容的格式保存实例数据，便于与Java服务互通
+	LayoutCurator Layout = "curator"
+)
+
+// conn 是注册中心使用的ZooKeeper连接操作，由 *zk.Conn 实现
+type conn interface {
+	AddAuth(scheme string, auth []byte) error
+	Exists(path string) (bool, *zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Delete(path string, version int32) error
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	SessionID() int64
+	Close()
+}
+
+var _ conn = (*zk.Conn)(nil)
+
 // Registry 是基于ZooKeeper的服务注册发现中心
+// 会话过期后会在新会话上重新创建所有已注册实例的临时节点
 type Registry struct {
-	conn     *zk.Conn
+	conn     conn
 	prefix   string // 服务注册的前缀
+	layout   Layout
+	acl      []zk.ACL
 	ctx      context.Context
 	cancel   context.CancelFunc
 	lock     sync.RWMutex
-	watchChs map[string]chan []*registry.ServiceInstance // 服务名称到观察通道的映射
-	services map[string]*registry.ServiceInstance        // 本地缓存的服务实例
+	services map[string]*registry.ServiceInstance // 本地缓存的服务实例，用于会话过期后重新注册
+	watchers map[string]*serviceWatch             // 服务名称到共享监视循环的映射
 	logger   log.Logger
+	options  *Options
+
+	expired    atomic.Bool   // 会话是否已过期，新会话建立后需要重新注册
+	reregister chan struct{} // 通知重新注册协程
 }
 
 // Options 是ZooKeeper注册中心的选项
 type Options struct {
 	Prefix         string        // 注册前缀
 	SessionTimeout time.Duration // 会话超时时间
+	Layout         Layout        // 节点数据格式
+	AuthScheme     string        // 认证方式，例如digest
+	Auth           []byte        // 认证信息
+	ACL            []zk.ACL      // 创建节点使用的ACL
 	Logger         log.Logger
 }
 
@@ -55,6 +95,31 @@ func WithSessionTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithLayout 设置节点数据格式
+func WithLayout(layout Layout) Option {
+	return func(o *Options) {
+		o.Layout = layout
+	}
+}
+
+// WithDigestAuth 使用digest方式认证，未设置ACL时创建的节点仅对该用户开放全部权限
+func WithDigestAuth(user, password string) Option {
+	return func(o *Options) {
+		o.AuthScheme = "digest"
+		o.Auth = []byte(user + ":" + password)
+		if o.ACL == nil {
+			o.ACL = zk.DigestACL(zk.PermAll, user, password)
+		}
+	}
+}
+
+// WithACL 设置创建节点使用的ACL
+func WithACL(acl []zk.ACL) Option {
+	return func(o *Options) {
+		o.ACL = acl
+	}
+}
+
 // WithLogger 设置日志记录器
 func WithLogger(logger log.Logger) Option {
 	return func(o *Options) {
@@ -64,41 +129,139 @@ func WithLogger(logger log.Logger) Option {
 
 // NewRegistry 创建ZooKeeper注册中心实例
 func NewRegistry(servers []string, opts ...Option) (*Registry, error) {
+	r := newRegistry(opts...)
+	c, _, err := zk.Connect(servers, r.options.SessionTimeout, zk.WithEventCallback(r.onEvent))
+	if err != nil {
+		r.cancel()
+		return nil, err
+	}
+	if err := r.start(c); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newRegistry 创建尚未连接的注册中心
+func newRegistry(opts ...Option) *Registry {
 	options := &Options{
 		Prefix:         "/services",
 		SessionTimeout: time.Second * 15,
+		Layout:         LayoutNative,
 		Logger:         log.DefaultLogger,
 	}
 
 	for _, o := range opts {
 		o(options)
 	}
-
-	conn, _, err := zk.Connect(servers, options.SessionTimeout)
-	if err != nil {
-		return nil, err
+	if options.ACL == nil {
+		options.ACL = zk.WorldACL(zk.PermAll)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	r := &Registry{
-		conn:     conn,
-		prefix:   options.Prefix,
-		ctx:      ctx,
-		cancel:   cancel,
-		lock:     sync.RWMutex{},
-		watchChs: make(map[string]chan []*registry.ServiceInstance),
-		services: make(map[string]*registry.ServiceInstance),
-		logger:   options.Logger,
+	return &Registry{
+		prefix:     options.Prefix,
+		layout:     options.Layout,
+		acl:        options.ACL,
+		ctx:        ctx,
+		cancel:     cancel,
+		services:   make(map[string]*registry.ServiceInstance),
+		watchers:   make(map[string]*serviceWatch),
+		logger:     options.Logger,
+		options:    options,
+		reregister: make(chan struct{}, 1),
+	}
+}
+
+// start 使用已建立的连接完成认证和前缀路径的创建，并启动重新注册协程，失败时关闭连接
+func (r *Registry) start(c conn) error {
+	r.conn = c
+	if r.options.AuthScheme != "" {
+		// 认证信息会在重连后由客户端自动重新提交
+		if err := c.AddAuth(r.options.AuthScheme, r.options.Auth); err != nil {
+			r.cancel()
+			c.Close()
+			return err
+		}
 	}
 
 	// 确保前缀路径存在
-	if err := r.ensurePathExists(options.Prefix); err != nil {
-		cancel()
-		conn.Close()
-		return nil, err
+	if err := r.ensurePathExists(r.prefix); err != nil {
+		r.cancel()
+		c.Close()
+		return err
 	}
 
-	return r, nil
+	go r.reregisterLoop()
+	return nil
+}
+
+// onEvent 处理会话事件，会话过期后在新会话建立时触发重新注册
+// 该回调在客户端的事件循环中执行，不能阻塞
+func (r *Registry) onEvent(ev zk.Event) {
+	if ev.Type != zk.EventSession {
+		return
+	}
+	switch ev.State {
+	case zk.StateExpired:
+		r.expired.Store(true)
+	case zk.StateHasSession:
+		if r.expired.CompareAndSwap(true, false) {
+			select {
+			case r.reregister <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// reregisterLoop 在会话过期后重新创建所有缓存实例的临时节点，失败时指数退避重试
+func (r *Registry) reregisterLoop() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.reregister:
+		}
+
+		backoff := time.Second
+		for {
+			err := r.registerAll()
+			if err == nil {
+				break
+			}
+			r.logger.Error("会话过期后重新注册失败", log.Err(err))
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > time.Second*30 {
+				backoff = time.Second * 30
+			}
+		}
+	}
+}
+
+// registerAll 重新注册所有缓存的服务实例
+func (r *Registry) registerAll() error {
+	r.lock.RLock()
+	services := make([]*registry.ServiceInstance, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, service)
+	}
+	r.lock.RUnlock()
+
+	var errs []error
+	for _, service := range services {
+		if err := r.put(service); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		r.logger.Info("会话过期后重新注册服务实例",
+			log.String("service", service.Name),
+			log.String("id", service.ID))
+	}
+	return errors.Join(errs...)
 }
 
 // Register 注册服务实例
@@ -114,8 +277,21 @@ func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstan
 	}
 	service.UpdatedAt = now
 
-	// 序列化服务实例
-	data, err := json.Marshal(service)
+	if err := r.put(service); err != nil {
+		return err
+	}
+
+	// 缓存服务实例
+	r.lock.Lock()
+	r.services[service.ID] = service
+	r.lock.Unlock()
+
+	return nil
+}
+
+// put 创建或更新服务实例的临时节点
+func (r *Registry) put(service *registry.ServiceInstance) error {
+	data, err := encode(r.layout, service)
 	if err != nil {
 		return err
 	}
@@ -126,35 +302,36 @@ func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstan
 		return err
 	}
 
-	// 创建服务实例节点
 	instancePath := path.Join(servicePath, service.ID)
 	exists, stat, err := r.conn.Exists(instancePath)
 	if err != nil {
 		return err
 	}
 
-	if exists {
-		// 更新已存在的节点
+	if exists && stat.EphemeralOwner == r.conn.SessionID() {
+		// 更新当前会话创建的节点
 		_, err = r.conn.Set(instancePath, data, stat.Version)
-	} else {
-		// 创建新节点，临时节点，当会话关闭时自动删除
-		_, err = r.conn.Create(instancePath, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
-	}
-
-	if err != nil {
 		return err
 	}
+	if exists {
+		// 节点属于旧会话，旧会话过期时节点会被删除，因此需要在当前会话上重新创建
+		if err := r.conn.Delete(instancePath, stat.Version); err != nil && !errors.Is(err, zk.ErrNoNode) {
+			return err
+		}
+	}
 
-	// 缓存服务实例
-	r.lock.Lock()
-	r.services[service.ID] = service
-	r.lock.Unlock()
-
-	return nil
+	// 创建新节点，临时节点，当会话关闭时自动删除
+	_, err = r.conn.Create(instancePath, data, zk.FlagEphemeral, r.acl)
+	return err
 }
 
 // Deregister 注销服务实例
 func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	// 先移除缓存，避免会话过期后被重新注册
+	r.lock.Lock()
+	delete(r.services, service.ID)
+	r.lock.Unlock()
+
 	instancePath := path.Join(r.prefix, service.Name, service.ID)
 	exists, stat, err := r.conn.Exists(instancePath)
 	if err != nil {
@@ -163,184 +340,235 @@ func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInst
 
 	if exists {
 		err = r.conn.Delete(instancePath, stat.Version)
-		if err != nil {
+		if err != nil && !errors.Is(err, zk.ErrNoNode) {
 			return err
 		}
 	}
 
-	// 移除缓存的服务实例
-	r.lock.Lock()
-	delete(r.services, service.ID)
-	r.lock.Unlock()
-
 	return nil
 }
 
 // GetService 获取服务实例列表
 func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
 	servicePath := path.Join(r.prefix, serviceName)
-	exists, _, err := r.conn.Exists(servicePath)
-	if err != nil {
-		return nil, err
-	}
 
-	if !exists {
+	// 获取所有服务实例ID
+	instanceIDs, _, err := r.conn.Children(servicePath)
+	if errors.Is(err, zk.ErrNoNode) {
 		// 服务不存在
 		return nil, nil
 	}
-
-	// 获取所有服务实例ID
-	instanceIDs, _, err := r.conn.Children(servicePath)
 	if err != nil {
 		return nil, err
 	}
 
-	instances := make([]*registry.ServiceInstance, 0, len(instanceIDs))
+	items := make(map[string]*registry.ServiceInstance, len(instanceIDs))
 	for _, id := range instanceIDs {
 		instancePath := path.Join(servicePath, id)
 		data, _, err := r.conn.Get(instancePath)
 		if err != nil {
-			r.logger.Warn("获取服务实例数据失败",
-				log.String("path", instancePath),
-				log.String("error", err.Error()))
-			continue
-		}
-
-		instance := &registry.ServiceInstance{}
-		if err := json.Unmarshal(data, instance); err != nil {
-			r.logger.Warn("解析服务实例数据失败",
-				log.String("path", instancePath),
-				log.String("error", err.Error()))
+			if !errors.Is(err, zk.ErrNoNode) {
+				r.logger.Warn("获取服务实例数据失败", log.String("path", instancePath), log.Err(err))
+			}
 			continue
 		}
-
-		if instance.Status != registry.StatusDown {
-			instances = append(instances, instance)
+		if si := r.decode(instancePath, data); si != nil {
+			items[id] = si
 		}
 	}
 
-	return instances, nil
+	return sortedInstances(items), nil
 }
 
-// Watch 监视服务变更
-func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
-	servicePath := path.Join(r.prefix, serviceName)
-	exists, _, err := r.conn.Exists(servicePath)
+// decode 解析服务实例数据，兼容两种节点格式
+func (r *Registry) decode(instancePath string, data []byte) *registry.ServiceInstance {
+	si, err := decode(data)
 	if err != nil {
-		return nil, err
+		r.logger.Warn("解析服务实例数据失败", log.String("path", instancePath), log.Err(err))
+		return nil
 	}
+	return si
+}
 
-	if !exists {
-		// 创建服务路径
-		if err := r.ensurePathExists(servicePath); err != nil {
-			return nil, err
+// sortedInstances 按ID排序并过滤已下线的实例
+func sortedInstances(items map[string]*registry.ServiceInstance) []*registry.ServiceInstance {
+	instances := make([]*registry.ServiceInstance, 0, len(items))
+	for _, si := range items {
+		if si.Status != registry.StatusDown {
+			instances = append(instances, si)
 		}
 	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
 
-	// 创建通道
-	r.lock.Lock()
-	ch := make(chan []*registry.ServiceInstance, 10)
-	r.watchChs[serviceName] = ch
-	r.lock.Unlock()
+// serviceWatch 是同一服务共享的监视循环
+type serviceWatch struct {
+	hub    *fanout.Hub
+	cancel context.CancelFunc
+}
 
-	// 获取初始服务列表
-	services, err := r.GetService(ctx, serviceName)
-	if err != nil {
+// Watch 监视服务变更
+// 同一服务的所有观察者共享一个监视循环，子节点和实例数据的变更都会合并为一次实例列表更新
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	servicePath := path.Join(r.prefix, serviceName)
+	if err := r.ensurePathExists(servicePath); err != nil {
 		return nil, err
 	}
 
-	if len(services) > 0 {
-		select {
-		case ch <- services:
-		default:
-			// 避免阻塞
-		}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok {
+		loopCtx, cancel := context.WithCancel(r.ctx)
+		sw = &serviceWatch{cancel: cancel}
+		sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+			r.unwatch(serviceName, hub)
+		})
+		r.watchers[serviceName] = sw
+		go r.watchLoop(loopCtx, serviceName, servicePath, sw.hub)
 	}
+	return sw.hub.Subscribe(ctx), nil
+}
 
-	// 启动goroutine监视变更
-	go r.watchService(serviceName, servicePath, ch)
-
-	return &watcher{
-		registry: r,
-		ch:       ch,
-		service:  serviceName,
-	}, nil
+// unwatch 在服务的最后一个观察者停止后结束共享的监视循环
+func (r *Registry) unwatch(serviceName string, hub *fanout.Hub) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sw, ok := r.watchers[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
+	}
+	sw.cancel()
+	delete(r.watchers, serviceName)
 }
 
-// 监视服务变更
-func (r *Registry) watchService(serviceName, servicePath string, ch chan []*registry.ServiceInstance) {
+// watchLoop 监视服务的子节点和每个实例节点的数据
+// ZooKeeper的监视是一次性的，只有已触发的监视才会重新设置，避免同一节点上堆积重复的监视
+// 会话过期或连接断开时所有监视都会以EventNotWatching触发，随后在新会话上重新设置
+func (r *Registry) watchLoop(ctx context.Context, serviceName, servicePath string, hub *fanout.Hub) {
+	var (
+		childCh <-chan zk.Event
+		armed   = make(map[string]bool) // 已设置数据监视且尚未触发的实例节点
+		fired   = make(chan string, 16) // 已触发数据监视的实例ID
+	)
+
 	for {
-		// 监视子节点变更
-		children, _, childEventCh, err := r.conn.ChildrenW(servicePath)
+		items, err := r.scan(ctx, servicePath, &childCh, armed, fired)
 		if err != nil {
-			r.logger.Error("监视服务变更失败",
-				log.String("service", serviceName),
-				log.String("error", err.Error()))
-
-			// 检查节点是否存在，可能需要重新创建
-			exists, _, err := r.conn.Exists(servicePath)
-			if err != nil || !exists {
+			if !errors.Is(err, zk.ErrClosing) && !errors.Is(err, zk.ErrConnectionClosed) {
+				r.logger.Error("监视服务变更失败", log.String("service", serviceName), log.Err(err))
+			}
+			if errors.Is(err, zk.ErrNoNode) {
 				if err := r.ensurePathExists(servicePath); err != nil {
-					r.logger.Error("创建服务路径失败",
-						log.String("path", servicePath),
-						log.String("error", err.Error()))
+					r.logger.Error("创建服务路径失败", log.String("path", servicePath), log.Err(err))
 				}
 			}
 
 			// 短暂休眠后重试
 			select {
-			case <-r.ctx.Done():
+			case <-ctx.Done():
 				return
 			case <-time.After(time.Second):
 				continue
 			}
 		}
+		hub.Publish(sortedInstances(items))
 
-		// 构建实例列表
-		instances := make([]*registry.ServiceInstance, 0, len(children))
-		for _, id := range children {
-			instancePath := path.Join(servicePath, id)
-			data, _, err := r.conn.Get(instancePath)
-			if err != nil {
-				continue
-			}
+		// 等待子节点或实例数据变更
+		select {
+		case <-ctx.Done():
+			return
+		case <-childCh:
+			childCh = nil
+		case id := <-fired:
+			delete(armed, id)
+		}
 
-			instance := &registry.ServiceInstance{}
-			if err := json.Unmarshal(data, instance); err != nil {
-				continue
+		// 合并短时间内的多个事件
+		for drained := false; !drained; {
+			select {
+			case id := <-fired:
+				delete(armed, id)
+			default:
+				drained = true
 			}
+		}
+	}
+}
+
+// scan 读取服务的实例列表，并为尚未设置监视的节点重新设置监视
+func (r *Registry) scan(ctx context.Context, servicePath string, childCh *<-chan zk.Event, armed map[string]bool, fired chan<- string) (map[string]*registry.ServiceInstance, error) {
+	var (
+		children []string
+		err      error
+	)
+	if *childCh == nil {
+		children, _, *childCh, err = r.conn.ChildrenW(servicePath)
+	} else {
+		children, _, err = r.conn.Children(servicePath)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-			if instance.Status != registry.StatusDown {
-				instances = append(instances, instance)
+	items := make(map[string]*registry.ServiceInstance, len(children))
+	for _, id := range children {
+		instancePath := path.Join(servicePath, id)
+
+		var data []byte
+		if armed[id] {
+			data, _, err = r.conn.Get(instancePath)
+		} else {
+			var dataCh <-chan zk.Event
+			data, _, dataCh, err = r.conn.GetW(instancePath)
+			if err == nil {
+				armed[id] = true
+				go forward(ctx, id, dataCh, fired)
 			}
 		}
+		if errors.Is(err, zk.ErrNoNode) {
+			// 节点在列出后被删除，子节点监视会再次触发
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
 
-		// 通知观察者
-		r.lock.RLock()
-		ch, ok := r.watchChs[serviceName]
-		r.lock.RUnlock()
-		if ok {
-			select {
-			case ch <- instances:
-			default:
-				// 避免阻塞
-			}
+		if si := r.decode(instancePath, data); si != nil {
+			items[id] = si
 		}
+	}
+	return items, nil
+}
 
-		// 等待事件或上下文取消
+// forward 在数据监视触发后通知监视循环
+func forward(ctx context.Context, id string, dataCh <-chan zk.Event, fired chan<- string) {
+	select {
+	case <-ctx.Done():
+	case <-dataCh:
 		select {
-		case <-r.ctx.Done():
-			return
-		case <-childEventCh:
-			// 子节点变更，重新获取服务列表
+		case fired <- id:
+		case <-ctx.Done():
 		}
 	}
 }
 
-// Stop 停止注册中心
+// Stop 停止注册中心，关闭会话后所有临时节点随之删除，所有观察者随之停止
 func (r *Registry) Stop() error {
 	r.cancel()
 	r.conn.Close()
+
+	r.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(r.watchers))
+	for _, sw := range r.watchers {
+		hubs = append(hubs, sw.hub)
+	}
+	r.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.Close()
+	}
 	return nil
 }
 
@@ -366,8 +594,8 @@ func (r *Registry) ensurePathExists(path string) error {
 		}
 
 		if !exists {
-			_, err = r.conn.Create(current, []byte{}, 0, zk.WorldACL(zk.PermAll))
-			if err != nil && err != zk.ErrNodeExists {
+			_, err = r.conn.Create(current, []byte{}, 0, r.acl)
+			if err != nil && !errors.Is(err, zk.ErrNodeExists) {
 				return err
 			}
 		}
@@ -375,40 +603,3 @@ func (r *Registry) ensurePathExists(path string) error {
 
 	return nil
 }
-
-// watcher 是服务监视实现
-type watcher struct {
-	registry *Registry
-	ch       chan []*registry.ServiceInstance
-	service  string
-	done     bool
-}
-
-// Next 等待下一个服务更新
-func (w *watcher) Next() ([]*registry.ServiceInstance, error) {
-	if w.done {
-		return nil, fmt.Errorf("watcher已关闭")
-	}
-
-	select {
-	case services := <-w.ch:
-		return services, nil
-	case <-w.registry.ctx.Done():
-		return nil, w.registry.ctx.Err()
-	}
-}
-
-// Stop 停止监视
-func (w *watcher) Stop() error {
-	if w.done {
-		return nil
-	}
-
-	w.registry.lock.Lock()
-	delete(w.registry.watchChs, w.service)
-	w.registry.lock.Unlock()
-
-	w.done = true
-	close(w.ch)
-	return nil
-}
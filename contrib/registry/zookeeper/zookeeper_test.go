@@ -0,0 +1,540 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+
+	"github.com/go-zookeeper/zk"
+)
+
+func TestCuratorLayoutRoundTrip(t *testing.T) {
+	ins := &registry.ServiceInstance{
+		ID:        "greeter-1",
+		Name:      "greeter",
+		Version:   "v1.0.0",
+		Metadata:  map[string]string{"zone": "a"},
+		Endpoints: []string{"grpc://10.0.0.1:9000", "http://10.0.0.1:8000"},
+		Status:    registry.StatusUp,
+		CreatedAt: time.UnixMilli(1700000000000),
+	}
+	data, err := encode(LayoutCurator, ins)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	ci := &curatorInstance{}
+	if err := json.Unmarshal(data, ci); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if ci.Address != "10.0.0.1" || ci.Port == nil || *ci.Port != 8000 || ci.ServiceType != "DYNAMIC" {
+		t.Errorf("unexpected curator instance: %s", data)
+	}
+
+	got, err := decode(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.ID != ins.ID || got.Name != ins.Name || got.Version != ins.Version || !got.CreatedAt.Equal(ins.CreatedAt) {
+		t.Errorf("decode = %+v", got)
+	}
+	if !reflect.DeepEqual(got.Endpoints, ins.Endpoints) || !reflect.DeepEqual(got.Metadata, ins.Metadata) {
+		t.Errorf("endpoints = %v, metadata = %v", got.Endpoints, got.Metadata)
+	}
+}
+
+func TestDecodeJavaInstance(t *testing.T) {
+	// Spring Cloud Zookeeper注册的实例
+	data := []byte(`{"name":"orders","id":"7f3c","address":"10.0.0.2","port":8080,"sslPort":8443,
+		"payload":{"@class":"org.springframework.cloud.zookeeper.discovery.ZookeeperInstance","id":"orders","name":"orders","metadata":{"instance_status":"UP"}},
+		"registrationTimeUTC":1700000000000,"serviceType":"DYNAMIC","uriSpec":{"parts":[]}}`)
+
+	got, err := decode(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := []string{"http://10.0.0.2:8080", "https://10.0.0.2:8443"}
+	if !reflect.DeepEqual(got.Endpoints, want) {
+		t.Errorf("endpoints = %v, want %v", got.Endpoints, want)
+	}
+	if got.Status != registry.StatusUp || got.Metadata["instance_status"] != "UP" {
+		t.Errorf("decode = %+v", got)
+	}
+}
+
+func TestDecodeNative(t *testing.T) {
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	data, err := encode(LayoutNative, ins)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	got, err := decode(data)
+	if err != nil || got.ID != "a" || !reflect.DeepEqual(got.Endpoints, ins.Endpoints) {
+		t.Fatalf("decode = %+v, %v", got, err)
+	}
+}
+
+// fakeServer 是内存中的ZooKeeper数据树，多个fakeConn共享同一棵树
+// 它模拟了注册中心用到的语义：节点版本、临时节点的所有者、ACL读写检查，以及一次性的数据和子节点监视
+type fakeServer struct {
+	lock    sync.Mutex
+	nodes   map[string]*fakeNode
+	watches []*fakeWatch
+	session int64
+}
+
+type fakeNode struct {
+	data    []byte
+	version int32
+	owner   int64
+	acl     []zk.ACL
+}
+
+// fakeWatch 是一次性的监视，child为true时监视子节点变化
+type fakeWatch struct {
+	conn  *fakeConn
+	path  string
+	child bool
+	ch    chan zk.Event
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{nodes: map[string]*fakeNode{"/": {acl: zk.WorldACL(zk.PermAll)}}}
+}
+
+// connect 建立新会话，onEvent接收会话事件
+func (s *fakeServer) connect(onEvent func(zk.Event)) *fakeConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.session++
+	return &fakeConn{srv: s, session: s.session, onEvent: onEvent}
+}
+
+// fire 触发并移除匹配的监视，调用方需持有锁
+func (s *fakeServer) fire(p string, child bool, typ zk.EventType) {
+	watches := s.watches[:0]
+	for _, w := range s.watches {
+		if w.path == p && w.child == child {
+			w.ch <- zk.Event{Type: typ, Path: p}
+			close(w.ch)
+			continue
+		}
+		watches = append(watches, w)
+	}
+	s.watches = watches
+}
+
+// dropSession 删除会话的临时节点并以EventNotWatching结束会话的所有监视，调用方需持有锁
+func (s *fakeServer) dropSession(c *fakeConn, err error) {
+	for p, n := range s.nodes {
+		if n.owner == c.session {
+			delete(s.nodes, p)
+			s.fire(p, false, zk.EventNodeDeleted)
+			s.fire(path.Dir(p), true, zk.EventNodeChildrenChanged)
+		}
+	}
+	watches := s.watches[:0]
+	for _, w := range s.watches {
+		if w.conn == c {
+			w.ch <- zk.Event{Type: zk.EventNotWatching, State: zk.StateDisconnected, Path: w.path, Err: err}
+			close(w.ch)
+			continue
+		}
+		watches = append(watches, w)
+	}
+	s.watches = watches
+}
+
+// fakeConn 是fakeServer上的会话，实现了conn
+type fakeConn struct {
+	srv     *fakeServer
+	session int64
+	auths   []string
+	closed  bool
+	onEvent func(zk.Event)
+}
+
+var _ conn = (*fakeConn)(nil)
+
+// expire 使会话过期并建立新会话，与客户端重连后收到的事件顺序一致
+func (c *fakeConn) expire() {
+	c.srv.lock.Lock()
+	c.srv.dropSession(c, zk.ErrSessionExpired)
+	c.srv.session++
+	c.session = c.srv.session
+	c.srv.lock.Unlock()
+
+	if c.onEvent != nil {
+		c.onEvent(zk.Event{Type: zk.EventSession, State: zk.StateExpired})
+		c.onEvent(zk.Event{Type: zk.EventSession, State: zk.StateHasSession})
+	}
+}
+
+// check 检查会话状态和节点ACL，调用方需持有锁
+func (c *fakeConn) check(p string) (*fakeNode, error) {
+	if c.closed {
+		return nil, zk.ErrClosing
+	}
+	n, ok := c.srv.nodes[p]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+	for _, acl := range n.acl {
+		if acl.Scheme == "world" {
+			return n, nil
+		}
+		for _, id := range c.auths {
+			if acl.Scheme == "digest" && acl.ID == id {
+				return n, nil
+			}
+		}
+	}
+	return nil, zk.ErrNoAuth
+}
+
+func (c *fakeConn) stat(n *fakeNode) *zk.Stat {
+	return &zk.Stat{Version: n.version, EphemeralOwner: n.owner}
+}
+
+func (c *fakeConn) AddAuth(scheme string, auth []byte) error {
+	user, password, _ := strings.Cut(string(auth), ":")
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	c.auths = append(c.auths, zk.DigestACL(zk.PermAll, user, password)[0].ID)
+	return nil
+}
+
+func (c *fakeConn) Exists(p string) (bool, *zk.Stat, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	if c.closed {
+		return false, nil, zk.ErrClosing
+	}
+	n, ok := c.srv.nodes[p]
+	if !ok {
+		return false, &zk.Stat{}, nil
+	}
+	return true, c.stat(n), nil
+}
+
+func (c *fakeConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	if _, err := c.check(path.Dir(p)); err != nil {
+		return "", err
+	}
+	if _, ok := c.srv.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	n := &fakeNode{data: data, acl: acl}
+	if flags&zk.FlagEphemeral != 0 {
+		n.owner = c.session
+	}
+	c.srv.nodes[p] = n
+	c.srv.fire(path.Dir(p), true, zk.EventNodeChildrenChanged)
+	return p, nil
+}
+
+func (c *fakeConn) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	n, err := c.check(p)
+	if err != nil {
+		return nil, err
+	}
+	if version != -1 && version != n.version {
+		return nil, zk.ErrBadVersion
+	}
+	n.data = data
+	n.version++
+	c.srv.fire(p, false, zk.EventNodeDataChanged)
+	return c.stat(n), nil
+}
+
+func (c *fakeConn) Delete(p string, version int32) error {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	n, err := c.check(p)
+	if err != nil {
+		return err
+	}
+	if version != -1 && version != n.version {
+		return zk.ErrBadVersion
+	}
+	for child := range c.srv.nodes {
+		if path.Dir(child) == p && child != p {
+			return zk.ErrNotEmpty
+		}
+	}
+	delete(c.srv.nodes, p)
+	c.srv.fire(p, false, zk.EventNodeDeleted)
+	c.srv.fire(path.Dir(p), true, zk.EventNodeChildrenChanged)
+	return nil
+}
+
+func (c *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	n, err := c.check(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.data, c.stat(n), nil
+}
+
+func (c *fakeConn) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	n, err := c.check(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	w := &fakeWatch{conn: c, path: p, ch: make(chan zk.Event, 1)}
+	c.srv.watches = append(c.srv.watches, w)
+	return n.data, c.stat(n), w.ch, nil
+}
+
+func (c *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	n, err := c.check(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	var children []string
+	for child := range c.srv.nodes {
+		if path.Dir(child) == p && child != p {
+			children = append(children, path.Base(child))
+		}
+	}
+	sort.Strings(children)
+	return children, c.stat(n), nil
+}
+
+func (c *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := c.Children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	w := &fakeWatch{conn: c, path: p, child: true, ch: make(chan zk.Event, 1)}
+	c.srv.watches = append(c.srv.watches, w)
+	return children, stat, w.ch, nil
+}
+
+func (c *fakeConn) SessionID() int64 {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	return c.session
+}
+
+func (c *fakeConn) Close() {
+	c.srv.lock.Lock()
+	defer c.srv.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.srv.dropSession(c, zk.ErrClosing)
+}
+
+// newTestRegistry 创建连接到内存ZooKeeper的注册中心
+func newTestRegistry(t *testing.T, srv *fakeServer, opts ...Option) (*Registry, *fakeConn) {
+	t.Helper()
+	r := newRegistry(opts...)
+	c := srv.connect(r.onEvent)
+	if err := r.start(c); err != nil {
+		t.Fatalf("start registry: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Stop() })
+	return r, c
+}
+
+// next 在超时时间内读取观察者的下一次更新
+func next(t *testing.T, w registry.Watcher) []*registry.ServiceInstance {
+	t.Helper()
+	type result struct {
+		items []*registry.ServiceInstance
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		items, err := w.Next()
+		ch <- result{items, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("next: %v", r.err)
+		}
+		return r.items
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for watch update")
+	}
+	return nil
+}
+
+func TestWatchChildAndData(t *testing.T) {
+	r, _ := newTestRegistry(t, newFakeServer(), WithLayout(LayoutCurator))
+	ctx := context.Background()
+
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items := next(t, w); len(items) != 0 {
+		t.Fatalf("initial = %v", items)
+	}
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if items := next(t, w); len(items) != 1 {
+		t.Fatalf("after register = %v", items)
+	}
+
+	// 修改实例数据触发数据监视
+	ins.Metadata = map[string]string{"weight": "50"}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if items := next(t, w); len(items) != 1 || items[0].Metadata["weight"] != "50" {
+		t.Fatalf("after update = %v", items)
+	}
+
+	if err := r.Deregister(ctx, ins); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if items := next(t, w); len(items) != 0 {
+		t.Fatalf("after deregister = %v", items)
+	}
+}
+
+func TestReregisterAfterSessionExpired(t *testing.T) {
+	srv := newFakeServer()
+	r, c := newTestRegistry(t, srv)
+	ctx := context.Background()
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items := next(t, w); len(items) != 1 {
+		t.Fatalf("initial = %v", items)
+	}
+	session := c.SessionID()
+
+	// 会话过期时服务端删除临时节点，新会话建立后重新注册
+	c.expire()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		exists, stat, err := c.Exists("/services/svc/a")
+		if err == nil && exists && stat.EphemeralOwner != session && stat.EphemeralOwner == c.SessionID() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("instance was not re-registered on the new session")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// 监视在新会话上重新设置，后续变更仍能收到
+	b := &registry.ServiceInstance{ID: "b", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9001"}}
+	if err := r.Register(ctx, b); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	for {
+		if items := next(t, w); len(items) == 2 {
+			break
+		}
+	}
+
+	// 注销的实例不会在会话过期后重新注册
+	if err := r.Deregister(ctx, ins); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	c.expire()
+	deadline = time.Now().Add(time.Second * 5)
+	for {
+		items, err := r.GetService(ctx, "svc")
+		if err == nil && len(items) == 1 && items[0].ID == "b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after second expiry = %v, %v", items, err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	srv := newFakeServer()
+	r, _ := newTestRegistry(t, srv, WithPrefix("/secure"), WithDigestAuth("user", "secret"))
+	ctx := context.Background()
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if items, err := r.GetService(ctx, "svc"); err != nil || len(items) != 1 {
+		t.Fatalf("get service = %v, %v", items, err)
+	}
+
+	anon := srv.connect(nil)
+	defer anon.Close()
+	if _, _, err := anon.Get("/secure/svc/a"); !errors.Is(err, zk.ErrNoAuth) {
+		t.Errorf("expected ErrNoAuth for unauthenticated read, got %v", err)
+	}
+
+	other := srv.connect(nil)
+	defer other.Close()
+	_ = other.AddAuth("digest", []byte("user:secret"))
+	if _, _, err := other.Get("/secure/svc/a"); err != nil {
+		t.Errorf("authenticated read: %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	srv := newFakeServer()
+	r, _ := newTestRegistry(t, srv)
+	ctx := context.Background()
+
+	ins := &registry.ServiceInstance{ID: "a", Name: "svc", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	next(t, w)
+
+	// 关闭会话后临时节点被删除，观察者停止
+	if err := r.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := w.Next(); err == nil {
+		t.Error("expected error after stop")
+	}
+	other := srv.connect(nil)
+	if exists, _, _ := other.Exists("/services/svc/a"); exists {
+		t.Error("ephemeral node survived session close")
+	}
+}
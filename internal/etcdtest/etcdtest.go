@@ -0,0 +1,99 @@
+// Package etcdtest 在测试进程内启动一个单节点的嵌入式etcd服务，用于测试依赖etcd的组件
+package etcdtest
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Server 是进程内的嵌入式etcd服务
+type Server struct {
+	etcd   *embed.Etcd
+	client *clientv3.Client
+}
+
+// NewServer 启动一个嵌入式etcd服务，数据保存在测试的临时目录中，测试结束时自动关闭
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, _ := url.Parse("http://127.0.0.1:0")
+	peer, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*client}
+	cfg.AdvertiseClientUrls = []url.URL{*client}
+	cfg.ListenPeerUrls = []url.URL{*peer}
+	cfg.AdvertisePeerUrls = []url.URL{*peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("etcdtest: start: %v", err)
+	}
+	s := &Server{etcd: e}
+	t.Cleanup(s.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case err := <-e.Err():
+		t.Fatalf("etcdtest: start: %v", err)
+	case <-time.After(time.Second * 30):
+		t.Fatal("etcdtest: server not ready")
+	}
+
+	s.client, err = clientv3.New(clientv3.Config{
+		Endpoints:   []string{s.Endpoint()},
+		DialTimeout: time.Second * 5,
+	})
+	if err != nil {
+		t.Fatalf("etcdtest: create client: %v", err)
+	}
+	return s
+}
+
+// Endpoint 返回客户端访问地址
+func (s *Server) Endpoint() string {
+	return s.etcd.Clients[0].Addr().String()
+}
+
+// Client 返回服务自带的客户端，用于在测试中直接操作数据
+func (s *Server) Client() *clientv3.Client {
+	return s.client
+}
+
+// Close 关闭服务
+func (s *Server) Close() {
+	if s.client != nil {
+		_ = s.client.Close()
+	}
+	s.etcd.Close()
+}
+
+// ExpireLeases 撤销所有租约，用于模拟会话丢失
+func (s *Server) ExpireLeases(t testing.TB) {
+	t.Helper()
+	ctx := context.Background()
+	resp, err := s.client.Leases(ctx)
+	if err != nil {
+		t.Fatalf("etcdtest: list leases: %v", err)
+	}
+	for _, l := range resp.Leases {
+		if _, err := s.client.Revoke(ctx, l.ID); err != nil {
+			t.Fatalf("etcdtest: revoke lease: %v", err)
+		}
+	}
+}
+
+// LeaseCount 返回当前有效的租约数量
+func (s *Server) LeaseCount(t testing.TB) int {
+	t.Helper()
+	resp, err := s.client.Leases(context.Background())
+	if err != nil {
+		t.Fatalf("etcdtest: list leases: %v", err)
+	}
+	return len(resp.Leases)
+}
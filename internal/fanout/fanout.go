@@ -0,0 +1,206 @@
+package fanout
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+// Hub 将同一服务的实例列表更新分发给任意数量的观察者
+// 每个观察者只保留最新的实例列表，消费慢的观察者不会阻塞发布者，也不会丢失最终状态
+type Hub struct {
+	lock     sync.Mutex
+	watchers map[*Watcher]struct{}
+	latest   []*registry.ServiceInstance
+	has      bool
+	onIdle   func(*Hub)
+}
+
+// NewHub 创建一个分发器，onIdle在最后一个观察者停止后调用，可用于停止共享的监视循环
+func NewHub(onIdle func(*Hub)) *Hub {
+	return &Hub{
+		watchers: make(map[*Watcher]struct{}),
+		onIdle:   onIdle,
+	}
+}
+
+// Publish 发布最新的实例列表
+func (h *Hub) Publish(instances []*registry.ServiceInstance) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.latest = instances
+	h.has = true
+	for w := range h.watchers {
+		w.set(instances)
+	}
+}
+
+// Latest 返回最近一次发布的实例列表
+func (h *Hub) Latest() ([]*registry.ServiceInstance, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.latest, h.has
+}
+
+// Len 返回当前观察者数量
+func (h *Hub) Len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.watchers)
+}
+
+// Subscribe 添加一个观察者，ctx结束时观察者自动停止
+// 如果已有发布过的实例列表，观察者的第一次Next会立即返回它
+func (h *Hub) Subscribe(ctx context.Context) *Watcher {
+	w := &Watcher{
+		hub:    h,
+		ctx:    ctx,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	h.lock.Lock()
+	h.watchers[w] = struct{}{}
+	if h.has {
+		w.set(h.latest)
+	}
+	h.lock.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = w.Stop()
+	})
+	w.lock.Lock()
+	w.stopCtx = stop
+	stopped := w.stopped
+	w.lock.Unlock()
+	if stopped {
+		stop()
+	}
+	return w
+}
+
+// Close 停止所有观察者
+func (h *Hub) Close() {
+	h.lock.Lock()
+	watchers := make([]*Watcher, 0, len(h.watchers))
+	for w := range h.watchers {
+		watchers = append(watchers, w)
+	}
+	h.lock.Unlock()
+
+	for _, w := range watchers {
+		_ = w.Stop()
+	}
+}
+
+// remove 移除观察者，返回是否已无观察者
+func (h *Hub) remove(w *Watcher) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.watchers, w)
+	return len(h.watchers) == 0
+}
+
+// Watcher 是 Hub 的观察者，实现了 registry.Watcher
+type Watcher struct {
+	hub     *Hub
+	ctx     context.Context
+	stopCtx func() bool
+
+	lock    sync.Mutex
+	value   []*registry.ServiceInstance
+	notify  chan struct{}
+	done    chan struct{}
+	stopped bool
+}
+
+var _ registry.Watcher = (*Watcher)(nil)
+
+// set 用最新值覆盖未消费的值并唤醒Next
+func (w *Watcher) set(instances []*registry.ServiceInstance) {
+	w.lock.Lock()
+	w.value = instances
+	w.lock.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+		// 已有未消费的通知，Next会读到最新值
+	}
+}
+
+// Next 等待下一个服务更新，返回实例列表的副本
+// 观察者停止后返回错误
+func (w *Watcher) Next() ([]*registry.ServiceInstance, error) {
+	select {
+	case <-w.done:
+		return nil, w.err()
+	default:
+	}
+
+	select {
+	case <-w.done:
+		return nil, w.err()
+	case <-w.notify:
+		w.lock.Lock()
+		instances := w.value
+		w.lock.Unlock()
+		return Copy(instances), nil
+	}
+}
+
+// Stop 停止观察
+func (w *Watcher) Stop() error {
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return nil
+	}
+	w.stopped = true
+	close(w.done)
+	stop := w.stopCtx
+	w.lock.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+	if w.hub.remove(w) && w.hub.onIdle != nil {
+		w.hub.onIdle(w.hub)
+	}
+	return nil
+}
+
+// err 返回观察者停止的原因
+func (w *Watcher) err() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return context.Canceled
+}
+
+// Copy 复制实例列表，避免观察者之间共享可变数据
+func Copy(instances []*registry.ServiceInstance) []*registry.ServiceInstance {
+	if instances == nil {
+		return nil
+	}
+	items := make([]*registry.ServiceInstance, len(instances))
+	for i, ins := range instances {
+		if ins == nil {
+			continue
+		}
+		c := *ins
+		if ins.Metadata != nil {
+			c.Metadata = make(map[string]string, len(ins.Metadata))
+			for k, v := range ins.Metadata {
+				c.Metadata[k] = v
+			}
+		}
+		if ins.Endpoints != nil {
+			c.Endpoints = append([]string(nil), ins.Endpoints...)
+		}
+		items[i] = &c
+	}
+	return items
+}
@@ -0,0 +1,216 @@
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func instances(ids ...string) []*registry.ServiceInstance {
+	items := make([]*registry.ServiceInstance, len(ids))
+	for i, id := range ids {
+		items[i] = &registry.ServiceInstance{ID: id, Name: "svc", Metadata: map[string]string{"id": id}}
+	}
+	return items
+}
+
+// next 在超时时间内调用Next
+func next(t *testing.T, w *Watcher) ([]*registry.ServiceInstance, error) {
+	t.Helper()
+	type result struct {
+		items []*registry.ServiceInstance
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		items, err := w.Next()
+		ch <- result{items, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.items, r.err
+	case <-time.After(time.Second):
+		t.Fatal("Next did not return")
+		return nil, nil
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	h := NewHub(nil)
+	w := h.Subscribe(context.Background())
+	defer w.Stop()
+
+	// 慢的观察者只读到最后一次发布，发布者不会阻塞
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			h.Publish(instances("a"))
+		}
+		h.Publish(instances("a", "b"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher blocked by slow watcher")
+	}
+
+	items, err := next(t, w)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("items = %v, err = %v", items, err)
+	}
+	// 已消费最新值后没有更多通知
+	select {
+	case <-w.notify:
+		t.Error("unexpected pending notification")
+	default:
+	}
+}
+
+func TestSubscribeLatest(t *testing.T) {
+	h := NewHub(nil)
+	if _, ok := h.Latest(); ok {
+		t.Fatal("latest before publish")
+	}
+	h.Publish(instances("a"))
+
+	w := h.Subscribe(context.Background())
+	defer w.Stop()
+	items, err := next(t, w)
+	if err != nil || len(items) != 1 || items[0].ID != "a" {
+		t.Fatalf("items = %v, err = %v", items, err)
+	}
+
+	// 返回的是副本，修改不影响其他观察者
+	items[0].Metadata["id"] = "changed"
+	items[0].ID = "changed"
+	latest, _ := h.Latest()
+	if latest[0].ID != "a" || latest[0].Metadata["id"] != "a" {
+		t.Errorf("watcher mutated published instances: %+v", latest[0])
+	}
+}
+
+func TestStop(t *testing.T) {
+	h := NewHub(nil)
+	w := h.Subscribe(context.Background())
+
+	// 阻塞中的Next在Stop后返回错误
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.Next()
+		errc <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next did not return after Stop")
+	}
+
+	// 已停止的观察者即使有未消费的值也返回错误
+	h.Publish(instances("a"))
+	if _, err := next(t, w); err == nil {
+		t.Error("expected error after Stop")
+	}
+	if err := w.Stop(); err != nil {
+		t.Errorf("second Stop: %v", err)
+	}
+	if h.Len() != 0 {
+		t.Errorf("hub still has %d watchers", h.Len())
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	h := NewHub(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := h.Subscribe(ctx)
+	cancel()
+	if _, err := next(t, w); err != context.Canceled {
+		t.Errorf("err = %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	w = h.Subscribe(ctx)
+	if _, err := next(t, w); err != context.DeadlineExceeded {
+		t.Errorf("err = %v", err)
+	}
+
+	// 已结束的ctx订阅的观察者立即停止
+	w = h.Subscribe(ctx)
+	if _, err := next(t, w); err != context.DeadlineExceeded {
+		t.Errorf("err = %v", err)
+	}
+	if h.Len() != 0 {
+		t.Errorf("hub still has %d watchers", h.Len())
+	}
+}
+
+func TestOnIdle(t *testing.T) {
+	idle := make(chan *Hub, 2)
+	h := NewHub(func(h *Hub) { idle <- h })
+
+	w1 := h.Subscribe(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	w2 := h.Subscribe(ctx)
+
+	_ = w1.Stop()
+	select {
+	case <-idle:
+		t.Fatal("onIdle called while a watcher remains")
+	default:
+	}
+
+	cancel()
+	select {
+	case got := <-idle:
+		if got != h {
+			t.Error("onIdle called with another hub")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onIdle not called after last watcher stopped")
+	}
+	_ = w2.Stop()
+	select {
+	case <-idle:
+		t.Error("onIdle called twice")
+	default:
+	}
+}
+
+func TestClose(t *testing.T) {
+	idle := make(chan struct{}, 1)
+	h := NewHub(func(*Hub) { idle <- struct{}{} })
+	ws := []*Watcher{h.Subscribe(context.Background()), h.Subscribe(context.Background())}
+	h.Close()
+	for _, w := range ws {
+		if _, err := next(t, w); err == nil {
+			t.Error("expected error after Close")
+		}
+	}
+	select {
+	case <-idle:
+	default:
+		t.Error("onIdle not called after Close")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	if Copy(nil) != nil {
+		t.Error("Copy(nil) != nil")
+	}
+	src := []*registry.ServiceInstance{{ID: "a", Endpoints: []string{"grpc://a"}}, nil}
+	dst := Copy(src)
+	dst[0].Endpoints[0] = "changed"
+	if src[0].Endpoints[0] != "grpc://a" || dst[1] != nil {
+		t.Errorf("copy = %+v", dst)
+	}
+}
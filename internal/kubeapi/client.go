@@ -0,0 +1,136 @@
+package kubeapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ServiceAccountPath 是Pod内服务账号凭据的挂载目录
+const ServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client 是访问Kubernetes API Server的最小化REST客户端
+type Client struct {
+	Host       string
+	HTTPClient *http.Client
+	Token      string
+	TokenFile  string // 服务账号令牌会轮换，每次请求时重新读取
+}
+
+// APIError 是API Server返回的错误
+type APIError struct {
+	Status
+}
+
+// Error 实现error接口
+func (e *APIError) Error() string {
+	return fmt.Sprintf("kubernetes: %s (%d): %s", e.Reason, e.Code, e.Message)
+}
+
+// IsGone 判断错误是否表示resourceVersion已过期
+func IsGone(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusGone
+}
+
+// IsNotFound 判断错误是否表示对象不存在
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// InClusterClient 使用Pod内的服务账号创建客户端
+func InClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes: not running in a cluster, KUBERNETES_SERVICE_HOST is not set")
+	}
+
+	ca, err := os.ReadFile(ServiceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes: invalid service account CA")
+	}
+
+	return &Client{
+		Host: "https://" + net.JoinHostPort(host, port),
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}},
+		TokenFile: ServiceAccountPath + "/token",
+	}, nil
+}
+
+// Do 发送请求，非2xx响应转换为APIError
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := c.Host + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	token := c.Token
+	if c.TokenFile != "" {
+		data, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		apiErr := &APIError{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr.Status); err != nil || apiErr.Code == 0 {
+			apiErr.Code, apiErr.Reason = resp.StatusCode, resp.Status
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// Get 读取对象或列表
+func (c *Client) Get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	resp, err := c.Do(ctx, http.MethodGet, path, query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
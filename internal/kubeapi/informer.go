@@ -0,0 +1,205 @@
+package kubeapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dormoron/phantasm/log"
+)
+
+const (
+	minRetryDelay = time.Second      // 重新监视或列出的初始等待时间
+	maxRetryDelay = time.Second * 30 // 重新监视或列出的最长等待时间
+)
+
+// Informer 以list+watch的方式维护一类对象的本地缓存
+// 监视流结束后从最后的resourceVersion继续监视，resourceVersion过期（410 Gone）时重新列出全部对象
+type Informer[T any] struct {
+	Client   *Client
+	Path     string
+	Selector string                   // 标签选择器，为空时不过滤
+	Fields   string                   // 字段选择器，例如 metadata.name=app，为空时不过滤
+	OnChange func(items map[string]T) // 本地缓存变化时调用，items为名称到对象的映射
+	Logger   log.Logger
+
+	items map[string]T
+	rv    string
+}
+
+// List 列出全部对象并替换本地缓存
+func (i *Informer[T]) List(ctx context.Context) error {
+	list := &ObjectList[json.RawMessage]{}
+	if err := i.Client.Get(ctx, i.Path, i.query(), list); err != nil {
+		return err
+	}
+
+	items := make(map[string]T, len(list.Items))
+	for _, raw := range list.Items {
+		name, _, obj, err := DecodeObject[T](raw)
+		if err != nil {
+			return err
+		}
+		items[name] = obj
+	}
+	i.items, i.rv = items, list.Metadata.ResourceVersion
+	i.OnChange(i.items)
+	return nil
+}
+
+// Run 持续监视对象变化，直到ctx结束，需要先调用List
+// 监视流结束或出错后按指数退避等待再重新监视，避免服务端立即关闭连接时频繁请求
+func (i *Informer[T]) Run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		start := time.Now()
+		changed, err := i.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// 监视流收到过事件或持续了足够长的时间，说明连接正常，重置退避
+		if changed || time.Since(start) >= maxRetryDelay {
+			delay = minRetryDelay
+		}
+		if err != nil && !IsGone(err) {
+			i.Logger.Warn("监视Kubernetes资源失败", log.String("path", i.Path), log.Err(err))
+		}
+		if !sleep(ctx, delay) {
+			return
+		}
+		delay = min(delay*2, maxRetryDelay)
+		if err == nil {
+			// 服务端正常结束监视流，从当前resourceVersion继续
+			continue
+		}
+
+		// 重新列出全部对象
+		if !i.relist(ctx, &delay) {
+			return
+		}
+	}
+}
+
+// ListAndRun 列出全部对象后持续监视对象变化，直到ctx结束
+// 与先调用 List 再调用 Run 不同，列出失败时按指数退避重试，适合在后台启动
+func (i *Informer[T]) ListAndRun(ctx context.Context) {
+	delay := minRetryDelay
+	if i.relist(ctx, &delay) {
+		i.Run(ctx)
+	}
+}
+
+// relist 列出全部对象直到成功，失败时按指数退避等待，ctx结束时返回false
+func (i *Informer[T]) relist(ctx context.Context, delay *time.Duration) bool {
+	for {
+		err := i.List(ctx)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() == nil {
+			i.Logger.Warn("列出Kubernetes资源失败", log.String("path", i.Path), log.Err(err))
+		}
+		if !sleep(ctx, *delay) {
+			return false
+		}
+		*delay = min(*delay*2, maxRetryDelay)
+	}
+}
+
+// sleep 等待d，ctx结束时返回false
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// query 返回list和watch共用的选择器参数
+func (i *Informer[T]) query() url.Values {
+	query := url.Values{}
+	if i.Selector != "" {
+		query.Set("labelSelector", i.Selector)
+	}
+	if i.Fields != "" {
+		query.Set("fieldSelector", i.Fields)
+	}
+	return query
+}
+
+// watch 从当前resourceVersion开始读取一次监视流，返回期间本地缓存是否发生过变化
+func (i *Informer[T]) watch(ctx context.Context) (bool, error) {
+	query := i.query()
+	query.Set("watch", "1")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", i.rv)
+	resp, err := i.Client.Do(ctx, http.MethodGet, i.Path, query, nil, "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	changed := false
+	for {
+		ev := &WatchEvent{}
+		if err := dec.Decode(ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return changed, nil
+			}
+			return changed, err
+		}
+
+		switch ev.Type {
+		case "ERROR":
+			apiErr := &APIError{}
+			if err := json.Unmarshal(ev.Object, &apiErr.Status); err != nil {
+				return changed, err
+			}
+			return changed, apiErr
+		case "BOOKMARK":
+			_, rv, _, err := DecodeObject[T](ev.Object)
+			if err != nil {
+				return changed, err
+			}
+			i.rv = rv
+		case "ADDED", "MODIFIED", "DELETED":
+			name, rv, obj, err := DecodeObject[T](ev.Object)
+			if err != nil {
+				return changed, err
+			}
+			if ev.Type == "DELETED" {
+				delete(i.items, name)
+			} else {
+				i.items[name] = obj
+			}
+			i.rv = rv
+			changed = true
+			i.OnChange(i.items)
+		}
+	}
+}
+
+// DecodeObject 解析对象及其名称和resourceVersion
+func DecodeObject[T any](raw json.RawMessage) (string, string, T, error) {
+	var (
+		meta struct {
+			Metadata ObjectMeta `json:"metadata"`
+		}
+		obj T
+	)
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return "", "", obj, err
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return "", "", obj, err
+	}
+	return meta.Metadata.Name, meta.Metadata.ResourceVersion, obj, nil
+}
@@ -0,0 +1,58 @@
+package kubeapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/log"
+)
+
+func TestRunBackoff(t *testing.T) {
+	// 服务端总是立即正常结束监视流
+	var lists, watches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Query().Get("watch") == "" {
+			lists.Add(1)
+			_, _ = w.Write([]byte(`{"metadata":{"resourceVersion":"1"},"items":[]}`))
+			return
+		}
+		watches.Add(1)
+	}))
+	defer srv.Close()
+
+	i := &Informer[ObjectMeta]{
+		Client:   &Client{Host: srv.URL, HTTPClient: srv.Client()},
+		Path:     "/api/v1/namespaces/default/pods",
+		Logger:   log.DefaultLogger,
+		OnChange: func(map[string]ObjectMeta) {},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := i.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		i.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(minRetryDelay*3 + minRetryDelay/2)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after ctx canceled")
+	}
+	// 等待时间依次为1s、2s，期间最多发起3次监视
+	if n := watches.Load(); n < 2 || n > 3 {
+		t.Errorf("watches = %d, want 2 or 3 with backoff", n)
+	}
+	if n := lists.Load(); n != 1 {
+		t.Errorf("lists = %d, want no re-list after a clean EOF", n)
+	}
+}
@@ -0,0 +1,40 @@
+// Package kubeapi 提供访问Kubernetes API Server的最小化客户端和informer，
+// 供Kubernetes相关的注册中心和配置源使用，不依赖client-go
+package kubeapi
+
+import "encoding/json"
+
+// 这里只定义各组件共用的Kubernetes API字段
+
+// ObjectMeta 是Kubernetes对象的元数据
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// ListMeta 是列表的元数据
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// ObjectList 是列表响应
+type ObjectList[T any] struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []T      `json:"items"`
+}
+
+// WatchEvent 是监视流中的一个事件
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Status 是API错误响应，监视流中的ERROR事件也使用该结构
+type Status struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
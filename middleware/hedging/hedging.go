@@ -0,0 +1,431 @@
+package hedging
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/errors"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/middleware"
+	"github.com/dormoron/phantasm/selector"
+)
+
+// Option 是对冲中间件的选项
+type Option func(*options)
+
+// WithDelay 设置发起对冲请求前的固定等待时间
+func WithDelay(delay time.Duration) Option {
+	return func(o *options) {
+		o.delay = delay
+	}
+}
+
+// WithPercentile 设置使用节点延迟分位数作为对冲等待时间，例如0.95表示p95
+// 节点样本不足时退回到 WithDelay 设置的固定等待时间
+func WithPercentile(p float64) Option {
+	return func(o *options) {
+		o.percentile = p
+	}
+}
+
+// WithBudget 设置对冲预算，即对冲请求占总请求的最大百分比
+func WithBudget(percent float64) Option {
+	return func(o *options) {
+		o.budget = percent
+	}
+}
+
+// WithMaxHedges 设置每个请求最多发送的对冲请求数，默认为1
+func WithMaxHedges(n int) Option {
+	return func(o *options) {
+		o.maxHedges = n
+	}
+}
+
+// WithMaxConcurrent 设置最大并发请求数，超过时直接拒绝请求（减载）
+// 0表示不限制
+func WithMaxConcurrent(n int64) Option {
+	return func(o *options) {
+		o.maxConcurrent = n
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithClassifier 设置判断一次请求是否失败的函数，返回非nil错误表示失败，可重试的失败会立即触发对冲
+// 默认把handler返回的错误和状态码为5xx的 *http.Response 视为失败
+func WithClassifier(fn func(resp interface{}, err error) error) Option {
+	return func(o *options) {
+		o.classify = fn
+	}
+}
+
+// options 是对冲中间件的选项
+type options struct {
+	delay         time.Duration
+	percentile    float64
+	budget        float64
+	maxHedges     int
+	maxConcurrent int64
+	classify      func(resp interface{}, err error) error
+	logger        log.Logger
+}
+
+// result 是一次请求的结果，fail 是 classify 判定的失败原因
+type result struct {
+	attempt int
+	node    selector.Node
+	resp    interface{}
+	err     error
+	fail    error
+}
+
+// Client 返回一个对冲请求中间件，主要用于延迟敏感的读请求
+// 中间件通过sel选择节点，并通过 selector.NewNodeContext 将节点放入上下文，
+// gRPC和HTTP客户端会将请求发送到上下文中的节点（见 transport/grpc.WithClientMiddleware 和 transport/http.WithClientMiddleware）。
+// 请求在等待时间内未返回时向另一个节点发送重复请求，最多发送 WithMaxHedges 个对冲请求；
+// 请求失败（4xx业务错误除外）时立即发起下一个对冲请求。取先返回的成功结果并取消其余请求，
+// 未返回给调用方的HTTP响应体会被读完并关闭。
+func Client(sel selector.Selector, opts ...Option) middleware.Middleware {
+	options := options{
+		delay:     time.Millisecond * 50,
+		budget:    10,
+		maxHedges: 1,
+		classify:  classify,
+		logger:    log.DefaultLogger,
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+	h := &hedger{
+		opts:      options,
+		selector:  sel,
+		latencies: make(map[string]*window),
+		budget:    newBudget(options.budget),
+	}
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			return h.do(ctx, req, handler)
+		}
+	}
+}
+
+// hedger 保存对冲所需的共享状态
+type hedger struct {
+	opts     options
+	selector selector.Selector
+	budget   *budget
+
+	mu        sync.Mutex
+	inflight  int64
+	latencies map[string]*window
+}
+
+// do 执行一次可能被对冲的请求
+func (h *hedger) do(ctx context.Context, req interface{}, handler middleware.Handler) (interface{}, error) {
+	if !h.acquire() {
+		return nil, errors.ServiceUnavailable("HEDGING_LOAD_SHED", "too many concurrent requests")
+	}
+	defer h.release()
+
+	primary, err := h.selector.Select(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h.budget.request()
+
+	results := make(chan result, h.opts.maxHedges+1)
+	tried := []selector.Node{primary}
+	cancels := []context.CancelFunc{h.send(ctx, 0, primary, req, handler, results)}
+	winner := -1
+	pending := 1
+	// 取消所有尚未返回的请求，成功请求的上下文保持有效，以便调用方继续读取响应（例如HTTP响应体）
+	// 尚未返回的请求的响应在后台丢弃
+	defer func() {
+		for i, cancel := range cancels {
+			if i != winner {
+				cancel()
+			}
+		}
+		if pending > 0 {
+			go drain(results, pending)
+		}
+	}()
+
+	// hedge 向尚未尝试过的节点发起一个对冲请求，超出次数或预算时返回false
+	hedge := func(reason string) bool {
+		if len(tried) > h.opts.maxHedges {
+			return false
+		}
+		node, ok := h.pickOther(ctx, tried)
+		if !ok || !h.budget.allow() {
+			return false
+		}
+		h.opts.logger.Debug("Hedging request",
+			log.String("reason", reason),
+			log.String("primary", primary.Address),
+			log.String("hedge", node.Address))
+		cancels = append(cancels, h.send(ctx, len(tried), node, req, handler, results))
+		tried = append(tried, node)
+		return true
+	}
+
+	timer := time.NewTimer(h.hedgeDelay(primary))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			if hedge("delay") {
+				pending++
+				timer.Reset(h.hedgeDelay(tried[len(tried)-1]))
+			}
+		case r := <-results:
+			pending--
+			if r.fail == nil {
+				winner = r.attempt
+				return r.resp, r.err
+			}
+			if retryable(r.fail) && hedge("error") {
+				pending++
+			} else if pending == 0 {
+				// 没有其他请求可等，最后一个失败的结果原样返回，例如5xx的HTTP响应
+				winner = r.attempt
+				return r.resp, r.err
+			}
+			discard(r.resp)
+		}
+	}
+}
+
+// send 使用独立的可取消上下文异步向节点发送请求，并记录延迟
+func (h *hedger) send(ctx context.Context, attempt int, node selector.Node, req interface{}, handler middleware.Handler, results chan<- result) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		start := time.Now()
+		resp, err := handler(selector.NewNodeContext(ctx, node), req)
+		fail := h.opts.classify(resp, err)
+		if fail == nil {
+			h.observe(node.Address, time.Since(start))
+		}
+		results <- result{attempt: attempt, node: node, resp: resp, err: err, fail: fail}
+	}()
+	return cancel
+}
+
+// classify 是默认的失败判定，状态码为5xx的HTTP响应按服务端错误处理
+func classify(resp interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	if r, ok := resp.(*http.Response); ok && r != nil && r.StatusCode >= http.StatusInternalServerError {
+		return errors.New(int32(r.StatusCode), "HEDGING_UPSTREAM_ERROR", r.Status)
+	}
+	return nil
+}
+
+// drain 接收n个尚未返回的结果并丢弃其响应
+func drain(results <-chan result, n int) {
+	for i := 0; i < n; i++ {
+		discard((<-results).resp)
+	}
+}
+
+// discard 丢弃不返回给调用方的响应，HTTP响应体读完并关闭后连接才能复用
+func discard(resp interface{}) {
+	if r, ok := resp.(*http.Response); ok && r != nil && r.Body != nil {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_ = r.Body.Close()
+	}
+}
+
+// retryable 判断失败的请求是否值得向其他节点重发，4xx业务错误不重发
+func retryable(err error) bool {
+	e := errors.FromError(err)
+	return e.Code < 400 || e.Code >= 500
+}
+
+// pickOther 选择一个与已尝试节点地址都不同的节点
+func (h *hedger) pickOther(ctx context.Context, tried []selector.Node) (selector.Node, bool) {
+	for i := 0; i < 3; i++ {
+		node, err := h.selector.Select(ctx)
+		if err != nil {
+			return selector.Node{}, false
+		}
+		if !containsAddress(tried, node.Address) {
+			return node, true
+		}
+	}
+	return selector.Node{}, false
+}
+
+// containsAddress 判断节点列表中是否有指定地址的节点
+func containsAddress(nodes []selector.Node, address string) bool {
+	for _, n := range nodes {
+		if n.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// hedgeDelay 返回发起对冲前的等待时间
+func (h *hedger) hedgeDelay(node selector.Node) time.Duration {
+	if h.opts.percentile <= 0 {
+		return h.opts.delay
+	}
+	h.mu.Lock()
+	w, ok := h.latencies[node.Address]
+	h.mu.Unlock()
+	if !ok {
+		return h.opts.delay
+	}
+	if d, ok := w.quantile(h.opts.percentile); ok {
+		return d
+	}
+	return h.opts.delay
+}
+
+// observe 记录节点的一次成功请求延迟
+func (h *hedger) observe(address string, d time.Duration) {
+	h.mu.Lock()
+	w, ok := h.latencies[address]
+	if !ok {
+		w = newWindow(windowSize)
+		h.latencies[address] = w
+	}
+	h.mu.Unlock()
+	w.add(d)
+}
+
+// acquire 占用一个并发名额
+func (h *hedger) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.opts.maxConcurrent > 0 && h.inflight >= h.opts.maxConcurrent {
+		return false
+	}
+	h.inflight++
+	return true
+}
+
+// release 释放一个并发名额
+func (h *hedger) release() {
+	h.mu.Lock()
+	h.inflight--
+	h.mu.Unlock()
+}
+
+const (
+	// windowSize 是每个节点保留的延迟样本数
+	windowSize = 128
+	// minSamples 是计算分位数所需的最少样本数
+	minSamples = 16
+)
+
+// window 是固定大小的延迟样本环形缓冲区
+type window struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// newWindow 创建一个延迟样本窗口
+func newWindow(size int) *window {
+	return &window{samples: make([]time.Duration, size)}
+}
+
+// add 添加一个样本
+func (w *window) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// quantile 计算分位数，样本不足时返回false
+func (w *window) quantile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	if n < minSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(float64(n-1) * p)
+	if idx >= n {
+		idx = n - 1
+	}
+	return sorted[idx], true
+}
+
+// budgetWindow 是对冲预算的统计周期，每个周期计数减半以淡化历史流量
+const budgetWindow = time.Second * 10
+
+// budget 限制对冲请求占总请求的比例，超出预算的对冲请求会被丢弃
+type budget struct {
+	mu       sync.Mutex
+	percent  float64
+	requests float64
+	hedges   float64
+	reset    time.Time
+}
+
+// newBudget 创建一个对冲预算
+func newBudget(percent float64) *budget {
+	return &budget{percent: percent, reset: time.Now().Add(budgetWindow)}
+}
+
+// request 记录一次原始请求
+func (b *budget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.decay()
+	b.requests++
+}
+
+// allow 判断是否还有对冲预算，有则占用一次
+func (b *budget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.decay()
+	if b.hedges+1 > b.requests*b.percent/100 {
+		return false
+	}
+	b.hedges++
+	return true
+}
+
+// decay 在周期结束时将计数减半
+func (b *budget) decay() {
+	now := time.Now()
+	if now.Before(b.reset) {
+		return
+	}
+	b.requests /= 2
+	b.hedges /= 2
+	b.reset = now.Add(budgetWindow)
+}
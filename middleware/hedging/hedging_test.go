@@ -0,0 +1,379 @@
+package hedging
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/errors"
+	"github.com/dormoron/phantasm/middleware"
+	"github.com/dormoron/phantasm/selector"
+)
+
+// roundRobin 是按顺序轮流返回节点的选择器
+type roundRobin struct {
+	mu    sync.Mutex
+	nodes []selector.Node
+	next  int
+}
+
+func newRoundRobin(addrs ...string) *roundRobin {
+	s := &roundRobin{}
+	for _, addr := range addrs {
+		s.nodes = append(s.nodes, selector.Node{ID: addr, Address: addr})
+	}
+	return s
+}
+
+func (s *roundRobin) Select(context.Context) (selector.Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.nodes) == 0 {
+		return selector.Node{}, selector.ErrNoAvailable
+	}
+	n := s.nodes[s.next%len(s.nodes)]
+	s.next++
+	return n, nil
+}
+
+func (s *roundRobin) Update(nodes []selector.Node) error { return nil }
+func (s *roundRobin) Apply(...selector.FilterFunc)       {}
+
+// backend 模拟按节点地址返回的后端，记录每个节点收到的请求及其上下文
+type backend struct {
+	mu      sync.Mutex
+	delays  map[string]time.Duration
+	errs    map[string]error
+	calls   []string
+	ctxs    map[string]context.Context
+	started chan string
+}
+
+func newBackend() *backend {
+	return &backend{
+		delays:  make(map[string]time.Duration),
+		errs:    make(map[string]error),
+		ctxs:    make(map[string]context.Context),
+		started: make(chan string, 10),
+	}
+}
+
+func (b *backend) handler(ctx context.Context, _ interface{}) (interface{}, error) {
+	node, ok := selector.NodeFromContext(ctx)
+	if !ok {
+		return nil, errors.InternalServer("NO_NODE", "node not in context")
+	}
+	b.mu.Lock()
+	b.calls = append(b.calls, node.Address)
+	b.ctxs[node.Address] = ctx
+	delay, err := b.delays[node.Address], b.errs[node.Address]
+	b.mu.Unlock()
+	b.started <- node.Address
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return node.Address, nil
+}
+
+func (b *backend) called() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.calls...)
+}
+
+func (b *backend) ctx(addr string) context.Context {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ctxs[addr]
+}
+
+func call(t *testing.T, m middleware.Middleware, b *backend) (interface{}, error, time.Duration) {
+	t.Helper()
+	start := time.Now()
+	resp, err := m(b.handler)(context.Background(), "req")
+	return resp, err, time.Since(start)
+}
+
+func TestHedgeAfterDelay(t *testing.T) {
+	b := newBackend()
+	b.delays["a"] = time.Second
+	m := Client(newRoundRobin("a", "b"), WithDelay(time.Millisecond*20), WithBudget(100))
+
+	resp, err, elapsed := call(t, m, b)
+	if err != nil || resp != "b" {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if elapsed < time.Millisecond*20 || elapsed > time.Millisecond*500 {
+		t.Errorf("elapsed = %s", elapsed)
+	}
+	// 慢的请求被取消，成功的请求的上下文保持有效
+	if err := b.ctx("a").Err(); err != context.Canceled {
+		t.Errorf("primary ctx err = %v", err)
+	}
+	if err := b.ctx("b").Err(); err != nil {
+		t.Errorf("winner ctx err = %v", err)
+	}
+}
+
+func TestNoHedgeBeforeDelay(t *testing.T) {
+	b := newBackend()
+	m := Client(newRoundRobin("a", "b"), WithDelay(time.Millisecond*100), WithBudget(100))
+	resp, err, _ := call(t, m, b)
+	if err != nil || resp != "a" {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if calls := b.called(); len(calls) != 1 {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestMaxHedges(t *testing.T) {
+	b := newBackend()
+	b.delays["a"] = time.Second
+	b.delays["b"] = time.Second
+	m := Client(newRoundRobin("a", "b", "c"), WithDelay(time.Millisecond*10), WithBudget(200), WithMaxHedges(2))
+	resp, err, _ := call(t, m, b)
+	if err != nil || resp != "c" {
+		t.Fatalf("resp = %v, err = %v (calls %v)", resp, err, b.called())
+	}
+
+	b = newBackend()
+	b.delays["a"] = time.Millisecond * 200
+	b.delays["b"] = time.Millisecond * 200
+	m = Client(newRoundRobin("a", "b", "c"), WithDelay(time.Millisecond*10), WithBudget(100))
+	if resp, err, _ := call(t, m, b); err != nil || resp == "c" {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if calls := b.called(); len(calls) != 2 {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestHedgeOnFailure(t *testing.T) {
+	b := newBackend()
+	b.errs["a"] = errors.ServiceUnavailable("DOWN", "node down")
+	m := Client(newRoundRobin("a", "b"), WithDelay(time.Second), WithBudget(100))
+	resp, err, elapsed := call(t, m, b)
+	if err != nil || resp != "b" {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if elapsed > time.Millisecond*500 {
+		t.Errorf("failure hedge waited for delay: %s", elapsed)
+	}
+
+	// 业务错误不重发
+	b = newBackend()
+	b.errs["a"] = errors.BadRequest("INVALID", "bad request")
+	m = Client(newRoundRobin("a", "b"), WithDelay(time.Second), WithBudget(100))
+	if _, err, _ := call(t, m, b); !errors.IsBadRequest(err) {
+		t.Fatalf("err = %v", err)
+	}
+	if calls := b.called(); len(calls) != 1 {
+		t.Errorf("calls = %v", calls)
+	}
+
+	// 所有节点都失败时返回最后的错误
+	b = newBackend()
+	b.errs["a"] = errors.ServiceUnavailable("DOWN", "a down")
+	b.errs["b"] = errors.ServiceUnavailable("DOWN", "b down")
+	m = Client(newRoundRobin("a", "b"), WithDelay(time.Second), WithBudget(100))
+	if _, err, _ := call(t, m, b); err == nil || errors.FromError(err).Message != "b down" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// trackedBody 记录响应体是否被读完并关闭
+type trackedBody struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (b *trackedBody) Close() error {
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		panic("body closed before drained")
+	}
+	close(b.closed)
+	return nil
+}
+
+func TestHTTPResponses(t *testing.T) {
+	bodies := map[string]*trackedBody{}
+	handler := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		node, _ := selector.NodeFromContext(ctx)
+		status, delay := http.StatusOK, time.Duration(0)
+		switch node.Address {
+		case "bad":
+			status = http.StatusServiceUnavailable
+		case "slow":
+			delay = time.Millisecond * 100
+		}
+		time.Sleep(delay)
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: bodies[node.Address]}, nil
+	}
+	reset := func(addrs ...string) {
+		for _, addr := range addrs {
+			bodies[addr] = &trackedBody{Reader: strings.NewReader(addr), closed: make(chan struct{})}
+		}
+	}
+	closed := func(addr string) bool {
+		select {
+		case <-bodies[addr].closed:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	// 5xx响应立即触发对冲，其响应体被丢弃
+	reset("bad", "ok")
+	m := Client(newRoundRobin("bad", "ok"), WithDelay(time.Second), WithBudget(100))
+	start := time.Now()
+	resp, err := m(handler)(context.Background(), "req")
+	if err != nil || resp.(*http.Response).Body != bodies["ok"] {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("5xx hedge waited for delay: %s", elapsed)
+	}
+	if !closed("bad") {
+		t.Error("5xx response body not closed")
+	}
+
+	// 较晚返回的响应在后台被丢弃
+	reset("slow", "ok")
+	m = Client(newRoundRobin("slow", "ok"), WithDelay(time.Millisecond*10), WithBudget(100))
+	if resp, err = m(handler)(context.Background(), "req"); err != nil || resp.(*http.Response).Body != bodies["ok"] {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if !closed("slow") {
+		t.Error("losing response body not closed")
+	}
+
+	// 没有其他节点可用时原样返回5xx响应
+	reset("bad")
+	m = Client(newRoundRobin("bad"), WithDelay(time.Second), WithBudget(100))
+	resp, err = m(handler)(context.Background(), "req")
+	if err != nil || resp.(*http.Response).StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	select {
+	case <-bodies["bad"].closed:
+		t.Error("returned response body closed")
+	default:
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := newBackend()
+	b.delays["a"] = time.Millisecond * 100
+	m := Client(newRoundRobin("a", "b"), WithDelay(time.Millisecond*10), WithBudget(0))
+	resp, err, _ := call(t, m, b)
+	if err != nil || resp != "a" {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if calls := b.called(); len(calls) != 1 {
+		t.Errorf("hedged without budget: %v", calls)
+	}
+
+	// 10%的预算在10个请求后只允许一次对冲
+	bg := newBudget(10)
+	for i := 0; i < 10; i++ {
+		bg.request()
+	}
+	if !bg.allow() {
+		t.Error("first hedge should be allowed")
+	}
+	if bg.allow() {
+		t.Error("second hedge should exceed budget")
+	}
+	bg.reset = time.Now()
+	bg.request()
+	if bg.requests != 6 || bg.hedges != 0.5 {
+		t.Errorf("decay: requests = %v, hedges = %v", bg.requests, bg.hedges)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	b := newBackend()
+	b.delays["a"] = time.Second
+	b.delays["b"] = time.Second
+	m := Client(newRoundRobin("a", "b"), WithDelay(time.Millisecond*10), WithBudget(100))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-b.started
+		<-b.started
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := m(b.handler)(ctx, "req"); err != context.Canceled {
+		t.Fatalf("err = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("elapsed = %s", elapsed)
+	}
+	for _, addr := range []string{"a", "b"} {
+		if b.ctx(addr).Err() == nil {
+			t.Errorf("attempt %s not cancelled", addr)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	b := newBackend()
+	b.delays["a"] = time.Millisecond * 200
+	b.delays["b"] = time.Millisecond * 200
+	m := Client(newRoundRobin("a", "b"), WithDelay(time.Second), WithMaxConcurrent(1))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m(b.handler)(context.Background(), "req")
+		done <- err
+	}()
+	<-b.started
+
+	_, err := m(b.handler)(context.Background(), "req")
+	if e := errors.FromError(err); e == nil || e.Reason != "HEDGING_LOAD_SHED" {
+		t.Fatalf("err = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	// 名额释放后可以继续请求
+	if _, err := m(b.handler)(context.Background(), "req"); err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+}
+
+func TestPercentileDelay(t *testing.T) {
+	h := &hedger{opts: options{delay: time.Second, percentile: 0.5}, latencies: make(map[string]*window)}
+	node := selector.Node{Address: "a"}
+	if d := h.hedgeDelay(node); d != time.Second {
+		t.Errorf("delay without samples = %s", d)
+	}
+	for i := 1; i <= minSamples; i++ {
+		h.observe("a", time.Duration(i)*time.Millisecond)
+	}
+	if d := h.hedgeDelay(node); d != time.Millisecond*8 {
+		t.Errorf("p50 delay = %s", d)
+	}
+
+	w := newWindow(4)
+	for i := 0; i < 6; i++ {
+		w.add(time.Duration(i))
+	}
+	if n := len(w.samples); n != 4 || !w.full || w.next != 2 {
+		t.Errorf("window = %+v", w)
+	}
+}
@@ -0,0 +1,427 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/middleware/metrics"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.Discovery = (*Discovery)(nil)
+)
+
+const (
+	// MetricHit 是后端不可用时使用缓存的次数，标签为service和reason（error或empty）
+	MetricHit = "registry_cache_hit_total"
+	// MetricMiss 是后端不可用且没有缓存的次数，标签为service
+	MetricMiss = "registry_cache_miss_total"
+	// MetricStaleness 是使用缓存时缓存距上次更新的秒数，标签为service
+	MetricStaleness = "registry_cache_staleness_seconds"
+
+	reasonError = "error"
+	reasonEmpty = "empty"
+
+	// saveDelay 是缓存变化后写入快照的延迟，期间的多次变化合并为一次写入
+	saveDelay = time.Second
+)
+
+// entry 是一个服务的缓存
+type entry struct {
+	Instances []*registry.ServiceInstance `json:"instances"`
+	UpdatedAt time.Time                   `json:"updated_at"`
+}
+
+// Discovery 是带缓存的服务发现装饰器，用于在注册中心不可用时继续提供服务实例
+// 缓存由后端的查询结果和Watch更新维护，并可持久化到本地快照文件，进程在注册中心故障期间重启也能使用上次的结果
+type Discovery struct {
+	discovery registry.Discovery
+	options   *Options
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+	entries   map[string]*entry
+	hubs      map[string]*serviceWatch // 服务名称到共享监视的映射
+	saveLock  sync.Mutex               // 串行化快照写入
+	saveTimer *time.Timer              // 待执行的快照写入，为空时快照与缓存一致
+	savedAt   time.Time                // 上次写入快照时缓存的时间
+	logger    log.Logger
+}
+
+// Options 是缓存服务发现的选项
+type Options struct {
+	SnapshotPath    string          // 快照文件路径，为空时不持久化
+	EmptyProtection bool            // 后端返回空列表而缓存非空时继续使用缓存
+	MaxStaleness    time.Duration   // 缓存超过该时间未被后端确认时不再保护，0表示不限制
+	RetryInterval   time.Duration   // 后端Watch失败后的最大重试间隔
+	Metrics         metrics.Metrics // 指标收集器，为空时不上报
+	Logger          log.Logger
+}
+
+// Option 是缓存服务发现的选项函数
+type Option func(*Options)
+
+// WithSnapshot 设置快照文件路径
+func WithSnapshot(path string) Option {
+	return func(o *Options) {
+		o.SnapshotPath = path
+	}
+}
+
+// WithEmptyProtection 设置是否启用空列表保护，默认启用
+// 注册中心故障或数据被误删时可能返回空列表，启用后保留缓存中的实例，代价是服务确实下线全部实例时不会感知
+func WithEmptyProtection(enable bool) Option {
+	return func(o *Options) {
+		o.EmptyProtection = enable
+	}
+}
+
+// WithMaxStaleness 设置缓存的最长有效时间，默认不限制
+// 缓存超过该时间未被后端的非空结果确认时，后端返回的空列表会被采用，快照中超过该时间的服务也不会被加载，
+// 避免服务确实下线全部实例后一直使用过期的缓存
+func WithMaxStaleness(d time.Duration) Option {
+	return func(o *Options) {
+		o.MaxStaleness = d
+	}
+}
+
+// WithRetryInterval 设置后端Watch失败后的最大重试间隔
+func WithRetryInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.RetryInterval = interval
+	}
+}
+
+// WithMetrics 设置指标收集器
+func WithMetrics(m metrics.Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = m
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewDiscovery 创建带缓存的服务发现，设置了快照文件时从快照加载缓存
+func NewDiscovery(discovery registry.Discovery, opts ...Option) *Discovery {
+	options := &Options{
+		EmptyProtection: true,
+		RetryInterval:   time.Second * 30,
+		Logger:          log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Discovery{
+		discovery: discovery,
+		options:   options,
+		ctx:       ctx,
+		cancel:    cancel,
+		lock:      sync.Mutex{},
+		entries:   make(map[string]*entry),
+		hubs:      make(map[string]*serviceWatch),
+		logger:    options.Logger,
+	}
+	if options.SnapshotPath != "" {
+		if err := d.load(); err != nil && !os.IsNotExist(err) {
+			d.logger.Warn("读取服务发现快照失败", log.String("path", options.SnapshotPath), log.Err(err))
+		}
+	}
+	return d
+}
+
+// GetService 从后端获取服务实例，后端出错或意外返回空列表时使用缓存
+func (d *Discovery) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	instances, err := d.discovery.GetService(ctx, serviceName)
+	if err == nil && d.update(serviceName, instances) {
+		return instances, nil
+	}
+
+	reason := reasonEmpty
+	if err != nil {
+		reason = reasonError
+	}
+	if cached, ok := d.cached(serviceName, reason); ok {
+		if err != nil {
+			d.logger.Warn("获取服务实例失败，使用缓存", log.String("service", serviceName), log.Err(err))
+		}
+		return cached, nil
+	}
+	if err != nil {
+		d.counter(MetricMiss, map[string]string{"service": serviceName})
+	}
+	return instances, err
+}
+
+// update 用后端的结果更新缓存，返回结果是否被采用
+// 启用空列表保护时，空列表不会覆盖未过期的非空缓存
+func (d *Discovery) update(serviceName string, instances []*registry.ServiceInstance) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	e, ok := d.entries[serviceName]
+	if len(instances) == 0 && d.options.EmptyProtection && ok && len(e.Instances) > 0 && !d.stale(e) {
+		return false
+	}
+	if ok && reflect.DeepEqual(e.Instances, instances) {
+		// 实例没有变化时只刷新内存中的更新时间，不重写快照；
+		// 设置了最长有效时间时定期重写，避免快照中的更新时间过期导致重启后不加载
+		d.entries[serviceName] = &entry{Instances: e.Instances, UpdatedAt: time.Now()}
+		if d.options.MaxStaleness > 0 && time.Since(d.savedAt) >= d.options.MaxStaleness/2 {
+			d.scheduleSave()
+		}
+		return true
+	}
+	d.entries[serviceName] = &entry{Instances: fanout.Copy(instances), UpdatedAt: time.Now()}
+	d.scheduleSave()
+	return true
+}
+
+// stale 判断缓存是否超过最长有效时间
+func (d *Discovery) stale(e *entry) bool {
+	return d.options.MaxStaleness > 0 && time.Since(e.UpdatedAt) > d.options.MaxStaleness
+}
+
+// scheduleSave 在saveDelay后写入快照，调用方需持有锁
+func (d *Discovery) scheduleSave() {
+	if d.options.SnapshotPath != "" && d.saveTimer == nil {
+		d.saveTimer = time.AfterFunc(saveDelay, d.save)
+	}
+}
+
+// cached 返回缓存的实例列表并上报指标
+func (d *Discovery) cached(serviceName, reason string) ([]*registry.ServiceInstance, bool) {
+	d.lock.Lock()
+	e, ok := d.entries[serviceName]
+	d.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	labels := map[string]string{"service": serviceName}
+	d.counter(MetricHit, map[string]string{"service": serviceName, "reason": reason})
+	if d.options.Metrics != nil {
+		d.options.Metrics.Gauge(MetricStaleness, time.Since(e.UpdatedAt).Seconds(), labels)
+	}
+	return fanout.Copy(e.Instances), true
+}
+
+// counter 上报计数指标
+func (d *Discovery) counter(name string, labels map[string]string) {
+	if d.options.Metrics != nil {
+		d.options.Metrics.Counter(name, 1, labels)
+	}
+}
+
+// serviceWatch 是同一服务共享的监视
+type serviceWatch struct {
+	hub    *fanout.Hub
+	cancel context.CancelFunc
+}
+
+// Watch 监视服务变更
+// 已有缓存时观察者立即收到缓存的实例列表；后端Watch失败或中断时继续提供缓存，并在后台重试
+func (d *Discovery) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	d.lock.Lock()
+	if sw, ok := d.hubs[serviceName]; ok {
+		w := sw.hub.Subscribe(ctx)
+		d.lock.Unlock()
+		return w, nil
+	}
+	d.lock.Unlock()
+
+	// 后端的监视属于共享的监视循环，不随调用方的ctx结束
+	// 调用后端时不持有锁，避免后端阻塞时影响其他服务的查询和监视
+	loopCtx, cancel := context.WithCancel(d.ctx)
+	w, err := d.discovery.Watch(loopCtx, serviceName)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sw, ok := d.hubs[serviceName]
+	if ok || d.ctx.Err() != nil {
+		// 并发的Watch已经建立了共享的监视，或者期间已经停止
+		cancel()
+		if w != nil {
+			_ = w.Stop()
+		}
+		if !ok {
+			return nil, d.ctx.Err()
+		}
+		return sw.hub.Subscribe(ctx), nil
+	}
+	e, cached := d.entries[serviceName]
+	if err != nil && !cached {
+		cancel()
+		d.counter(MetricMiss, map[string]string{"service": serviceName})
+		return nil, err
+	}
+
+	sw = &serviceWatch{cancel: cancel}
+	sw.hub = fanout.NewHub(func(hub *fanout.Hub) {
+		d.unwatch(serviceName, hub)
+	})
+	if cached {
+		sw.hub.Publish(e.Instances)
+	}
+	if err != nil {
+		d.logger.Warn("监视服务失败，使用缓存", log.String("service", serviceName), log.Err(err))
+		d.counter(MetricHit, map[string]string{"service": serviceName, "reason": reasonError})
+		if d.options.Metrics != nil {
+			d.options.Metrics.Gauge(MetricStaleness, time.Since(e.UpdatedAt).Seconds(), map[string]string{"service": serviceName})
+		}
+	}
+	d.hubs[serviceName] = sw
+
+	go d.watchLoop(loopCtx, serviceName, sw.hub, w)
+	return sw.hub.Subscribe(ctx), nil
+}
+
+// watchLoop 将后端的更新写入缓存并发布，后端Watch中断后按指数退避重新监视
+func (d *Discovery) watchLoop(ctx context.Context, serviceName string, hub *fanout.Hub, w registry.Watcher) {
+	minBackoff := min(time.Second, d.options.RetryInterval)
+	backoff := minBackoff
+	for {
+		if w != nil {
+			stop := context.AfterFunc(ctx, func() { _ = w.Stop() })
+			for {
+				instances, err := w.Next()
+				if err != nil {
+					if ctx.Err() == nil {
+						d.logger.Warn("服务监视中断，使用缓存", log.String("service", serviceName), log.Err(err))
+					}
+					break
+				}
+				backoff = minBackoff
+				if d.update(serviceName, instances) {
+					hub.Publish(instances)
+				} else {
+					d.cached(serviceName, reasonEmpty)
+				}
+			}
+			stop()
+			_ = w.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > d.options.RetryInterval {
+			backoff = d.options.RetryInterval
+		}
+
+		var err error
+		if w, err = d.discovery.Watch(ctx, serviceName); err != nil {
+			w = nil
+			if ctx.Err() == nil {
+				d.logger.Warn("重新监视服务失败", log.String("service", serviceName), log.Err(err))
+			}
+		}
+	}
+}
+
+// unwatch 在服务的最后一个观察者停止后结束共享的监视
+func (d *Discovery) unwatch(serviceName string, hub *fanout.Hub) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sw, ok := d.hubs[serviceName]
+	if !ok || sw.hub != hub || hub.Len() > 0 {
+		return
+	}
+	sw.cancel()
+	delete(d.hubs, serviceName)
+}
+
+// load 从快照文件加载缓存，跳过超过最长有效时间的服务
+func (d *Discovery) load() error {
+	data, err := os.ReadFile(d.options.SnapshotPath)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]*entry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for name, e := range entries {
+		if e == nil || d.stale(e) {
+			delete(entries, name)
+		}
+	}
+	d.lock.Lock()
+	d.entries = entries
+	d.lock.Unlock()
+	return nil
+}
+
+// save 将缓存原子地写入快照文件，没有待写入的变化时直接返回
+func (d *Discovery) save() {
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+
+	d.lock.Lock()
+	if d.saveTimer == nil {
+		d.lock.Unlock()
+		return
+	}
+	d.saveTimer.Stop()
+	d.saveTimer = nil
+	data, err := json.MarshalIndent(d.entries, "", "  ")
+	if err == nil {
+		d.savedAt = time.Now()
+	}
+	d.lock.Unlock()
+	if err != nil {
+		d.logger.Warn("序列化服务发现快照失败", log.Err(err))
+		return
+	}
+
+	path := d.options.SnapshotPath
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		d.logger.Warn("写入服务发现快照失败", log.String("path", path), log.Err(err))
+	}
+}
+
+// Stop 停止所有监视，所有观察者随之停止，并立即写入尚未保存的快照
+func (d *Discovery) Stop() error {
+	d.cancel()
+
+	d.lock.Lock()
+	hubs := make([]*fanout.Hub, 0, len(d.hubs))
+	for _, sw := range d.hubs {
+		hubs = append(hubs, sw.hub)
+	}
+	d.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.Close()
+	}
+	d.save()
+	return nil
+}
@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/middleware/metrics"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var errUnavailable = errors.New("registry unavailable")
+
+// fakeDiscovery 是可以模拟故障的服务发现
+type fakeDiscovery struct {
+	lock      sync.Mutex
+	instances []*registry.ServiceInstance
+	down      bool
+	hub       *fanout.Hub
+	entered   chan struct{} // 非空时Watch开始前发送通知
+	block     chan struct{} // 非空时Watch等待关闭后再返回
+}
+
+func newFakeDiscovery(instances ...*registry.ServiceInstance) *fakeDiscovery {
+	return &fakeDiscovery{instances: instances, hub: fanout.NewHub(nil)}
+}
+
+func (f *fakeDiscovery) set(down bool, instances ...*registry.ServiceInstance) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.down, f.instances = down, instances
+	if down {
+		f.hub.Close()
+		f.hub = fanout.NewHub(nil)
+	} else {
+		f.hub.Publish(instances)
+	}
+}
+
+func (f *fakeDiscovery) GetService(context.Context, string) ([]*registry.ServiceInstance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down {
+		return nil, errUnavailable
+	}
+	return f.instances, nil
+}
+
+func (f *fakeDiscovery) Watch(ctx context.Context, _ string) (registry.Watcher, error) {
+	if f.block != nil {
+		f.entered <- struct{}{}
+		<-f.block
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.down {
+		return nil, errUnavailable
+	}
+	f.hub.Publish(f.instances)
+	return f.hub.Subscribe(ctx), nil
+}
+
+// recorder 记录上报的计数指标
+type recorder struct {
+	metrics.Metrics
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (r *recorder) Counter(name string, value float64, labels map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.counts[name+"/"+labels["reason"]] += int(value)
+}
+
+func (r *recorder) Gauge(string, float64, map[string]string) {}
+
+func (r *recorder) count(key string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.counts[key]
+}
+
+func instance(id string) *registry.ServiceInstance {
+	return &registry.ServiceInstance{ID: id, Name: "svc", Endpoints: []string{"grpc://" + id + ":9000"}}
+}
+
+func TestGetServiceFallback(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeDiscovery(instance("a"))
+	m := &recorder{counts: make(map[string]int)}
+	d := NewDiscovery(backend, WithMetrics(m))
+	defer d.Stop()
+
+	if got, err := d.GetService(ctx, "svc"); err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+
+	backend.set(true)
+	if got, err := d.GetService(ctx, "svc"); err != nil || len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("get service during outage = %v, %v", got, err)
+	}
+	if m.count(MetricHit+"/error") != 1 {
+		t.Errorf("hit count = %v", m.counts)
+	}
+
+	// 空列表保护
+	backend.set(false)
+	if got, err := d.GetService(ctx, "svc"); err != nil || len(got) != 1 {
+		t.Fatalf("get service with empty backend = %v, %v", got, err)
+	}
+	if m.count(MetricHit+"/empty") != 1 {
+		t.Errorf("hit count = %v", m.counts)
+	}
+
+	if _, err := d.GetService(ctx, "other"); err != nil {
+		t.Fatalf("get other: %v", err)
+	}
+	backend.set(true)
+	if _, err := d.GetService(ctx, "unknown"); !errors.Is(err, errUnavailable) {
+		t.Errorf("expected backend error without cache, got %v", err)
+	}
+	if m.count(MetricMiss+"/") != 1 {
+		t.Errorf("miss count = %v", m.counts)
+	}
+}
+
+func TestEmptyProtectionDisabled(t *testing.T) {
+	backend := newFakeDiscovery(instance("a"))
+	d := NewDiscovery(backend, WithEmptyProtection(false))
+	defer d.Stop()
+
+	_, _ = d.GetService(context.Background(), "svc")
+	backend.set(false)
+	if got, err := d.GetService(context.Background(), "svc"); err != nil || len(got) != 0 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+}
+
+func TestMaxStaleness(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeDiscovery(instance("a"))
+	d := NewDiscovery(backend, WithMaxStaleness(time.Millisecond*100))
+	defer d.Stop()
+
+	if got, err := d.GetService(ctx, "svc"); err != nil || len(got) != 1 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	// 缓存未过期时保护空列表
+	backend.set(false)
+	if got, err := d.GetService(ctx, "svc"); err != nil || len(got) != 1 {
+		t.Fatalf("get service with empty backend = %v, %v", got, err)
+	}
+	// 缓存过期后采用空列表
+	time.Sleep(time.Millisecond * 150)
+	if got, err := d.GetService(ctx, "svc"); err != nil || len(got) != 0 {
+		t.Fatalf("get service after max staleness = %v, %v", got, err)
+	}
+}
+
+func TestSnapshotMaxStaleness(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	snapshot := `{
+  "fresh": {"instances": [{"id": "a", "name": "fresh"}], "updated_at": "` + time.Now().Format(time.RFC3339Nano) + `"},
+  "stale": {"instances": [{"id": "b", "name": "stale"}], "updated_at": "` + time.Now().Add(-time.Hour*2).Format(time.RFC3339Nano) + `"}
+}`
+	if err := os.WriteFile(path, []byte(snapshot), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newFakeDiscovery()
+	backend.set(true)
+	d := NewDiscovery(backend, WithSnapshot(path), WithMaxStaleness(time.Hour))
+	defer d.Stop()
+	if got, err := d.GetService(context.Background(), "fresh"); err != nil || len(got) != 1 {
+		t.Fatalf("get fresh service = %v, %v", got, err)
+	}
+	if _, err := d.GetService(context.Background(), "stale"); !errors.Is(err, errUnavailable) {
+		t.Fatalf("expected stale snapshot entry skipped, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	d := NewDiscovery(newFakeDiscovery(instance("a"), instance("b")), WithSnapshot(path))
+	if _, err := d.GetService(context.Background(), "svc"); err != nil {
+		t.Fatalf("get service: %v", err)
+	}
+	d.Stop()
+
+	// 注册中心故障期间重启
+	backend := newFakeDiscovery()
+	backend.set(true)
+	d = NewDiscovery(backend, WithSnapshot(path))
+	defer d.Stop()
+	got, err := d.GetService(context.Background(), "svc")
+	if err != nil || len(got) != 2 || got[1].Endpoints[0] != "grpc://b:9000" {
+		t.Fatalf("get service from snapshot = %v, %v", got, err)
+	}
+}
+
+func TestWatchSurvivesOutage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	d := NewDiscovery(newFakeDiscovery(instance("a")), WithSnapshot(path))
+	_, _ = d.GetService(context.Background(), "svc")
+	d.Stop()
+
+	backend := newFakeDiscovery()
+	backend.set(true)
+	d = NewDiscovery(backend, WithSnapshot(path), WithRetryInterval(time.Millisecond*20))
+	defer d.Stop()
+
+	w, err := d.Watch(context.Background(), "svc")
+	if err != nil {
+		t.Fatalf("watch during outage: %v", err)
+	}
+	defer w.Stop()
+	if items, err := w.Next(); err != nil || len(items) != 1 || items[0].ID != "a" {
+		t.Fatalf("cached next = %v, %v", items, err)
+	}
+
+	// 后端恢复后重新监视
+	backend.set(false, instance("a"), instance("b"))
+	if items, err := w.Next(); err != nil || len(items) != 2 {
+		t.Fatalf("next after recovery = %v, %v", items, err)
+	}
+
+	// 后端再次中断，观察者不受影响，恢复后继续收到更新
+	backend.set(true)
+	backend.set(false, instance("c"))
+	if items, err := w.Next(); err != nil || len(items) != 1 || items[0].ID != "c" {
+		t.Fatalf("next after second outage = %v, %v", items, err)
+	}
+}
+
+func TestSnapshotOnlyOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	backend := newFakeDiscovery(instance("a"))
+	d := NewDiscovery(backend, WithSnapshot(path))
+	defer d.Stop()
+	ctx := context.Background()
+
+	// 多次查询合并为一次延迟写入
+	for i := 0; i < 3; i++ {
+		_, _ = d.GetService(ctx, "svc")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("snapshot written synchronously: %v", err)
+	}
+	deadline := time.Now().Add(saveDelay * 3)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot not written after delay")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	// 结果没有变化时不重写快照
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = d.GetService(ctx, "svc")
+	d.save()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot rewritten without change: %v", err)
+	}
+
+	// 结果变化后Stop时立即写入
+	backend.set(false, instance("a"), instance("b"))
+	_, _ = d.GetService(ctx, "svc")
+	d.Stop()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("snapshot not flushed on stop: %v", err)
+	}
+}
+
+func TestWatchDoesNotHoldLock(t *testing.T) {
+	backend := newFakeDiscovery(instance("a"))
+	backend.entered, backend.block = make(chan struct{}, 1), make(chan struct{})
+	d := NewDiscovery(backend)
+	defer d.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		w, err := d.Watch(context.Background(), "svc")
+		if err == nil {
+			_, err = w.Next()
+			_ = w.Stop()
+		}
+		done <- err
+	}()
+	<-backend.entered
+
+	// 后端Watch阻塞期间查询不受影响
+	got := make(chan struct{})
+	go func() {
+		_, _ = d.GetService(context.Background(), "svc")
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("GetService blocked by a pending backend Watch")
+	}
+	close(backend.block)
+	if err := <-done; err != nil {
+		t.Errorf("watch: %v", err)
+	}
+}
@@ -3,54 +3,314 @@ package eidola
 import (
 	"context"
 	"encoding/json"
+	"strconv"
+	"sync"
 
 	"github.com/dormoron/eidola/registry"
 
+	"github.com/dormoron/phantasm/internal/fanout"
 	phantasm_registry "github.com/dormoron/phantasm/registry"
 )
 
+var (
+	_ phantasm_registry.Registrar = (*Adapter)(nil)
+	_ phantasm_registry.Discovery = (*Adapter)(nil)
+)
+
 // Adapter 适配器用于将eidola的registry适配为github.com/dormoron/phantasm的registry
+// eidola的服务实例只有一个地址，适配器为每个端点注册一个eidola实例，Group仍然是eidola用于路由的分组，取自元数据中的group；
+// ID、版本、元数据和端点列表编码后保存在单独的元数据条目中，发现时按端点重新合并为一个服务实例
 type Adapter struct {
 	eidolaRegistry registry.Registry
+	lock           sync.Mutex
+	hubs           map[string]*fanout.Hub // 服务名称到共享监视的映射
+	subscribed     map[string]bool        // 已订阅的服务，eidola的订阅无法取消，每个服务只订阅一次
 }
 
 // NewAdapter 创建一个新的适配器
 func NewAdapter(eidolaRegistry registry.Registry) *Adapter {
 	return &Adapter{
 		eidolaRegistry: eidolaRegistry,
+		hubs:           make(map[string]*fanout.Hub),
+		subscribed:     make(map[string]bool),
+	}
+}
+
+// metadataPrefix 是元数据条目的服务名称前缀
+// 使用前缀而不是后缀，避免按服务名称前缀列出实例时把元数据条目也列出来
+const metadataPrefix = "phantasm-metadata."
+
+// metadataName 返回服务的元数据条目所在的eidola服务名称
+func metadataName(serviceName string) string {
+	return metadataPrefix + serviceName
+}
+
+// instanceInfo 是元数据条目中保存的服务实例信息，条目的Address是实例ID
+type instanceInfo struct {
+	ID        string            `json:"-"`
+	Version   string            `json:"version,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Endpoints []string          `json:"endpoints"`
+}
+
+// toEidola 将服务实例转换为eidola的服务实例，每个端点对应一个，并返回保存其余信息的元数据条目
+func toEidola(service *phantasm_registry.ServiceInstance) ([]registry.ServiceInstance, registry.ServiceInstance, error) {
+	info, err := json.Marshal(instanceInfo{
+		Version:   service.Version,
+		Metadata:  service.Metadata,
+		Status:    string(service.Status),
+		Endpoints: service.Endpoints,
+	})
+	if err != nil {
+		return nil, registry.ServiceInstance{}, err
+	}
+	meta := registry.ServiceInstance{
+		Name:    metadataName(service.Name),
+		Address: service.ID,
+		Group:   string(info),
+	}
+
+	// eidola的负载均衡使用Weight字段，取自元数据中的权重，默认为1
+	weight := uint32(1)
+	if w, err := strconv.ParseUint(service.Metadata["weight"], 10, 32); err == nil && w > 0 {
+		weight = uint32(w)
+	}
+
+	instances := make([]registry.ServiceInstance, 0, len(service.Endpoints))
+	for _, ep := range service.Endpoints {
+		instances = append(instances, registry.ServiceInstance{
+			Name:    service.Name,
+			Address: ep,
+			Weight:  weight,
+			Group:   service.Metadata["group"],
+		})
+	}
+	return instances, meta, nil
+}
+
+// fromEidola 按元数据条目将eidola的服务实例合并为服务实例
+// 没有对应元数据条目的实例（例如eidola服务器直接注册的实例）以地址作为ID，Group和Weight保存在元数据中
+func fromEidola(instances, metas []registry.ServiceInstance) []*phantasm_registry.ServiceInstance {
+	infos := make(map[string]*instanceInfo, len(instances))
+	for _, m := range metas {
+		info := &instanceInfo{}
+		if err := json.Unmarshal([]byte(m.Group), info); err != nil {
+			continue
+		}
+		info.ID = m.Address
+		for _, ep := range info.Endpoints {
+			infos[ep] = info
+		}
 	}
+
+	services := make([]*phantasm_registry.ServiceInstance, 0, len(instances))
+	byID := make(map[string]*phantasm_registry.ServiceInstance, len(instances))
+	for _, ins := range instances {
+		info, ok := infos[ins.Address]
+		if !ok {
+			info = &instanceInfo{ID: ins.Address}
+		}
+		if service, ok := byID[info.ID]; ok {
+			service.Endpoints = append(service.Endpoints, ins.Address)
+			continue
+		}
+
+		metadata := make(map[string]string, len(info.Metadata)+2)
+		for k, v := range info.Metadata {
+			metadata[k] = v
+		}
+		if ins.Group != "" {
+			metadata["group"] = ins.Group
+		}
+		if _, ok := metadata["weight"]; !ok && ins.Weight > 0 {
+			metadata["weight"] = strconv.FormatUint(uint64(ins.Weight), 10)
+		}
+		status := phantasm_registry.ServiceInstanceStatus(info.Status)
+		if status == "" {
+			status = phantasm_registry.StatusUp
+		}
+		service := &phantasm_registry.ServiceInstance{
+			ID:        info.ID,
+			Name:      ins.Name,
+			Version:   info.Version,
+			Metadata:  metadata,
+			Endpoints: []string{ins.Address},
+			Status:    status,
+		}
+		byID[info.ID] = service
+		services = append(services, service)
+	}
+	return services
 }
 
 // Register 注册服务实例
+// 先注册元数据条目，保证端点可见时已经能够合并为完整的服务实例
 func (a *Adapter) Register(ctx context.Context, service *phantasm_registry.ServiceInstance) error {
-	// 将github.com/dormoron/phantasm的ServiceInstance转换为eidola的ServiceInstance
-	eservice := registry.ServiceInstance{
-		Name:    service.Name,
-		Address: getFirstEndpoint(service.Endpoints),
-		Weight:  1,               // 默认权重
-		Group:   service.Version, // 使用版本作为分组
+	instances, meta, err := toEidola(service)
+	if err != nil {
+		return err
 	}
-
-	return a.eidolaRegistry.Register(ctx, eservice)
+	if err := a.eidolaRegistry.Register(ctx, meta); err != nil {
+		return err
+	}
+	for i, ins := range instances {
+		if err := a.eidolaRegistry.Register(ctx, ins); err != nil {
+			// 撤销已注册的端点和元数据条目，避免服务实例只有部分端点可见
+			for _, registered := range instances[:i] {
+				_ = a.eidolaRegistry.UnRegister(ctx, registered)
+			}
+			_ = a.eidolaRegistry.UnRegister(ctx, meta)
+			return err
+		}
+	}
+	return nil
 }
 
-// Deregister 注销服务实例
+// Deregister 注销服务实例，元数据条目在端点之后注销
 func (a *Adapter) Deregister(ctx context.Context, service *phantasm_registry.ServiceInstance) error {
-	// 将github.com/dormoron/phantasm的ServiceInstance转换为eidola的ServiceInstance
-	eservice := registry.ServiceInstance{
-		Name:    service.Name,
-		Address: getFirstEndpoint(service.Endpoints),
+	instances, meta, err := toEidola(service)
+	if err != nil {
+		return err
 	}
+	var firstErr error
+	for _, ins := range append(instances, meta) {
+		if err := a.eidolaRegistry.UnRegister(ctx, ins); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
-	return a.eidolaRegistry.UnRegister(ctx, eservice)
+// GetService 获取服务实例
+func (a *Adapter) GetService(ctx context.Context, serviceName string) ([]*phantasm_registry.ServiceInstance, error) {
+	instances, err := a.eidolaRegistry.ListServices(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := a.eidolaRegistry.ListServices(ctx, metadataName(serviceName))
+	if err != nil {
+		return nil, err
+	}
+	return fromEidola(instances, metas), nil
+}
+
+// Watch 监视服务变更
+// 订阅的事件只作为重新获取服务实例的通知，同一服务的所有观察者共享一个监视，最后一个观察者停止后释放
+func (a *Adapter) Watch(ctx context.Context, serviceName string) (phantasm_registry.Watcher, error) {
+	a.lock.Lock()
+	if hub, ok := a.hubs[serviceName]; ok {
+		w := hub.Subscribe(ctx)
+		a.lock.Unlock()
+		return w, nil
+	}
+	if !a.subscribed[serviceName] {
+		if err := a.subscribe(serviceName); err != nil {
+			a.lock.Unlock()
+			return nil, err
+		}
+		a.subscribed[serviceName] = true
+	}
+	a.lock.Unlock()
+
+	instances, err := a.GetService(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	hub, ok := a.hubs[serviceName]
+	if !ok {
+		hub = fanout.NewHub(func(hub *fanout.Hub) {
+			a.unwatch(serviceName, hub)
+		})
+		hub.Publish(instances)
+		a.hubs[serviceName] = hub
+	}
+	return hub.Subscribe(ctx), nil
+}
+
+// subscribe 订阅服务及其元数据条目的变更，调用方需要持有锁
+// eidola没有取消订阅的方法，订阅在注册中心关闭前一直有效，没有观察者时只消费事件
+func (a *Adapter) subscribe(serviceName string) error {
+	events, err := a.eidolaRegistry.Subscribe(serviceName)
+	if err != nil {
+		return err
+	}
+	metaEvents, err := a.eidolaRegistry.Subscribe(metadataName(serviceName))
+	if err != nil {
+		go drain(events)
+		return err
+	}
+	go a.refreshLoop(serviceName, notifications(events, metaEvents))
+	return nil
+}
+
+// refreshLoop 收到通知后重新获取服务实例，发布给服务当前的共享监视
+func (a *Adapter) refreshLoop(serviceName string, notify <-chan struct{}) {
+	for range notify {
+		a.lock.Lock()
+		hub := a.hubs[serviceName]
+		a.lock.Unlock()
+		if hub == nil {
+			continue
+		}
+		instances, err := a.GetService(context.Background(), serviceName)
+		if err != nil {
+			continue
+		}
+		hub.Publish(instances)
+	}
+
+	// 订阅结束（通常是eidola注册中心关闭），停止服务的所有观察者
+	a.lock.Lock()
+	hub := a.hubs[serviceName]
+	delete(a.hubs, serviceName)
+	delete(a.subscribed, serviceName)
+	a.lock.Unlock()
+	if hub != nil {
+		hub.Close()
+	}
+}
+
+// unwatch 在服务的最后一个观察者停止后释放共享的监视，订阅继续保留供之后的Watch使用
+func (a *Adapter) unwatch(serviceName string, hub *fanout.Hub) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.hubs[serviceName] != hub || hub.Len() > 0 {
+		return
+	}
+	delete(a.hubs, serviceName)
+}
+
+// notifications 将多个事件通道合并为一个通知通道，未处理的通知只保留一个，所有事件通道关闭后关闭通知通道
+func notifications[E any](chs ...<-chan E) <-chan struct{} {
+	notify := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	wg.Add(len(chs))
+	for _, ch := range chs {
+		go func(ch <-chan E) {
+			defer wg.Done()
+			for range ch {
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(notify)
+	}()
+	return notify
 }
 
-// getFirstEndpoint 获取第一个端点地址
-func getFirstEndpoint(endpoints []string) string {
-	if len(endpoints) > 0 {
-		return endpoints[0]
+// drain 消费不再需要的事件通道
+func drain[E any](ch <-chan E) {
+	for range ch {
 	}
-	return ""
 }
 
 // EidolaRegistryFactory 创建基于eidola的服务注册器
@@ -59,9 +319,8 @@ func EidolaRegistryFactory(eidolaRegistry registry.Registry) (phantasm_registry.
 	return NewAdapter(eidolaRegistry), nil
 }
 
-// StoreMetadata 将元数据存储到服务实例中
-// 由于eidola的ServiceInstance结构没有直接的元数据字段
-// 我们可以将元数据序列化后存储在Group字段中
+// StoreMetadata 将元数据序列化为字符串
+// 适配器注册时会把元数据连同版本和端点一起保存在单独的元数据条目中，无需单独调用
 func StoreMetadata(metadata map[string]string) (string, error) {
 	if len(metadata) == 0 {
 		return "", nil
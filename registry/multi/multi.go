@@ -0,0 +1,348 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/registry"
+)
+
+var (
+	_ registry.ServiceRegistrar = (*Registry)(nil)
+)
+
+// Policy 是注册失败时的处理策略
+type Policy int
+
+const (
+	// PolicyAll 要求所有后端都注册成功，任一后端失败时撤销已成功的注册并返回错误
+	PolicyAll Policy = iota
+	// PolicyBestEffort 至少一个后端成功即可，失败的后端只记录日志
+	PolicyBestEffort
+)
+
+// Registry 是组合多个注册中心的注册中心，常用于注册中心迁移期间的双注册
+// 注册同时写入所有后端；发现时合并所有后端的实例，后端的顺序即优先级，
+// ID或任一端点与优先级更高的后端重复的实例会被去掉
+type Registry struct {
+	backends []registry.ServiceRegistrar
+	options  *Options
+	logger   log.Logger
+}
+
+// Options 是组合注册中心的选项
+type Options struct {
+	Policy      Policy
+	InitialWait time.Duration // Watch等待所有后端返回初始结果的最长时间
+	Logger      log.Logger
+}
+
+// Option 是组合注册中心的选项函数
+type Option func(*Options)
+
+// WithPolicy 设置注册失败时的处理策略
+func WithPolicy(policy Policy) Option {
+	return func(o *Options) {
+		o.Policy = policy
+	}
+}
+
+// WithInitialWait 设置Watch等待所有后端返回初始结果的最长时间，超时后先发布已返回的结果
+func WithInitialWait(wait time.Duration) Option {
+	return func(o *Options) {
+		o.InitialWait = wait
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// NewRegistry 创建组合注册中心，backends按优先级从高到低排列
+func NewRegistry(backends []registry.ServiceRegistrar, opts ...Option) *Registry {
+	options := &Options{
+		Policy:      PolicyAll,
+		InitialWait: time.Second,
+		Logger:      log.DefaultLogger,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Registry{
+		backends: backends,
+		options:  options,
+		logger:   options.Logger,
+	}
+}
+
+// each 并发地在所有后端上执行fn，返回每个后端的错误
+func (r *Registry) each(fn func(i int, b registry.ServiceRegistrar) error) []error {
+	errs := make([]error, len(r.backends))
+	var wg sync.WaitGroup
+	for i, b := range r.backends {
+		wg.Add(1)
+		go func(i int, b registry.ServiceRegistrar) {
+			defer wg.Done()
+			errs[i] = fn(i, b)
+		}(i, b)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Register 在所有后端注册服务实例
+func (r *Registry) Register(ctx context.Context, service *registry.ServiceInstance) error {
+	errs := r.each(func(_ int, b registry.ServiceRegistrar) error {
+		return b.Register(ctx, service)
+	})
+	failed := r.failures(errs, "注册服务实例失败", service)
+	if failed == nil {
+		return nil
+	}
+
+	if r.options.Policy == PolicyBestEffort && len(failed) < len(r.backends) {
+		return nil
+	}
+	if r.options.Policy == PolicyAll {
+		// 撤销已成功的注册，避免实例只出现在部分后端
+		for i, b := range r.backends {
+			if errs[i] == nil {
+				if err := b.Deregister(ctx, service); err != nil {
+					r.logger.Warn("撤销注册失败", log.Int("backend", i), log.String("id", service.ID), log.Err(err))
+				}
+			}
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// Deregister 在所有后端注销服务实例
+func (r *Registry) Deregister(ctx context.Context, service *registry.ServiceInstance) error {
+	errs := r.each(func(_ int, b registry.ServiceRegistrar) error {
+		return b.Deregister(ctx, service)
+	})
+	failed := r.failures(errs, "注销服务实例失败", service)
+	if failed == nil || (r.options.Policy == PolicyBestEffort && len(failed) < len(r.backends)) {
+		return nil
+	}
+	return errors.Join(failed...)
+}
+
+// failures 记录并返回失败后端的错误，错误中带有后端的序号
+func (r *Registry) failures(errs []error, msg string, service *registry.ServiceInstance) []error {
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			r.logger.Warn(msg, log.Int("backend", i), log.String("id", service.ID), log.Err(err))
+			failed = append(failed, fmt.Errorf("multi: backend %d: %w", i, err))
+		}
+	}
+	return failed
+}
+
+// GetService 合并所有后端的服务实例，只有所有后端都失败时才返回错误
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*registry.ServiceInstance, error) {
+	results := make([][]*registry.ServiceInstance, len(r.backends))
+	errs := r.each(func(i int, b registry.ServiceRegistrar) error {
+		instances, err := b.GetService(ctx, serviceName)
+		results[i] = instances
+		return err
+	})
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			r.logger.Warn("获取服务实例失败", log.Int("backend", i), log.String("service", serviceName), log.Err(err))
+			failed = append(failed, fmt.Errorf("multi: backend %d: %w", i, err))
+		}
+	}
+	if len(failed) == len(r.backends) && len(failed) > 0 {
+		return nil, errors.Join(failed...)
+	}
+	return merge(results), nil
+}
+
+// merge 按后端优先级合并实例列表，ID或任一端点已出现的实例会被去掉
+func merge(results [][]*registry.ServiceInstance) []*registry.ServiceInstance {
+	ids := make(map[string]struct{})
+	endpoints := make(map[string]struct{})
+	merged := make([]*registry.ServiceInstance, 0)
+	for _, instances := range results {
+	next:
+		for _, ins := range instances {
+			if ins == nil {
+				continue
+			}
+			if _, ok := ids[ins.ID]; ok {
+				continue
+			}
+			for _, ep := range ins.Endpoints {
+				if _, ok := endpoints[ep]; ok {
+					continue next
+				}
+			}
+			ids[ins.ID] = struct{}{}
+			for _, ep := range ins.Endpoints {
+				endpoints[ep] = struct{}{}
+			}
+			merged = append(merged, ins)
+		}
+	}
+	return merged
+}
+
+// Watch 合并所有后端的服务变更
+// 所有后端都返回初始结果或等待超过InitialWait后才发布第一次合并结果，避免启动时只看到部分后端的实例；
+// 某个后端的观察者出错后保留它最后的结果，所有后端都出错时观察者停止
+func (r *Registry) Watch(ctx context.Context, serviceName string) (registry.Watcher, error) {
+	watchers := make([]registry.Watcher, len(r.backends))
+	var failed []error
+	for i, b := range r.backends {
+		w, err := b.Watch(ctx, serviceName)
+		if err != nil {
+			r.logger.Warn("监视服务失败", log.Int("backend", i), log.String("service", serviceName), log.Err(err))
+			failed = append(failed, fmt.Errorf("multi: backend %d: %w", i, err))
+			continue
+		}
+		watchers[i] = w
+	}
+	if len(failed) == len(r.backends) && len(failed) > 0 {
+		return nil, errors.Join(failed...)
+	}
+
+	m := &mergedWatch{
+		serviceName: serviceName,
+		watchers:    watchers,
+		results:     make([][]*registry.ServiceInstance, len(watchers)),
+		received:    make([]bool, len(watchers)),
+		failed:      make([]bool, len(watchers)),
+		logger:      r.logger,
+	}
+	for i, w := range watchers {
+		m.failed[i] = w == nil
+	}
+	m.hub = fanout.NewHub(func(*fanout.Hub) { m.stop() })
+	m.timer = time.AfterFunc(r.options.InitialWait, func() {
+		m.lock.Lock()
+		m.waited = true
+		m.lock.Unlock()
+		m.publish()
+	})
+	watcher := m.hub.Subscribe(ctx)
+	for i, w := range watchers {
+		if w != nil {
+			go m.loop(i, w)
+		}
+	}
+	return watcher, nil
+}
+
+// mergedWatch 将多个后端观察者的结果合并后发布
+type mergedWatch struct {
+	serviceName string
+	watchers    []registry.Watcher
+	hub         *fanout.Hub
+	timer       *time.Timer
+	logger      log.Logger
+
+	lock     sync.Mutex
+	results  [][]*registry.ServiceInstance
+	received []bool // 后端是否已返回过结果
+	failed   []bool // 后端的观察者是否已出错
+	waited   bool   // 是否已超过初始等待时间
+	stopped  bool
+}
+
+// loop 读取一个后端观察者的更新
+func (m *mergedWatch) loop(i int, w registry.Watcher) {
+	for {
+		instances, err := w.Next()
+
+		m.lock.Lock()
+		if m.stopped {
+			m.lock.Unlock()
+			return
+		}
+		if err != nil {
+			m.logger.Warn("后端观察者已停止", log.Int("backend", i), log.String("service", m.serviceName), log.Err(err))
+			m.failed[i] = true
+			allFailed := true
+			for _, failed := range m.failed {
+				allFailed = allFailed && failed
+			}
+			m.lock.Unlock()
+			if allFailed {
+				m.hub.Close()
+			} else {
+				m.publish()
+			}
+			return
+		}
+		m.results[i] = instances
+		m.received[i] = true
+		m.lock.Unlock()
+		m.publish()
+	}
+}
+
+// publish 在所有后端都返回过结果（或已出错）后发布合并结果，超过初始等待时间后只要有结果就发布
+func (m *mergedWatch) publish() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stopped {
+		return
+	}
+	all, some := true, false
+	for i := range m.received {
+		if m.received[i] {
+			some = true
+		} else if !m.failed[i] {
+			all = false
+		}
+	}
+	if !all && !(m.waited && some) {
+		return
+	}
+	m.hub.Publish(merge(m.results))
+}
+
+// stop 在观察者停止后停止所有后端观察者
+func (m *mergedWatch) stop() {
+	m.lock.Lock()
+	if m.stopped {
+		m.lock.Unlock()
+		return
+	}
+	m.stopped = true
+	m.timer.Stop()
+	m.lock.Unlock()
+
+	for _, w := range m.watchers {
+		if w != nil {
+			_ = w.Stop()
+		}
+	}
+}
+
+// Stop 停止所有支持停止的后端
+func (r *Registry) Stop() error {
+	var errs []error
+	for i, b := range r.backends {
+		if s, ok := b.(interface{ Stop() error }); ok {
+			if err := s.Stop(); err != nil {
+				errs = append(errs, fmt.Errorf("multi: backend %d: %w", i, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/internal/fanout"
+	"github.com/dormoron/phantasm/registry"
+)
+
+// fakeBackend 是测试用的注册中心，可以模拟注册失败和监视前的静默
+type fakeBackend struct {
+	lock      sync.Mutex
+	instances map[string]*registry.ServiceInstance
+	hub       *fanout.Hub
+	failWith  error
+	silent    bool // Watch不返回初始结果
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{instances: make(map[string]*registry.ServiceInstance), hub: fanout.NewHub(nil)}
+}
+
+func (f *fakeBackend) list() []*registry.ServiceInstance {
+	items := make([]*registry.ServiceInstance, 0, len(f.instances))
+	for _, ins := range f.instances {
+		items = append(items, ins)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+func (f *fakeBackend) Register(_ context.Context, ins *registry.ServiceInstance) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failWith != nil {
+		return f.failWith
+	}
+	f.instances[ins.ID] = ins
+	f.hub.Publish(f.list())
+	return nil
+}
+
+func (f *fakeBackend) Deregister(_ context.Context, ins *registry.ServiceInstance) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.instances, ins.ID)
+	f.hub.Publish(f.list())
+	return nil
+}
+
+func (f *fakeBackend) GetService(context.Context, string) ([]*registry.ServiceInstance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failWith != nil {
+		return nil, f.failWith
+	}
+	return f.list(), nil
+}
+
+func (f *fakeBackend) Watch(ctx context.Context, _ string) (registry.Watcher, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.silent {
+		f.hub.Publish(f.list())
+	}
+	return f.hub.Subscribe(ctx), nil
+}
+
+func (f *fakeBackend) has(id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, ok := f.instances[id]
+	return ok
+}
+
+func instance(id string, endpoints ...string) *registry.ServiceInstance {
+	return &registry.ServiceInstance{ID: id, Name: "svc", Endpoints: endpoints}
+}
+
+func TestRegisterPolicy(t *testing.T) {
+	ctx := context.Background()
+	ins := instance("a", "grpc://10.0.0.1:9000")
+
+	zk, etcd := newFakeBackend(), newFakeBackend()
+	etcd.failWith = errors.New("unavailable")
+	r := NewRegistry([]registry.ServiceRegistrar{etcd, zk})
+	if err := r.Register(ctx, ins); err == nil {
+		t.Fatal("expected error with PolicyAll")
+	}
+	if zk.has("a") {
+		t.Error("expected successful registration to be rolled back")
+	}
+
+	r = NewRegistry([]registry.ServiceRegistrar{etcd, zk}, WithPolicy(PolicyBestEffort))
+	if err := r.Register(ctx, ins); err != nil {
+		t.Fatalf("best effort register: %v", err)
+	}
+	if !zk.has("a") {
+		t.Error("expected instance registered to healthy backend")
+	}
+
+	zk.failWith = etcd.failWith
+	if err := r.Register(ctx, instance("b")); err == nil {
+		t.Error("expected error when every backend fails")
+	}
+}
+
+func TestGetServiceMerge(t *testing.T) {
+	ctx := context.Background()
+	etcd, zk := newFakeBackend(), newFakeBackend()
+	_ = etcd.Register(ctx, &registry.ServiceInstance{ID: "a", Version: "etcd", Endpoints: []string{"grpc://10.0.0.1:9000"}})
+	_ = zk.Register(ctx, &registry.ServiceInstance{ID: "a", Version: "zk", Endpoints: []string{"grpc://10.0.0.1:9000"}})
+	// 同一进程在ZooKeeper中使用了不同的ID
+	_ = zk.Register(ctx, instance("zk-a", "grpc://10.0.0.1:9000"))
+	_ = zk.Register(ctx, instance("b", "grpc://10.0.0.2:9000"))
+
+	r := NewRegistry([]registry.ServiceRegistrar{etcd, zk})
+	got, err := r.GetService(ctx, "svc")
+	if err != nil || len(got) != 2 {
+		t.Fatalf("get service = %v, %v", got, err)
+	}
+	if got[0].ID != "a" || got[0].Version != "etcd" || got[1].ID != "b" {
+		t.Errorf("merged = %+v, %+v", got[0], got[1])
+	}
+
+	// 部分后端失败时仍返回其他后端的结果
+	etcd.failWith = errors.New("unavailable")
+	got, err = r.GetService(ctx, "svc")
+	if err != nil || len(got) != 2 || got[0].Version != "zk" {
+		t.Fatalf("partial get service = %v, %v", got, err)
+	}
+	zk.failWith = etcd.failWith
+	if _, err := r.GetService(ctx, "svc"); err == nil {
+		t.Error("expected error when every backend fails")
+	}
+}
+
+func TestWatchMerge(t *testing.T) {
+	ctx := context.Background()
+	etcd, zk := newFakeBackend(), newFakeBackend()
+	_ = zk.Register(ctx, instance("a", "grpc://10.0.0.1:9000"))
+
+	r := NewRegistry([]registry.ServiceRegistrar{etcd, zk})
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+	if items, err := w.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("initial next = %v, %v", items, err)
+	}
+
+	_ = etcd.Register(ctx, instance("b", "grpc://10.0.0.2:9000"))
+	if items, err := w.Next(); err != nil || len(items) != 2 || items[0].ID != "b" {
+		t.Fatalf("next after etcd register = %v, %v", items, err)
+	}
+
+	_ = zk.Deregister(ctx, instance("a"))
+	if items, err := w.Next(); err != nil || len(items) != 1 {
+		t.Fatalf("next after zk deregister = %v, %v", items, err)
+	}
+}
+
+func TestWatchInitialWait(t *testing.T) {
+	ctx := context.Background()
+	etcd, zk := newFakeBackend(), newFakeBackend()
+	etcd.silent = true
+	_ = zk.Register(ctx, instance("a", "grpc://10.0.0.1:9000"))
+
+	r := NewRegistry([]registry.ServiceRegistrar{etcd, zk}, WithInitialWait(time.Millisecond*50))
+	w, err := r.Watch(ctx, "svc")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Stop()
+
+	start := time.Now()
+	items, err := w.Next()
+	if err != nil || len(items) != 1 {
+		t.Fatalf("next = %v, %v", items, err)
+	}
+	if time.Since(start) < time.Millisecond*40 {
+		t.Error("expected merged result to wait for the silent backend")
+	}
+}
@@ -36,6 +36,8 @@ const (
 	StatusDown ServiceInstanceStatus = "DOWN"
 	// StatusUnknown 表示服务实例状态未知
 	StatusUnknown ServiceInstanceStatus = "UNKNOWN"
+	// StatusOutOfService 表示服务实例仍在运行但已停止接收流量
+	StatusOutOfService ServiceInstanceStatus = "OUT_OF_SERVICE"
 )
 
 // Registry 是服务注册接口
@@ -87,6 +89,8 @@ const (
 	Eureka RegistryType = "eureka"
 	// Memory 内存注册中心类型
 	Memory RegistryType = "memory"
+	// Kubernetes 注册中心类型
+	Kubernetes RegistryType = "kubernetes"
 )
 
 // RegistryConfig 是注册中心配置
@@ -103,6 +107,10 @@ type RegistryConfig struct {
 	Password string
 	// TLSEnabled 是否启用TLS
 	TLSEnabled bool
+	// Prefix 是注册路径前缀，具体含义由注册中心实现解释
+	Prefix string
+	// Params 是注册中心实现相关的参数
+	Params map[string]string
 }
 
 // RegistryOption 是注册中心选项函数
@@ -137,6 +145,25 @@ func WithTLS(enabled bool) RegistryOption {
 	}
 }
 
+// WithPrefix 设置注册路径前缀
+func WithPrefix(prefix string) RegistryOption {
+	return func(o *RegistryConfig) {
+		o.Prefix = prefix
+	}
+}
+
+// WithParam 设置注册中心实现相关的参数
+func WithParam(key, value string) RegistryOption {
+	return func(o *RegistryConfig) {
+		params := make(map[string]string, len(o.Params)+1)
+		for k, v := range o.Params {
+			params[k] = v
+		}
+		params[key] = value
+		o.Params = params
+	}
+}
+
 // ValidateEndpoints 验证终端点列表
 func ValidateEndpoints(endpoints []string) error {
 	for _, endpoint := range endpoints {
@@ -0,0 +1,17 @@
+package selector
+
+import "context"
+
+type nodeKey struct{}
+
+// NewNodeContext 创建携带已选节点的新上下文
+// 客户端处理程序可以通过 NodeFromContext 取出节点，并将请求发送到该节点
+func NewNodeContext(ctx context.Context, node Node) context.Context {
+	return context.WithValue(ctx, nodeKey{}, node)
+}
+
+// NodeFromContext 从上下文中获取已选节点
+func NodeFromContext(ctx context.Context) (Node, bool) {
+	node, ok := ctx.Value(nodeKey{}).(Node)
+	return node, ok
+}
@@ -0,0 +1,47 @@
+package selector
+
+// VersionFilter 返回只保留指定版本节点的过滤器
+func VersionFilter(version string) FilterFunc {
+	return func(nodes []Node) []Node {
+		filtered := make([]Node, 0, len(nodes))
+		for _, n := range nodes {
+			if n.Version == version {
+				filtered = append(filtered, n)
+			}
+		}
+		return filtered
+	}
+}
+
+// SchemeFilter 返回只保留指定协议节点的过滤器
+func SchemeFilter(schemes ...string) FilterFunc {
+	return func(nodes []Node) []Node {
+		filtered := make([]Node, 0, len(nodes))
+		for _, n := range nodes {
+			for _, s := range schemes {
+				if n.Scheme == s {
+					filtered = append(filtered, n)
+					break
+				}
+			}
+		}
+		return filtered
+	}
+}
+
+// ZoneFilter 返回优先保留同可用区节点的过滤器
+// 如果同可用区没有节点，则返回全部节点，避免因可用区故障导致无节点可用
+func ZoneFilter(zone string) FilterFunc {
+	return func(nodes []Node) []Node {
+		filtered := make([]Node, 0, len(nodes))
+		for _, n := range nodes {
+			if n.Zone() == zone {
+				filtered = append(filtered, n)
+			}
+		}
+		if len(filtered) == 0 {
+			return nodes
+		}
+		return filtered
+	}
+}
@@ -0,0 +1,130 @@
+package selector
+
+import (
+	"strconv"
+
+	"github.com/dormoron/phantasm/internal/endpoint"
+	"github.com/dormoron/phantasm/registry"
+)
+
+const (
+	// defaultWeight 是未声明权重时节点的默认权重
+	defaultWeight int64 = 100
+
+	// MetadataWeight 是实例元数据中权重的键
+	MetadataWeight = "weight"
+	// MetadataZone 是实例元数据中可用区的键
+	MetadataZone = "zone"
+	// MetadataRegion 是实例元数据中地域的键
+	MetadataRegion = "region"
+)
+
+// Zone 返回节点所在的可用区
+func (n Node) Zone() string {
+	return n.Metadata[MetadataZone]
+}
+
+// Region 返回节点所在的地域
+func (n Node) Region() string {
+	return n.Metadata[MetadataRegion]
+}
+
+// EndpointOption 是端点节点构建器的选项
+type EndpointOption func(*endpointOptions)
+
+// endpointOptions 是端点节点构建器的选项
+type endpointOptions struct {
+	schemes       []string
+	defaultWeight int64
+}
+
+// WithSchemes 设置需要保留的端点协议，例如 grpc、grpcs、http、https
+func WithSchemes(schemes ...string) EndpointOption {
+	return func(o *endpointOptions) {
+		o.schemes = schemes
+	}
+}
+
+// WithDefaultWeight 设置元数据中没有合法权重时使用的默认权重
+func WithDefaultWeight(weight int64) EndpointOption {
+	return func(o *endpointOptions) {
+		o.defaultWeight = weight
+	}
+}
+
+// available 判断服务实例是否可以接收请求，下线和暂停服务的实例不生成节点
+func available(ins *registry.ServiceInstance) bool {
+	return ins != nil && ins.Status != registry.StatusDown && ins.Status != registry.StatusOutOfService
+}
+
+// NewEndpointNodeBuilder 创建一个解析端点URL的节点构建器
+// 它只保留指定协议的端点，从实例元数据中读取权重、可用区和地域，并按地址去重
+// 同一实例的每个端点是一个节点，节点ID为"实例ID@地址"，InstanceID为实例ID
+func NewEndpointNodeBuilder(opts ...EndpointOption) InstanceNodeBuilderFunc {
+	o := endpointOptions{
+		defaultWeight: defaultWeight,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(instances []*registry.ServiceInstance) ([]Node, error) {
+		nodes := make([]Node, 0, len(instances))
+		seen := make(map[string]struct{}, len(instances))
+		for _, ins := range instances {
+			if !available(ins) {
+				continue
+			}
+			urls, err := endpoint.ParseEndpoints(ins.Endpoints)
+			if err != nil {
+				return nil, err
+			}
+			weight := parseWeight(ins.Metadata, o.defaultWeight)
+			for _, u := range urls {
+				if u.Host == "" || !o.acceptScheme(u.Scheme) {
+					continue
+				}
+				if _, ok := seen[u.Host]; ok {
+					continue
+				}
+				seen[u.Host] = struct{}{}
+				nodes = append(nodes, Node{
+					ID:         ins.ID + "@" + u.Host,
+					Address:    u.Host,
+					Metadata:   ins.Metadata,
+					Weight:     weight,
+					Scheme:     u.Scheme,
+					Version:    ins.Version,
+					InstanceID: ins.ID,
+				})
+			}
+		}
+		return nodes, nil
+	}
+}
+
+// acceptScheme 判断协议是否在保留列表中，未设置列表时保留全部协议
+func (o *endpointOptions) acceptScheme(scheme string) bool {
+	if len(o.schemes) == 0 {
+		return true
+	}
+	for _, s := range o.schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWeight 从元数据中解析权重，解析失败或非正数时返回默认值
+func parseWeight(metadata map[string]string, def int64) int64 {
+	v, ok := metadata[MetadataWeight]
+	if !ok {
+		return def
+	}
+	weight, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || weight <= 0 {
+		return def
+	}
+	return weight
+}
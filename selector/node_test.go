@@ -0,0 +1,109 @@
+package selector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dormoron/phantasm/registry"
+)
+
+func TestEndpointNodeBuilder(t *testing.T) {
+	instances := []*registry.ServiceInstance{
+		{
+			ID:        "a",
+			Version:   "v1",
+			Metadata:  map[string]string{MetadataWeight: "20", MetadataZone: "z1"},
+			Endpoints: []string{"grpc://10.0.0.1:9000", "http://10.0.0.1:8000"},
+		},
+		{
+			ID:        "b",
+			Version:   "v2",
+			Metadata:  map[string]string{MetadataWeight: "bad"},
+			Endpoints: []string{"grpc://10.0.0.2:9000", "grpc://10.0.0.1:9000"},
+		},
+		{ID: "c", Status: registry.StatusDown, Endpoints: []string{"grpc://10.0.0.3:9000"}},
+		{ID: "d", Status: registry.StatusOutOfService, Endpoints: []string{"grpc://10.0.0.4:9000"}},
+		nil,
+	}
+
+	nodes, err := NewEndpointNodeBuilder()(instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		{ID: "a@10.0.0.1:9000", Address: "10.0.0.1:9000", Scheme: "grpc", Weight: 20, Version: "v1", InstanceID: "a", Metadata: instances[0].Metadata},
+		{ID: "a@10.0.0.1:8000", Address: "10.0.0.1:8000", Scheme: "http", Weight: 20, Version: "v1", InstanceID: "a", Metadata: instances[0].Metadata},
+		{ID: "b@10.0.0.2:9000", Address: "10.0.0.2:9000", Scheme: "grpc", Weight: defaultWeight, Version: "v2", InstanceID: "b", Metadata: instances[1].Metadata},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("nodes = %+v", nodes)
+	}
+	if nodes[0].Zone() != "z1" {
+		t.Errorf("zone = %q", nodes[0].Zone())
+	}
+
+	nodes, err = NewEndpointNodeBuilder(WithSchemes("http"), WithDefaultWeight(5))(instances[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "a@10.0.0.1:8000" {
+		t.Errorf("http nodes = %+v", nodes)
+	}
+
+	if _, err := NewEndpointNodeBuilder()([]*registry.ServiceInstance{{ID: "e", Endpoints: []string{"grpc://%zz"}}}); err == nil {
+		t.Error("expected endpoint parse error")
+	}
+}
+
+func TestInstancesToNodes(t *testing.T) {
+	instances := []*registry.ServiceInstance{
+		{ID: "a", Version: "v1", Endpoints: []string{"grpc://10.0.0.1:9000"}},
+		{ID: "c", Status: registry.StatusDown, Endpoints: []string{"grpc://10.0.0.3:9000"}},
+		{ID: "d", Status: registry.StatusOutOfService, Endpoints: []string{"grpc://10.0.0.4:9000"}},
+		nil,
+	}
+	builder := func(id, endpoint string, _ map[string]string) (Node, error) {
+		return Node{ID: id, Address: endpoint}, nil
+	}
+
+	// 与NewEndpointNodeBuilder一样跳过下线和暂停服务的实例
+	nodes, err := instancesToNodes(instances, builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "a" || nodes[0].Version != "v1" {
+		t.Errorf("nodes = %+v", nodes)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	nodes := []Node{
+		{ID: "1", Scheme: "grpc", Version: "v1", Metadata: map[string]string{MetadataZone: "z1"}},
+		{ID: "2", Scheme: "http", Version: "v2", Metadata: map[string]string{MetadataZone: "z2"}},
+		{ID: "3", Scheme: "grpcs", Version: "v1"},
+	}
+	ids := func(nodes []Node) []string {
+		var ids []string
+		for _, n := range nodes {
+			ids = append(ids, n.ID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name   string
+		filter FilterFunc
+		want   []string
+	}{
+		{"version", VersionFilter("v1"), []string{"1", "3"}},
+		{"version none", VersionFilter("v3"), nil},
+		{"scheme", SchemeFilter("grpc", "grpcs"), []string{"1", "3"}},
+		{"zone", ZoneFilter("z2"), []string{"2"}},
+		{"zone fallback", ZoneFilter("z3"), []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		if got := ids(tt.filter(nodes)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/metadata"
+	"github.com/dormoron/phantasm/selector"
+	"github.com/dormoron/phantasm/transport"
+)
+
+// Rules 是路由规则集合，通常从配置中加载
+//
+// 示例（yaml）:
+//
+//	routing:
+//	  dry_run: false
+//	  rules:
+//	    - name: canary
+//	      match:
+//	        operation: /helloworld.Greeter/*
+//	        headers:
+//	          x-canary: "true"
+//	      routes:
+//	        - version: v2
+//	          weight: 10
+//	        - version: v1
+//	          weight: 90
+type Rules struct {
+	// DryRun 为true时只以Debug级别记录会命中的规则，不改变流量
+	DryRun bool `json:"dry_run"`
+	// Rules 是按顺序匹配的规则列表，首个命中的规则生效
+	Rules []Rule `json:"rules"`
+}
+
+// Rule 是一条路由规则
+type Rule struct {
+	// Name 是规则名称
+	Name string `json:"name"`
+	// Match 是规则的匹配条件
+	Match Match `json:"match"`
+	// Routes 是按权重分配流量的目标
+	Routes []Route `json:"routes"`
+}
+
+// Match 是规则匹配条件，所有条件同时满足时规则命中
+type Match struct {
+	// Operation 是操作名，gRPC为完整方法名，HTTP为请求路径，以*结尾表示前缀匹配
+	Operation string `json:"operation"`
+	// Headers 是请求头匹配条件
+	Headers map[string]string `json:"headers"`
+	// Metadata 是上下文元数据匹配条件
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Route 是流量目标，Version和Metadata共同确定节点子集
+type Route struct {
+	// Version 是目标节点版本，为空时不限制版本
+	Version string `json:"version"`
+	// Metadata 是目标节点需要包含的元数据
+	Metadata map[string]string `json:"metadata"`
+	// Weight 是该目标的流量权重
+	Weight int `json:"weight"`
+}
+
+// Option 是路由器选项
+type Option func(*options)
+
+// options 是路由器选项
+type options struct {
+	dryRun bool
+	logger log.Logger
+}
+
+// WithDryRun 设置试运行模式，只记录会命中的规则，不改变流量
+func WithDryRun(dryRun bool) Option {
+	return func(o *options) {
+		o.dryRun = dryRun
+	}
+}
+
+// WithLogger 设置日志记录器
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// Router 是在负载均衡之前执行的路由规则引擎
+// 它实现了 selector.BalancerType，按规则筛选出节点子集后再交给内部均衡器选择节点：
+//
+//	sel := selector.NewSelector(selector.WithBalancer(routing.New(&selector.WeightedRandom{})))
+type Router struct {
+	balancer selector.BalancerType
+	opts     options
+	rules    atomic.Pointer[Rules]
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+var _ selector.BalancerType = (*Router)(nil)
+
+// New 创建一个路由器，balancer为规则筛选后使用的均衡器
+func New(balancer selector.BalancerType, opts ...Option) *Router {
+	o := options{
+		logger: log.DefaultLogger,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := &Router{
+		balancer: balancer,
+		opts:     o,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	r.rules.Store(&Rules{DryRun: o.dryRun})
+	return r
+}
+
+// Update 替换当前的路由规则
+func (r *Router) Update(rules Rules) {
+	if r.opts.dryRun {
+		rules.DryRun = true
+	}
+	r.rules.Store(&rules)
+}
+
+// Rules 返回当前的路由规则
+func (r *Router) Rules() Rules {
+	return *r.rules.Load()
+}
+
+// Pick 按路由规则筛选节点后交给内部均衡器选择
+func (r *Router) Pick(ctx context.Context, nodes []selector.Node) (selector.Node, error) {
+	rules := r.rules.Load()
+	rule, ok := matchRule(ctx, rules.Rules)
+	if !ok {
+		return r.balancer.Pick(ctx, nodes)
+	}
+	route, ok := r.pickRoute(rule.Routes)
+	if !ok {
+		return r.balancer.Pick(ctx, nodes)
+	}
+	subset := filterNodes(nodes, route)
+
+	if rules.DryRun {
+		r.opts.logger.Debug("Routing rule matched (dry run)",
+			log.String("rule", rule.Name),
+			log.String("operation", operation(ctx)),
+			log.String("version", route.Version),
+			log.Int("nodes", len(subset)))
+		return r.balancer.Pick(ctx, nodes)
+	}
+
+	if len(subset) == 0 {
+		r.opts.logger.Warn("Routing rule matched no nodes, falling back to all nodes",
+			log.String("rule", rule.Name),
+			log.String("version", route.Version))
+		return r.balancer.Pick(ctx, nodes)
+	}
+	return r.balancer.Pick(ctx, subset)
+}
+
+// pickRoute 按权重随机选择一个目标
+func (r *Router) pickRoute(routes []Route) (Route, bool) {
+	var total int
+	for _, route := range routes {
+		if route.Weight > 0 {
+			total += route.Weight
+		}
+	}
+	if total == 0 {
+		return Route{}, false
+	}
+
+	r.randLock.Lock()
+	offset := r.rand.Intn(total)
+	r.randLock.Unlock()
+
+	for _, route := range routes {
+		if route.Weight <= 0 {
+			continue
+		}
+		offset -= route.Weight
+		if offset < 0 {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// Load 从配置的key处加载路由规则，key不存在时返回空规则
+func Load(c config.Config, key string) (Rules, error) {
+	return scan(c.Value(key))
+}
+
+// scan 将配置值解码为路由规则，值不存在（例如key被删除）时返回空规则
+func scan(v config.Value) (Rules, error) {
+	var rules Rules
+	if err := v.Scan(&rules); err != nil {
+		if errors.Is(err, config.ErrNotFound) {
+			return Rules{}, nil
+		}
+		return Rules{}, err
+	}
+	return rules, nil
+}
+
+// Watch 从配置的key处加载路由规则，并在配置变更时热更新
+func (r *Router) Watch(c config.Config, key string) error {
+	rules, err := Load(c, key)
+	if err != nil {
+		return err
+	}
+	r.Update(rules)
+
+	return c.Watch(key, func(_ string, v config.Value) {
+		rules, err := scan(v)
+		if err != nil {
+			r.opts.logger.Error("Failed to reload routing rules",
+				log.String("key", key),
+				log.Err(err))
+			return
+		}
+		r.Update(rules)
+		r.opts.logger.Info("Routing rules reloaded",
+			log.String("key", key),
+			log.Int("rules", len(rules.Rules)))
+	})
+}
+
+// matchRule 返回首个命中的规则
+func matchRule(ctx context.Context, rules []Rule) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.Match.matches(ctx) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// matches 判断请求上下文是否满足匹配条件
+func (m Match) matches(ctx context.Context) bool {
+	if m.Operation != "" && !matchOperation(m.Operation, operation(ctx)) {
+		return false
+	}
+	for k, v := range m.Headers {
+		if header(ctx, k) != v {
+			return false
+		}
+	}
+	if len(m.Metadata) > 0 {
+		md, ok := metadata.FromContext(ctx)
+		if !ok {
+			return false
+		}
+		for k, v := range m.Metadata {
+			if md.Get(k) != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchOperation 匹配操作名，pattern以*结尾时为前缀匹配
+func matchOperation(pattern, op string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(op, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == op
+}
+
+// operation 从上下文中获取操作名
+// 优先使用客户端放入的请求信息（transport.NewClientContext），其次是服务端上下文中HTTP的请求路径和gRPC的完整方法名
+func operation(ctx context.Context) string {
+	if info, ok := transport.FromClientContext(ctx); ok {
+		return info.Operation
+	}
+	if path, ok := ctx.Value("path").(string); ok && path != "" {
+		return path
+	}
+	if method, ok := ctx.Value("method").(string); ok {
+		return method
+	}
+	return ""
+}
+
+// header 忽略大小写从上下文中获取请求头，优先使用客户端请求信息中的请求头
+func header(ctx context.Context, key string) string {
+	if info, ok := transport.FromClientContext(ctx); ok {
+		return info.Header.Get(key)
+	}
+	headers, _ := ctx.Value("headers").(map[string]string)
+	if v, ok := headers[key]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// filterNodes 返回满足目标条件的节点
+func filterNodes(nodes []selector.Node, route Route) []selector.Node {
+	subset := make([]selector.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if route.Version != "" && n.Version != route.Version {
+			continue
+		}
+		if !containsMetadata(n.Metadata, route.Metadata) {
+			continue
+		}
+		subset = append(subset, n)
+	}
+	return subset
+}
+
+// containsMetadata 判断节点元数据是否包含全部期望的键值
+func containsMetadata(md, want map[string]string) bool {
+	for k, v := range want {
+		if md[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/config"
+	"github.com/dormoron/phantasm/log"
+	"github.com/dormoron/phantasm/metadata"
+	"github.com/dormoron/phantasm/selector"
+	"github.com/dormoron/phantasm/transport"
+)
+
+// firstBalancer 总是选择第一个节点，并记录收到的节点列表
+type firstBalancer struct {
+	mu    sync.Mutex
+	nodes []selector.Node
+}
+
+func (b *firstBalancer) Pick(_ context.Context, nodes []selector.Node) (selector.Node, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nodes = nodes
+	if len(nodes) == 0 {
+		return selector.Node{}, selector.ErrNoAvailable
+	}
+	return nodes[0], nil
+}
+
+// recordLogger 记录Debug级别日志的消息
+type recordLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordLogger) Debug(msg string, _ ...log.Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+func (l *recordLogger) Info(string, ...log.Field)              {}
+func (l *recordLogger) Warn(string, ...log.Field)              {}
+func (l *recordLogger) Error(string, ...log.Field)             {}
+func (l *recordLogger) WithContext(context.Context) log.Logger { return l }
+
+func (l *recordLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.msgs)
+}
+
+var testNodes = []selector.Node{
+	{ID: "v1", Address: "10.0.0.1:8000", Version: "v1"},
+	{ID: "v2", Address: "10.0.0.2:8000", Version: "v2", Metadata: map[string]string{"zone": "b"}},
+}
+
+func clientContext(op string, header map[string]string) context.Context {
+	return transport.NewClientContext(context.Background(), transport.ClientInfo{
+		Operation: op,
+		Header:    metadata.New(header),
+	})
+}
+
+func canary(weight int) Rules {
+	return Rules{Rules: []Rule{{
+		Name:  "canary",
+		Match: Match{Operation: "/helloworld.Greeter/*", Headers: map[string]string{"X-Canary": "true"}},
+		Routes: []Route{
+			{Version: "v2", Weight: weight},
+			{Version: "v1", Weight: 100 - weight},
+		},
+	}}}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		match Match
+		ctx   context.Context
+		want  bool
+	}{
+		{"empty", Match{}, context.Background(), true},
+		{"operation exact", Match{Operation: "/a.B/C"}, clientContext("/a.B/C", nil), true},
+		{"operation mismatch", Match{Operation: "/a.B/C"}, clientContext("/a.B/D", nil), false},
+		{"operation prefix", Match{Operation: "/a.B/*"}, clientContext("/a.B/D", nil), true},
+		{"header case insensitive", Match{Headers: map[string]string{"X-Canary": "true"}},
+			clientContext("/", map[string]string{"x-canary": "true"}), true},
+		{"header mismatch", Match{Headers: map[string]string{"x-canary": "true"}},
+			clientContext("/", map[string]string{"x-canary": "false"}), false},
+		{"header missing", Match{Headers: map[string]string{"x-canary": "true"}}, clientContext("/", nil), false},
+		{"metadata", Match{Metadata: map[string]string{"tenant": "t1"}},
+			metadata.NewContext(context.Background(), metadata.New(map[string]string{"tenant": "t1"})), true},
+		{"metadata missing", Match{Metadata: map[string]string{"tenant": "t1"}}, context.Background(), false},
+		{"server path", Match{Operation: "/v1/*", Headers: map[string]string{"x-canary": "true"}},
+			context.WithValue(context.WithValue(context.Background(), "path", "/v1/items"),
+				"headers", map[string]string{"X-Canary": "true"}), true},
+		{"server method", Match{Operation: "/a.B/C"}, context.WithValue(context.Background(), "method", "/a.B/C"), true},
+	}
+	for _, tt := range tests {
+		if got := tt.match.matches(tt.ctx); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	b := &firstBalancer{}
+	r := New(b)
+	r.Update(canary(100))
+
+	ctx := clientContext("/helloworld.Greeter/SayHello", map[string]string{"x-canary": "true"})
+	n, err := r.Pick(ctx, testNodes)
+	if err != nil || n.ID != "v2" {
+		t.Fatalf("node = %v, err = %v", n.ID, err)
+	}
+	if len(b.nodes) != 1 {
+		t.Errorf("balancer got %d nodes, want the v2 subset", len(b.nodes))
+	}
+
+	// 未命中规则时使用全部节点
+	if n, _ := r.Pick(clientContext("/helloworld.Greeter/SayHello", nil), testNodes); n.ID != "v1" || len(b.nodes) != 2 {
+		t.Errorf("unmatched: node = %v, nodes = %d", n.ID, len(b.nodes))
+	}
+
+	// 目标没有节点时回退到全部节点
+	r.Update(Rules{Rules: []Rule{{Name: "v3", Routes: []Route{{Version: "v3", Weight: 1}}}}})
+	if n, _ := r.Pick(ctx, testNodes); n.ID != "v1" || len(b.nodes) != 2 {
+		t.Errorf("empty subset: node = %v, nodes = %d", n.ID, len(b.nodes))
+	}
+
+	// 按元数据筛选
+	r.Update(Rules{Rules: []Rule{{Name: "zone", Routes: []Route{{Metadata: map[string]string{"zone": "b"}, Weight: 1}}}}})
+	if n, _ := r.Pick(ctx, testNodes); n.ID != "v2" {
+		t.Errorf("metadata route: node = %v", n.ID)
+	}
+}
+
+func TestWeightedSplit(t *testing.T) {
+	r := New(&firstBalancer{})
+	r.Update(canary(20))
+	ctx := clientContext("/helloworld.Greeter/SayHello", map[string]string{"x-canary": "true"})
+
+	const total = 5000
+	var v2 int
+	for i := 0; i < total; i++ {
+		n, err := r.Pick(ctx, testNodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.ID == "v2" {
+			v2++
+		}
+	}
+	if ratio := float64(v2) / total; ratio < 0.15 || ratio > 0.25 {
+		t.Errorf("v2 ratio = %.3f, want about 0.2", ratio)
+	}
+
+	// 权重非正的目标不会被选中
+	if _, ok := r.pickRoute([]Route{{Version: "v1", Weight: 0}, {Version: "v2", Weight: -1}}); ok {
+		t.Error("picked a route without weight")
+	}
+	for i := 0; i < 100; i++ {
+		if route, _ := r.pickRoute([]Route{{Version: "v1", Weight: 0}, {Version: "v2", Weight: 1}}); route.Version != "v2" {
+			t.Fatalf("route = %v", route.Version)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	b := &firstBalancer{}
+	logger := &recordLogger{}
+	r := New(b, WithDryRun(true), WithLogger(logger))
+	r.Update(canary(100))
+	if !r.Rules().DryRun {
+		t.Error("WithDryRun not applied to updated rules")
+	}
+
+	ctx := clientContext("/helloworld.Greeter/SayHello", map[string]string{"x-canary": "true"})
+	n, err := r.Pick(ctx, testNodes)
+	if err != nil || n.ID != "v1" || len(b.nodes) != 2 {
+		t.Fatalf("dry run changed traffic: node = %v, nodes = %d, err = %v", n.ID, len(b.nodes), err)
+	}
+	if logger.count() != 1 {
+		t.Errorf("logged %d matches, want 1", logger.count())
+	}
+}
+
+// memSource 是测试用的配置源，通过update推送新的配置
+type memSource struct {
+	kv *config.KeyValue
+	ch chan []*config.KeyValue
+}
+
+func (s *memSource) Load() ([]*config.KeyValue, error) { return []*config.KeyValue{s.kv}, nil }
+
+func (s *memSource) Watch() (config.Watcher, error) {
+	return &memWatcher{ch: s.ch, done: make(chan struct{})}, nil
+}
+
+func (s *memSource) update(value string) {
+	s.ch <- []*config.KeyValue{{Key: s.kv.Key, Value: value, Format: s.kv.Format}}
+}
+
+type memWatcher struct {
+	ch   chan []*config.KeyValue
+	done chan struct{}
+	once sync.Once
+}
+
+func (w *memWatcher) Next() ([]*config.KeyValue, error) {
+	select {
+	case <-w.done:
+		return nil, config.ErrWatcherClosed
+	case kvs := <-w.ch:
+		return kvs, nil
+	}
+}
+
+func (w *memWatcher) Stop() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+const rulesYAML = `
+routing:
+  rules:
+    - name: canary
+      match:
+        operation: /helloworld.Greeter/*
+      routes:
+        - version: %s
+          weight: 1
+`
+
+func TestWatch(t *testing.T) {
+	src := &memSource{
+		kv: &config.KeyValue{Key: "app", Value: fmt.Sprintf(rulesYAML, "v2"), Format: "yaml"},
+		ch: make(chan []*config.KeyValue, 1),
+	}
+	c := config.New(config.WithSource(src))
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := New(&firstBalancer{})
+	if err := r.Watch(c, "routing"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := clientContext("/helloworld.Greeter/SayHello", nil)
+	if n, _ := r.Pick(ctx, testNodes); n.ID != "v2" {
+		t.Fatalf("initial rules: node = %v", n.ID)
+	}
+
+	src.update(fmt.Sprintf(rulesYAML, "v1"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		rules := r.Rules()
+		if len(rules.Rules) == 1 && rules.Rules[0].Routes[0].Version == "v1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rules not reloaded: %+v", rules)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n, _ := r.Pick(ctx, testNodes); n.ID != "v1" {
+		t.Errorf("reloaded rules: node = %v", n.ID)
+	}
+
+	// 删除规则后恢复为空规则
+	src.update("other: 1")
+	deadline = time.Now().Add(time.Second)
+	for len(r.Rules().Rules) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rules not cleared: %+v", r.Rules())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWatchMissingKey(t *testing.T) {
+	src := &memSource{
+		kv: &config.KeyValue{Key: "app", Value: "other: 1", Format: "yaml"},
+		ch: make(chan []*config.KeyValue, 1),
+	}
+	c := config.New(config.WithSource(src))
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := New(&firstBalancer{})
+	r.Update(canary(100))
+	if err := r.Watch(c, "routing"); err != nil {
+		t.Fatalf("watch missing key: %v", err)
+	}
+	if rules := r.Rules(); len(rules.Rules) != 0 {
+		t.Errorf("rules = %+v, want empty", rules)
+	}
+}
@@ -18,6 +18,12 @@ type Node struct {
 	Metadata map[string]string
 	// Weight 是节点的权重
 	Weight int64
+	// Scheme 是节点端点的协议，例如 grpc、http
+	Scheme string
+	// Version 是节点所属服务实例的版本
+	Version string
+	// InstanceID 是节点所属服务实例的ID
+	InstanceID string
 }
 
 // FilterFunc 是节点选择过滤器
@@ -26,6 +32,9 @@ type FilterFunc func(nodes []Node) []Node
 // NodeBuilderFunc 构建节点
 type NodeBuilderFunc func(id string, address string, metadata map[string]string) (Node, error)
 
+// InstanceNodeBuilderFunc 从服务实例列表构建节点
+type InstanceNodeBuilderFunc func(instances []*registry.ServiceInstance) ([]Node, error)
+
 // Selector 是节点选择器接口
 type Selector interface {
 	// Select 选择一个节点
@@ -43,6 +52,7 @@ type Option func(o *options)
 type options struct {
 	filters      []FilterFunc
 	nodeBuilder  NodeBuilderFunc
+	insBuilder   InstanceNodeBuilderFunc
 	balancer     BalancerType
 	cacheTTL     time.Duration
 	subsetSize   int
@@ -60,10 +70,11 @@ var (
 	// DefaultNodeBuilder 是默认的节点构建器
 	DefaultNodeBuilder = func(id string, address string, metadata map[string]string) (Node, error) {
 		return Node{
-			ID:       id,
-			Address:  address,
-			Metadata: metadata,
-			Weight:   100,
+			ID:         id,
+			Address:    address,
+			Metadata:   metadata,
+			Weight:     defaultWeight,
+			InstanceID: id,
 		}, nil
 	}
 )
@@ -130,7 +141,7 @@ func BuildSelector(discovery registry.Discovery, serviceName string, opts ...Opt
 		if err != nil {
 			return
 		}
-		nodes, err := instancesToNodes(instances, sel.(*defaultSelector).opts.nodeBuilder)
+		nodes, err := sel.(*defaultSelector).buildNodes(instances)
 		if err != nil {
 			return
 		}
@@ -139,15 +150,29 @@ func BuildSelector(discovery registry.Discovery, serviceName string, opts ...Opt
 	return sel, nil
 }
 
+// buildNodes 使用配置的构建器将服务实例转换为节点
+func (s *defaultSelector) buildNodes(instances []*registry.ServiceInstance) ([]Node, error) {
+	if s.opts.insBuilder != nil {
+		return s.opts.insBuilder(instances)
+	}
+	return instancesToNodes(instances, s.opts.nodeBuilder)
+}
+
 // instancesToNodes 转换服务实例为节点
 func instancesToNodes(instances []*registry.ServiceInstance, builder NodeBuilderFunc) ([]Node, error) {
 	nodes := make([]Node, 0, len(instances))
 	for _, ins := range instances {
+		if !available(ins) {
+			continue
+		}
 		for _, endpoint := range ins.Endpoints {
 			node, err := builder(ins.ID, endpoint, ins.Metadata)
 			if err != nil {
 				return nil, err
 			}
+			if node.Version == "" {
+				node.Version = ins.Version
+			}
 			nodes = append(nodes, node)
 		}
 	}
@@ -168,6 +193,14 @@ func WithNodeBuilder(builder NodeBuilderFunc) Option {
 	}
 }
 
+// WithInstanceNodeBuilder 选项用于设置基于服务实例的节点构建器，
+// 设置后优先于 WithNodeBuilder
+func WithInstanceNodeBuilder(builder InstanceNodeBuilderFunc) Option {
+	return func(o *options) {
+		o.insBuilder = builder
+	}
+}
+
 // WithBalancer 选项用于设置均衡器
 func WithBalancer(balancer BalancerType) Option {
 	return func(o *options) {
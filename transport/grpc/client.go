@@ -0,0 +1,300 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcmd "google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dormoron/phantasm/metadata"
+	"github.com/dormoron/phantasm/middleware"
+	"github.com/dormoron/phantasm/selector"
+	"github.com/dormoron/phantasm/transport"
+)
+
+// GRPCClientOption 是gRPC客户端选项
+type GRPCClientOption func(*GRPCClientOptions)
+
+// GRPCClientOptions 是gRPC客户端选项集合
+type GRPCClientOptions struct {
+	Endpoint     string
+	Timeout      time.Duration
+	TLSCert      string
+	Insecure     bool
+	Balancer     string
+	DialOptions  []grpc.DialOption
+	Interceptors []grpc.UnaryClientInterceptor
+	Middleware   []middleware.Middleware
+	Selector     selector.Selector
+}
+
+// WithEndpoint 设置客户端端点
+func WithEndpoint(endpoint string) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Endpoint = endpoint
+	}
+}
+
+// WithClientTimeout 设置客户端超时
+func WithClientTimeout(timeout time.Duration) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Timeout = timeout
+	}
+}
+
+// WithClientTLS 设置客户端TLS
+func WithClientTLS(cert string) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.TLSCert = cert
+	}
+}
+
+// WithInsecure 设置不安全连接
+func WithInsecure() GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Insecure = true
+	}
+}
+
+// WithBalancer 设置负载均衡器
+func WithBalancer(balancer string) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Balancer = balancer
+	}
+}
+
+// WithDialOption 添加拨号选项
+func WithDialOption(opts ...grpc.DialOption) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.DialOptions = append(o.DialOptions, opts...)
+	}
+}
+
+// WithClientInterceptor 添加客户端拦截器
+func WithClientInterceptor(interceptors ...grpc.UnaryClientInterceptor) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Interceptors = append(o.Interceptors, interceptors...)
+	}
+}
+
+// WithClientMiddleware 设置一元调用的客户端中间件，例如 hedging.Client
+// 中间件通过 selector.NewNodeContext 选择节点时，调用发送到该节点的连接
+func WithClientMiddleware(m ...middleware.Middleware) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Middleware = append(o.Middleware, m...)
+	}
+}
+
+// WithSelector 设置选择器，中间件没有选择节点时由它为每个调用选择节点，此时可以不设置端点
+func WithSelector(sel selector.Selector) GRPCClientOption {
+	return func(o *GRPCClientOptions) {
+		o.Selector = sel
+	}
+}
+
+// Dial 创建到gRPC服务器的连接
+// 设置了客户端中间件或选择器时，选择的节点使用相同的拨号选项单独建立连接，这些连接在返回的连接关闭后关闭
+func Dial(ctx context.Context, opts ...GRPCClientOption) (*grpc.ClientConn, error) {
+	options := &GRPCClientOptions{
+		Timeout: time.Second * 10,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
+	dialOpts := append([]grpc.DialOption(nil), options.DialOptions...)
+
+	// 设置超时
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	// 设置TLS
+	if options.Insecure {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else if options.TLSCert != "" {
+		creds, err := credentials.NewClientTLSFromFile(options.TLSCert, "")
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
+	}
+
+	// 节点连接只使用基础的拨号选项，中间件和拦截器在原始连接上执行
+	var nodes *nodeConns
+	interceptors := options.Interceptors
+	target := options.Endpoint
+	if len(options.Middleware) > 0 || options.Selector != nil {
+		nodes = newNodeConns(append([]grpc.DialOption(nil), dialOpts...))
+		interceptors = append(interceptors, unaryClientInterceptor(options.Selector, nodes, options.Middleware...))
+		if target == "" && options.Selector != nil {
+			// 所有调用都发送到选择的节点，原始连接不会建立
+			target = "passthrough:///selector"
+		}
+	}
+
+	// 设置拦截器
+	if len(interceptors) > 0 {
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(interceptors...))
+	}
+
+	// 设置负载均衡
+	if options.Balancer != "" {
+		dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingPolicy":"%s"}`, options.Balancer)))
+	}
+
+	conn, err := grpc.DialContext(ctx, target, dialOpts...)
+	if err != nil {
+		if nodes != nil {
+			_ = nodes.Close()
+		}
+		return nil, err
+	}
+	if nodes != nil {
+		go nodes.closeWith(conn)
+	}
+	return conn, nil
+}
+
+// unaryClientInterceptor 在一元调用上执行phantasm客户端中间件
+// 调用信息通过 transport.NewClientContext 放入上下文；中间件选择了节点或设置了选择器时调用发送到节点的连接，
+// 否则使用原始连接。每次发送使用独立的响应对象，避免对冲请求并发写入同一个响应
+func unaryClientInterceptor(sel selector.Selector, nodes *nodeConns, m ...middleware.Middleware) grpc.UnaryClientInterceptor {
+	chain := middleware.Chain(m...)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		header := make(metadata.Metadata)
+		if md, ok := grpcmd.FromOutgoingContext(ctx); ok {
+			for k, vs := range md {
+				header[k] = vs
+			}
+		}
+		ctx = transport.NewClientContext(ctx, transport.ClientInfo{Operation: method, Header: header})
+
+		h := func(ctx context.Context, req interface{}) (interface{}, error) {
+			out := newReply(reply)
+			node, ok := selector.NodeFromContext(ctx)
+			if !ok && sel != nil {
+				var err error
+				if node, err = sel.Select(ctx); err != nil {
+					return nil, err
+				}
+				ok = true
+			}
+			if !ok {
+				if err := invoker(ctx, method, req, out, cc, opts...); err != nil {
+					return nil, err
+				}
+				return out, nil
+			}
+			conn, err := nodes.get(node.Address)
+			if err != nil {
+				return nil, err
+			}
+			if err := conn.Invoke(ctx, method, req, out, opts...); err != nil {
+				return nil, err
+			}
+			return out, nil
+		}
+
+		resp, err := chain(h)(ctx, req)
+		if err != nil {
+			return err
+		}
+		return copyReply(reply, resp)
+	}
+}
+
+// newReply 为一次发送创建新的响应对象，不是protobuf消息时返回原响应
+func newReply(reply interface{}) interface{} {
+	if m, ok := reply.(proto.Message); ok {
+		return m.ProtoReflect().New().Interface()
+	}
+	return reply
+}
+
+// copyReply 将中间件返回的响应复制到调用方的响应对象
+func copyReply(dst, src interface{}) error {
+	if dst == src {
+		return nil
+	}
+	d, ok := dst.(proto.Message)
+	if !ok {
+		return errors.New("grpc: unexpected reply type")
+	}
+	s, ok := src.(proto.Message)
+	if !ok {
+		return fmt.Errorf("grpc: middleware returned %T instead of the reply", src)
+	}
+	proto.Reset(d)
+	proto.Merge(d, s)
+	return nil
+}
+
+// nodeConns 是按节点地址缓存的连接
+type nodeConns struct {
+	opts   []grpc.DialOption
+	lock   sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	closed bool
+}
+
+// newNodeConns 创建节点连接缓存
+func newNodeConns(opts []grpc.DialOption) *nodeConns {
+	return &nodeConns{
+		opts:  opts,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+// get 返回到节点地址的连接，不存在时创建
+func (n *nodeConns) get(address string) (*grpc.ClientConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return nil, errors.New("grpc: client connection is closed")
+	}
+	if conn, ok := n.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(address, n.opts...)
+	if err != nil {
+		return nil, err
+	}
+	n.conns[address] = conn
+	return conn, nil
+}
+
+// Close 关闭所有节点连接
+func (n *nodeConns) Close() error {
+	n.lock.Lock()
+	conns := n.conns
+	n.conns = nil
+	n.closed = true
+	n.lock.Unlock()
+
+	var firstErr error
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// closeWith 在conn关闭后关闭所有节点连接
+func (n *nodeConns) closeWith(conn *grpc.ClientConn) {
+	for state := conn.GetState(); state != connectivity.Shutdown; state = conn.GetState() {
+		conn.WaitForStateChange(context.Background(), state)
+	}
+	_ = n.Close()
+}
@@ -0,0 +1,140 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/dormoron/phantasm/middleware"
+	"github.com/dormoron/phantasm/middleware/hedging"
+	"github.com/dormoron/phantasm/selector"
+	"github.com/dormoron/phantasm/transport"
+)
+
+// sequenceSelector 按顺序返回节点，并记录选择时上下文中的操作名
+type sequenceSelector struct {
+	mu         sync.Mutex
+	nodes      []selector.Node
+	next       int
+	operations []string
+}
+
+func (s *sequenceSelector) Select(ctx context.Context) (selector.Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, ok := transport.FromClientContext(ctx); ok {
+		s.operations = append(s.operations, info.Operation)
+	}
+	n := s.nodes[s.next%len(s.nodes)]
+	s.next++
+	return n, nil
+}
+
+func (s *sequenceSelector) Update([]selector.Node) error { return nil }
+func (s *sequenceSelector) Apply(...selector.FilterFunc) {}
+
+// newHealthServer 启动一个返回指定状态的健康检查服务，delay是每个调用的处理延迟
+func newHealthServer(t *testing.T, status healthpb.HealthCheckResponse_ServingStatus, delay time.Duration) selector.Node {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return handler(ctx, req)
+	}))
+	hs := health.NewServer()
+	hs.SetServingStatus("svc", status)
+	healthpb.RegisterHealthServer(srv, hs)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	return selector.Node{ID: lis.Addr().String(), Address: lis.Addr().String(), Scheme: "grpc"}
+}
+
+func TestDialSelector(t *testing.T) {
+	serving := newHealthServer(t, healthpb.HealthCheckResponse_SERVING, 0)
+	notServing := newHealthServer(t, healthpb.HealthCheckResponse_NOT_SERVING, 0)
+	sel := &sequenceSelector{nodes: []selector.Node{serving, notServing}}
+
+	conn, err := Dial(context.Background(), WithInsecure(), WithSelector(sel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	for _, want := range []healthpb.HealthCheckResponse_ServingStatus{
+		healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING,
+	} {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "svc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != want {
+			t.Errorf("status = %s, want %s", resp.Status, want)
+		}
+	}
+	if len(sel.operations) != 2 || sel.operations[0] != healthpb.Health_Check_FullMethodName {
+		t.Errorf("operations = %v", sel.operations)
+	}
+}
+
+func TestDialHedging(t *testing.T) {
+	slow := newHealthServer(t, healthpb.HealthCheckResponse_SERVING, time.Second)
+	fast := newHealthServer(t, healthpb.HealthCheckResponse_NOT_SERVING, time.Millisecond*20)
+	sel := &sequenceSelector{nodes: []selector.Node{slow, fast}}
+
+	conn, err := Dial(context.Background(), WithInsecure(), WithEndpoint(slow.Address),
+		WithClientMiddleware(hedging.Client(sel, hedging.WithDelay(time.Millisecond*50), hedging.WithBudget(100))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("answered by slow node: %s", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*800 {
+		t.Errorf("hedged call took %s", elapsed)
+	}
+}
+
+func TestDialWithoutNode(t *testing.T) {
+	serving := newHealthServer(t, healthpb.HealthCheckResponse_SERVING, 0)
+	var operation string
+	conn, err := Dial(context.Background(), WithInsecure(), WithEndpoint(serving.Address),
+		WithClientMiddleware(func(next middleware.Handler) middleware.Handler {
+			return func(ctx context.Context, req interface{}) (interface{}, error) {
+				info, _ := transport.FromClientContext(ctx)
+				operation = info.Operation
+				return next(ctx, req)
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("resp = %v, err = %v", resp, err)
+	}
+	if operation != healthpb.Health_Check_FullMethodName {
+		t.Errorf("operation = %q", operation)
+	}
+}
@@ -2,14 +2,12 @@ package grpc
 
 import (
 	"context"
-	"fmt"
 	"net/url"
 	"time"
 
 	"github.com/dormoron/eidola"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/dormoron/phantasm/internal/endpoint"
 	"github.com/dormoron/phantasm/middleware"
@@ -179,110 +177,3 @@ func (s *GRPCServer) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
 func (s *GRPCServer) Server() *grpc.Server {
 	return s.server.Server
 }
-
-// Client 相关函数
-
-// GRPCClientOption 是gRPC客户端选项
-type GRPCClientOption func(*GRPCClientOptions)
-
-// GRPCClientOptions 是gRPC客户端选项集合
-type GRPCClientOptions struct {
-	Endpoint     string
-	Timeout      time.Duration
-	TLSCert      string
-	Insecure     bool
-	Balancer     string
-	DialOptions  []grpc.DialOption
-	Interceptors []grpc.UnaryClientInterceptor
-}
-
-// WithEndpoint 设置客户端端点
-func WithEndpoint(endpoint string) GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.Endpoint = endpoint
-	}
-}
-
-// WithClientTimeout 设置客户端超时
-func WithClientTimeout(timeout time.Duration) GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.Timeout = timeout
-	}
-}
-
-// WithClientTLS 设置客户端TLS
-func WithClientTLS(cert string) GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.TLSCert = cert
-	}
-}
-
-// WithInsecure 设置不安全连接
-func WithInsecure() GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.Insecure = true
-	}
-}
-
-// WithBalancer 设置负载均衡器
-func WithBalancer(balancer string) GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.Balancer = balancer
-	}
-}
-
-// WithDialOption 添加拨号选项
-func WithDialOption(opts ...grpc.DialOption) GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.DialOptions = append(o.DialOptions, opts...)
-	}
-}
-
-// WithClientInterceptor 添加客户端拦截器
-func WithClientInterceptor(interceptors ...grpc.UnaryClientInterceptor) GRPCClientOption {
-	return func(o *GRPCClientOptions) {
-		o.Interceptors = append(o.Interceptors, interceptors...)
-	}
-}
-
-// Dial 创建到gRPC服务器的连接
-func Dial(ctx context.Context, opts ...GRPCClientOption) (*grpc.ClientConn, error) {
-	options := &GRPCClientOptions{
-		Timeout: time.Second * 10,
-	}
-	for _, o := range opts {
-		o(options)
-	}
-
-	dialOpts := options.DialOptions
-
-	// 设置超时
-	if options.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
-		defer cancel()
-	}
-
-	// 设置TLS
-	if options.Insecure {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	} else if options.TLSCert != "" {
-		creds, err := credentials.NewClientTLSFromFile(options.TLSCert, "")
-		if err != nil {
-			return nil, err
-		}
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
-	}
-
-	// 设置拦截器
-	if len(options.Interceptors) > 0 {
-		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(options.Interceptors...))
-	}
-
-	// 设置负载均衡
-	if options.Balancer != "" {
-		dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingPolicy":"%s"}`, options.Balancer)))
-	}
-
-	return grpc.DialContext(ctx, options.Endpoint, dialOpts...)
-}
@@ -0,0 +1,182 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dormoron/phantasm/metadata"
+	"github.com/dormoron/phantasm/middleware"
+	"github.com/dormoron/phantasm/selector"
+	"github.com/dormoron/phantasm/transport"
+)
+
+// ClientOption 是HTTP客户端选项
+type ClientOption func(*clientOptions)
+
+// clientOptions 是HTTP客户端选项
+type clientOptions struct {
+	endpoint   string
+	timeout    time.Duration
+	transport  http.RoundTripper
+	middleware []middleware.Middleware
+	selector   selector.Selector
+}
+
+// WithEndpoint 设置请求URL中没有主机时使用的服务端点，例如 http://127.0.0.1:8000
+func WithEndpoint(endpoint string) ClientOption {
+	return func(o *clientOptions) {
+		o.endpoint = endpoint
+	}
+}
+
+// WithClientTimeout 设置客户端超时
+func WithClientTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithClientTransport 设置发送请求使用的 http.RoundTripper
+func WithClientTransport(rt http.RoundTripper) ClientOption {
+	return func(o *clientOptions) {
+		o.transport = rt
+	}
+}
+
+// WithClientMiddleware 设置客户端中间件，例如 hedging.Client
+func WithClientMiddleware(m ...middleware.Middleware) ClientOption {
+	return func(o *clientOptions) {
+		o.middleware = append(o.middleware, m...)
+	}
+}
+
+// WithSelector 设置选择器，中间件没有选择节点时由它为每个请求选择节点
+func WithSelector(sel selector.Selector) ClientOption {
+	return func(o *clientOptions) {
+		o.selector = sel
+	}
+}
+
+// Client 是HTTP客户端
+// 请求经过客户端中间件后发送到上下文中的节点（selector.NodeFromContext），
+// 没有节点时使用 WithSelector 设置的选择器选择节点，否则发送到请求URL或 WithEndpoint 设置的端点
+type Client struct {
+	opts     clientOptions
+	endpoint *url.URL
+	client   *http.Client
+	handler  middleware.Handler
+}
+
+// NewClient 创建HTTP客户端
+func NewClient(opts ...ClientOption) (*Client, error) {
+	o := clientOptions{
+		timeout:   time.Second * 10,
+		transport: http.DefaultTransport,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &Client{
+		opts:   o,
+		client: &http.Client{Transport: o.transport, Timeout: o.timeout},
+	}
+	if o.endpoint != "" {
+		u, err := url.Parse(o.endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("http: endpoint must contain a host")
+		}
+		c.endpoint = u
+	}
+	c.handler = middleware.Chain(o.middleware...)(c.send)
+	return c, nil
+}
+
+// Do 发送HTTP请求
+// 请求体会被缓存以便中间件（例如对冲、重试）多次发送同一请求
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		data, err := io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
+	ctx := transport.NewClientContext(req.Context(), transport.ClientInfo{
+		Operation: req.URL.Path,
+		Header:    headerMetadata(req.Header),
+	})
+	resp, err := c.handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := resp.(*http.Response)
+	if !ok {
+		return nil, errors.New("http: middleware returned a non-http response")
+	}
+	return r, nil
+}
+
+// send 是中间件链末端的处理程序，将请求发送到选择的节点
+func (c *Client) send(ctx context.Context, req interface{}) (interface{}, error) {
+	r, ok := req.(*http.Request)
+	if !ok {
+		return nil, errors.New("http: request is not an *http.Request")
+	}
+
+	node, ok := selector.NodeFromContext(ctx)
+	if !ok && c.opts.selector != nil {
+		var err error
+		if node, err = c.opts.selector.Select(ctx); err != nil {
+			return nil, err
+		}
+		ok = true
+	}
+
+	out := r.Clone(ctx)
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	switch {
+	case ok:
+		out.URL.Host = node.Address
+		out.Host = ""
+		if node.Scheme == "http" || node.Scheme == "https" {
+			out.URL.Scheme = node.Scheme
+		}
+	case out.URL.Host == "" && c.endpoint != nil:
+		out.URL.Scheme = c.endpoint.Scheme
+		out.URL.Host = c.endpoint.Host
+	}
+	if out.URL.Scheme == "" {
+		out.URL.Scheme = "http"
+	}
+	return c.client.Do(out)
+}
+
+// headerMetadata 将请求头转换为元数据
+func headerMetadata(header http.Header) metadata.Metadata {
+	md := make(metadata.Metadata, len(header))
+	for k, vs := range header {
+		md[strings.ToLower(k)] = vs
+	}
+	return md
+}
@@ -0,0 +1,165 @@
+package http_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dormoron/phantasm/middleware/hedging"
+	"github.com/dormoron/phantasm/selector"
+	"github.com/dormoron/phantasm/transport"
+	phttp "github.com/dormoron/phantasm/transport/http"
+)
+
+// sequenceSelector 按顺序返回节点，并记录选择时上下文中的操作名
+type sequenceSelector struct {
+	mu         sync.Mutex
+	nodes      []selector.Node
+	next       int
+	operations []string
+}
+
+func (s *sequenceSelector) Select(ctx context.Context) (selector.Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, ok := transport.FromClientContext(ctx); ok {
+		s.operations = append(s.operations, info.Operation)
+	}
+	n := s.nodes[s.next%len(s.nodes)]
+	s.next++
+	return n, nil
+}
+
+func (s *sequenceSelector) Update([]selector.Node) error { return nil }
+func (s *sequenceSelector) Apply(...selector.FilterFunc) {}
+
+// newBackend 启动一个返回"名称:请求体"的测试服务器
+func newBackend(t *testing.T, name string, delay time.Duration) selector.Node {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, name+":"+string(body))
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return selector.Node{ID: name, Address: u.Host, Scheme: "http"}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(data)
+}
+
+func TestClientHedging(t *testing.T) {
+	slow := newBackend(t, "slow", time.Second)
+	fast := newBackend(t, "fast", time.Millisecond*50)
+	sel := &sequenceSelector{nodes: []selector.Node{slow, fast}}
+	client, err := phttp.NewClient(phttp.WithClientMiddleware(
+		hedging.Client(sel, hedging.WithDelay(time.Millisecond*20), hedging.WithBudget(100))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/echo", strings.NewReader("ping"))
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 响应体在对冲中间件返回后仍然可以读取
+	if body := readBody(t, resp); body != "fast:ping" {
+		t.Errorf("body = %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*800 {
+		t.Errorf("hedged request took %s", elapsed)
+	}
+}
+
+func TestClientHedgingServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	bad := selector.Node{ID: "bad", Address: u.Host, Scheme: "http"}
+	good := newBackend(t, "good", 0)
+	sel := &sequenceSelector{nodes: []selector.Node{bad, good}}
+	client, err := phttp.NewClient(phttp.WithClientMiddleware(
+		hedging.Client(sel, hedging.WithDelay(time.Second), hedging.WithBudget(100))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/echo", strings.NewReader("ping"))
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 5xx响应按失败处理，立即向另一个节点对冲
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "good:ping" {
+		t.Errorf("status = %d, body = %q", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("hedge on 5xx waited for delay: %s", elapsed)
+	}
+}
+
+func TestClientSelector(t *testing.T) {
+	a := newBackend(t, "a", 0)
+	b := newBackend(t, "b", 0)
+	sel := &sequenceSelector{nodes: []selector.Node{a, b}}
+	client, err := phttp.NewClient(phttp.WithSelector(sel))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"a:x", "b:x"} {
+		req, _ := http.NewRequest(http.MethodPost, "/v1/items", strings.NewReader("x"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); body != want {
+			t.Errorf("body = %q, want %q", body, want)
+		}
+	}
+	if len(sel.operations) != 2 || sel.operations[0] != "/v1/items" {
+		t.Errorf("operations = %v", sel.operations)
+	}
+}
+
+func TestClientEndpoint(t *testing.T) {
+	a := newBackend(t, "a", 0)
+	client, err := phttp.NewClient(phttp.WithEndpoint("http://" + a.Address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "a:" {
+		t.Errorf("body = %q", body)
+	}
+
+	if _, err := phttp.NewClient(phttp.WithEndpoint("127.0.0.1")); err == nil {
+		t.Error("expected endpoint without host to fail")
+	}
+}
@@ -3,6 +3,8 @@ package transport
 import (
 	"context"
 	"net/url"
+
+	"github.com/dormoron/phantasm/metadata"
 )
 
 // Server 是传输服务器接口
@@ -24,3 +26,25 @@ type Handler interface{}
 
 // Middleware 是服务中间件函数
 type Middleware func(Handler) Handler
+
+// ClientInfo 是客户端请求的信息
+// gRPC和HTTP客户端在执行客户端中间件之前将其放入上下文，路由、对冲等中间件据此按操作名和请求头决策
+type ClientInfo struct {
+	// Operation 是操作名，gRPC为完整方法名，HTTP为请求路径
+	Operation string
+	// Header 是请求头，gRPC为发送的元数据
+	Header metadata.Metadata
+}
+
+type clientInfoKey struct{}
+
+// NewClientContext 创建携带客户端请求信息的新上下文
+func NewClientContext(ctx context.Context, info ClientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, info)
+}
+
+// FromClientContext 从上下文中获取客户端请求信息
+func FromClientContext(ctx context.Context) (ClientInfo, bool) {
+	info, ok := ctx.Value(clientInfoKey{}).(ClientInfo)
+	return info, ok
+}